@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/zouuup/memadvise/internal/api"
+	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/output"
+	"github.com/zouuup/memadvise/internal/syscall"
+	"github.com/zouuup/memadvise/internal/units"
+)
+
+// clientCommand returns the "client" subcommand
+func clientCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "client",
+		Usage: "Send requests to a running daemon over its control socket",
+		Description: "Talks to a daemon started with --socket. Requests are carried out by the daemon, " +
+			"so the client needs access to the socket but no privileges of its own.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "socket",
+				Aliases: []string{"s"},
+				Usage:   "Control socket of the daemon",
+				Value:   api.DefaultSocket,
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "Give up on a request after this long",
+				Value: 10 * time.Minute,
+			},
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"v"},
+				Usage:   "Enable verbose output",
+			},
+			&cli.BoolFlag{
+				Name:    "json",
+				Aliases: []string{"j"},
+				Usage:   "Output results in JSON format",
+			},
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:  "inspect",
+				Usage: "Show the memory of a process",
+				Flags: []cli.Flag{clientTargetFlag()},
+				Action: func(c *cli.Context) error {
+					client, out := newClient(c)
+					inspection, err := client.Inspect(c.Int("target"))
+					if err != nil {
+						return err
+					}
+					stats := &inspector.MemoryStats{
+						TotalRSS:  inspection.RSS,
+						Anon:      inspection.Anon,
+						Private:   inspection.Private,
+						Shared:    inspection.Shared,
+						TotalSwap: inspection.Swap,
+					}
+					out.ProcessInspection(inspection.PID, inspection.Comm, stats, inspection.EligibleBytes, inspection.Regions)
+					out.Finish()
+					return nil
+				},
+			},
+			{
+				Name:  "plan",
+				Usage: "Show what reclaiming from a process would advise, without advising anything",
+				Flags: clientBudgetFlags(),
+				Action: func(c *cli.Context) error {
+					req, err := reclaimRequest(c)
+					if err != nil {
+						return err
+					}
+					client, out := newClient(c)
+					plan, err := client.Plan(req)
+					if err != nil {
+						return err
+					}
+					regions := make([]syscall.MemoryRegion, 0, len(plan.Regions))
+					for _, region := range plan.Regions {
+						regions = append(regions, syscall.MemoryRegion{
+							Start: region.Start,
+							End:   region.End,
+							Size:  region.Size,
+							Path:  region.Path,
+						})
+					}
+					out.ReclaimPlan(plan.PID, plan.Mode, plan.Budget, regions)
+					out.Finish()
+					return nil
+				},
+			},
+			{
+				Name:  "apply",
+				Usage: "Reclaim from a process now",
+				Flags: clientBudgetFlags(),
+				Action: func(c *cli.Context) error {
+					req, err := reclaimRequest(c)
+					if err != nil {
+						return err
+					}
+					client, out := newClient(c)
+					result, err := client.Apply(req)
+					if err != nil {
+						return err
+					}
+					out.RequestResult(result.PID, result.Mode, result.Advised, result.RSSBefore, result.RSSAfter)
+					out.Finish()
+					return nil
+				},
+			},
+			{
+				Name:  "warm",
+				Usage: "Read the memory of a process back in (MADV_WILLNEED)",
+				Flags: []cli.Flag{
+					clientTargetFlag(),
+					&cli.StringFlag{
+						Name:  "bytes",
+						Usage: "Warm at most this many bytes (e.g. 512M); by default every eligible region",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					req := api.WarmRequest{PID: c.Int("target")}
+					if spec := c.String("bytes"); spec != "" {
+						bytes, err := units.ParseBytes(spec)
+						if err != nil {
+							return fmt.Errorf("invalid bytes: %w", err)
+						}
+						req.Bytes = bytes
+					}
+					client, out := newClient(c)
+					result, err := client.Warm(req)
+					if err != nil {
+						return err
+					}
+					out.RequestResult(result.PID, result.Mode, result.Advised, result.RSSBefore, result.RSSAfter)
+					out.Finish()
+					return nil
+				},
+			},
+			{
+				Name:  "status",
+				Usage: "Show the daemon's policy and the processes it keeps state for",
+				Action: func(c *cli.Context) error {
+					client, out := newClient(c)
+					status, err := client.Status()
+					if err != nil {
+						return err
+					}
+					out.DaemonStatus(status.PID, status.Started, status.Interval, status.Rules, len(status.Targets))
+					for _, t := range status.Targets {
+						out.DaemonTarget(t.PID, t.Comm, t.LastAdvised, t.LastAdvisedB, t.LastRSS, t.RefaultRate, t.RefaultRatio, t.BudgetScale, t.HotUntil)
+					}
+					out.Finish()
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// clientTargetFlag returns the flag naming the process a request is about
+func clientTargetFlag() cli.Flag {
+	return &cli.IntFlag{
+		Name:     "target",
+		Aliases:  []string{"t"},
+		Usage:    "Target process ID",
+		Required: true,
+	}
+}
+
+// clientBudgetFlags returns the flags of plan and apply requests
+func clientBudgetFlags() []cli.Flag {
+	return []cli.Flag{
+		clientTargetFlag(),
+		&cli.StringFlag{
+			Name:    "mode",
+			Aliases: []string{"m"},
+			Usage:   "Advice mode: cold or pageout (default: the daemon's --mode)",
+		},
+		&cli.IntFlag{
+			Name:    "percent",
+			Aliases: []string{"p"},
+			Usage:   "Percentage of eligible memory to advise (default: the daemon's --percent)",
+		},
+		&cli.StringFlag{
+			Name:  "bytes",
+			Usage: "Advise this many bytes (e.g. 512M); overrides --percent",
+		},
+		&cli.StringFlag{
+			Name:  "target-rss",
+			Usage: "Advise down to this RSS (e.g. 1G); overrides --percent",
+		},
+	}
+}
+
+// newClient creates a client and output from the "client" command's flags
+func newClient(c *cli.Context) (*api.Client, *output.OutputManager) {
+	client := api.NewClient(c.String("socket"), c.Duration("timeout"))
+	return client, output.New(c.Bool("verbose"), c.Bool("json"))
+}
+
+// reclaimRequest builds a reclaim request from the budget flags
+func reclaimRequest(c *cli.Context) (api.ReclaimRequest, error) {
+	req := api.ReclaimRequest{
+		PID:     c.Int("target"),
+		Mode:    c.String("mode"),
+		Percent: c.Int("percent"),
+	}
+
+	var err error
+	if spec := c.String("bytes"); spec != "" {
+		if req.Bytes, err = units.ParseBytes(spec); err != nil {
+			return req, fmt.Errorf("invalid bytes: %w", err)
+		}
+	}
+	if spec := c.String("target-rss"); spec != "" {
+		if req.TargetRSS, err = units.ParseBytes(spec); err != nil {
+			return req, fmt.Errorf("invalid target RSS: %w", err)
+		}
+	}
+	return req, nil
+}
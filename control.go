@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/zouuup/memadvise/internal/advisor"
+	"github.com/zouuup/memadvise/internal/api"
+	"github.com/zouuup/memadvise/internal/daemon"
+	"github.com/zouuup/memadvise/internal/history"
+	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/output"
+	"github.com/zouuup/memadvise/internal/syscall"
+)
+
+// warmEverything is a warm budget larger than any address space, leaving
+// room for the budget to be scaled without overflowing
+const warmEverything = 1 << 62
+
+// controlBackend carries out control socket requests for the daemon. Requests
+// use the daemon's reclaim flags, but not its reclaim conditions: a request
+// to advise a process is carried out whatever the memory pressure.
+type controlBackend struct {
+	ctx    context.Context // Stops requests in progress when the daemon stops
+	out    *output.OutputManager
+	daemon *daemon.Daemon
+
+	mu   sync.Mutex
+	base *reclaimConfig // Rebuilt when the daemon reloads its policy
+}
+
+// listenControl starts serving the control API on the socket given by the
+// daemon flags. Reclaims started by requests stop at their next batch once
+// ctx is done.
+func listenControl(ctx context.Context, c *cli.Context, d *daemon.Daemon, out *output.OutputManager) (*api.Server, *controlBackend, error) {
+	backend := &controlBackend{ctx: ctx, out: out, daemon: d}
+	if err := backend.reload(c); err != nil {
+		return nil, nil, err
+	}
+
+	mode, err := strconv.ParseUint(c.String("socket-mode"), 8, 32)
+	if err != nil || mode > 0777 {
+		return nil, nil, fmt.Errorf("invalid socket mode: %s", c.String("socket-mode"))
+	}
+
+	access := api.Access{UIDs: c.IntSlice("allow-uid"), GIDs: c.IntSlice("allow-gid")}
+	gid := -1
+	if name := c.String("socket-group"); name != "" {
+		if gid, err = lookupGroup(name); err != nil {
+			return nil, nil, err
+		}
+		access.GIDs = append(access.GIDs, gid)
+	}
+
+	server, err := api.Listen(c.String("socket"), os.FileMode(mode), gid, backend, access, out)
+	if err != nil {
+		return nil, nil, err
+	}
+	return server, backend, nil
+}
+
+// reload parses the daemon's reclaim flags again, so that requests pick up
+// what a SIGHUP reload changed, such as a reopened audit log
+func (b *controlBackend) reload(c *cli.Context) error {
+	base, err := parseReclaimConfig(c)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.base = base
+	b.mu.Unlock()
+	return nil
+}
+
+// lookupGroup resolves a group name or numeric GID
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("invalid socket group: %w", err)
+	}
+	return strconv.Atoi(group.Gid)
+}
+
+// Inspect reports the memory of pid
+func (b *controlBackend) Inspect(pid int) (*api.Inspection, error) {
+	t, err := b.inspect(pid, b.baseRequestConfig().options)
+	if err != nil {
+		return nil, err
+	}
+
+	inspection := &api.Inspection{
+		PID:           pid,
+		RSS:           t.before.TotalRSS,
+		Anon:          t.before.Anon,
+		Private:       t.before.Private,
+		Shared:        t.before.Shared,
+		Swap:          t.before.TotalSwap,
+		EligibleBytes: t.advisor.EligibleBytes(),
+		Regions:       len(t.regions),
+	}
+	if id, err := inspector.ReadIdentity(pid); err == nil {
+		inspection.Comm = id.Comm
+		inspection.Exe = id.Exe
+		inspection.Cgroup = id.Cgroup
+	}
+	return inspection, nil
+}
+
+// Plan reports the regions a reclaim would advise
+func (b *controlBackend) Plan(req api.ReclaimRequest) (*api.Plan, error) {
+	cfg, err := b.requestConfig(req)
+	if err != nil {
+		return nil, err
+	}
+	t, err := b.inspect(req.PID, cfg.options)
+	if err != nil {
+		return nil, err
+	}
+
+	budget := cfg.targetBudget(t.before.TotalRSS)
+	sel := t.advisor.Select(budget)
+
+	plan := &api.Plan{
+		PID:           req.PID,
+		Mode:          cfg.mode,
+		RSS:           t.before.TotalRSS,
+		EligibleBytes: t.advisor.EligibleBytes(),
+		Budget:        budget,
+		SelectedBytes: int64(sel.Bytes),
+		Regions:       make([]api.Region, 0, len(sel.Regions)),
+	}
+	for _, region := range sel.Regions {
+		plan.Regions = append(plan.Regions, api.Region{
+			Start: region.Start,
+			End:   region.End,
+			Size:  region.Size,
+			Path:  region.Path,
+		})
+	}
+	return plan, nil
+}
+
+// Apply reclaims from a process; the daemon's cooldown starts over for it
+func (b *controlBackend) Apply(req api.ReclaimRequest) (*api.Result, error) {
+	cfg, err := b.requestConfig(req)
+	if err != nil {
+		return nil, err
+	}
+	if !inspector.PidExists(req.PID) {
+		return nil, fmt.Errorf("PID %d: %w", req.PID, api.ErrNotFound)
+	}
+	cfg.caller = req.Caller
+
+	b.out.Info(fmt.Sprintf("api: reclaiming from PID %d using mode '%s'", req.PID, cfg.mode))
+	outcomes, err := b.daemon.Apply(func() ([]daemon.Outcome, error) {
+		return reclaimFunc(cfg, b.out)(b.ctx, []int{req.PID}, nil)
+	}, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return requestResult(req.PID, cfg.mode, outcomes)
+}
+
+// Warm asks the kernel to read the memory of a process back in
+func (b *controlBackend) Warm(req api.WarmRequest) (*api.Result, error) {
+	if req.PID <= 0 {
+		return nil, fmt.Errorf("missing or invalid pid: %w", api.ErrBadRequest)
+	}
+	if req.Bytes < 0 {
+		return nil, fmt.Errorf("invalid bytes: %d: %w", req.Bytes, api.ErrBadRequest)
+	}
+	if !inspector.PidExists(req.PID) {
+		return nil, fmt.Errorf("PID %d: %w", req.PID, api.ErrNotFound)
+	}
+
+	cfg := b.baseRequestConfig()
+	cfg.caller = req.Caller
+	cfg.mode = "willneed"
+	cfg.iterative = false
+	cfg.maxBytes = 0
+	cfg.budgetBytes = req.Bytes
+	if cfg.budgetBytes == 0 {
+		cfg.budgetBytes = warmEverything
+	}
+
+	b.out.Info(fmt.Sprintf("api: warming PID %d", req.PID))
+	var outcomes []daemon.Outcome
+	var err error
+	b.daemon.Do(func() {
+		outcomes, err = reclaimFunc(cfg, b.out)(b.ctx, []int{req.PID}, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return requestResult(req.PID, cfg.mode, outcomes)
+}
+
+// Status reports the daemon's policy and per-target state
+func (b *controlBackend) Status() (*api.Status, error) {
+	summary := b.daemon.Summary()
+
+	status := &api.Status{
+		PID:      os.Getpid(),
+		Started:  summary.Started,
+		Interval: summary.Interval.String(),
+		Rules:    summary.Rules,
+		Targets:  make([]api.TargetStatus, 0, len(summary.Targets)),
+	}
+	for _, state := range summary.Targets {
+		status.Targets = append(status.Targets, api.TargetStatus{
+			PID:          state.PID,
+			Comm:         state.Comm,
+			LastAdvised:  state.LastAdvised,
+			LastAdvisedB: state.LastAdvisedB,
+			LastRSS:      state.LastRSS,
+			RefaultRate:  state.RefaultRate,
+			RefaultRatio: state.RefaultRatio,
+			BudgetScale:  state.BudgetScale,
+			HotUntil:     state.HotUntil,
+		})
+	}
+	return status, nil
+}
+
+// inspect gathers the state of a target without reporting it
+func (b *controlBackend) inspect(pid int, opts advisor.Options) (*target, error) {
+	if pid <= 0 {
+		return nil, fmt.Errorf("missing or invalid pid: %w", api.ErrBadRequest)
+	}
+	if !inspector.PidExists(pid) {
+		return nil, fmt.Errorf("PID %d: %w", pid, api.ErrNotFound)
+	}
+
+	procInspector, err := inspector.NewProcessInspector(pid)
+	if err != nil {
+		return nil, fmt.Errorf("PID %d: %w", pid, api.ErrNotFound)
+	}
+	stats, err := procInspector.GetMemoryStats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get memory stats for PID %d: %w", pid, err)
+	}
+	regions, err := procInspector.GetEligibleRegions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get memory regions for PID %d: %w", pid, err)
+	}
+
+	return &target{
+		pid:       pid,
+		inspector: procInspector,
+		before:    stats,
+		regions:   regions,
+		advisor:   advisor.New(pid, regions, b.out, opts),
+	}, nil
+}
+
+// baseRequestConfig returns the daemon's reclaim settings without the
+// conditions and multi-target settings that don't apply to a request
+func (b *controlBackend) baseRequestConfig() *reclaimConfig {
+	b.mu.Lock()
+	cfg := *b.base
+	b.mu.Unlock()
+
+	cfg.conditions = nil
+	cfg.when = nil
+	cfg.idleFor = 0
+	cfg.minRSS = 0
+	cfg.dryRun = false
+	cfg.totalBudget = 0
+	cfg.cooldown = 0
+	cfg.ignoreHot = true
+	cfg.source = history.SourceAPI
+	return &cfg
+}
+
+// requestConfig applies the settings of a reclaim request
+func (b *controlBackend) requestConfig(req api.ReclaimRequest) (*reclaimConfig, error) {
+	if req.PID <= 0 {
+		return nil, fmt.Errorf("missing or invalid pid: %w", api.ErrBadRequest)
+	}
+
+	cfg := b.baseRequestConfig()
+	if req.Mode != "" {
+		if req.Mode != "cold" && req.Mode != "pageout" {
+			return nil, fmt.Errorf("invalid mode: %s (must be 'cold' or 'pageout'): %w", req.Mode, api.ErrBadRequest)
+		}
+		cfg.mode = req.Mode
+	}
+
+	switch {
+	case req.Percent < 0 || req.Percent > 100:
+		return nil, fmt.Errorf("invalid percent: %d: %w", req.Percent, api.ErrBadRequest)
+	case req.Bytes < 0 || req.TargetRSS < 0:
+		return nil, fmt.Errorf("invalid budget: %w", api.ErrBadRequest)
+	case req.Bytes > 0:
+		cfg.budgetBytes = req.Bytes
+	case req.TargetRSS > 0:
+		cfg.targetRSS = req.TargetRSS
+	case req.Percent > 0:
+		cfg.percent = req.Percent
+	}
+	return cfg, nil
+}
+
+// requestResult turns the outcome of reclaiming from a single PID into a result
+func requestResult(pid int, mode string, outcomes []daemon.Outcome) (*api.Result, error) {
+	if len(outcomes) == 0 {
+		return nil, fmt.Errorf("PID %d could not be inspected", pid)
+	}
+	outcome := outcomes[0]
+	if errors.Is(outcome.Err, syscall.ErrNoProcess) {
+		return nil, fmt.Errorf("PID %d: %w", pid, api.ErrNotFound)
+	}
+	if outcome.Err != nil {
+		return nil, fmt.Errorf("failed to advise PID %d: %w", pid, outcome.Err)
+	}
+
+	return &api.Result{
+		PID:       pid,
+		Mode:      mode,
+		Advised:   outcome.Advised,
+		RSSBefore: outcome.RSSBefore,
+		RSSAfter:  outcome.RSSAfter,
+	}, nil
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/signal"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/urfave/cli/v2"
+	"github.com/zouuup/memadvise/internal/api"
+	"github.com/zouuup/memadvise/internal/config"
+	"github.com/zouuup/memadvise/internal/daemon"
+	"github.com/zouuup/memadvise/internal/history"
+	"github.com/zouuup/memadvise/internal/metrics"
+	"github.com/zouuup/memadvise/internal/output"
+	"github.com/zouuup/memadvise/internal/syscall"
+	"github.com/zouuup/memadvise/internal/watch"
+)
+
+// daemonCommand returns the "daemon" subcommand
+func daemonCommand() *cli.Command {
+	flags := append(reclaimFlags(),
+		&cli.DurationFlag{
+			Name:  "period",
+			Usage: "How often the policy is evaluated",
+			Value: time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:  "cooldown",
+			Usage: "Minimum time between two reclaims of the same process",
+			Value: 10 * time.Minute,
+		},
+		&cli.StringFlag{
+			Name:  "history",
+			Usage: "File in which the advice given to each process is kept; empty disables the history",
+			Value: history.DefaultPath,
+		},
+		&cli.StringFlag{
+			Name:  "psi-trigger",
+			Usage: "Also evaluate the policy when this memory PSI trigger fires (e.g. 'some 150000 1000000', in microseconds)",
+		},
+		&cli.StringFlag{
+			Name:  "psi-cgroup",
+			Usage: "Register --psi-trigger on this cgroup's memory.pressure instead of /proc/pressure/memory",
+		},
+		&cli.StringFlag{
+			Name:  "cgroup-events",
+			Usage: "Also reclaim from this cgroup's processes when its memory.events reports high or max breaches",
+		},
+		&cli.Float64Flag{
+			Name:  "refault-threshold",
+			Usage: "Halve the next budget of a process once this share of its last reclaim was faulted back in (e.g. 0.2); 0 disables",
+		},
+		&cli.Float64Flag{
+			Name:  "rollback-rate",
+			Usage: "Read a pageout back in with willneed when the process then takes this many more major faults per second than before it; 0 disables",
+		},
+		&cli.DurationFlag{
+			Name:  "hot-cooldown",
+			Usage: "Leave a process alone this long after its pageout was rolled back",
+			Value: time.Hour,
+		},
+		&cli.DurationFlag{
+			Name:  "debounce",
+			Usage: "Minimum time between two evaluations caused by PSI triggers or memory.events",
+			Value: 30 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:  "socket",
+			Usage: "Serve the control API on this Unix socket (e.g. " + api.DefaultSocket + ")",
+		},
+		&cli.StringFlag{
+			Name:  "socket-mode",
+			Usage: "Permissions of the control socket",
+			Value: "0660",
+		},
+		&cli.StringFlag{
+			Name:  "socket-group",
+			Usage: "Group owning the control socket; its members may use the API",
+		},
+		&cli.IntSliceFlag{
+			Name:  "allow-uid",
+			Usage: "Users, besides root and the daemon's own, allowed to use the control socket",
+		},
+		&cli.IntSliceFlag{
+			Name:  "allow-gid",
+			Usage: "Groups whose members are allowed to use the control socket",
+		},
+		&cli.StringFlag{
+			Name:  "metrics-listen",
+			Usage: "Serve Prometheus metrics on this address at /metrics (e.g. 127.0.0.1:9464)",
+		},
+	)
+
+	return &cli.Command{
+		Name:  "daemon",
+		Usage: "Evaluate the reclaim policy periodically",
+		Description: "Runs until SIGTERM or SIGINT, evaluating the policy every --period and keeping " +
+			"per-target state between runs. With --psi-trigger or --cgroup-events, the policy is also " +
+			"evaluated as soon as memory pressure rises. SIGHUP reloads the policy. With --socket, " +
+			"processes can also be inspected and advised on request through a local HTTP API.",
+		Flags: flags,
+		Action: func(c *cli.Context) error {
+			return runDaemon(c)
+		},
+	}
+}
+
+func runDaemon(c *cli.Context) error {
+	out := output.New(c.Bool("verbose"), c.Bool("json"))
+	defer out.Finish()
+
+	var backend *controlBackend
+	loader := func() (*daemon.Policy, error) {
+		var policy *daemon.Policy
+		var err error
+		if filename := c.String("config"); filename != "" {
+			policy, err = configPolicy(c, out, filename)
+		} else {
+			policy, err = flagPolicy(c, out)
+		}
+		// The control API follows reloads as well
+		if err == nil && backend != nil {
+			err = backend.reload(c)
+		}
+		return policy, err
+	}
+
+	d := daemon.New(loader, out)
+
+	// Stop a reclaim pass in progress too, not only the wait for the next,
+	// whether the policy or a control request started it
+	ctx, stop := signal.NotifyContext(context.Background(), unix.SIGTERM, unix.SIGINT)
+	defer stop()
+
+	if c.String("socket") != "" {
+		server, control, err := listenControl(ctx, c, d, out)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+		backend = control
+
+		go func() {
+			if err := server.Serve(); err != nil {
+				out.Error(fmt.Sprintf("control socket stopped: %v", err))
+			}
+		}()
+		out.Info(fmt.Sprintf("control API listening on %s", c.String("socket")))
+	}
+
+	if addr := c.String("metrics-listen"); addr != "" {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to serve metrics: %w", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Default.Handler())
+		server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		defer server.Close()
+
+		go func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				out.Error(fmt.Sprintf("metrics endpoint stopped: %v", err))
+			}
+		}()
+		out.Info(fmt.Sprintf("metrics served on http://%s/metrics", listener.Addr()))
+	}
+
+	return d.Run(ctx)
+}
+
+// flagPolicy builds a single-rule policy from the command line flags
+func flagPolicy(c *cli.Context, out *output.OutputManager) (*daemon.Policy, error) {
+	eventsCgroup := c.String("cgroup-events")
+
+	var targets func() ([]int, error)
+	switch targetStr := c.String("target"); {
+	case targetStr != "":
+		pids, err := parsePids(targetStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target PIDs: %w", err)
+		}
+		targets = func() ([]int, error) {
+			return pids, nil
+		}
+	case eventsCgroup != "":
+		// Reclaim from whatever runs in the cgroup, but only on its events
+		targets = config.Selector{Cgroup: eventsCgroup}.Resolve
+	default:
+		return nil, fmt.Errorf("required flag \"target\", \"config\" or \"cgroup-events\" not set")
+	}
+
+	cfg, err := parseReclaimConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	cfg.source = "rule command-line"
+
+	if c.Duration("period") <= 0 {
+		return nil, fmt.Errorf("invalid period: %s (must be positive)", c.Duration("period"))
+	}
+	if c.Float64("refault-threshold") < 0 {
+		return nil, fmt.Errorf("invalid refault threshold: %v (must be positive)", c.Float64("refault-threshold"))
+	}
+	if err := checkRollbackFlags(c); err != nil {
+		return nil, err
+	}
+
+	rule := daemon.Rule{
+		Name:          "command-line",
+		Cooldown:      c.Duration("cooldown"),
+		TriggeredOnly: c.String("target") == "",
+		Targets:       targets,
+		Reclaim:       reclaimFunc(cfg, out),
+		Debounce:      c.Duration("debounce"),
+
+		RefaultThreshold: c.Float64("refault-threshold"),
+		RollbackRate:     c.Float64("rollback-rate"),
+		HotCooldown:      c.Duration("hot-cooldown"),
+		Warm:             warmRanges,
+	}
+	if spec := c.String("psi-trigger"); spec != "" {
+		trigger, err := watch.ParseTrigger(spec)
+		if err != nil {
+			return nil, err
+		}
+		trigger.Cgroup = c.String("psi-cgroup")
+		rule.Trigger = &trigger
+	}
+	if eventsCgroup != "" {
+		rule.EventsCgroup = eventsCgroup
+		rule.Events = []string{watch.EventHigh, watch.EventMax}
+	}
+
+	return &daemon.Policy{
+		Interval: c.Duration("period"),
+		Rules:    []daemon.Rule{rule},
+		History:  c.String("history"),
+		Audit:    cfg.audit,
+	}, nil
+}
+
+// configPolicy builds a policy with one daemon rule per config file rule
+func configPolicy(c *cli.Context, out *output.OutputManager, filename string) (*daemon.Policy, error) {
+	file, err := loadConfig(filename, out)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := parseReclaimConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRollbackFlags(c); err != nil {
+		return nil, err
+	}
+
+	policy := &daemon.Policy{
+		Interval: time.Duration(file.Interval),
+		History:  c.String("history"),
+		Audit:    base.audit,
+	}
+	if policy.Interval == 0 {
+		policy.Interval = c.Duration("period")
+	}
+
+	for _, rule := range file.Rules {
+		cfg, err := ruleConfig(base, rule)
+		if err != nil {
+			return nil, err
+		}
+
+		cooldown := time.Duration(rule.Schedule.Cooldown)
+		if cooldown == 0 {
+			cooldown = c.Duration("cooldown")
+		}
+
+		refaultThreshold := rule.Limits.RefaultRatio
+		if refaultThreshold == 0 {
+			refaultThreshold = c.Float64("refault-threshold")
+		}
+
+		rollbackRate := rule.Rollback.FaultRate
+		if rollbackRate == 0 {
+			rollbackRate = c.Float64("rollback-rate")
+		}
+		hotCooldown := time.Duration(rule.Rollback.Hold)
+		if hotCooldown == 0 {
+			hotCooldown = c.Duration("hot-cooldown")
+		}
+
+		daemonRule := daemon.Rule{
+			Name:     rule.Name,
+			Every:    time.Duration(rule.Schedule.Every),
+			Cooldown: cooldown,
+			Targets:  rule.Selector.Resolve,
+			Reclaim:  reclaimFunc(cfg, out),
+
+			RefaultThreshold: refaultThreshold,
+			RollbackRate:     rollbackRate,
+			HotCooldown:      hotCooldown,
+			Warm:             warmRanges,
+		}
+		if rule.Trigger.PSI != "" {
+			trigger, err := watch.ParseTrigger(rule.Trigger.PSI)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+			}
+			trigger.Cgroup = rule.Trigger.Cgroup
+			daemonRule.Trigger = &trigger
+		}
+		if len(rule.Trigger.Events) > 0 {
+			daemonRule.EventsCgroup = rule.Trigger.Cgroup
+			daemonRule.Events = rule.Trigger.Events
+		}
+		daemonRule.Debounce = time.Duration(rule.Trigger.Debounce)
+		if daemonRule.Debounce == 0 {
+			daemonRule.Debounce = c.Duration("debounce")
+		}
+
+		policy.Rules = append(policy.Rules, daemonRule)
+	}
+
+	return policy, nil
+}
+
+// reclaimFunc adapts reclaim to the daemon's Rule.Reclaim signature
+func reclaimFunc(cfg *reclaimConfig, out *output.OutputManager) func(context.Context, []int, map[int]float64) ([]daemon.Outcome, error) {
+	return func(ctx context.Context, pids []int, scales map[int]float64) ([]daemon.Outcome, error) {
+		run := *cfg
+		run.budgetScales = scales
+		results, err := reclaim(ctx, &run, out, pids)
+		if errors.Is(err, errConditionNotMet) || errors.Is(err, errNothingEligible) {
+			return nil, nil // Already reported; try again next tick
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		outcomes := make([]daemon.Outcome, 0, len(results))
+		for _, result := range results {
+			outcomes = append(outcomes, daemon.Outcome{
+				PID:       result.pid,
+				Advised:   result.advised,
+				RSSBefore: result.rssBefore,
+				RSSAfter:  result.rssAfter,
+				PagedOut:  result.pagedOut,
+				Err:       result.err,
+			})
+		}
+		return outcomes, nil
+	}
+}
+
+// warmRanges reads ranges of a process back in, for the daemon's rollbacks.
+// It is not paced: the process is already stalling on these pages.
+func warmRanges(pid int, ranges []syscall.MemoryRegion) (int64, error) {
+	restored, err := syscall.ProcessMadvise(pid, ranges, "willneed")
+	if err != nil {
+		metrics.SyscallErrors.Inc(metrics.Errno(err))
+	}
+	return restored, err
+}
+
+// checkRollbackFlags validates the flags that configure rollbacks
+func checkRollbackFlags(c *cli.Context) error {
+	if c.Float64("rollback-rate") < 0 {
+		return fmt.Errorf("invalid rollback rate: %v (must be positive)", c.Float64("rollback-rate"))
+	}
+	if c.Duration("hot-cooldown") < 0 {
+		return fmt.Errorf("invalid hot cooldown: %s (must be positive)", c.Duration("hot-cooldown"))
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+	"github.com/zouuup/memadvise/internal/features"
+	"github.com/zouuup/memadvise/internal/output"
+)
+
+// doctorCommand returns the "doctor" subcommand
+func doctorCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "doctor",
+		Usage: "Report what the running kernel supports",
+		Description: "Probes the kernel version, each advice mode (on a scratch page of memadvise's own), " +
+			"smaps_rollup, page_idle, transparent huge pages, swap, zswap and zram, MGLRU, cgroup v2 " +
+			"controllers and PSI. The results are cached in " + features.DefaultPath + " for the rest of the " +
+			"boot, where other commands read which modes are supported. Exits with status 6 if no advice " +
+			"mode is supported.",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"v"},
+				Usage:   "Enable verbose logging",
+			},
+			&cli.BoolFlag{
+				Name:    "json",
+				Aliases: []string{"j"},
+				Usage:   "Output results in JSON format",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return runDoctor(c)
+		},
+	}
+}
+
+func runDoctor(c *cli.Context) error {
+	out := output.New(c.Bool("verbose"), c.Bool("json"))
+	defer out.Finish()
+
+	report := features.Probe()
+	if err := report.Save(features.DefaultPath); err != nil && out.IsVerbose() {
+		out.Info(fmt.Sprintf("results not cached: %v", err))
+	}
+	out.Features(report)
+
+	for _, mode := range features.Modes {
+		if report.Modes[mode].Status != features.Unsupported {
+			return nil
+		}
+	}
+	return cli.Exit("", exitUnsupported)
+}
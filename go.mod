@@ -5,6 +5,7 @@ go 1.20
 require (
 	github.com/urfave/cli/v2 v2.27.0
 	golang.org/x/sys v0.17.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
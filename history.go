@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/urfave/cli/v2"
+	"github.com/zouuup/memadvise/internal/history"
+	"github.com/zouuup/memadvise/internal/output"
+)
+
+// historyCommand returns the "history" subcommand
+func historyCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "history",
+		Usage: "Show the advice given to each process in earlier runs",
+		Description: "Lists the processes in the advice history, most recently advised first, with their " +
+			"reclaims, rollbacks and the refaults measured afterwards. Processes are identified by their " +
+			"executable, command line and start time, so a reused PID has a history of its own.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "history",
+				Usage: "File the advice history is kept in",
+				Value: history.DefaultPath,
+			},
+			&cli.StringFlag{
+				Name:    "target",
+				Aliases: []string{"t"},
+				Usage:   "Only show these PIDs",
+			},
+			&cli.StringFlag{
+				Name:  "exe",
+				Usage: "Only show processes whose executable matches this glob",
+			},
+			&cli.IntFlag{
+				Name:  "limit",
+				Usage: "Show at most this many records per process; 0 shows all",
+				Value: 10,
+			},
+			&cli.BoolFlag{
+				Name:    "verbose",
+				Aliases: []string{"v"},
+				Usage:   "Also list the advised ranges",
+			},
+			&cli.BoolFlag{
+				Name:    "json",
+				Aliases: []string{"j"},
+				Usage:   "Output results in JSON format",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			return runHistory(c)
+		},
+	}
+}
+
+func runHistory(c *cli.Context) error {
+	var pids map[int]bool
+	if spec := c.String("target"); spec != "" {
+		list, err := parsePids(spec)
+		if err != nil {
+			return fmt.Errorf("invalid target PIDs: %w", err)
+		}
+		pids = make(map[int]bool, len(list))
+		for _, pid := range list {
+			pids[pid] = true
+		}
+	}
+	exe := c.String("exe")
+	if _, err := path.Match(exe, ""); err != nil {
+		return fmt.Errorf("invalid exe pattern: %s", exe)
+	}
+	if c.Int("limit") < 0 {
+		return fmt.Errorf("invalid limit: %d (must be positive)", c.Int("limit"))
+	}
+
+	store, err := history.Load(c.String("history"))
+	if err != nil {
+		return err
+	}
+
+	out := output.New(c.Bool("verbose"), c.Bool("json"))
+	defer out.Finish()
+
+	shown := 0
+	for _, t := range store.List() {
+		if pids != nil && !pids[t.PID] {
+			continue
+		}
+		if ok, _ := path.Match(exe, t.Key.Exe); exe != "" && !ok {
+			continue
+		}
+		out.HistoryTarget(t, c.Int("limit"))
+		shown++
+	}
+	if shown == 0 {
+		out.Info(fmt.Sprintf("no matching advice recorded in %s", c.String("history")))
+	}
+	return nil
+}
@@ -1,70 +1,313 @@
 package advisor
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sort"
 
+	"golang.org/x/sys/unix"
+
+	"github.com/zouuup/memadvise/internal/features"
+	"github.com/zouuup/memadvise/internal/metrics"
 	"github.com/zouuup/memadvise/internal/output"
 	"github.com/zouuup/memadvise/internal/syscall"
+	"github.com/zouuup/memadvise/internal/sysinfo"
+)
+
+// THP policies controlling how regions backed by transparent huge pages are handled
+const (
+	THPSkip  = "skip"  // Never advise THP-backed regions
+	THPFull  = "full"  // Advise THP-backed regions, trimming only at huge page boundaries
+	THPSplit = "split" // Trim THP-backed regions at page granularity, allowing huge pages to split
 )
 
+// Strategies controlling the order in which regions are selected
+const (
+	StrategyLargest  = "largest"  // Largest regions first
+	StrategySmallest = "smallest" // Smallest regions first
+	StrategyAddress  = "address"  // Lowest addresses first
+)
+
+// ErrNoRegions is returned when a target has no memory eligible for advice
+var ErrNoRegions = errors.New("no eligible memory regions found")
+
+// Page sizes vary by architecture and kernel configuration; arm64 kernels,
+// for one, use 4 KiB, 16 KiB or 64 KiB base pages
+var (
+	pageSize     = uint64(unix.Getpagesize())
+	hugePageSize = sysinfo.HugePageSize(pageSize)
+)
+
+// Options configures how the advisor selects regions
+type Options struct {
+	THPPolicy string
+	Strategy  string
+	Filter    RegionFilter
+	Pacing    PacingOptions
+
+	// Hot ranges were faulted back in after earlier advice; regions
+	// overlapping them are selected last, whatever the strategy
+	Hot []syscall.MemoryRegion
+}
+
+// RegionFilter narrows down the eligible regions an advisor works with
+type RegionFilter struct {
+	MinSize      uint64   // Skip regions smaller than this
+	MaxSize      uint64   // Skip regions larger than this; 0 means no limit
+	Paths        []string // Only keep regions with these paths ("[anon]" matches unnamed regions)
+	ExcludePaths []string // Drop regions with these paths
+}
+
+// Apply returns the regions that pass the filter
+func (f RegionFilter) Apply(regions []syscall.MemoryRegion) []syscall.MemoryRegion {
+	filtered := make([]syscall.MemoryRegion, 0, len(regions))
+	for _, region := range regions {
+		path := region.Path
+		if path == "" {
+			path = "[anon]"
+		}
+
+		if region.Size < f.MinSize || (f.MaxSize > 0 && region.Size > f.MaxSize) {
+			continue
+		}
+		if len(f.Paths) > 0 && !containsString(f.Paths, path) {
+			continue
+		}
+		if containsString(f.ExcludePaths, path) {
+			continue
+		}
+		filtered = append(filtered, region)
+	}
+	return filtered
+}
+
+// ValidStrategy reports whether strategy is a known selection strategy
+func ValidStrategy(strategy string) bool {
+	return strategy == StrategyLargest || strategy == StrategySmallest || strategy == StrategyAddress
+}
+
+// ValidTHPPolicy reports whether policy is a known THP policy
+func ValidTHPPolicy(policy string) bool {
+	return policy == THPSkip || policy == THPFull || policy == THPSplit
+}
+
+// Selection is the set of regions chosen to fit a budget
+type Selection struct {
+	Regions         []syscall.MemoryRegion
+	Bytes           uint64
+	THPBytes        uint64 // THP-backed bytes within the selected regions
+	SkippedTHP      int    // Regions skipped because they are THP-backed
+	SkippedTHPBytes uint64
+}
+
+// Result describes an applied advice operation
+type Result struct {
+	BytesAdvised  int64
+	BytesSelected int64
+	Regions       int
+	Iovecs        int
+	Ranges        []syscall.MemoryRegion // Ranges the advice was applied to
+}
+
 // Advisor handles memory advice operations
 type Advisor struct {
-	pid     int
-	regions []syscall.MemoryRegion
-	output  *output.OutputManager
+	pid      int
+	regions  []syscall.MemoryRegion
+	filtered int // Eligible regions dropped by the region filter
+	output   *output.OutputManager
+	opts     Options
 }
 
 // New creates a new Advisor
-func New(pid int, regions []syscall.MemoryRegion, out *output.OutputManager) *Advisor {
+func New(pid int, regions []syscall.MemoryRegion, out *output.OutputManager, opts Options) *Advisor {
+	if opts.THPPolicy == "" {
+		opts.THPPolicy = THPFull
+	}
+	if opts.Strategy == "" {
+		opts.Strategy = StrategyLargest
+	}
+	filtered := opts.Filter.Apply(regions)
 	return &Advisor{
-		pid:     pid,
-		regions: regions,
-		output:  out,
+		pid:      pid,
+		regions:  filtered,
+		filtered: len(regions) - len(filtered),
+		output:   out,
+		opts:     opts,
 	}
 }
 
-// Execute performs the memory advice operation
-func (a *Advisor) Execute(budget int64, mode string) error {
-	if len(a.regions) == 0 {
-		return fmt.Errorf("no eligible memory regions found")
-	}
+// Select chooses regions to advise, in the order given by the strategy, up
+// to the budget. The last region is trimmed so the selection does not exceed
+// the budget.
+func (a *Advisor) Select(budget int64) Selection {
+	return a.selectFrom(a.regions, budget)
+}
 
-	// First, check if the syscall is supported
-	if !syscall.SupportsProcessMadvise() {
-		return fmt.Errorf("process_madvise syscall is not supported on this system")
-	}
+// selectFrom applies the selection rules to an arbitrary set of regions
+func (a *Advisor) selectFrom(regions []syscall.MemoryRegion, budget int64) Selection {
+	var sel Selection
 
-	// Sort regions by size (largest first) for better efficiency
-	sortedRegions := make([]syscall.MemoryRegion, len(a.regions))
-	copy(sortedRegions, a.regions)
-	sort.Slice(sortedRegions, func(i, j int) bool {
-		return sortedRegions[i].Size > sortedRegions[j].Size
+	// Sort regions by strategy; largest first is the most efficient by default
+	sortedRegions := make([]syscall.MemoryRegion, len(regions))
+	copy(sortedRegions, regions)
+	sort.SliceStable(sortedRegions, func(i, j int) bool {
+		if hi, hj := a.isHot(sortedRegions[i]), a.isHot(sortedRegions[j]); hi != hj {
+			return hj
+		}
+		switch a.opts.Strategy {
+		case StrategySmallest:
+			return sortedRegions[i].Size < sortedRegions[j].Size
+		case StrategyAddress:
+			return sortedRegions[i].Start < sortedRegions[j].Start
+		default:
+			return sortedRegions[i].Size > sortedRegions[j].Size
+		}
 	})
 
-	// Select regions to advise, up to the budget
-	var selectedRegions []syscall.MemoryRegion
-	var totalBytes uint64
-
 	for _, region := range sortedRegions {
-		if int64(totalBytes) >= budget {
+		if int64(sel.Bytes) >= budget {
 			break
 		}
 
-		selectedRegions = append(selectedRegions, region)
-		totalBytes += region.Size
+		thp := region.AnonHugePages > 0
+		if thp && a.opts.THPPolicy == THPSkip {
+			sel.SkippedTHP++
+			sel.SkippedTHPBytes += region.AnonHugePages
+			continue
+		}
+
+		remaining := uint64(budget) - sel.Bytes
+		if region.Size > remaining {
+			region = trimRegion(region, remaining, thp && a.opts.THPPolicy == THPFull)
+		}
 
-		if a.output.IsVerbose() {
-			a.output.SelectedRegion(a.pid, region)
+		sel.Regions = append(sel.Regions, region)
+		sel.Bytes += region.Size
+		if thp {
+			sel.THPBytes += region.AnonHugePages
 		}
 	}
 
+	return sel
+}
+
+// isHot reports whether region overlaps one of the hot ranges
+func (a *Advisor) isHot(region syscall.MemoryRegion) bool {
+	for _, hot := range a.opts.Hot {
+		if region.Start < hot.End && hot.Start < region.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Execute performs the memory advice operation. Paced advice stops early
+// once ctx is done.
+func (a *Advisor) Execute(ctx context.Context, budget int64, mode string) (*Result, error) {
+	if len(a.regions) == 0 {
+		return nil, ErrNoRegions
+	}
+
+	// First, check that the kernel supports the mode
+	if err := features.Current().CheckMode(mode); err != nil {
+		return nil, err
+	}
+
+	// Select regions to advise, up to the budget
+	sel := a.Select(budget)
+	for _, region := range sel.Regions {
+		a.output.SelectedRegion(a.pid, region)
+	}
+
+	a.recordSkipped(sel.SkippedTHP)
+
 	// Apply the advice
-	bytesAdvised, err := syscall.ProcessMadvise(a.pid, selectedRegions, mode)
+	bytesAdvised, pacing, err := a.apply(ctx, sel.Regions, mode)
 	if err != nil {
-		return fmt.Errorf("failed to apply memory advice: %w", err)
+		return nil, fmt.Errorf("failed to apply memory advice: %w", err)
 	}
 
-	a.output.SummaryResults(a.pid, bytesAdvised, int64(totalBytes), len(selectedRegions), mode)
-	return nil
+	// Adjacent regions are merged into one iovec by the syscall layer, but
+	// the summary still accounts for every selected region
+	iovecCount := len(syscall.CoalesceRegions(sel.Regions))
+
+	a.output.SummaryResults(a.pid, bytesAdvised, int64(sel.Bytes), len(sel.Regions), iovecCount, mode)
+	if sel.THPBytes > 0 || sel.SkippedTHP > 0 {
+		a.output.THPResults(a.pid, a.opts.THPPolicy, int64(sel.THPBytes), sel.SkippedTHP, int64(sel.SkippedTHPBytes))
+	}
+	if a.opts.Pacing.Enabled() {
+		a.output.PacingResults(a.pid, pacing.Batches, pacing.Bytes, pacing.Slept, pacing.Paused, pacing.Elapsed)
+	}
+
+	return &Result{
+		BytesAdvised:  bytesAdvised,
+		BytesSelected: int64(sel.Bytes),
+		Regions:       len(sel.Regions),
+		Iovecs:        iovecCount,
+		Ranges:        sel.Regions,
+	}, nil
+}
+
+// recordSkipped counts the regions left out of a reclaim in the metrics
+func (a *Advisor) recordSkipped(thp int) {
+	if a.filtered > 0 {
+		metrics.SkippedRegions.Add(float64(a.filtered), metrics.SkipFilter)
+	}
+	if thp > 0 {
+		metrics.SkippedRegions.Add(float64(thp), metrics.SkipTHP)
+	}
+}
+
+// EligibleBytes returns the resident bytes across the advisor's regions,
+// falling back to region sizes when per-region RSS is unknown
+func (a *Advisor) EligibleBytes() int64 {
+	var total uint64
+	for _, region := range a.regions {
+		if region.Rss > 0 {
+			total += region.Rss
+		} else {
+			total += region.Size
+		}
+	}
+	return int64(total)
+}
+
+// trimRegion shortens region to roughly length bytes, rounded up to a page.
+// When hugeAligned is set the cut is moved up to the next huge page boundary
+// so no huge page is split.
+func trimRegion(region syscall.MemoryRegion, length uint64, hugeAligned bool) syscall.MemoryRegion {
+	end := alignUp(region.Start+length, pageSize)
+	if hugeAligned {
+		end = alignUp(end, hugePageSize)
+	}
+	if end >= region.End {
+		return region
+	}
+
+	trimmed := region
+	trimmed.End = end
+	trimmed.Size = end - region.Start
+	if trimmed.Rss > trimmed.Size {
+		trimmed.Rss = trimmed.Size
+	}
+	if trimmed.AnonHugePages > trimmed.Size {
+		trimmed.AnonHugePages = trimmed.Size
+	}
+	return trimmed
+}
+
+// alignUp rounds addr up to a multiple of align, which must be a power of two
+func alignUp(addr, align uint64) uint64 {
+	return (addr + align - 1) &^ (align - 1)
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,349 @@
+package advisor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zouuup/memadvise/internal/syscall"
+)
+
+// setPageSizes makes the advisor use the given page sizes for the rest of
+// the test, whatever those of the machine running it
+func setPageSizes(t *testing.T, page, huge uint64) {
+	oldPage, oldHuge := pageSize, hugePageSize
+	pageSize, hugePageSize = page, huge
+	t.Cleanup(func() {
+		pageSize, hugePageSize = oldPage, oldHuge
+	})
+}
+
+func TestSelect(t *testing.T) {
+	const mib = 1024 * 1024
+	setPageSizes(t, 4096, 2*mib)
+
+	regions := []syscall.MemoryRegion{
+		{Start: 0x10000000, End: 0x10000000 + 8*mib, Size: 8 * mib, AnonHugePages: 8 * mib},
+		{Start: 0x20000000, End: 0x20000000 + 4*mib, Size: 4 * mib},
+		{Start: 0x30000000, End: 0x30000000 + 1*mib, Size: 1 * mib},
+	}
+
+	testCases := []struct {
+		name        string
+		policy      string
+		budget      int64
+		wantBytes   uint64
+		wantRegions int
+		wantTHP     uint64
+		wantSkipped int
+	}{
+		{
+			name:        "full policy keeps trims huge page aligned",
+			policy:      THPFull,
+			budget:      3 * mib,
+			wantBytes:   4 * mib,
+			wantRegions: 1,
+			wantTHP:     4 * mib,
+		},
+		{
+			name:        "split policy trims at page granularity",
+			policy:      THPSplit,
+			budget:      3*mib + 100,
+			wantBytes:   3*mib + pageSize,
+			wantRegions: 1,
+			wantTHP:     3*mib + pageSize,
+		},
+		{
+			name:        "skip policy ignores huge page regions",
+			policy:      THPSkip,
+			budget:      5 * mib,
+			wantBytes:   5 * mib,
+			wantRegions: 2,
+			wantSkipped: 1,
+		},
+		{
+			name:        "budget larger than all regions",
+			policy:      THPFull,
+			budget:      100 * mib,
+			wantBytes:   13 * mib,
+			wantRegions: 3,
+			wantTHP:     8 * mib,
+		},
+		{
+			name:        "zero budget",
+			policy:      THPFull,
+			budget:      0,
+			wantBytes:   0,
+			wantRegions: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			adv := New(1, regions, nil, Options{THPPolicy: tc.policy})
+			sel := adv.Select(tc.budget)
+
+			if sel.Bytes != tc.wantBytes {
+				t.Errorf("Select() bytes = %d, want %d", sel.Bytes, tc.wantBytes)
+			}
+			if len(sel.Regions) != tc.wantRegions {
+				t.Errorf("Select() regions = %d, want %d", len(sel.Regions), tc.wantRegions)
+			}
+			if sel.THPBytes != tc.wantTHP {
+				t.Errorf("Select() THP bytes = %d, want %d", sel.THPBytes, tc.wantTHP)
+			}
+			if sel.SkippedTHP != tc.wantSkipped {
+				t.Errorf("Select() skipped = %d, want %d", sel.SkippedTHP, tc.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestTrimRegionPageSizes(t *testing.T) {
+	const (
+		mib   = 1024 * 1024
+		start = 0x40000000
+	)
+	region := syscall.MemoryRegion{Start: start, End: start + 1024*mib, Size: 1024 * mib}
+
+	testCases := []struct {
+		name string
+		page uint64
+		huge uint64
+	}{
+		{name: "4K pages", page: 4 << 10, huge: 2 * mib},
+		{name: "16K pages", page: 16 << 10, huge: 32 * mib},
+		{name: "64K pages", page: 64 << 10, huge: 512 * mib},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setPageSizes(t, tc.page, tc.huge)
+
+			if got := trimRegion(region, 1000, false); got.End != start+tc.page {
+				t.Errorf("trimRegion() ends at %#x, want %#x", got.End, start+tc.page)
+			}
+			if got := trimRegion(region, 1000, true); got.End != start+tc.huge {
+				t.Errorf("trimRegion() huge aligned ends at %#x, want %#x", got.End, start+tc.huge)
+			}
+
+			left := subtractRegions([]syscall.MemoryRegion{region}, []syscall.MemoryRegion{trimRegion(region, tc.page+1, false)})
+			if len(left) != 1 || left[0].Start != start+2*tc.page || left[0].Start%tc.page != 0 {
+				t.Errorf("subtractRegions() left %+v, want the rest from %#x", left, start+2*tc.page)
+			}
+		})
+	}
+}
+
+func TestSubtractRegions(t *testing.T) {
+	regions := []syscall.MemoryRegion{
+		{Start: 0x1000, End: 0x5000, Size: 0x4000},
+		{Start: 0x8000, End: 0x9000, Size: 0x1000},
+	}
+	selected := []syscall.MemoryRegion{
+		{Start: 0x1000, End: 0x3000, Size: 0x2000},
+		{Start: 0x8000, End: 0x9000, Size: 0x1000},
+	}
+
+	left := subtractRegions(regions, selected)
+	if len(left) != 1 {
+		t.Fatalf("subtractRegions() got %d regions, want 1", len(left))
+	}
+	if left[0].Start != 0x3000 || left[0].End != 0x5000 || left[0].Size != 0x2000 {
+		t.Errorf("subtractRegions() got %+v, want 0x3000-0x5000", left[0])
+	}
+}
+
+func TestNextStep(t *testing.T) {
+	testCases := []struct {
+		name          string
+		remainingGoal int64
+		reclaimed     int64
+		advised       int64
+		firstStep     int64
+		want          int64
+	}{
+		{name: "goal reached", remainingGoal: 0, reclaimed: 100, advised: 100, firstStep: 1 << 20, want: 0},
+		{name: "fully effective", remainingGoal: 1 << 20, reclaimed: 1 << 20, advised: 1 << 20, firstStep: 1 << 20, want: 1 << 20},
+		{name: "half effective", remainingGoal: 1 << 20, reclaimed: 1 << 20, advised: 2 << 20, firstStep: 1 << 20, want: 2 << 20},
+		{name: "capped at four steps", remainingGoal: 8 << 20, reclaimed: 0, advised: 1 << 20, firstStep: 1 << 20, want: 4 << 20},
+		{name: "at least one page", remainingGoal: 10, reclaimed: 100, advised: 100, firstStep: 1 << 20, want: int64(pageSize)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := nextStep(tc.remainingGoal, tc.reclaimed, tc.advised, tc.firstStep)
+			if got != tc.want {
+				t.Errorf("nextStep() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSplitBatches(t *testing.T) {
+	regions := []syscall.MemoryRegion{
+		{Start: 0x10000, End: 0x15000, Size: 0x5000},
+		{Start: 0x20000, End: 0x21000, Size: 0x1000},
+	}
+
+	batches := splitBatches(regions, 0x2000, false)
+	if len(batches) != 3 {
+		t.Fatalf("splitBatches() got %d batches, want 3", len(batches))
+	}
+
+	var total uint64
+	for i, batch := range batches {
+		var size uint64
+		for _, region := range batch {
+			size += region.Size
+		}
+		if size != 0x2000 {
+			t.Errorf("splitBatches() batch %d has %#x bytes, want 0x2000", i, size)
+		}
+		total += size
+	}
+	if total != 0x6000 {
+		t.Errorf("splitBatches() total = %#x, want 0x6000", total)
+	}
+
+	// The last batch spans the tail of the first region and the second region
+	last := batches[2]
+	if len(last) != 2 || last[0].Start != 0x14000 || last[1].Start != 0x20000 {
+		t.Errorf("splitBatches() last batch = %+v", last)
+	}
+
+	if got := splitBatches(regions, 0, false); len(got) != 1 || len(got[0]) != 2 {
+		t.Errorf("splitBatches() without a limit got %v, want one batch", got)
+	}
+}
+
+func TestSplitBatchesTHP(t *testing.T) {
+	const mib = 1024 * 1024
+	setPageSizes(t, 4096, 2*mib)
+
+	regions := []syscall.MemoryRegion{
+		{Start: 0x10000000, End: 0x10000000 + 1*mib, Size: 1 * mib},
+		{Start: 0x20000000, End: 0x20000000 + 8*mib, Size: 8 * mib, AnonHugePages: 8 * mib},
+	}
+
+	// 3 MiB batches would cut the THP region in the middle of a huge page
+	batches := splitBatches(regions, 3*mib, true)
+	var total uint64
+	for i, batch := range batches {
+		var size uint64
+		for _, region := range batch {
+			size += region.Size
+			if region.AnonHugePages > 0 && (region.Start%(2*mib) != 0 || region.End%(2*mib) != 0) {
+				t.Errorf("splitBatches() batch %d splits a huge page: %#x-%#x", i, region.Start, region.End)
+			}
+		}
+		if size > 2*mib {
+			t.Errorf("splitBatches() batch %d has %#x bytes, want at most 2 MiB", i, size)
+		}
+		total += size
+	}
+	if total != 9*mib || len(batches) != 5 {
+		t.Errorf("splitBatches() got %d batches of %#x bytes, want 5 of 9 MiB", len(batches), total)
+	}
+
+	// Batches smaller than a huge page still hold one
+	if got := splitBatches(regions[1:], 64*1024, true); len(got) != 4 || got[0][0].Size != 2*mib {
+		t.Errorf("splitBatches() with 64K batches got %d batches, want 4 of 2 MiB", len(got))
+	}
+
+	// Without the full THP policy, huge pages may be split
+	if got := splitBatches(regions[1:], 3*mib, false); got[0][0].Size != 3*mib {
+		t.Errorf("splitBatches() split at %#x, want 3 MiB", got[0][0].Size)
+	}
+}
+
+func TestRegionFilter(t *testing.T) {
+	regions := []syscall.MemoryRegion{
+		{Start: 0x1000, End: 0x2000, Size: 0x1000, Path: "[heap]"},
+		{Start: 0x10000, End: 0x20000, Size: 0x10000},
+		{Start: 0x100000, End: 0x200000, Size: 0x100000},
+	}
+
+	testCases := []struct {
+		name   string
+		filter RegionFilter
+		want   int
+	}{
+		{name: "no filter", filter: RegionFilter{}, want: 3},
+		{name: "min size", filter: RegionFilter{MinSize: 0x2000}, want: 2},
+		{name: "max size", filter: RegionFilter{MaxSize: 0x10000}, want: 2},
+		{name: "anonymous only", filter: RegionFilter{Paths: []string{"[anon]"}}, want: 2},
+		{name: "exclude heap", filter: RegionFilter{ExcludePaths: []string{"[heap]"}}, want: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.filter.Apply(regions); len(got) != tc.want {
+				t.Errorf("Apply() got %d regions, want %d", len(got), tc.want)
+			}
+		})
+	}
+}
+
+func TestSelectStrategy(t *testing.T) {
+	regions := []syscall.MemoryRegion{
+		{Start: 0x30000, End: 0x31000, Size: 0x1000},
+		{Start: 0x10000, End: 0x14000, Size: 0x4000},
+		{Start: 0x20000, End: 0x22000, Size: 0x2000},
+	}
+
+	testCases := []struct {
+		name      string
+		strategy  string
+		hot       []syscall.MemoryRegion
+		wantStart uint64
+	}{
+		{name: "largest", strategy: StrategyLargest, wantStart: 0x10000},
+		{name: "smallest", strategy: StrategySmallest, wantStart: 0x30000},
+		{name: "address", strategy: StrategyAddress, wantStart: 0x10000},
+		{
+			name:      "hot regions last",
+			strategy:  StrategyLargest,
+			hot:       []syscall.MemoryRegion{{Start: 0x13000, End: 0x14000}},
+			wantStart: 0x20000,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sel := New(1, regions, nil, Options{Strategy: tc.strategy, Hot: tc.hot}).Select(0x1000)
+			if len(sel.Regions) != 1 || sel.Regions[0].Start != tc.wantStart {
+				t.Errorf("Select() got %+v, want region at %#x", sel.Regions, tc.wantStart)
+			}
+		})
+	}
+}
+
+func TestExecuteNoRegions(t *testing.T) {
+	adv := New(1, nil, nil, Options{})
+	if _, err := adv.Execute(context.Background(), 0x1000, "cold"); !errors.Is(err, ErrNoRegions) {
+		t.Errorf("Execute() = %v, want ErrNoRegions", err)
+	}
+	if _, err := adv.ExecuteIterative(context.Background(), 0x1000, "cold", IterativeOptions{}, nil, nil); !errors.Is(err, ErrNoRegions) {
+		t.Errorf("ExecuteIterative() = %v, want ErrNoRegions", err)
+	}
+}
+
+func TestApplyCancelled(t *testing.T) {
+	regions := []syscall.MemoryRegion{{Start: 0x10000, End: 0x20000, Size: 0x10000}}
+	adv := New(1, regions, nil, Options{Pacing: PacingOptions{Rate: 1 << 20, MaxInflight: 0x4000}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	advised, stats, err := adv.apply(ctx, regions, "cold")
+	if !errors.Is(err, context.Canceled) || advised != 0 || stats.Batches != 0 {
+		t.Errorf("apply() = %d, %+v, %v; want no batches and context.Canceled", advised, stats, err)
+	}
+
+	start := time.Now()
+	if err := SleepContext(ctx, time.Hour); !errors.Is(err, context.Canceled) || time.Since(start) > time.Second {
+		t.Errorf("SleepContext() = %v after %s, want context.Canceled at once", err, time.Since(start))
+	}
+}
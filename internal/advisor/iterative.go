@@ -0,0 +1,223 @@
+package advisor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/zouuup/memadvise/internal/features"
+	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/syscall"
+)
+
+// Reasons an iterative run stopped
+const (
+	StopGoalReached = "goal_reached"
+	StopMaxRounds   = "max_rounds"
+	StopTimeout     = "timeout"
+	StopExhausted   = "regions_exhausted"
+)
+
+// minEfficiency bounds how much a step is scaled up when advice shows
+// little observable effect, as is common with lazy MADV_COLD
+const minEfficiency = 0.25
+
+// IterativeOptions configures closed-loop reclaim
+type IterativeOptions struct {
+	Step      int64         // Bytes to advise in the first round; 0 means a quarter of the goal
+	Interval  time.Duration // Wait between advising and re-reading memory stats
+	MaxRounds int
+	Timeout   time.Duration // Overall limit; 0 means no limit
+}
+
+// Round is one advise-wait-measure step of an iterative run
+type Round struct {
+	Round     int
+	Step      int64         // Bytes requested this round
+	Advised   int64         // Bytes the kernel reported advised this round
+	RSS       int64         // RSS measured after the round
+	Reclaimed int64         // Cumulative RSS reduction since the start
+	Elapsed   time.Duration // Time since the start of the run
+}
+
+// IterativeResult describes a completed iterative run
+type IterativeResult struct {
+	Goal       int64
+	Reclaimed  int64
+	Advised    int64
+	Rounds     []Round
+	StopReason string
+	Ranges     []syscall.MemoryRegion // Ranges advised across all rounds
+}
+
+// StatsFunc returns current memory statistics for the target
+type StatsFunc func() (*inspector.MemoryStats, error)
+
+// ExecuteIterative advises memory in steps, re-reading stats after each step
+// and sizing the next step from the observed RSS reduction, until goal bytes
+// have been reclaimed, a limit is hit or ctx is done
+func (a *Advisor) ExecuteIterative(ctx context.Context, goal int64, mode string, opts IterativeOptions, before *inspector.MemoryStats, stats StatsFunc) (*IterativeResult, error) {
+	if len(a.regions) == 0 {
+		return nil, ErrNoRegions
+	}
+
+	if err := features.Current().CheckMode(mode); err != nil {
+		return nil, err
+	}
+
+	step := opts.Step
+	if step <= 0 {
+		step = goal / 4
+	}
+	if step < int64(pageSize) {
+		step = int64(pageSize)
+	}
+	firstStep := step
+
+	// THP-backed regions are skipped in every round; count them once
+	skippedTHP := 0
+	if a.opts.THPPolicy == THPSkip {
+		for _, region := range a.regions {
+			if region.AnonHugePages > 0 {
+				skippedTHP++
+			}
+		}
+	}
+	a.recordSkipped(skippedTHP)
+
+	result := &IterativeResult{Goal: goal}
+	remaining := a.regions
+	var pacing PacingStats
+	start := time.Now()
+
+	for {
+		if result.Reclaimed >= goal {
+			result.StopReason = StopGoalReached
+			break
+		}
+		if opts.MaxRounds > 0 && len(result.Rounds) >= opts.MaxRounds {
+			result.StopReason = StopMaxRounds
+			break
+		}
+		if opts.Timeout > 0 && time.Since(start) >= opts.Timeout {
+			result.StopReason = StopTimeout
+			break
+		}
+
+		sel := a.selectFrom(remaining, step)
+		if len(sel.Regions) == 0 {
+			result.StopReason = StopExhausted
+			break
+		}
+		remaining = subtractRegions(remaining, sel.Regions)
+		for _, region := range sel.Regions {
+			a.output.SelectedRegion(a.pid, region)
+		}
+
+		advised, batchStats, err := a.apply(ctx, sel.Regions, mode)
+		pacing.add(batchStats)
+		if err != nil {
+			return result, fmt.Errorf("failed to apply memory advice in round %d: %w", len(result.Rounds)+1, err)
+		}
+		result.Advised += advised
+		result.Ranges = append(result.Ranges, sel.Regions...)
+
+		// Give the kernel time to act on the advice, without overrunning the timeout
+		wait := opts.Interval
+		if opts.Timeout > 0 {
+			if left := opts.Timeout - time.Since(start); left < wait {
+				wait = left
+			}
+		}
+		if err := SleepContext(ctx, wait); err != nil {
+			return result, fmt.Errorf("stopped in round %d: %w", len(result.Rounds)+1, err)
+		}
+
+		current, err := stats()
+		if err != nil {
+			return result, fmt.Errorf("failed to get memory stats in round %d: %w", len(result.Rounds)+1, err)
+		}
+		result.Reclaimed = before.TotalRSS - current.TotalRSS
+
+		round := Round{
+			Round:     len(result.Rounds) + 1,
+			Step:      int64(sel.Bytes),
+			Advised:   advised,
+			RSS:       current.TotalRSS,
+			Reclaimed: result.Reclaimed,
+			Elapsed:   time.Since(start),
+		}
+		result.Rounds = append(result.Rounds, round)
+		a.output.IterationRound(a.pid, round.Round, round.Step, round.Advised, round.RSS, round.Reclaimed, goal, round.Elapsed)
+
+		step = nextStep(goal-result.Reclaimed, result.Reclaimed, result.Advised, firstStep)
+	}
+
+	a.output.IterationSummary(a.pid, goal, result.Reclaimed, result.Advised, len(result.Rounds), result.StopReason)
+	if a.opts.Pacing.Enabled() {
+		a.output.PacingResults(a.pid, pacing.Batches, pacing.Bytes, pacing.Slept, pacing.Paused, pacing.Elapsed)
+	}
+	return result, nil
+}
+
+// nextStep sizes the next round from how much of the advised memory has
+// actually left RSS so far. The step is bounded to four times the first step
+// so a run of lazy advice doesn't turn into one huge final round.
+func nextStep(remainingGoal, reclaimed, advised, firstStep int64) int64 {
+	if remainingGoal <= 0 {
+		return 0
+	}
+
+	efficiency := 1.0
+	if advised > 0 {
+		efficiency = float64(reclaimed) / float64(advised)
+	}
+	if efficiency < minEfficiency {
+		efficiency = minEfficiency
+	}
+	if efficiency > 1 {
+		efficiency = 1
+	}
+
+	step := int64(float64(remainingGoal) / efficiency)
+	if step > 4*firstStep {
+		step = 4 * firstStep
+	}
+	if step < int64(pageSize) {
+		step = int64(pageSize)
+	}
+	return step
+}
+
+// subtractRegions removes the selected ranges from regions. Selected ranges
+// are always a prefix of a region, as produced by trimRegion.
+func subtractRegions(regions []syscall.MemoryRegion, selected []syscall.MemoryRegion) []syscall.MemoryRegion {
+	taken := make(map[uint64]uint64, len(selected))
+	for _, region := range selected {
+		taken[region.Start] = region.End
+	}
+
+	left := make([]syscall.MemoryRegion, 0, len(regions))
+	for _, region := range regions {
+		end, ok := taken[region.Start]
+		if !ok {
+			left = append(left, region)
+			continue
+		}
+		if end >= region.End {
+			continue
+		}
+
+		rest := region
+		rest.Start = end
+		rest.Size = region.End - end
+		if rest.Rss > rest.Size {
+			rest.Rss = rest.Size
+		}
+		if rest.AnonHugePages > rest.Size {
+			rest.AnonHugePages = rest.Size
+		}
+		left = append(left, rest)
+	}
+	return left
+}
@@ -0,0 +1,218 @@
+package advisor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/zouuup/memadvise/internal/gate"
+	"github.com/zouuup/memadvise/internal/metrics"
+	"github.com/zouuup/memadvise/internal/syscall"
+)
+
+// PacingOptions limits how quickly advice is applied
+type PacingOptions struct {
+	Rate        int64          // Bytes per second; 0 means unlimited
+	MaxInflight int64          // Bytes per process_madvise call; 0 means unlimited
+	IOGuard     gate.Condition // Pause while this condition is met; nil disables the guard
+	IOPoll      time.Duration  // How often to re-check the guard while paused
+	MaxPause    time.Duration  // Give up once paused this long in one stretch
+}
+
+// Enabled reports whether any pacing is configured
+func (p PacingOptions) Enabled() bool {
+	return p.Rate > 0 || p.MaxInflight > 0 || p.IOGuard != nil
+}
+
+// PacingStats summarises how advice was paced
+type PacingStats struct {
+	Batches int
+	Bytes   int64         // Bytes advised across all batches
+	Slept   time.Duration // Time spent sleeping to honour the rate
+	Paused  time.Duration // Time spent waiting for the I/O guard
+	Elapsed time.Duration
+}
+
+// add accumulates other into s
+func (s *PacingStats) add(other PacingStats) {
+	s.Batches += other.Batches
+	s.Bytes += other.Bytes
+	s.Slept += other.Slept
+	s.Paused += other.Paused
+	s.Elapsed += other.Elapsed
+}
+
+// apply advises regions, splitting them into paced batches when pacing is
+// enabled. Paced advice stops at the next batch once ctx is done.
+func (a *Advisor) apply(ctx context.Context, regions []syscall.MemoryRegion, mode string) (int64, PacingStats, error) {
+	var stats PacingStats
+	start := time.Now()
+
+	if !a.opts.Pacing.Enabled() {
+		advised, err := syscall.ProcessMadvise(a.pid, regions, mode)
+		a.output.BatchResult(a.pid, regions, err)
+		if err == nil {
+			stats.Batches = 1
+			stats.Bytes = advised
+		} else {
+			metrics.SyscallErrors.Inc(metrics.Errno(err))
+		}
+		stats.Elapsed = time.Since(start)
+		return advised, stats, err
+	}
+
+	pacing := a.opts.Pacing
+	batchSize := pacing.MaxInflight
+	if batchSize <= 0 && pacing.Rate > 0 {
+		// Default to a quarter second of work per call
+		batchSize = pacing.Rate / 4
+	}
+	if batchSize > 0 && batchSize < int64(pageSize) {
+		batchSize = int64(pageSize)
+	}
+
+	for _, batch := range splitBatches(regions, batchSize, a.opts.THPPolicy == THPFull) {
+		if err := ctx.Err(); err != nil {
+			stats.Elapsed = time.Since(start)
+			return stats.Bytes, stats, fmt.Errorf("stopped after %d batches: %w", stats.Batches, err)
+		}
+		if pacing.IOGuard != nil {
+			paused, err := waitForGuard(ctx, pacing)
+			stats.Paused += paused
+			if err != nil {
+				stats.Elapsed = time.Since(start)
+				return stats.Bytes, stats, fmt.Errorf("stopped after %d batches: %w", stats.Batches, err)
+			}
+		}
+
+		callStart := time.Now()
+		advised, err := syscall.ProcessMadvise(a.pid, batch, mode)
+		a.output.BatchResult(a.pid, batch, err)
+		if err != nil {
+			metrics.SyscallErrors.Inc(metrics.Errno(err))
+			stats.Elapsed = time.Since(start)
+			return stats.Bytes, stats, err
+		}
+		stats.Batches++
+		stats.Bytes += advised
+
+		if pacing.Rate > 0 {
+			target := time.Duration(float64(advised) / float64(pacing.Rate) * float64(time.Second))
+			if sleep := target - time.Since(callStart); sleep > 0 {
+				sleepStart := time.Now()
+				SleepContext(ctx, sleep) // Cut short when ctx is done, which the next batch reports
+				stats.Slept += time.Since(sleepStart)
+			}
+		}
+	}
+
+	stats.Elapsed = time.Since(start)
+	return stats.Bytes, stats, nil
+}
+
+// waitForGuard blocks while the I/O guard condition is met and returns the
+// time spent waiting
+func waitForGuard(ctx context.Context, pacing PacingOptions) (time.Duration, error) {
+	poll := pacing.IOPoll
+	if poll <= 0 {
+		poll = time.Second
+	}
+
+	start := time.Now()
+	for {
+		result, err := pacing.IOGuard.Evaluate()
+		if err != nil {
+			return time.Since(start), fmt.Errorf("failed to evaluate I/O guard: %w", err)
+		}
+		if !result.Met {
+			return time.Since(start), nil
+		}
+		if pacing.MaxPause > 0 && time.Since(start) >= pacing.MaxPause {
+			return time.Since(start), fmt.Errorf("I/O pressure stayed above %s for %s", result.Condition, pacing.MaxPause)
+		}
+		if err := SleepContext(ctx, poll); err != nil {
+			return time.Since(start), err
+		}
+	}
+}
+
+// SleepContext waits for d, or until ctx is done and returns its error
+func SleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// splitBatches groups regions into batches of at most batchSize bytes,
+// splitting regions at page boundaries where needed. With hugeAligned, THP-backed
+// regions are only split at huge page boundaries, and batches hold at least
+// one huge page. A batchSize of 0 returns all regions as a single batch.
+func splitBatches(regions []syscall.MemoryRegion, batchSize int64, hugeAligned bool) [][]syscall.MemoryRegion {
+	if len(regions) == 0 {
+		return nil
+	}
+	if batchSize <= 0 {
+		return [][]syscall.MemoryRegion{regions}
+	}
+
+	limit := uint64(batchSize) &^ (pageSize - 1)
+	if hugeAligned {
+		limit &^= hugePageSize - 1
+		if limit < hugePageSize {
+			limit = hugePageSize
+		}
+	}
+
+	var batches [][]syscall.MemoryRegion
+	var current []syscall.MemoryRegion
+	var currentBytes uint64
+
+	for _, region := range regions {
+		huge := hugeAligned && region.AnonHugePages > 0
+		start := region.Start
+		for start < region.End {
+			end := region.End
+			if room := limit - currentBytes; end-start > room {
+				end = start + room
+				if huge {
+					end &^= hugePageSize - 1
+				}
+				// No huge page fits in the rest of this batch; start the next
+				if end <= start {
+					batches = append(batches, current)
+					current, currentBytes = nil, 0
+					continue
+				}
+			}
+
+			piece := region
+			piece.Start, piece.End, piece.Size = start, end, end-start
+			if piece.Rss > piece.Size {
+				piece.Rss = piece.Size
+			}
+			if piece.AnonHugePages > piece.Size {
+				piece.AnonHugePages = piece.Size
+			}
+
+			current = append(current, piece)
+			currentBytes += piece.Size
+			start = end
+
+			if currentBytes >= limit {
+				batches = append(batches, current)
+				current, currentBytes = nil, 0
+			}
+		}
+	}
+	if len(current) > 0 {
+		batches = append(batches, current)
+	}
+
+	return batches
+}
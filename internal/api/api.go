@@ -0,0 +1,129 @@
+package api
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultSocket is where the daemon serves the API unless told otherwise
+const DefaultSocket = "/run/memadvise/memadvise.sock"
+
+// Endpoints, all under the API version prefix
+const (
+	PathInspect = "/v1/inspect"
+	PathPlan    = "/v1/plan"
+	PathApply   = "/v1/apply"
+	PathWarm    = "/v1/warm"
+	PathStatus  = "/v1/status"
+)
+
+// Errors a Backend wraps to choose the HTTP status of a failed request
+var (
+	ErrBadRequest = errors.New("bad request")
+	ErrNotFound   = errors.New("process not found")
+)
+
+// ReclaimRequest asks for a plan or a reclaim of a single process. Fields
+// left out fall back to the daemon's reclaim flags.
+type ReclaimRequest struct {
+	PID       int    `json:"pid"`
+	Mode      string `json:"mode,omitempty"`       // "cold" or "pageout"
+	Percent   int    `json:"percent,omitempty"`    // Share of eligible memory to advise
+	Bytes     int64  `json:"bytes,omitempty"`      // Fixed budget; overrides percent
+	TargetRSS int64  `json:"target_rss,omitempty"` // Advise down to this RSS; overrides percent
+
+	Caller Caller `json:"-"` // Filled in by the server
+}
+
+// WarmRequest asks for the memory of a process to be read back in
+type WarmRequest struct {
+	PID   int   `json:"pid"`
+	Bytes int64 `json:"bytes,omitempty"` // At most this many bytes; 0 warms every eligible region
+
+	Caller Caller `json:"-"` // Filled in by the server
+}
+
+// Caller is the process that sent a request, from its socket credentials
+type Caller struct {
+	UID int
+	PID int
+}
+
+// Inspection describes the memory of a process
+type Inspection struct {
+	PID           int    `json:"pid"`
+	Comm          string `json:"comm"`
+	Exe           string `json:"exe,omitempty"`
+	Cgroup        string `json:"cgroup,omitempty"`
+	RSS           int64  `json:"rss"`
+	Anon          int64  `json:"anon"`
+	Private       int64  `json:"private"`
+	Shared        int64  `json:"shared"`
+	Swap          int64  `json:"swap"`
+	EligibleBytes int64  `json:"eligible_bytes"` // Resident bytes in regions that may be advised
+	Regions       int    `json:"regions"`        // Number of eligible regions
+}
+
+// Region is a memory range selected for advice
+type Region struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+	Size  uint64 `json:"size"`
+	Path  string `json:"path,omitempty"`
+}
+
+// Plan is what a reclaim would advise, without advising anything
+type Plan struct {
+	PID           int      `json:"pid"`
+	Mode          string   `json:"mode"`
+	RSS           int64    `json:"rss"`
+	EligibleBytes int64    `json:"eligible_bytes"`
+	Budget        int64    `json:"budget"`
+	SelectedBytes int64    `json:"selected_bytes"`
+	Regions       []Region `json:"regions"`
+}
+
+// Result is the outcome of advising a process
+type Result struct {
+	PID       int    `json:"pid"`
+	Mode      string `json:"mode"`
+	Advised   int64  `json:"advised"`
+	RSSBefore int64  `json:"rss_before"`
+	RSSAfter  int64  `json:"rss_after"`
+}
+
+// Status describes the daemon and the processes it keeps state for
+type Status struct {
+	PID      int            `json:"pid"`
+	Started  time.Time      `json:"started"`
+	Interval string         `json:"interval"`
+	Rules    []string       `json:"rules"`
+	Targets  []TargetStatus `json:"targets"`
+}
+
+// TargetStatus is the daemon's state for one process
+type TargetStatus struct {
+	PID          int       `json:"pid"`
+	Comm         string    `json:"comm"`
+	LastAdvised  time.Time `json:"last_advised,omitempty"`
+	LastAdvisedB int64     `json:"last_advised_bytes"`
+	LastRSS      int64     `json:"last_rss"`
+	RefaultRate  float64   `json:"refault_rate"`        // Smoothed major faults per second
+	RefaultRatio float64   `json:"refault_ratio"`       // Share of the last advice faulted back in
+	BudgetScale  float64   `json:"budget_scale"`        // Factor applied to the next budget
+	HotUntil     time.Time `json:"hot_until,omitempty"` // Left alone until then after a rollback
+}
+
+// Backend carries out API requests
+type Backend interface {
+	Inspect(pid int) (*Inspection, error)
+	Plan(req ReclaimRequest) (*Plan, error)
+	Apply(req ReclaimRequest) (*Result, error)
+	Warm(req WarmRequest) (*Result, error)
+	Status() (*Status, error)
+}
+
+// errorResponse is the body of a failed request
+type errorResponse struct {
+	Error string `json:"error"`
+}
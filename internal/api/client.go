@@ -0,0 +1,129 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Error is a request the daemon refused or failed to carry out
+type Error struct {
+	Status  int // HTTP status code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Client talks to the daemon's API over its Unix socket
+type Client struct {
+	socket string
+	http   *http.Client
+}
+
+// NewClient creates a client for the daemon listening on socket. Requests
+// time out after timeout; 0 means no limit.
+func NewClient(socket string, timeout time.Duration) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &Client{
+		socket: socket,
+		http:   &http.Client{Transport: transport, Timeout: timeout},
+	}
+}
+
+// Inspect returns the memory of pid
+func (c *Client) Inspect(pid int) (*Inspection, error) {
+	var inspection Inspection
+	if err := c.do(http.MethodGet, fmt.Sprintf("%s?pid=%d", PathInspect, pid), nil, &inspection); err != nil {
+		return nil, err
+	}
+	return &inspection, nil
+}
+
+// Plan returns what reclaiming as requested would advise
+func (c *Client) Plan(req ReclaimRequest) (*Plan, error) {
+	var plan Plan
+	if err := c.do(http.MethodPost, PathPlan, req, &plan); err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// Apply reclaims from a process
+func (c *Client) Apply(req ReclaimRequest) (*Result, error) {
+	var result Result
+	if err := c.do(http.MethodPost, PathApply, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Warm reads the memory of a process back in
+func (c *Client) Warm(req WarmRequest) (*Result, error) {
+	var result Result
+	if err := c.do(http.MethodPost, PathWarm, req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Status returns the daemon's status
+func (c *Client) Status() (*Status, error) {
+	var status Status
+	if err := c.do(http.MethodGet, PathStatus, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// do sends a request with body encoded as JSON, if not nil, and decodes the
+// response into result
+func (c *Client) do(method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	// The host is ignored by the dialer but required in the URL
+	req, err := http.NewRequest(method, "http://memadvise"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach the daemon on %s: %w", c.socket, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&failure); err != nil || failure.Error == "" {
+			return &Error{Status: resp.StatusCode, Message: resp.Status}
+		}
+		return &Error{Status: resp.StatusCode, Message: failure.Error}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("invalid response from the daemon: %w", err)
+	}
+	return nil
+}
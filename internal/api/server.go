@@ -0,0 +1,363 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/zouuup/memadvise/internal/output"
+)
+
+// maxRequestBody bounds the size of a request body
+const maxRequestBody = 64 * 1024
+
+// shutdownTimeout is how long Close waits for requests in progress
+const shutdownTimeout = 5 * time.Second
+
+// Access decides which peers may use the API, on top of the socket's file
+// permissions. Root and the daemon's own user are always allowed.
+type Access struct {
+	UIDs []int // Allowed users
+	GIDs []int // Allowed groups, matched against the peer's primary and supplementary groups
+}
+
+// Server serves the API on a Unix socket
+type Server struct {
+	path     string
+	backend  Backend
+	access   Access
+	output   *output.OutputManager
+	listener net.Listener
+	http     *http.Server
+}
+
+// peerKey is the context key under which a connection's peer credentials are stored
+type peerKey struct{}
+
+// peer is who is on the other end of a connection
+type peer struct {
+	cred *unix.Ucred
+	err  error
+}
+
+// Listen creates the socket at path with the given permissions and group
+// (-1 keeps the daemon's group). A stale socket left behind by a previous
+// daemon is replaced; one another daemon is listening on is not.
+func Listen(path string, mode os.FileMode, gid int, backend Backend, access Access, out *output.OutputManager) (*Server, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	// Create the socket without any access so nobody can connect before
+	// its permissions are set
+	oldMask := unix.Umask(0777)
+	listener, err := net.Listen("unix", path)
+	unix.Umask(oldMask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+
+	if gid >= 0 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set group of %s: %w", path, err)
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set permissions of %s: %w", path, err)
+	}
+
+	s := &Server{
+		path:     path,
+		backend:  backend,
+		access:   access,
+		output:   out,
+		listener: listener,
+	}
+	s.http = &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			cred, err := peerCredentials(conn)
+			return context.WithValue(ctx, peerKey{}, peer{cred: cred, err: err})
+		},
+	}
+	return s, nil
+}
+
+// Serve handles requests until Close is called
+func (s *Server) Serve() error {
+	err := s.http.Serve(s.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stops accepting requests, waits for those in progress and removes the socket
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := s.http.Shutdown(ctx)
+	os.Remove(s.path)
+	return err
+}
+
+// Handler returns the HTTP handler of the API. Requests without peer
+// credentials in their context are refused.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathInspect, s.handleInspect)
+	mux.HandleFunc(PathPlan, s.handlePlan)
+	mux.HandleFunc(PathApply, s.handleApply)
+	mux.HandleFunc(PathWarm, s.handleWarm)
+	mux.HandleFunc(PathStatus, s.handleStatus)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := r.Context().Value(peerKey{}).(peer)
+		if p.err != nil || p.cred == nil {
+			writeError(w, http.StatusForbidden, "cannot identify peer")
+			return
+		}
+		if !s.access.allows(p.cred) {
+			s.output.Warning(fmt.Sprintf("api: refused %s %s from uid %d (pid %d)", r.Method, r.URL.Path, p.cred.Uid, p.cred.Pid))
+			writeError(w, http.StatusForbidden, fmt.Sprintf("uid %d is not allowed to use this socket", p.cred.Uid))
+			return
+		}
+		if s.output.IsVerbose() {
+			s.output.Info(fmt.Sprintf("api: %s %s from uid %d (pid %d)", r.Method, r.URL.Path, p.cred.Uid, p.cred.Pid))
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleInspect(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	pid, err := strconv.Atoi(r.URL.Query().Get("pid"))
+	if err != nil || pid <= 0 {
+		writeError(w, http.StatusBadRequest, "missing or invalid pid")
+		return
+	}
+	inspection, err := s.backend.Inspect(pid)
+	writeResult(w, inspection, err)
+}
+
+func (s *Server) handlePlan(w http.ResponseWriter, r *http.Request) {
+	var req ReclaimRequest
+	if !readRequest(w, r, &req) {
+		return
+	}
+	plan, err := s.backend.Plan(req)
+	writeResult(w, plan, err)
+}
+
+func (s *Server) handleApply(w http.ResponseWriter, r *http.Request) {
+	var req ReclaimRequest
+	if !readRequest(w, r, &req) {
+		return
+	}
+	req.Caller = callerOf(r)
+	result, err := s.backend.Apply(req)
+	writeResult(w, result, err)
+}
+
+func (s *Server) handleWarm(w http.ResponseWriter, r *http.Request) {
+	var req WarmRequest
+	if !readRequest(w, r, &req) {
+		return
+	}
+	req.Caller = callerOf(r)
+	result, err := s.backend.Warm(req)
+	writeResult(w, result, err)
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	status, err := s.backend.Status()
+	writeResult(w, status, err)
+}
+
+// callerOf returns who sent r, from the peer credentials checked by Handler
+func callerOf(r *http.Request) Caller {
+	p, _ := r.Context().Value(peerKey{}).(peer)
+	if p.cred == nil {
+		return Caller{}
+	}
+	return Caller{UID: int(p.cred.Uid), PID: int(p.cred.Pid)}
+}
+
+// allowMethod replies with 405 unless r uses method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s requires %s", r.URL.Path, method))
+		return false
+	}
+	return true
+}
+
+// readRequest decodes the JSON body of a POST request into v, replying with
+// an error if it can't
+func readRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if !allowMethod(w, r, http.MethodPost) {
+		return false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+		return false
+	}
+	return true
+}
+
+// writeResult replies with v, or with err mapped to an HTTP status
+func writeResult(w http.ResponseWriter, v interface{}, err error) {
+	switch {
+	case errors.Is(err, ErrBadRequest):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	default:
+		writeJSON(w, http.StatusOK, v)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// allows reports whether the peer with the given credentials may use the API
+func (a Access) allows(cred *unix.Ucred) bool {
+	uid := int(cred.Uid)
+	if uid == 0 || uid == os.Getuid() || containsInt(a.UIDs, uid) {
+		return true
+	}
+	if len(a.GIDs) == 0 {
+		return false
+	}
+	if containsInt(a.GIDs, int(cred.Gid)) {
+		return true
+	}
+
+	// SO_PEERCRED only carries the primary group
+	groups, err := supplementaryGroups(int(cred.Pid))
+	if err != nil {
+		return false
+	}
+	for _, gid := range groups {
+		if containsInt(a.GIDs, gid) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerCredentials returns the credentials of the process on the other end of
+// a Unix socket connection
+func peerCredentials(conn net.Conn) (*unix.Ucred, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a Unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// supplementaryGroups reads the Groups line of /proc/[pid]/status
+func supplementaryGroups(pid int) ([]int, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || key != "Groups" {
+			continue
+		}
+		var groups []int
+		for _, field := range strings.Fields(value) {
+			gid, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid group '%s'", field)
+			}
+			groups = append(groups, gid)
+		}
+		return groups, nil
+	}
+	return nil, scanner.Err()
+}
+
+// removeStaleSocket removes a socket at path that nobody is listening on
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another daemon", path)
+	}
+	return os.Remove(path)
+}
+
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/zouuup/memadvise/internal/output"
+)
+
+// fakeBackend answers for PID 42 only
+type fakeBackend struct {
+	applied []ReclaimRequest
+}
+
+func (b *fakeBackend) Inspect(pid int) (*Inspection, error) {
+	if pid != 42 {
+		return nil, fmt.Errorf("PID %d: %w", pid, ErrNotFound)
+	}
+	return &Inspection{PID: pid, Comm: "worker", RSS: 1 << 30}, nil
+}
+
+func (b *fakeBackend) Plan(req ReclaimRequest) (*Plan, error) {
+	if req.Mode != "" && req.Mode != "cold" && req.Mode != "pageout" {
+		return nil, fmt.Errorf("invalid mode: %s: %w", req.Mode, ErrBadRequest)
+	}
+	return &Plan{PID: req.PID, Mode: "cold", Budget: 100, Regions: []Region{{Start: 0x1000, End: 0x2000, Size: 0x1000}}}, nil
+}
+
+func (b *fakeBackend) Apply(req ReclaimRequest) (*Result, error) {
+	b.applied = append(b.applied, req)
+	return &Result{PID: req.PID, Mode: req.Mode, Advised: 4096}, nil
+}
+
+func (b *fakeBackend) Warm(req WarmRequest) (*Result, error) {
+	return &Result{PID: req.PID, Mode: "willneed", Advised: req.Bytes}, nil
+}
+
+func (b *fakeBackend) Status() (*Status, error) {
+	return &Status{PID: os.Getpid(), Interval: "1m0s", Rules: []string{"sidecars"}}, nil
+}
+
+func TestServer(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "run", "memadvise.sock")
+	backend := &fakeBackend{}
+
+	server, err := Listen(socket, 0600, -1, backend, Access{}, output.New(false, false))
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	go server.Serve()
+	defer server.Close()
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("socket not created: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	client := NewClient(socket, 5*time.Second)
+
+	status, err := client.Status()
+	if err != nil {
+		t.Fatalf("Status() error: %v", err)
+	}
+	if status.PID != os.Getpid() || len(status.Rules) != 1 {
+		t.Errorf("Status() = %+v", status)
+	}
+
+	inspection, err := client.Inspect(42)
+	if err != nil || inspection.Comm != "worker" {
+		t.Errorf("Inspect(42) = %+v, %v", inspection, err)
+	}
+
+	var apiErr *Error
+	if _, err := client.Inspect(7); !errors.As(err, &apiErr) || apiErr.Status != http.StatusNotFound {
+		t.Errorf("Inspect(7) error = %v, want 404", err)
+	}
+	if _, err := client.Plan(ReclaimRequest{PID: 42, Mode: "warm"}); !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest {
+		t.Errorf("Plan() with invalid mode error = %v, want 400", err)
+	}
+
+	plan, err := client.Plan(ReclaimRequest{PID: 42})
+	if err != nil || len(plan.Regions) != 1 {
+		t.Errorf("Plan() = %+v, %v", plan, err)
+	}
+
+	if _, err := client.Apply(ReclaimRequest{PID: 42, Mode: "pageout", Bytes: 4096}); err != nil {
+		t.Errorf("Apply() error: %v", err)
+	}
+	if len(backend.applied) != 1 || backend.applied[0].Bytes != 4096 {
+		t.Errorf("backend received %+v", backend.applied)
+	}
+
+	result, err := client.Warm(WarmRequest{PID: 42, Bytes: 8192})
+	if err != nil || result.Advised != 8192 {
+		t.Errorf("Warm() = %+v, %v", result, err)
+	}
+
+	// Mutating endpoints only accept POST
+	if err := client.do(http.MethodGet, PathApply, nil, &Result{}); !errors.As(err, &apiErr) || apiErr.Status != http.StatusMethodNotAllowed {
+		t.Errorf("GET %s error = %v, want 405", PathApply, err)
+	}
+
+	// A second daemon must not take over the socket
+	if _, err := Listen(socket, 0600, -1, backend, Access{}, output.New(false, false)); err == nil {
+		t.Errorf("Listen() on a socket in use succeeded")
+	}
+}
+
+func TestAccess(t *testing.T) {
+	self := int32(os.Getpid())
+	groups, err := supplementaryGroups(int(self))
+	if err != nil {
+		t.Fatalf("supplementaryGroups() error: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		access Access
+		cred   unix.Ucred
+		want   bool
+	}{
+		{"Root", Access{}, unix.Ucred{Pid: self, Uid: 0, Gid: 0}, true},
+		{"Own user", Access{}, unix.Ucred{Pid: self, Uid: uint32(os.Getuid()), Gid: 1}, true},
+		{"Other user", Access{}, unix.Ucred{Pid: self, Uid: 64000, Gid: 64000}, false},
+		{"Allowed user", Access{UIDs: []int{64000}}, unix.Ucred{Pid: self, Uid: 64000, Gid: 64000}, true},
+		{"Allowed primary group", Access{GIDs: []int{64001}}, unix.Ucred{Pid: self, Uid: 64000, Gid: 64001}, true},
+		{"Other group", Access{GIDs: []int{64001}}, unix.Ucred{Pid: self, Uid: 64000, Gid: 64000}, false},
+	}
+	if len(groups) > 0 {
+		testCases = append(testCases, struct {
+			name   string
+			access Access
+			cred   unix.Ucred
+			want   bool
+		}{"Allowed supplementary group", Access{GIDs: []int{groups[0]}}, unix.Ucred{Pid: self, Uid: 64000, Gid: 64000}, true})
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cred := tc.cred
+			if got := tc.access.allows(&cred); got != tc.want {
+				t.Errorf("allows(%+v) = %v, want %v", tc.cred, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+// Package audit appends a record of every advice action to an audit log: a
+// file of JSON lines rotated by size, syslog or the systemd journal
+package audit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Destinations besides a file path
+const (
+	Syslog   = "syslog"
+	Journald = "journald"
+)
+
+// journalSocket is where journald accepts native protocol datagrams
+const journalSocket = "/run/systemd/journal/socket"
+
+// Entry is one advice action
+type Entry struct {
+	Time      time.Time `json:"time"`
+	UID       int       `json:"uid"`                  // Who asked: the invoking user, or the API caller
+	LoginUID  *int      `json:"login_uid,omitempty"`  // User of the login session, which sudo doesn't change
+	CallerPID int       `json:"caller_pid,omitempty"` // Process that sent an API request
+	Command   []string  `json:"command"`              // Command line of memadvise
+	Source    string    `json:"source"`               // reclaim, api, rollback or "rule <name>"
+
+	PID       int    `json:"pid"`
+	Comm      string `json:"comm"`
+	Exe       string `json:"exe,omitempty"`
+	Cgroup    string `json:"cgroup,omitempty"`
+	StartTime uint64 `json:"start_time"`
+
+	Mode      string `json:"mode"`
+	Requested int64  `json:"requested"`
+	Advised   int64  `json:"advised"`
+	Result    string `json:"result"` // ok or error
+	Error     string `json:"error,omitempty"`
+}
+
+// Message summarises the entry in one line
+func (e Entry) Message() string {
+	msg := fmt.Sprintf("uid %d (%s) advised %d of %d bytes of PID %d (%s) with %s: %s",
+		e.UID, e.Source, e.Advised, e.Requested, e.PID, e.Comm, e.Mode, e.Result)
+	if e.Error != "" {
+		msg += ": " + e.Error
+	}
+	return msg
+}
+
+// Logger writes entries to a destination. Each entry is written with its
+// own open and lock, so several memadvise processes can share a file.
+type Logger struct {
+	Dest    string // File path, Syslog or Journald
+	MaxSize int64  // Rotate the file once it would grow past this; 0 never rotates
+	Keep    int    // Rotated files to keep, as Dest.1 to Dest.Keep
+}
+
+// Log writes e to the destination, filling in the time and command line. The
+// invoking user is filled in unless the entry is for an API caller.
+func (l *Logger) Log(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Command == nil {
+		e.Command = os.Args
+	}
+	if e.CallerPID == 0 {
+		e.UID = os.Getuid()
+		e.LoginUID = loginUID()
+	}
+	if e.Result == "" {
+		e.Result = "ok"
+		if e.Error != "" {
+			e.Result = "error"
+		}
+	}
+
+	var err error
+	switch l.Dest {
+	case Syslog:
+		err = writeSyslog(e)
+	case Journald:
+		err = writeJournal(e)
+	default:
+		err = l.writeFile(e)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// writeFile appends e as a JSON line, rotating the file first if needed
+func (l *Logger) writeFile(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(l.Dest), 0750); err != nil {
+		return err
+	}
+
+	for {
+		f, err := os.OpenFile(l.Dest, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+			f.Close()
+			return err
+		}
+
+		// Another process may have rotated the file while we waited
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if current, err := os.Stat(l.Dest); err != nil || !os.SameFile(info, current) {
+			f.Close()
+			continue
+		}
+
+		if l.MaxSize > 0 && info.Size() > 0 && info.Size()+int64(len(line)) > l.MaxSize {
+			err := l.rotate()
+			f.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = f.Write(line)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+}
+
+// rotate shifts Dest.N to Dest.N+1, dropping the oldest, and Dest to Dest.1
+func (l *Logger) rotate() error {
+	if l.Keep <= 0 {
+		return os.Remove(l.Dest)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", l.Dest, l.Keep))
+	for i := l.Keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.Dest, i), fmt.Sprintf("%s.%d", l.Dest, i+1))
+	}
+	return os.Rename(l.Dest, l.Dest+".1")
+}
+
+// writeSyslog sends e to the local syslog daemon as an authpriv notice
+func writeSyslog(e Entry) error {
+	w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_NOTICE, "memadvise")
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return w.Notice(e.Message() + " " + string(line))
+}
+
+// writeJournal sends e to journald with its fields as MEMADVISE_* journal fields
+func writeJournal(e Entry) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(journalFields(e))
+	return err
+}
+
+// journalFields encodes e in journald's native protocol
+func journalFields(e Entry) []byte {
+	fields := []struct{ name, value string }{
+		{"MESSAGE", e.Message()},
+		{"PRIORITY", strconv.Itoa(int(syslog.LOG_NOTICE))},
+		{"SYSLOG_IDENTIFIER", "memadvise"},
+		{"SYSLOG_FACILITY", strconv.Itoa(int(syslog.LOG_AUTHPRIV) >> 3)},
+		{"MEMADVISE_UID", strconv.Itoa(e.UID)},
+		{"MEMADVISE_COMMAND", strings.Join(e.Command, " ")},
+		{"MEMADVISE_SOURCE", e.Source},
+		{"MEMADVISE_TARGET_PID", strconv.Itoa(e.PID)},
+		{"MEMADVISE_TARGET_COMM", e.Comm},
+		{"MEMADVISE_TARGET_EXE", e.Exe},
+		{"MEMADVISE_TARGET_CGROUP", e.Cgroup},
+		{"MEMADVISE_TARGET_START_TIME", strconv.FormatUint(e.StartTime, 10)},
+		{"MEMADVISE_MODE", e.Mode},
+		{"MEMADVISE_REQUESTED", strconv.FormatInt(e.Requested, 10)},
+		{"MEMADVISE_ADVISED", strconv.FormatInt(e.Advised, 10)},
+		{"MEMADVISE_RESULT", e.Result},
+		{"MEMADVISE_ERROR", e.Error},
+	}
+	if e.LoginUID != nil {
+		fields = append(fields, struct{ name, value string }{"MEMADVISE_LOGIN_UID", strconv.Itoa(*e.LoginUID)})
+	}
+	if e.CallerPID > 0 {
+		fields = append(fields, struct{ name, value string }{"MEMADVISE_CALLER_PID", strconv.Itoa(e.CallerPID)})
+	}
+
+	var buf bytes.Buffer
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		if !strings.Contains(field.value, "\n") {
+			fmt.Fprintf(&buf, "%s=%s\n", field.name, field.value)
+			continue
+		}
+		// Values with newlines are sent as a little-endian length and the raw bytes
+		buf.WriteString(field.name + "\n")
+		binary.Write(&buf, binary.LittleEndian, uint64(len(field.value)))
+		buf.WriteString(field.value + "\n")
+	}
+	return buf.Bytes()
+}
+
+// loginUID returns the audit login UID of memadvise, or nil outside a login
+// session
+func loginUID() *int {
+	data, err := os.ReadFile("/proc/self/loginuid")
+	if err != nil {
+		return nil
+	}
+	uid, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil || uid == 1<<32-1 {
+		return nil
+	}
+	id := int(uid)
+	return &id
+}
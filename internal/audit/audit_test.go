@@ -0,0 +1,112 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.log")
+	logger := &Logger{Dest: path}
+
+	entries := []Entry{
+		{Source: "rule web", PID: 100, Comm: "postgres", Mode: "pageout", Requested: 64 << 20, Advised: 48 << 20},
+		{Source: "reclaim", PID: 200, Comm: "worker", Mode: "cold", Error: "process_madvise syscall failed: operation not permitted"},
+	}
+	for _, e := range entries {
+		if err := logger.Log(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var got []Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid audit line %q: %v", scanner.Text(), err)
+		}
+		got = append(got, e)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("got %d entries, want 2", len(got))
+	}
+	if got[0].Result != "ok" || got[1].Result != "error" {
+		t.Errorf("results = %q, %q; want ok, error", got[0].Result, got[1].Result)
+	}
+	if got[0].UID != os.Getuid() || len(got[0].Command) == 0 || got[0].Time.IsZero() {
+		t.Errorf("entry not filled in: %+v", got[0])
+	}
+}
+
+func TestLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger := &Logger{Dest: path, MaxSize: 600, Keep: 2}
+
+	for i := 0; i < 20; i++ {
+		if err := logger.Log(Entry{Source: "reclaim", PID: i, Mode: "cold"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("missing %s: %v", name, err)
+		}
+		if info.Size() > logger.MaxSize {
+			t.Errorf("%s is %d bytes, over the %d limit", name, info.Size(), logger.MaxSize)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("kept more than %d rotated files", logger.Keep)
+	}
+}
+
+func TestJournalFields(t *testing.T) {
+	e := Entry{
+		UID:     1000,
+		Command: []string{"memadvise", "--target", "100"},
+		Source:  "reclaim",
+		PID:     100,
+		Comm:    "worker",
+		Mode:    "cold",
+		Result:  "error",
+		Error:   "first line\nsecond line",
+	}
+	data := journalFields(e)
+
+	if !bytes.Contains(data, []byte("MEMADVISE_TARGET_PID=100\n")) || !bytes.Contains(data, []byte("SYSLOG_IDENTIFIER=memadvise\n")) {
+		t.Errorf("missing fields in %q", data)
+	}
+	if bytes.Contains(data, []byte("MEMADVISE_EXE=")) {
+		t.Errorf("empty field sent in %q", data)
+	}
+
+	// Multi-line values are length-prefixed
+	i := bytes.Index(data, []byte("MEMADVISE_ERROR\n"))
+	if i < 0 {
+		t.Fatalf("missing binary MEMADVISE_ERROR field in %q", data)
+	}
+	rest := data[i+len("MEMADVISE_ERROR\n"):]
+	size := binary.LittleEndian.Uint64(rest[:8])
+	if value := string(rest[8 : 8+size]); value != e.Error {
+		t.Errorf("MEMADVISE_ERROR = %q, want %q", value, e.Error)
+	}
+	if !strings.HasPrefix(e.Message(), "uid 1000 (reclaim) advised 0 of 0 bytes of PID 100 (worker) with cold: error") {
+		t.Errorf("Message() = %q", e.Message())
+	}
+}
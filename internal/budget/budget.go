@@ -0,0 +1,136 @@
+package budget
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Distribution policies for sharing a total budget across targets
+const (
+	Proportional = "proportional" // Proportional to each target's eligible RSS
+	Weighted     = "weight"       // Proportional to a per-target weight
+	LargestFirst = "largest"      // Fill the largest targets first
+)
+
+// ValidPolicy reports whether policy is a known distribution policy
+func ValidPolicy(policy string) bool {
+	return policy == Proportional || policy == Weighted || policy == LargestFirst
+}
+
+// Target is a candidate for a share of the total budget
+type Target struct {
+	PID      int
+	Capacity int64   // Most bytes the target can take, typically its eligible RSS
+	Weight   float64 // Only used by the Weighted policy
+}
+
+// Distribute splits total across targets according to policy and returns the
+// allocation for each target, in the same order. No target is allocated more
+// than its capacity; budget a target can't use is redistributed to the others.
+func Distribute(total int64, targets []Target, policy string) []int64 {
+	alloc := make([]int64, len(targets))
+	if total <= 0 {
+		return alloc
+	}
+
+	if policy == LargestFirst {
+		order := make([]int, len(targets))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return targets[order[i]].Capacity > targets[order[j]].Capacity
+		})
+
+		remaining := total
+		for _, i := range order {
+			if remaining <= 0 {
+				break
+			}
+			share := targets[i].Capacity
+			if share > remaining {
+				share = remaining
+			}
+			alloc[i] = share
+			remaining -= share
+		}
+		return alloc
+	}
+
+	weight := func(i int) float64 {
+		if policy == Weighted {
+			return targets[i].Weight
+		}
+		return float64(targets[i].Capacity)
+	}
+
+	var active []int
+	for i := range targets {
+		if targets[i].Capacity > 0 && weight(i) > 0 {
+			active = append(active, i)
+		}
+	}
+
+	// Share the remaining budget among unsaturated targets until either the
+	// budget is spent or every target is full
+	remaining := total
+	for remaining > 0 && len(active) > 0 {
+		var sum float64
+		for _, i := range active {
+			sum += weight(i)
+		}
+
+		var distributed int64
+		var unsaturated []int
+		for _, i := range active {
+			share := int64(float64(remaining) * weight(i) / sum)
+			room := targets[i].Capacity - alloc[i]
+			if share >= room {
+				share = room
+			} else {
+				unsaturated = append(unsaturated, i)
+			}
+			alloc[i] += share
+			distributed += share
+		}
+		remaining -= distributed
+
+		if len(unsaturated) == len(active) {
+			break // Nothing left to redistribute beyond rounding
+		}
+		active = unsaturated
+	}
+
+	return alloc
+}
+
+// ParseWeights parses a "pid=weight,pid=weight" list
+func ParseWeights(s string) (map[int]float64, error) {
+	weights := make(map[int]float64)
+	if strings.TrimSpace(s) == "" {
+		return weights, nil
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		pidStr, weightStr, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid weight '%s': expected pid=weight", entry)
+		}
+
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil || pid <= 0 {
+			return nil, fmt.Errorf("invalid PID '%s' in weight", pidStr)
+		}
+
+		weight, err := strconv.ParseFloat(weightStr, 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight '%s' for PID %d", weightStr, pid)
+		}
+
+		weights[pid] = weight
+	}
+
+	return weights, nil
+}
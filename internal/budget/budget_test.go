@@ -0,0 +1,107 @@
+package budget
+
+import (
+	"testing"
+)
+
+func TestDistribute(t *testing.T) {
+	testCases := []struct {
+		name    string
+		total   int64
+		targets []Target
+		policy  string
+		want    []int64
+	}{
+		{
+			name:  "proportional to capacity",
+			total: 300,
+			targets: []Target{
+				{PID: 1, Capacity: 1000},
+				{PID: 2, Capacity: 2000},
+			},
+			policy: Proportional,
+			want:   []int64{100, 200},
+		},
+		{
+			name:  "weights redistribute unused budget",
+			total: 600,
+			targets: []Target{
+				{PID: 1, Capacity: 100, Weight: 1},
+				{PID: 2, Capacity: 1000, Weight: 1},
+				{PID: 3, Capacity: 1000, Weight: 1},
+			},
+			policy: Weighted,
+			want:   []int64{100, 250, 250},
+		},
+		{
+			name:  "weights",
+			total: 400,
+			targets: []Target{
+				{PID: 1, Capacity: 1000, Weight: 3},
+				{PID: 2, Capacity: 1000, Weight: 1},
+				{PID: 3, Capacity: 1000, Weight: 0},
+			},
+			policy: Weighted,
+			want:   []int64{300, 100, 0},
+		},
+		{
+			name:  "largest first",
+			total: 1500,
+			targets: []Target{
+				{PID: 1, Capacity: 500},
+				{PID: 2, Capacity: 1000},
+				{PID: 3, Capacity: 800},
+			},
+			policy: LargestFirst,
+			want:   []int64{0, 1000, 500},
+		},
+		{
+			name:  "total exceeds all capacity",
+			total: 10000,
+			targets: []Target{
+				{PID: 1, Capacity: 500},
+				{PID: 2, Capacity: 1000},
+			},
+			policy: Proportional,
+			want:   []int64{500, 1000},
+		},
+		{
+			name:    "zero total",
+			total:   0,
+			targets: []Target{{PID: 1, Capacity: 500}},
+			policy:  Proportional,
+			want:    []int64{0},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Distribute(tc.total, tc.targets, tc.policy)
+			if len(got) != len(tc.want) {
+				t.Fatalf("Distribute() got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("Distribute() got %v, want %v", got, tc.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestParseWeights(t *testing.T) {
+	weights, err := ParseWeights("1234=3, 5678=0.5")
+	if err != nil {
+		t.Fatalf("ParseWeights() unexpected error: %v", err)
+	}
+	if weights[1234] != 3 || weights[5678] != 0.5 {
+		t.Errorf("ParseWeights() = %v", weights)
+	}
+
+	for _, input := range []string{"1234", "abc=1", "1234=-1", "0=1"} {
+		if _, err := ParseWeights(input); err == nil {
+			t.Errorf("ParseWeights(%q) expected error", input)
+		}
+	}
+}
@@ -0,0 +1,502 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/zouuup/memadvise/internal/advisor"
+	"github.com/zouuup/memadvise/internal/expr"
+	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/units"
+	"github.com/zouuup/memadvise/internal/watch"
+)
+
+// EnvPrefix is the prefix of environment variables that override config fields
+const EnvPrefix = "MEMADVISE_"
+
+// Config is a declarative reclaim policy
+type Config struct {
+	Interval Duration `yaml:"interval"` // How often the daemon evaluates the rules
+	Rules    []Rule   `yaml:"rules"`
+
+	// Ignored lists the MEMADVISE_* environment variables that matched no
+	// config field, e.g. because of a typo or because they belong to
+	// something else
+	Ignored []string `yaml:"-"`
+
+	path  string
+	lines []int // Line of each rule in the file, for error messages
+}
+
+// Rule describes which processes to reclaim from and how
+type Rule struct {
+	Name     string   `yaml:"name"`
+	Selector Selector `yaml:"selector"`
+	When     string   `yaml:"when"` // Expression each matched process must satisfy
+	Mode     string   `yaml:"mode"`
+	Budget   Budget   `yaml:"budget"`
+	Strategy string   `yaml:"strategy"`
+	Regions  Regions  `yaml:"regions"`
+	Schedule Schedule `yaml:"schedule"`
+	Trigger  Trigger  `yaml:"trigger"`
+	Limits   Limits   `yaml:"limits"`
+	Rollback Rollback `yaml:"rollback"`
+}
+
+// Selector matches processes; every non-empty field must match
+type Selector struct {
+	PID    []int  `yaml:"pid"`
+	Name   string `yaml:"name"`   // Glob matched against the command name
+	Exe    string `yaml:"exe"`    // Glob matched against the executable path
+	Cgroup string `yaml:"cgroup"` // cgroup path; matches the cgroup and everything below it
+
+	// IdleFor restricts the rule to processes that haven't used CPU for this
+	// long. It is applied when reclaiming, not by Matches.
+	IdleFor Duration `yaml:"idle_for"`
+}
+
+// Budget is how much to reclaim from each matched process; at most one
+// field may be set
+type Budget struct {
+	Percent   int  `yaml:"percent"`
+	Bytes     Size `yaml:"bytes"`
+	TargetRSS Size `yaml:"target_rss"` // Reclaim down to this RSS
+}
+
+// Regions filters the eligible regions of each process
+type Regions struct {
+	MinSize      Size     `yaml:"min_size"`
+	MaxSize      Size     `yaml:"max_size"`
+	Paths        []string `yaml:"paths"`
+	ExcludePaths []string `yaml:"exclude_paths"`
+	THP          string   `yaml:"thp"`
+}
+
+// Schedule controls how often a rule may act
+type Schedule struct {
+	Every    Duration `yaml:"every"`    // Minimum time between evaluations of the rule
+	Cooldown Duration `yaml:"cooldown"` // Minimum time between reclaims of the same process
+}
+
+// Trigger makes the daemon evaluate a rule as soon as memory pressure rises
+type Trigger struct {
+	PSI      string   `yaml:"psi"`      // PSI trigger, e.g. "some 150000 1000000"
+	Cgroup   string   `yaml:"cgroup"`   // Watch this cgroup's memory.pressure instead of the system's
+	Events   []string `yaml:"events"`   // memory.events counters of Cgroup to react to: high, max
+	Debounce Duration `yaml:"debounce"` // Minimum time between two triggered evaluations
+}
+
+// Limits are safety limits for a rule
+type Limits struct {
+	MaxBytes    Size   `yaml:"max_bytes"`    // Per-process cap on the budget
+	MinRSS      Size   `yaml:"min_rss"`      // Leave processes smaller than this alone
+	SwapReserve Size   `yaml:"swap_reserve"` // Swap to keep free when paging out
+	Rate        string `yaml:"rate"`         // Maximum advice rate, e.g. 64M/s
+
+	// RefaultRatio halves the daemon's next budget for a process once this
+	// share of its last reclaim has been faulted back in
+	RefaultRatio float64 `yaml:"refault_ratio"`
+}
+
+// Rollback makes the daemon read a pageout back in when it hurt the process
+type Rollback struct {
+	FaultRate float64  `yaml:"fault_rate"` // Rise in major faults per second after a pageout that triggers a rollback
+	Hold      Duration `yaml:"hold"`       // How long to leave the process alone afterwards
+}
+
+// Size is a byte count written as a human readable size, e.g. "512M"
+type Size int64
+
+// UnmarshalYAML parses a size such as 512M or a plain number of bytes
+func (s *Size) UnmarshalYAML(value *yaml.Node) error {
+	bytes, err := units.ParseBytes(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*s = Size(bytes)
+	return nil
+}
+
+// Duration is a time.Duration written as e.g. "30s" or "15m"
+type Duration time.Duration
+
+// UnmarshalYAML parses a duration string
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	duration, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid duration '%s'", value.Line, value.Value)
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Load reads, overrides from the environment and validates a config file
+func Load(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	cfg, err := Parse(data, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.ApplyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Parse decodes a config document without validating it
+func Parse(data []byte, filename string) (*Config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	cfg := &Config{path: filename}
+	if len(root.Content) == 0 {
+		return cfg, nil
+	}
+
+	// Decode the document again, rejecting keys that match no field so that
+	// a misspelled key doesn't leave the rule running with a default
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, decodeError(filename, err)
+	}
+
+	doc := root.Content[0]
+	// Remember where each rule starts so validation errors can point at it
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		if doc.Content[i].Value == "rules" {
+			for _, rule := range doc.Content[i+1].Content {
+				cfg.lines = append(cfg.lines, rule.Line)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// typeErrorLine matches the errors listed in a yaml.TypeError
+var typeErrorLine = regexp.MustCompile(`^line (\d+): (?:field (\S+) not found in type \S+|(.*))$`)
+
+// decodeError reports the first error of a failed decode as file:line, like
+// Validate does
+func decodeError(filename string, err error) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) || len(typeErr.Errors) == 0 {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	m := typeErrorLine.FindStringSubmatch(typeErr.Errors[0])
+	switch {
+	case m == nil:
+		return fmt.Errorf("%s: %s", filename, typeErr.Errors[0])
+	case m[2] != "":
+		return fmt.Errorf("%s:%s: unknown key '%s'", filename, m[1], m[2])
+	}
+	return fmt.Errorf("%s:%s: %s", filename, m[1], m[3])
+}
+
+// Validate checks every rule and reports the first problem found
+func (c *Config) Validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("%s: interval must be positive", c.path)
+	}
+	if len(c.Rules) == 0 {
+		return fmt.Errorf("%s: no rules defined", c.path)
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if err := rule.validate(); err != nil {
+			return c.ruleError(i, err)
+		}
+		if names[rule.Name] {
+			return c.ruleError(i, fmt.Errorf("duplicate rule name"))
+		}
+		names[rule.Name] = true
+	}
+
+	return nil
+}
+
+// ruleError prefixes err with the location and name of rule i
+func (c *Config) ruleError(i int, err error) error {
+	location := c.path
+	if i < len(c.lines) {
+		location = fmt.Sprintf("%s:%d", c.path, c.lines[i])
+	}
+	return fmt.Errorf("%s: rule %d (%q): %w", location, i+1, c.Rules[i].Name, err)
+}
+
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	sel := r.Selector
+	if len(sel.PID) == 0 && sel.Name == "" && sel.Exe == "" && sel.Cgroup == "" && sel.IdleFor == 0 {
+		return fmt.Errorf("selector: at least one of pid, name, exe, cgroup or idle_for is required")
+	}
+	if sel.IdleFor < 0 {
+		return fmt.Errorf("selector: idle_for must be positive")
+	}
+	for _, pattern := range []string{sel.Name, sel.Exe} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("selector: invalid pattern '%s'", pattern)
+		}
+	}
+	for _, pid := range sel.PID {
+		if pid <= 0 {
+			return fmt.Errorf("selector: invalid PID %d", pid)
+		}
+	}
+
+	if r.When != "" {
+		if _, err := expr.Parse(r.When); err != nil {
+			return fmt.Errorf("when: %w", err)
+		}
+	}
+
+	if r.Mode != "" && r.Mode != "cold" && r.Mode != "pageout" {
+		return fmt.Errorf("mode: invalid mode '%s' (must be 'cold' or 'pageout')", r.Mode)
+	}
+
+	set := 0
+	if r.Budget.Percent != 0 {
+		set++
+		if r.Budget.Percent < 0 || r.Budget.Percent > 100 {
+			return fmt.Errorf("budget: percent must be between 1 and 100")
+		}
+	}
+	if r.Budget.Bytes != 0 {
+		set++
+	}
+	if r.Budget.TargetRSS != 0 {
+		set++
+	}
+	if set > 1 {
+		return fmt.Errorf("budget: only one of percent, bytes or target_rss may be set")
+	}
+	if r.Budget.Bytes < 0 || r.Budget.TargetRSS < 0 {
+		return fmt.Errorf("budget: sizes must be positive")
+	}
+
+	if r.Strategy != "" && !advisor.ValidStrategy(r.Strategy) {
+		return fmt.Errorf("strategy: invalid strategy '%s' (must be 'largest', 'smallest' or 'address')", r.Strategy)
+	}
+
+	if r.Regions.THP != "" && !advisor.ValidTHPPolicy(r.Regions.THP) {
+		return fmt.Errorf("regions: invalid thp policy '%s' (must be 'skip', 'full' or 'split')", r.Regions.THP)
+	}
+	if r.Regions.MaxSize > 0 && r.Regions.MaxSize < r.Regions.MinSize {
+		return fmt.Errorf("regions: max_size is smaller than min_size")
+	}
+
+	if r.Schedule.Every < 0 || r.Schedule.Cooldown < 0 {
+		return fmt.Errorf("schedule: durations must be positive")
+	}
+
+	if r.Trigger.PSI != "" {
+		if _, err := watch.ParseTrigger(r.Trigger.PSI); err != nil {
+			return fmt.Errorf("trigger: %w", err)
+		}
+	}
+	for _, kind := range r.Trigger.Events {
+		if !watch.ValidEvent(kind) {
+			return fmt.Errorf("trigger: invalid event '%s' (must be 'high' or 'max')", kind)
+		}
+	}
+	if len(r.Trigger.Events) > 0 && r.Trigger.Cgroup == "" {
+		return fmt.Errorf("trigger: events requires cgroup")
+	}
+	if r.Trigger.Cgroup != "" && r.Trigger.PSI == "" && len(r.Trigger.Events) == 0 {
+		return fmt.Errorf("trigger: cgroup requires psi or events")
+	}
+	if r.Trigger.Debounce < 0 {
+		return fmt.Errorf("trigger: debounce must be positive")
+	}
+
+	if r.Limits.RefaultRatio < 0 {
+		return fmt.Errorf("limits: refault_ratio must be positive")
+	}
+	if r.Rollback.FaultRate < 0 || r.Rollback.Hold < 0 {
+		return fmt.Errorf("rollback: fault_rate and hold must be positive")
+	}
+	if r.Limits.Rate != "" {
+		if rate, err := units.ParseRate(r.Limits.Rate); err != nil || rate <= 0 {
+			return fmt.Errorf("limits: invalid rate '%s'", r.Limits.Rate)
+		}
+	}
+
+	return nil
+}
+
+// ApplyEnv overrides single fields from environment variables of the form
+// MEMADVISE_<FIELD> for top-level fields and MEMADVISE_RULE_<NAME>_<FIELD>
+// for rule fields, where FIELD is the upper-cased YAML path joined by
+// underscores (e.g. MEMADVISE_RULE_SIDECARS_BUDGET_PERCENT=20). Variables
+// that match no field are added to Ignored; only invalid values are errors.
+func (c *Config) ApplyEnv(environ []string) error {
+	for _, entry := range environ {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(key, EnvPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(key, EnvPrefix)
+
+		if strings.HasPrefix(name, "RULE_") {
+			applied := false
+			for i := range c.Rules {
+				prefix := "RULE_" + envName(c.Rules[i].Name) + "_"
+				if !strings.HasPrefix(name, prefix) {
+					continue
+				}
+				found, err := setField(reflect.ValueOf(&c.Rules[i]).Elem(), strings.TrimPrefix(name, prefix), value)
+				if err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+				applied = applied || found
+			}
+			if !applied {
+				c.Ignored = append(c.Ignored, key)
+			}
+			continue
+		}
+
+		found, err := setField(reflect.ValueOf(c).Elem(), name, value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if !found {
+			c.Ignored = append(c.Ignored, key)
+		}
+	}
+
+	return nil
+}
+
+// setField finds the field whose upper-cased YAML path matches name and
+// decodes value into it as YAML
+func setField(v reflect.Value, name string, value string) (bool, error) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "rules" {
+			continue
+		}
+		field := envName(tag)
+
+		if name == field {
+			if err := yaml.Unmarshal([]byte(value), v.Field(i).Addr().Interface()); err != nil {
+				return true, err
+			}
+			return true, nil
+		}
+
+		if v.Field(i).Kind() == reflect.Struct && strings.HasPrefix(name, field+"_") {
+			return setField(v.Field(i), strings.TrimPrefix(name, field+"_"), value)
+		}
+	}
+	return false, nil
+}
+
+// envName turns a rule name or YAML key into its environment variable form
+func envName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// Matches reports whether the process identity matches the selector
+func (s Selector) Matches(id *inspector.Identity) bool {
+	if len(s.PID) > 0 {
+		found := false
+		for _, pid := range s.PID {
+			if pid == id.PID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if s.Name != "" {
+		if ok, _ := path.Match(s.Name, id.Comm); !ok {
+			return false
+		}
+	}
+
+	if s.Exe != "" {
+		if ok, _ := path.Match(s.Exe, id.Exe); !ok {
+			return false
+		}
+	}
+
+	if s.Cgroup != "" && !id.InCgroup(s.Cgroup) {
+		return false
+	}
+
+	return true
+}
+
+// Resolve returns the PIDs of all running processes matching the selector
+func (s Selector) Resolve() ([]int, error) {
+	candidates := s.PID
+	if len(candidates) == 0 {
+		var err error
+		candidates, err = inspector.ListPIDs()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	self := os.Getpid()
+	var pids []int
+	for _, pid := range candidates {
+		if pid == self {
+			continue
+		}
+		id, err := inspector.ReadIdentity(pid)
+		if err != nil {
+			continue // The process exited or isn't accessible
+		}
+		if len(s.PID) == 0 && len(id.Cmdline) == 0 {
+			continue // Kernel threads have no user memory to advise
+		}
+		if s.Matches(id) {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids, nil
+}
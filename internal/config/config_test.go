@@ -0,0 +1,215 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zouuup/memadvise/internal/inspector"
+)
+
+const testConfig = `interval: 30s
+rules:
+  - name: sidecars
+    selector:
+      name: envoy*
+      cgroup: /kubepods.slice
+    mode: pageout
+    budget:
+      bytes: 512M
+    strategy: largest
+    regions:
+      min_size: 64K
+      thp: skip
+    schedule:
+      cooldown: 15m
+    limits:
+      max_bytes: 1G
+      rate: 64M/s
+  - name: batch
+    selector:
+      pid: [1234, 5678]
+    budget:
+      percent: 20
+`
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(testConfig), "test.yaml")
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() unexpected error: %v", err)
+	}
+
+	if time.Duration(cfg.Interval) != 30*time.Second {
+		t.Errorf("Interval = %v, want 30s", time.Duration(cfg.Interval))
+	}
+	if len(cfg.Rules) != 2 {
+		t.Fatalf("got %d rules, want 2", len(cfg.Rules))
+	}
+
+	rule := cfg.Rules[0]
+	if rule.Budget.Bytes != 512*1024*1024 {
+		t.Errorf("Budget.Bytes = %d, want 512M", rule.Budget.Bytes)
+	}
+	if rule.Regions.MinSize != 64*1024 || rule.Regions.THP != "skip" {
+		t.Errorf("Regions = %+v", rule.Regions)
+	}
+	if time.Duration(rule.Schedule.Cooldown) != 15*time.Minute {
+		t.Errorf("Schedule.Cooldown = %v, want 15m", time.Duration(rule.Schedule.Cooldown))
+	}
+	if len(cfg.Rules[1].Selector.PID) != 2 {
+		t.Errorf("Selector.PID = %v, want two PIDs", cfg.Rules[1].Selector.PID)
+	}
+}
+
+func TestValidateErrors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:    "no rules",
+			config:  "interval: 30s\n",
+			wantErr: "no rules defined",
+		},
+		{
+			name:    "missing selector",
+			config:  "rules:\n  - name: a\n    mode: cold\n",
+			wantErr: `test.yaml:2: rule 1 ("a"): selector`,
+		},
+		{
+			name:    "invalid mode points at second rule",
+			config:  "rules:\n  - name: a\n    selector: {pid: [1]}\n  - name: b\n    selector: {pid: [2]}\n    mode: warm\n",
+			wantErr: `test.yaml:4: rule 2 ("b"): mode`,
+		},
+		{
+			name:    "two budgets",
+			config:  "rules:\n  - name: a\n    selector: {name: x}\n    budget: {percent: 10, bytes: 1G}\n",
+			wantErr: "only one of percent, bytes or target_rss",
+		},
+		{
+			name:    "invalid condition",
+			config:  "rules:\n  - name: a\n    selector: {name: x}\n    when: rss > 2G && idle > 1\n",
+			wantErr: `rule 1 ("a"): when: column 13: unknown variable "idle"`,
+		},
+		{
+			name:    "invalid trigger",
+			config:  "rules:\n  - name: a\n    selector: {name: x}\n    trigger: {psi: some 150000 60000000}\n",
+			wantErr: `rule 1 ("a"): trigger: invalid PSI trigger window`,
+		},
+		{
+			name:    "events without cgroup",
+			config:  "rules:\n  - name: a\n    selector: {name: x}\n    trigger: {events: [high]}\n",
+			wantErr: "trigger: events requires cgroup",
+		},
+		{
+			name:    "negative rollback rate",
+			config:  "rules:\n  - name: a\n    selector: {name: x}\n    rollback: {fault_rate: -5}\n",
+			wantErr: "rollback: fault_rate and hold must be positive",
+		},
+		{
+			name:    "duplicate names",
+			config:  "rules:\n  - name: a\n    selector: {name: x}\n  - name: a\n    selector: {name: y}\n",
+			wantErr: "duplicate rule name",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := Parse([]byte(tc.config), "test.yaml")
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	if _, err := Parse([]byte("rules:\n  - name: a\n    budget: {bytes: lots}\n"), "test.yaml"); err == nil {
+		t.Errorf("Parse() expected error for invalid size")
+	}
+
+	// A misspelled key is an error rather than a silent default
+	misspelled := "rules:\n  - name: web\n    selector: {name: nginx}\n    schedule:\n      cooldwon: 5m\n"
+	if _, err := Parse([]byte(misspelled), "test.yaml"); err == nil || err.Error() != "test.yaml:5: unknown key 'cooldwon'" {
+		t.Errorf("Parse() of a misspelled key = %v, want test.yaml:5: unknown key 'cooldwon'", err)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	cfg, err := Parse([]byte(testConfig), "test.yaml")
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+
+	err = cfg.ApplyEnv([]string{
+		"PATH=/usr/bin",
+		"MEMADVISE_INTERVAL=2m",
+		"MEMADVISE_RULE_SIDECARS_MODE=cold",
+		"MEMADVISE_RULE_BATCH_BUDGET_PERCENT=40",
+		"MEMADVISE_RULE_SIDECARS_LIMITS_MAX_BYTES=2G",
+	})
+	if err != nil {
+		t.Fatalf("ApplyEnv() unexpected error: %v", err)
+	}
+
+	if time.Duration(cfg.Interval) != 2*time.Minute {
+		t.Errorf("Interval = %v, want 2m", time.Duration(cfg.Interval))
+	}
+	if cfg.Rules[0].Mode != "cold" {
+		t.Errorf("Mode = %q, want cold", cfg.Rules[0].Mode)
+	}
+	if cfg.Rules[1].Budget.Percent != 40 {
+		t.Errorf("Budget.Percent = %d, want 40", cfg.Rules[1].Budget.Percent)
+	}
+	if cfg.Rules[0].Limits.MaxBytes != 2*1024*1024*1024 {
+		t.Errorf("Limits.MaxBytes = %d, want 2G", cfg.Rules[0].Limits.MaxBytes)
+	}
+
+	// Variables matching no field, e.g. of other tools, don't fail the run
+	err = cfg.ApplyEnv([]string{"MEMADVISE_RULE_MISSING_MODE=cold", "MEMADVISE_DEBUG=1"})
+	if err != nil {
+		t.Errorf("ApplyEnv() with unknown variables: %v", err)
+	}
+	if len(cfg.Ignored) != 2 || cfg.Ignored[0] != "MEMADVISE_RULE_MISSING_MODE" || cfg.Ignored[1] != "MEMADVISE_DEBUG" {
+		t.Errorf("Ignored = %v, want both unknown variables", cfg.Ignored)
+	}
+	if err := cfg.ApplyEnv([]string{"MEMADVISE_RULE_BATCH_BUDGET_PERCENT=lots"}); err == nil {
+		t.Errorf("ApplyEnv() expected error for an invalid value")
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	id := &inspector.Identity{
+		PID:    42,
+		Comm:   "envoy-proxy",
+		Exe:    "/usr/local/bin/envoy",
+		Cgroup: "/kubepods.slice/pod1234/envoy",
+	}
+
+	testCases := []struct {
+		name     string
+		selector Selector
+		want     bool
+	}{
+		{name: "pid", selector: Selector{PID: []int{1, 42}}, want: true},
+		{name: "other pid", selector: Selector{PID: []int{1}}, want: false},
+		{name: "name glob", selector: Selector{Name: "envoy*"}, want: true},
+		{name: "exe", selector: Selector{Exe: "/usr/local/bin/envoy"}, want: true},
+		{name: "cgroup subtree", selector: Selector{Cgroup: "/kubepods.slice/"}, want: true},
+		{name: "cgroup prefix is not a parent", selector: Selector{Cgroup: "/kubepods"}, want: false},
+		{name: "all fields must match", selector: Selector{Name: "envoy*", Exe: "/bin/other"}, want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.selector.Matches(id); got != tc.want {
+				t.Errorf("Matches() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
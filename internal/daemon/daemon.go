@@ -0,0 +1,792 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/zouuup/memadvise/internal/audit"
+	"github.com/zouuup/memadvise/internal/history"
+	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/metrics"
+	"github.com/zouuup/memadvise/internal/output"
+	"github.com/zouuup/memadvise/internal/syscall"
+	"github.com/zouuup/memadvise/internal/watch"
+)
+
+// refaultSmoothing is the weight given to the newest major fault rate sample
+const refaultSmoothing = 0.5
+
+// minBudgetScale is as far as repeated over-reclaim shrinks a target's budget
+const minBudgetScale = 0.125
+
+// pageSize converts major faults to bytes
+var pageSize = uint64(os.Getpagesize())
+
+// Outcome is the result of reclaiming from a single target
+type Outcome struct {
+	PID       int
+	Advised   int64
+	RSSBefore int64
+	RSSAfter  int64
+	PagedOut  []syscall.MemoryRegion // Ranges paged out; empty for other modes
+	Err       error
+}
+
+// Rule is one unit of policy: which processes to look at and how to reclaim
+// from them
+type Rule struct {
+	Name     string
+	Every    time.Duration // Minimum time between evaluations of the rule; 0 means every tick
+	Cooldown time.Duration // Minimum time between two reclaims of the same process
+
+	// Trigger, if set, also evaluates the rule as soon as the PSI trigger
+	// fires. Firings within Debounce of the last triggered run are dropped.
+	Trigger  *watch.Trigger
+	Debounce time.Duration
+
+	// EventsCgroup, if set, also evaluates the rule as soon as one of the
+	// Events counters in the cgroup's memory.events increases. Such runs
+	// only reclaim from the rule's targets inside that cgroup.
+	EventsCgroup string
+	Events       []string
+
+	// TriggeredOnly rules are only evaluated on trigger events, not on ticks
+	TriggeredOnly bool
+
+	// Targets resolves the PIDs the rule currently applies to
+	Targets func() ([]int, error)
+
+	// RefaultThreshold, if set, halves the next budget of a target once more
+	// than this share of the bytes last advised from it has been faulted
+	// back in, and restores it step by step while it stays below
+	RefaultThreshold float64
+
+	// RollbackRate, if set, reads the ranges of a target's last pageout back
+	// in with Warm once its major faults per second rise by more than this
+	// over their rate before the pageout. The target is then left alone for
+	// HotCooldown.
+	RollbackRate float64
+	HotCooldown  time.Duration
+
+	// Reclaim advises the given PIDs and reports the outcome for each. scales
+	// holds the budget factor of PIDs whose budget is reduced. It should stop
+	// as soon as it can once ctx is done.
+	Reclaim func(ctx context.Context, pids []int, scales map[int]float64) ([]Outcome, error)
+
+	// Warm advises ranges of pid with MADV_WILLNEED and returns the bytes advised
+	Warm func(pid int, ranges []syscall.MemoryRegion) (int64, error)
+}
+
+// Policy is the set of rules evaluated on every tick
+type Policy struct {
+	Interval time.Duration
+	Rules    []Rule
+
+	// History is the file the advice history is kept in; empty disables it.
+	// New targets pick up their last reclaim and rollback from it, so
+	// cooldowns survive restarts, and refaults and rollbacks are added to it.
+	History string
+
+	// Audit logs rollbacks; nil disables it. Reclaims are logged by Reclaim.
+	Audit *audit.Logger
+}
+
+// Loader builds the policy; it is called at startup and on SIGHUP
+type Loader func() (*Policy, error)
+
+// TargetState is what the daemon remembers about a process between ticks
+type TargetState struct {
+	PID          int
+	Comm         string
+	StartTime    uint64 // Distinguishes a reused PID from the original process
+	LastAdvised  time.Time
+	LastAdvisedB int64     // Bytes advised on the last reclaim
+	LastRSS      int64     // RSS measured after the last reclaim
+	RefaultRate  float64   // Smoothed major faults per second
+	RefaultTrend float64   // Change in RefaultRate over the last tick; positive is rising
+	RefaultRatio float64   // Bytes faulted in since the last reclaim, over the bytes advised
+	BudgetScale  float64   // Factor applied to the next budget; below 1 after over-reclaim
+	HotUntil     time.Time // Not advised again before this, after a rollback
+	Rollbacks    int
+
+	rule          string                 // Rule that last matched the process
+	pagedOut      []syscall.MemoryRegion // Ranges of the last pageout, until rolled back
+	pagedOutRate  float64                // RefaultRate just before the last pageout
+	lastMajFlt    uint64
+	lastSample    time.Time
+	advisedMajFlt uint64 // Major faults when the process was last advised
+	judged        bool   // Whether the last reclaim has been judged by RefaultThreshold
+}
+
+// stateKey identifies a process across ticks
+type stateKey struct {
+	pid       int
+	startTime uint64
+}
+
+// Daemon evaluates a policy periodically and keeps per-target state
+type Daemon struct {
+	load    Loader
+	output  *output.OutputManager
+	started time.Time
+
+	// mu serializes evaluations with requests from other goroutines, such
+	// as the control socket, and guards the fields below
+	mu      sync.Mutex
+	policy  *Policy
+	states  map[stateKey]*TargetState
+	ranAt   map[string]time.Time // Last evaluation of each rule, by name
+	firedAt map[string]time.Time // Last triggered evaluation of each rule, by name
+}
+
+// watcher is a source of trigger events
+type watcher interface {
+	Watch(ctx context.Context, fn func(watch.Event)) error
+	Close() error
+}
+
+// Summary describes the running daemon
+type Summary struct {
+	Started  time.Time
+	Interval time.Duration
+	Rules    []string
+	Targets  []TargetState
+}
+
+// firing is a trigger event for a rule
+type firing struct {
+	rule  string
+	event watch.Event
+}
+
+// New creates a new Daemon
+func New(load Loader, out *output.OutputManager) *Daemon {
+	return &Daemon{
+		load:    load,
+		output:  out,
+		states:  make(map[stateKey]*TargetState),
+		ranAt:   make(map[string]time.Time),
+		firedAt: make(map[string]time.Time),
+	}
+}
+
+// Run loads the policy and evaluates it every interval, and whenever a rule's
+// trigger fires, until ctx is done or SIGTERM/SIGINT is received. SIGHUP
+// reloads the policy; if the new policy fails to load, the previous one stays
+// in effect.
+func (d *Daemon) Run(ctx context.Context) error {
+	policy, err := d.load()
+	if err != nil {
+		return fmt.Errorf("failed to load policy: %w", err)
+	}
+	d.mu.Lock()
+	d.policy = policy
+	d.started = time.Now()
+	d.mu.Unlock()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGTERM, unix.SIGINT, unix.SIGHUP)
+	defer signal.Stop(sigs)
+
+	d.output.Info(fmt.Sprintf("daemon started: %d rules, evaluated every %s", len(policy.Rules), policy.Interval))
+
+	fired := make(chan firing)
+	stopWatchers := d.startWatchers(ctx, policy, fired)
+	defer func() { stopWatchers() }()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			d.output.Info("daemon stopping")
+			return nil
+
+		case sig := <-sigs:
+			if sig != unix.SIGHUP {
+				d.output.Info(fmt.Sprintf("received %s, daemon stopping", sig))
+				return nil
+			}
+
+			policy, err := d.load()
+			if err != nil {
+				d.output.Error(fmt.Sprintf("failed to reload policy, keeping the previous one: %v", err))
+				continue
+			}
+			stopWatchers()
+			d.mu.Lock()
+			d.policy = policy
+			d.mu.Unlock()
+			stopWatchers = d.startWatchers(ctx, policy, fired)
+			d.output.Info(fmt.Sprintf("policy reloaded: %d rules, evaluated every %s", len(policy.Rules), policy.Interval))
+
+			// A new interval applies from now, not once the old one has run out
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(policy.Interval)
+
+		case f := <-fired:
+			d.Fire(ctx, f.rule, f.event, time.Now())
+
+		case <-timer.C:
+			d.Tick(ctx, time.Now())
+			timer.Reset(d.interval())
+		}
+	}
+}
+
+// interval returns how often the current policy is evaluated
+func (d *Daemon) interval() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.policy.Interval
+}
+
+// startWatchers registers the triggers of policy and forwards their events
+// to fired. The returned function stops the watchers and waits for them to
+// exit.
+func (d *Daemon) startWatchers(ctx context.Context, policy *Policy, fired chan<- firing) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+
+	for _, rule := range policy.Rules {
+		for _, w := range d.openWatchers(rule) {
+			wg.Add(1)
+			go func(name string, w watcher) {
+				defer wg.Done()
+				defer w.Close()
+
+				err := w.Watch(ctx, func(event watch.Event) {
+					select {
+					case fired <- firing{rule: name, event: event}:
+					case <-ctx.Done():
+					}
+				})
+				if err != nil {
+					d.output.Error(fmt.Sprintf("rule %q: %v; relying on periodic evaluation", name, err))
+				}
+			}(rule.Name, w)
+		}
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// openWatchers registers the triggers of rule. Triggers that can't be
+// registered are reported and skipped.
+func (d *Daemon) openWatchers(rule Rule) []watcher {
+	var watchers []watcher
+
+	if rule.Trigger != nil {
+		w, err := watch.OpenPSI(*rule.Trigger)
+		if err != nil {
+			d.output.Error(fmt.Sprintf("rule %q: %v; relying on periodic evaluation", rule.Name, err))
+		} else {
+			watchers = append(watchers, w)
+			if d.output.IsVerbose() {
+				d.output.Info(fmt.Sprintf("rule %q: PSI trigger '%s' registered on %s", rule.Name, rule.Trigger, rule.Trigger.Path()))
+			}
+		}
+	}
+
+	if rule.EventsCgroup != "" {
+		w, err := watch.OpenEvents(rule.EventsCgroup, rule.Events)
+		if err != nil {
+			d.output.Error(fmt.Sprintf("rule %q: %v; relying on periodic evaluation", rule.Name, err))
+		} else {
+			watchers = append(watchers, w)
+			if d.output.IsVerbose() {
+				d.output.Info(fmt.Sprintf("rule %q: watching %s events of cgroup %s",
+					rule.Name, strings.Join(rule.Events, " and "), rule.EventsCgroup))
+			}
+		}
+	}
+
+	return watchers
+}
+
+// Fire evaluates the rule called name in response to a trigger event, unless
+// a previous event triggered it less than the rule's debounce period ago. It
+// reports whether the rule was evaluated.
+func (d *Daemon) Fire(ctx context.Context, name string, event watch.Event, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.output.Finish()
+
+	for _, rule := range d.policy.Rules {
+		if rule.Name != name {
+			continue
+		}
+
+		if last, ok := d.firedAt[name]; ok && now.Sub(last) < rule.Debounce {
+			if d.output.IsVerbose() {
+				d.output.Info(fmt.Sprintf("rule %q: %s event on %s debounced until %s",
+					name, event.Kind, event.Source, last.Add(rule.Debounce).Format(time.RFC3339)))
+			}
+			metrics.Triggers.Inc(name, event.Kind, "debounced")
+			return false
+		}
+		d.firedAt[name] = now
+		metrics.Triggers.Inc(name, event.Kind, "evaluated")
+
+		pids, err := rule.Targets()
+		if err != nil {
+			d.output.Error(fmt.Sprintf("rule %q: failed to resolve targets: %v", rule.Name, err))
+			return true
+		}
+		if event.Cgroup != "" {
+			pids = inCgroup(pids, event.Cgroup)
+		}
+
+		outcomes := d.evaluate(ctx, rule, pids, now, make(map[stateKey]bool))
+
+		var advised int64
+		failed := 0
+		for _, outcome := range outcomes {
+			advised += outcome.Advised
+			if outcome.Err != nil {
+				failed++
+			}
+		}
+		d.output.TriggerOutcome(name, event.Kind, event.Source, event.Count, len(pids), len(outcomes), advised, failed)
+		return true
+	}
+	return false // The rule was removed by a reload
+}
+
+// Tick evaluates every rule that is due. Reclaim stops early once ctx is
+// done.
+func (d *Daemon) Tick(ctx context.Context, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.output.Finish()
+
+	seen := make(map[stateKey]bool)
+
+	for _, rule := range d.policy.Rules {
+		last, ok := d.ranAt[rule.Name]
+		if rule.TriggeredOnly || (ok && now.Sub(last) < rule.Every) {
+			// Keep the state of processes this rule still owns, while they live
+			for key, state := range d.states {
+				if state.rule == rule.Name && alive(key) {
+					seen[key] = true
+				}
+			}
+			continue
+		}
+		d.ranAt[rule.Name] = now
+
+		pids, err := rule.Targets()
+		if err != nil {
+			d.output.Error(fmt.Sprintf("rule %q: failed to resolve targets: %v", rule.Name, err))
+			continue
+		}
+		d.evaluate(ctx, rule, pids, now, seen)
+	}
+
+	// Forget processes that no rule matched this tick, along with the metrics
+	// of every process the daemon no longer tracks, e.g. after advising it on
+	// request
+	for key := range d.states {
+		if !seen[key] {
+			delete(d.states, key)
+		}
+	}
+	metrics.KeepTargets(d.tracks)
+}
+
+// alive reports whether the process of key is still running, and not a
+// process that reused its PID
+func alive(key stateKey) bool {
+	stat, err := inspector.ReadProcStat(key.pid)
+	return err == nil && stat.StartTime == key.startTime
+}
+
+// tracks reports whether the daemon keeps state for a process with pid
+func (d *Daemon) tracks(pid int) bool {
+	for key := range d.states {
+		if key.pid == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate reclaims from the pids that are not in cooldown, marking every
+// live target in seen, and returns the outcomes
+func (d *Daemon) evaluate(ctx context.Context, rule Rule, pids []int, now time.Time, seen map[stateKey]bool) []Outcome {
+	keys := make(map[int]stateKey, len(pids))
+	scales := make(map[int]float64)
+	var due []int
+	for _, pid := range pids {
+		stat, err := inspector.ReadProcStat(pid)
+		if err != nil {
+			continue // The process exited since it was resolved
+		}
+
+		key := stateKey{pid: pid, startTime: stat.StartTime}
+		keys[pid] = key
+		seen[key] = true
+
+		state := d.observe(key, stat, now)
+		state.rule = rule.Name
+		if rule.RollbackRate > 0 && d.rollback(rule, state, now) {
+			continue
+		}
+		if now.Before(state.HotUntil) {
+			if d.output.IsVerbose() {
+				d.output.Info(fmt.Sprintf("rule %q: PID %d is hot until %s",
+					rule.Name, pid, state.HotUntil.Format(time.RFC3339)))
+			}
+			continue
+		}
+		if !state.LastAdvised.IsZero() && now.Sub(state.LastAdvised) < rule.Cooldown {
+			if d.output.IsVerbose() {
+				d.output.Info(fmt.Sprintf("rule %q: PID %d in cooldown until %s",
+					rule.Name, pid, state.LastAdvised.Add(rule.Cooldown).Format(time.RFC3339)))
+			}
+			continue
+		}
+		due = append(due, pid)
+		if rule.RefaultThreshold > 0 {
+			d.judge(rule, state)
+			if state.BudgetScale < 1 {
+				scales[pid] = state.BudgetScale
+			}
+		}
+	}
+
+	if len(due) == 0 {
+		return nil
+	}
+
+	outcomes, err := rule.Reclaim(ctx, due, scales)
+	if err != nil {
+		d.output.Error(fmt.Sprintf("rule %q: %v", rule.Name, err))
+		return nil
+	}
+
+	for _, outcome := range outcomes {
+		state, ok := d.states[keys[outcome.PID]]
+		if !ok || outcome.Err != nil {
+			continue
+		}
+		state.advised(outcome, now)
+	}
+
+	return outcomes
+}
+
+// judge adjusts the budget scale of a target that is due again, from how
+// much of its last reclaim was faulted back in. Each reclaim is judged once.
+func (d *Daemon) judge(rule Rule, state *TargetState) {
+	if state.LastAdvised.IsZero() || state.judged {
+		return
+	}
+	state.judged = true
+	d.recordRefaults(state)
+
+	if state.RefaultRatio <= rule.RefaultThreshold {
+		state.BudgetScale *= 2
+		if state.BudgetScale > 1 {
+			state.BudgetScale = 1
+		}
+		return
+	}
+
+	state.BudgetScale /= 2
+	if state.BudgetScale < minBudgetScale {
+		state.BudgetScale = minBudgetScale
+	}
+	d.output.Warning(fmt.Sprintf("rule %q: PID %d refaulted %.0f%% of its last reclaim, reducing its budget to %.0f%%",
+		rule.Name, state.PID, state.RefaultRatio*100, state.BudgetScale*100))
+}
+
+// rollback reads the last pageout of a target back in if its major fault
+// rate has risen by more than the rule's RollbackRate since, and marks it
+// hot. A process that was already faulting before the pageout is only
+// rolled back for the faults the pageout added. It reports whether the
+// target was rolled back.
+func (d *Daemon) rollback(rule Rule, state *TargetState, now time.Time) bool {
+	rise := state.RefaultRate - state.pagedOutRate
+	if len(state.pagedOut) == 0 || rise <= rule.RollbackRate || rule.Warm == nil {
+		return false
+	}
+
+	ranges := state.pagedOut
+	state.pagedOut = nil
+	state.HotUntil = now.Add(rule.HotCooldown)
+	state.Rollbacks++
+
+	restored, err := rule.Warm(state.PID, ranges)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.Rollbacks.Inc(rule.Name, result)
+	d.output.Rollback(rule.Name, state.PID, rise, len(ranges), restored, state.HotUntil, err)
+
+	hotUntil := state.HotUntil
+	record := history.Record{
+		Time:     now,
+		Source:   history.SourceRollback,
+		Mode:     "willneed",
+		Advised:  restored,
+		Ranges:   history.RangesOf(ranges),
+		HotUntil: &hotUntil,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	d.remember(state, func(store *history.Store, key history.Key) {
+		store.Add(key, state.PID, state.Comm, record)
+	})
+	d.audit(rule, state, record)
+	return true
+}
+
+// audit logs a rollback to the audit log
+func (d *Daemon) audit(rule Rule, state *TargetState, record history.Record) {
+	if d.policy == nil || d.policy.Audit == nil {
+		return
+	}
+
+	entry := audit.Entry{
+		Time:      record.Time,
+		Source:    fmt.Sprintf("%s (rule %s)", record.Source, rule.Name),
+		PID:       state.PID,
+		Comm:      state.Comm,
+		StartTime: state.StartTime,
+		Mode:      record.Mode,
+		Advised:   record.Advised,
+		Error:     record.Error,
+	}
+	for _, r := range record.Ranges {
+		entry.Requested += int64(r.End - r.Start)
+	}
+	if id, err := inspector.ReadIdentity(state.PID); err == nil && id.StartTime == state.StartTime {
+		entry.Exe, entry.Cgroup = id.Exe, id.Cgroup
+	}
+	if err := d.policy.Audit.Log(entry); err != nil {
+		d.output.Warning(err.Error())
+	}
+}
+
+// recall seeds a newly seen target with its last reclaim and rollback from
+// the history. The major faults at that reclaim are unknown, so it is not
+// judged.
+func (d *Daemon) recall(state *TargetState, stat *inspector.ProcStat) {
+	if d.policy == nil || d.policy.History == "" {
+		return
+	}
+	key, _, err := history.ReadKey(state.PID)
+	if err != nil || key.StartTime != state.StartTime {
+		return
+	}
+	store, err := history.Load(d.policy.History)
+	if err != nil {
+		return // Reported by the reclaims that write it
+	}
+	past := store.Lookup(key)
+	if past == nil {
+		return
+	}
+
+	if last := past.LastAdvised(); last != nil {
+		state.LastAdvised = last.Time
+		state.LastAdvisedB = last.Advised
+		state.LastRSS = last.RSSAfter
+		state.advisedMajFlt = stat.MajFlt
+		state.judged = true
+	}
+	state.HotUntil = past.HotUntil()
+}
+
+// recordRefaults adds the refaults since the last reclaim of a target to its
+// record in the history
+func (d *Daemon) recordRefaults(state *TargetState) {
+	if state.lastMajFlt < state.advisedMajFlt {
+		return
+	}
+	faults := int64(state.lastMajFlt - state.advisedMajFlt)
+	d.remember(state, func(store *history.Store, key history.Key) {
+		if past := store.Lookup(key); past != nil {
+			if last := past.LastAdvised(); last != nil {
+				last.MajorFaults, last.RefaultRatio = faults, state.RefaultRatio
+			}
+		}
+	})
+}
+
+// remember updates the history of a target with fn
+func (d *Daemon) remember(state *TargetState, fn func(store *history.Store, key history.Key)) {
+	if d.policy == nil || d.policy.History == "" {
+		return
+	}
+	key, _, err := history.ReadKey(state.PID)
+	if err != nil || key.StartTime != state.StartTime {
+		return // The process exited
+	}
+
+	err = history.Update(d.policy.History, func(store *history.Store) error {
+		fn(store, key)
+		return nil
+	})
+	if err != nil {
+		d.output.Warning(fmt.Sprintf("PID %d: history not updated: %v", state.PID, err))
+	}
+}
+
+// advised records a successful reclaim of the target
+func (state *TargetState) advised(outcome Outcome, now time.Time) {
+	state.LastAdvised = now
+	state.LastAdvisedB = outcome.Advised
+	state.LastRSS = outcome.RSSAfter
+	state.RefaultRatio = 0
+	state.pagedOut = outcome.PagedOut
+	state.pagedOutRate = state.RefaultRate
+	state.judged = false
+	if stat, err := inspector.ReadProcStat(state.PID); err == nil {
+		state.advisedMajFlt = stat.MajFlt
+	}
+}
+
+// Do calls fn between policy evaluations, so that fn never advises a process
+// at the same time as the daemon
+func (d *Daemon) Do(fn func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.output.Finish()
+
+	fn()
+}
+
+// Apply reclaims outside of the policy, e.g. on request over the control
+// socket, between policy evaluations. The outcomes are recorded in the
+// per-target state, so cooldowns account for them.
+func (d *Daemon) Apply(reclaim func() ([]Outcome, error), now time.Time) ([]Outcome, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.output.Finish()
+
+	outcomes, err := reclaim()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, outcome := range outcomes {
+		if outcome.Err != nil {
+			continue
+		}
+		stat, err := inspector.ReadProcStat(outcome.PID)
+		if err != nil {
+			continue
+		}
+		state := d.observe(stateKey{pid: outcome.PID, startTime: stat.StartTime}, stat, now)
+		state.advised(outcome, now)
+	}
+
+	return outcomes, nil
+}
+
+// inCgroup returns the pids that are in cgroup or one of its descendants
+func inCgroup(pids []int, cgroup string) []int {
+	var matched []int
+	for _, pid := range pids {
+		id, err := inspector.ReadIdentity(pid)
+		if err == nil && id.InCgroup(cgroup) {
+			matched = append(matched, pid)
+		}
+	}
+	return matched
+}
+
+// Summary returns the daemon's policy and a snapshot of the per-target state
+func (d *Daemon) Summary() Summary {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	summary := Summary{Started: d.started, Targets: d.snapshot()}
+	if d.policy != nil {
+		summary.Interval = d.policy.Interval
+		for _, rule := range d.policy.Rules {
+			summary.Rules = append(summary.Rules, rule.Name)
+		}
+	}
+	return summary
+}
+
+// States returns a snapshot of the per-target state, ordered by PID
+func (d *Daemon) States() []TargetState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.snapshot()
+}
+
+func (d *Daemon) snapshot() []TargetState {
+	states := make([]TargetState, 0, len(d.states))
+	for _, state := range d.states {
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].PID < states[j].PID
+	})
+	return states
+}
+
+// observe records a /proc/[pid]/stat sample for the target and returns its state
+func (d *Daemon) observe(key stateKey, stat *inspector.ProcStat, now time.Time) *TargetState {
+	state, ok := d.states[key]
+	if !ok {
+		// A process that reused the PID of one the daemon tracked starts afresh
+		for other := range d.states {
+			if other.pid == key.pid {
+				delete(d.states, other)
+				metrics.ForgetTarget(key.pid)
+			}
+		}
+
+		state = &TargetState{
+			PID:         key.pid,
+			Comm:        stat.Comm,
+			StartTime:   key.startTime,
+			BudgetScale: 1,
+		}
+		d.states[key] = state
+		d.recall(state, stat)
+	}
+
+	if !state.lastSample.IsZero() && now.After(state.lastSample) && stat.MajFlt >= state.lastMajFlt {
+		rate := float64(stat.MajFlt-state.lastMajFlt) / now.Sub(state.lastSample).Seconds()
+		smoothed := refaultSmoothing*rate + (1-refaultSmoothing)*state.RefaultRate
+		state.RefaultTrend = smoothed - state.RefaultRate
+		state.RefaultRate = smoothed
+	}
+	state.lastMajFlt = stat.MajFlt
+	state.lastSample = now
+
+	if state.LastAdvisedB > 0 && stat.MajFlt >= state.advisedMajFlt {
+		state.RefaultRatio = float64((stat.MajFlt-state.advisedMajFlt)*pageSize) / float64(state.LastAdvisedB)
+		metrics.RefaultRatio.Set(state.RefaultRatio, strconv.Itoa(state.PID), state.Comm)
+	}
+
+	return state
+}
@@ -0,0 +1,425 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/metrics"
+	"github.com/zouuup/memadvise/internal/output"
+	"github.com/zouuup/memadvise/internal/syscall"
+	"github.com/zouuup/memadvise/internal/watch"
+)
+
+func TestTickCooldown(t *testing.T) {
+	pid := os.Getpid()
+	var reclaimed [][]int
+
+	policy := &Policy{
+		Interval: time.Minute,
+		Rules: []Rule{
+			{
+				Name:     "self",
+				Cooldown: 10 * time.Minute,
+				Targets: func() ([]int, error) {
+					return []int{pid, 999999999}, nil
+				},
+				Reclaim: func(_ context.Context, pids []int, _ map[int]float64) ([]Outcome, error) {
+					reclaimed = append(reclaimed, pids)
+					return []Outcome{{PID: pid, Advised: 4096, RSSAfter: 1 << 20}}, nil
+				},
+			},
+		},
+	}
+
+	d := New(func() (*Policy, error) { return policy, nil }, output.New(false, false))
+	d.policy = policy
+
+	start := time.Now()
+	d.Tick(context.Background(), start)
+	d.Tick(context.Background(), start.Add(time.Minute))
+	d.Tick(context.Background(), start.Add(11*time.Minute))
+
+	if len(reclaimed) != 2 {
+		t.Fatalf("Reclaim called %d times, want 2 (second tick is in cooldown)", len(reclaimed))
+	}
+	if len(reclaimed[0]) != 1 || reclaimed[0][0] != pid {
+		t.Errorf("Reclaim got PIDs %v, want only the live PID %d", reclaimed[0], pid)
+	}
+
+	states := d.States()
+	if len(states) != 1 {
+		t.Fatalf("States() got %d entries, want 1", len(states))
+	}
+	if states[0].LastRSS != 1<<20 || states[0].LastAdvisedB != 4096 {
+		t.Errorf("States() = %+v, want last RSS and advised bytes recorded", states[0])
+	}
+	if !states[0].LastAdvised.Equal(start.Add(11 * time.Minute)) {
+		t.Errorf("States() last advised = %v, want %v", states[0].LastAdvised, start.Add(11*time.Minute))
+	}
+}
+
+func TestObserveRefaultTrend(t *testing.T) {
+	d := New(nil, output.New(false, false))
+	key := stateKey{pid: 1, startTime: 100}
+	start := time.Now()
+
+	d.observe(key, &inspector.ProcStat{MajFlt: 0}, start)
+	state := d.observe(key, &inspector.ProcStat{MajFlt: 100}, start.Add(10*time.Second))
+
+	if state.RefaultRate != 5 {
+		t.Errorf("RefaultRate = %v, want 5", state.RefaultRate)
+	}
+	if state.RefaultTrend != 5 {
+		t.Errorf("RefaultTrend = %v, want 5", state.RefaultTrend)
+	}
+
+	state = d.observe(key, &inspector.ProcStat{MajFlt: 100}, start.Add(20*time.Second))
+	if state.RefaultTrend >= 0 {
+		t.Errorf("RefaultTrend = %v, want negative once faults stop", state.RefaultTrend)
+	}
+}
+
+func TestRefaultThreshold(t *testing.T) {
+	d := New(nil, output.New(false, false))
+	rule := Rule{Name: "web", RefaultThreshold: 0.2}
+	key := stateKey{pid: 1, startTime: 100}
+	start := time.Now()
+
+	state := d.observe(key, &inspector.ProcStat{MajFlt: 10}, start)
+	state.LastAdvised = start
+	state.LastAdvisedB = int64(100 * pageSize)
+	state.advisedMajFlt = 10
+
+	// Half of the advised pages came back
+	d.observe(key, &inspector.ProcStat{MajFlt: 60}, start.Add(time.Minute))
+	if state.RefaultRatio != 0.5 {
+		t.Fatalf("RefaultRatio = %v, want 0.5", state.RefaultRatio)
+	}
+
+	d.judge(rule, state)
+	d.judge(rule, state)
+	if state.BudgetScale != 0.5 {
+		t.Errorf("BudgetScale = %v, want 0.5 after one over-reclaim judged once", state.BudgetScale)
+	}
+
+	// The next reclaim barely refaults, so the budget recovers
+	state.judged = false
+	state.advisedMajFlt = 60
+	d.observe(key, &inspector.ProcStat{MajFlt: 61}, start.Add(2*time.Minute))
+	d.judge(rule, state)
+	if state.BudgetScale != 1 {
+		t.Errorf("BudgetScale = %v, want 1 once refaults drop", state.BudgetScale)
+	}
+
+	for i := 0; i < 10; i++ {
+		state.judged = false
+		state.RefaultRatio = 1
+		d.judge(rule, state)
+	}
+	if state.BudgetScale != minBudgetScale {
+		t.Errorf("BudgetScale = %v, want the minimum %v", state.BudgetScale, minBudgetScale)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	var warmed []syscall.MemoryRegion
+	rule := Rule{
+		Name:         "web",
+		RollbackRate: 100,
+		HotCooldown:  time.Hour,
+		Warm: func(pid int, ranges []syscall.MemoryRegion) (int64, error) {
+			warmed = append(warmed, ranges...)
+			return int64(len(ranges)) << 20, nil
+		},
+	}
+	d := New(nil, output.New(false, false))
+	key := stateKey{pid: 1, startTime: 100}
+	start := time.Now()
+
+	state := d.observe(key, &inspector.ProcStat{MajFlt: 0}, start)
+	state.advised(Outcome{PID: 1, Advised: 2 << 20, PagedOut: []syscall.MemoryRegion{
+		{Start: 0x1000, End: 0x101000}, {Start: 0x200000, End: 0x300000},
+	}}, start)
+
+	// A quiet process keeps its pageout
+	d.observe(key, &inspector.ProcStat{MajFlt: 600}, start.Add(time.Minute))
+	if d.rollback(rule, state, start.Add(time.Minute)) {
+		t.Fatalf("rolled back at %.1f faults/s, below the %v threshold", state.RefaultRate, rule.RollbackRate)
+	}
+
+	now := start.Add(2 * time.Minute)
+	d.observe(key, &inspector.ProcStat{MajFlt: 600 + 60*1000}, now)
+	if !d.rollback(rule, state, now) {
+		t.Fatalf("not rolled back at %.1f faults/s", state.RefaultRate)
+	}
+	if len(warmed) != 2 {
+		t.Errorf("warmed %d ranges, want the 2 paged out", len(warmed))
+	}
+	if !state.HotUntil.Equal(now.Add(time.Hour)) || state.Rollbacks != 1 {
+		t.Errorf("HotUntil = %v, Rollbacks = %d; want %v, 1", state.HotUntil, state.Rollbacks, now.Add(time.Hour))
+	}
+
+	// The same pageout is only rolled back once
+	if d.rollback(rule, state, now.Add(time.Minute)) {
+		t.Error("rolled back the same pageout twice")
+	}
+}
+
+func TestRollbackBaseline(t *testing.T) {
+	rule := Rule{
+		Name:         "web",
+		RollbackRate: 100,
+		HotCooldown:  time.Hour,
+		Warm: func(pid int, ranges []syscall.MemoryRegion) (int64, error) {
+			return int64(len(ranges)) << 20, nil
+		},
+	}
+	d := New(nil, output.New(false, false))
+	key := stateKey{pid: 1, startTime: 100}
+	start := time.Now()
+
+	// The process already takes 300 major faults per second before its pageout
+	state := d.observe(key, &inspector.ProcStat{MajFlt: 0}, start)
+	d.observe(key, &inspector.ProcStat{MajFlt: 300 * 60}, start.Add(time.Minute))
+	d.observe(key, &inspector.ProcStat{MajFlt: 2 * 300 * 60}, start.Add(2*time.Minute))
+	if state.RefaultRate <= rule.RollbackRate {
+		t.Fatalf("RefaultRate = %.1f, want a baseline above %v", state.RefaultRate, rule.RollbackRate)
+	}
+	state.advised(Outcome{PID: 1, Advised: 1 << 20, PagedOut: []syscall.MemoryRegion{
+		{Start: 0x1000, End: 0x101000},
+	}}, start.Add(2*time.Minute))
+
+	// Faulting on as before is not the pageout's doing
+	now := start.Add(3 * time.Minute)
+	d.observe(key, &inspector.ProcStat{MajFlt: 3 * 300 * 60}, now)
+	if d.rollback(rule, state, now) {
+		t.Fatalf("rolled back at %.1f faults/s with a baseline of %.1f", state.RefaultRate, state.pagedOutRate)
+	}
+
+	now = start.Add(4 * time.Minute)
+	d.observe(key, &inspector.ProcStat{MajFlt: 3*300*60 + 1000*60}, now)
+	if !d.rollback(rule, state, now) {
+		t.Fatalf("not rolled back at %.1f faults/s with a baseline of %.1f", state.RefaultRate, state.pagedOutRate)
+	}
+}
+
+func TestFireDebounce(t *testing.T) {
+	pid := os.Getpid()
+	runs := 0
+
+	policy := &Policy{
+		Interval: time.Minute,
+		Rules: []Rule{
+			{
+				Name:     "pressure",
+				Debounce: 30 * time.Second,
+				Trigger:  &watch.Trigger{Kind: "some", Stall: 150 * time.Millisecond, Window: time.Second},
+				Targets: func() ([]int, error) {
+					return []int{pid}, nil
+				},
+				Reclaim: func(_ context.Context, pids []int, _ map[int]float64) ([]Outcome, error) {
+					runs++
+					return nil, nil
+				},
+			},
+		},
+	}
+
+	d := New(func() (*Policy, error) { return policy, nil }, output.New(false, false))
+	d.policy = policy
+
+	start := time.Now()
+	event := watch.Event{Source: "/proc/pressure/memory", Kind: "psi", Time: start}
+
+	if !d.Fire(context.Background(), "pressure", event, start) {
+		t.Errorf("Fire() = false, want the first event to evaluate the rule")
+	}
+	if d.Fire(context.Background(), "pressure", event, start.Add(10*time.Second)) {
+		t.Errorf("Fire() = true, want an event within the debounce period dropped")
+	}
+	if !d.Fire(context.Background(), "pressure", event, start.Add(31*time.Second)) {
+		t.Errorf("Fire() = false, want an event after the debounce period to evaluate the rule")
+	}
+	if d.Fire(context.Background(), "removed", event, start.Add(time.Hour)) {
+		t.Errorf("Fire() = true for a rule that is not in the policy")
+	}
+
+	if runs != 2 {
+		t.Errorf("Reclaim called %d times, want 2", runs)
+	}
+}
+
+func TestTriggeredOnly(t *testing.T) {
+	pid := os.Getpid()
+	var reclaimed [][]int
+
+	policy := &Policy{
+		Interval: time.Minute,
+		Rules: []Rule{
+			{
+				Name:          "events",
+				TriggeredOnly: true,
+				EventsCgroup:  "/",
+				Events:        []string{watch.EventHigh},
+				Targets: func() ([]int, error) {
+					return []int{pid}, nil
+				},
+				Reclaim: func(_ context.Context, pids []int, _ map[int]float64) ([]Outcome, error) {
+					reclaimed = append(reclaimed, pids)
+					return nil, nil
+				},
+			},
+		},
+	}
+
+	d := New(func() (*Policy, error) { return policy, nil }, output.New(false, false))
+	d.policy = policy
+
+	start := time.Now()
+	d.Tick(context.Background(), start)
+	if len(reclaimed) != 0 {
+		t.Fatalf("Tick() reclaimed %v, want triggered-only rules skipped", reclaimed)
+	}
+
+	// Events only reclaim from targets inside the cgroup that reported them
+	d.Fire(context.Background(), "events", watch.Event{Kind: watch.EventHigh, Cgroup: "/memadvise-test-none", Count: 1}, start)
+	d.Fire(context.Background(), "events", watch.Event{Kind: watch.EventHigh, Cgroup: "/", Count: 1}, start.Add(time.Minute))
+
+	if len(reclaimed) != 1 || len(reclaimed[0]) != 1 || reclaimed[0][0] != pid {
+		t.Errorf("Reclaim got %v, want a single call for PID %d", reclaimed, pid)
+	}
+}
+
+func TestTickForgetsExited(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run true: %v", err)
+	}
+	exited := cmd.Process.Pid
+
+	policy := &Policy{
+		Interval: time.Minute,
+		Rules: []Rule{
+			{
+				Name:          "events",
+				TriggeredOnly: true,
+				Targets: func() ([]int, error) {
+					return nil, nil
+				},
+			},
+		},
+	}
+
+	d := New(func() (*Policy, error) { return policy, nil }, output.New(false, false))
+	d.policy = policy
+	d.states[stateKey{pid: exited, startTime: 1}] = &TargetState{PID: exited, rule: "events"}
+	metrics.RSSBefore.Set(1<<20, strconv.Itoa(exited), "true")
+
+	d.Tick(context.Background(), time.Now())
+
+	if states := d.States(); len(states) != 0 {
+		t.Errorf("States() = %+v, want the exited process forgotten", states)
+	}
+	var b strings.Builder
+	metrics.Default.Write(&b)
+	if strings.Contains(b.String(), fmt.Sprintf("pid=%q", strconv.Itoa(exited))) {
+		t.Errorf("metrics still hold series of exited PID %d:\n%s", exited, b.String())
+	}
+}
+
+func TestApplyStartsCooldown(t *testing.T) {
+	pid := os.Getpid()
+	ticked := 0
+
+	policy := &Policy{
+		Interval: time.Minute,
+		Rules: []Rule{
+			{
+				Name:     "self",
+				Cooldown: 10 * time.Minute,
+				Targets: func() ([]int, error) {
+					return []int{pid}, nil
+				},
+				Reclaim: func(_ context.Context, pids []int, _ map[int]float64) ([]Outcome, error) {
+					ticked++
+					return nil, nil
+				},
+			},
+		},
+	}
+
+	d := New(func() (*Policy, error) { return policy, nil }, output.New(false, false))
+	d.policy = policy
+
+	start := time.Now()
+	outcomes, err := d.Apply(func() ([]Outcome, error) {
+		return []Outcome{{PID: pid, Advised: 8192}}, nil
+	}, start)
+	if err != nil || len(outcomes) != 1 {
+		t.Fatalf("Apply() = %v, %v", outcomes, err)
+	}
+
+	d.Tick(context.Background(), start.Add(time.Minute))
+	if ticked != 0 {
+		t.Errorf("Reclaim called %d times, want 0 (requested reclaim starts the cooldown)", ticked)
+	}
+
+	summary := d.Summary()
+	if len(summary.Rules) != 1 || len(summary.Targets) != 1 || summary.Targets[0].LastAdvisedB != 8192 {
+		t.Errorf("Summary() = %+v", summary)
+	}
+}
+
+func TestReloadResetsInterval(t *testing.T) {
+	ticks := make(chan struct{}, 16)
+	loads := 0
+	load := func() (*Policy, error) {
+		loads++
+		interval := time.Hour
+		if loads > 1 {
+			interval = 10 * time.Millisecond
+		}
+		return &Policy{
+			Interval: interval,
+			Rules: []Rule{{
+				Name: "count",
+				Targets: func() ([]int, error) {
+					select {
+					case ticks <- struct{}{}:
+					default:
+					}
+					return nil, nil
+				},
+			}},
+		}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- New(load, output.New(false, false)).Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The first tick is immediate; SIGHUP is handled by Run from then on
+	<-ticks
+	if err := unix.Kill(os.Getpid(), unix.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ticks:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reloaded 10ms interval didn't apply before the old hour ran out")
+	}
+}
@@ -0,0 +1,492 @@
+package expr
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zouuup/memadvise/internal/units"
+)
+
+// Env holds the values of the variables an expression refers to
+type Env map[string]float64
+
+// Expr is a parsed boolean expression such as
+//
+//	rss > 2G && age > 15m && psi.memory.some10 > 3
+//
+// Expressions are side-effect free: they can only compare and combine
+// numbers taken from literals and from the documented variable set.
+type Expr struct {
+	src  string
+	root node
+	vars []string
+}
+
+// Parse parses and type checks an expression. Every variable must be one of
+// Variables and the expression as a whole must be a condition.
+func Parse(src string) (*Expr, error) {
+	p := &parser{lexer: lexer{src: src}, vars: make(map[string]bool)}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	if !root.boolean() {
+		return nil, fmt.Errorf("expression is a number, not a condition")
+	}
+
+	vars := make([]string, 0, len(p.vars))
+	for name := range p.vars {
+		vars = append(vars, name)
+	}
+	sort.Strings(vars)
+
+	return &Expr{src: src, root: root, vars: vars}, nil
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Vars returns the sorted names of the variables the expression uses
+func (e *Expr) Vars() []string {
+	return e.vars
+}
+
+// Uses reports whether the expression refers to the variable called name
+func (e *Expr) Uses(name string) bool {
+	for _, v := range e.vars {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Eval evaluates the expression. It fails if a variable the evaluation needs
+// is missing from env.
+func (e *Expr) Eval(env Env) (bool, error) {
+	value, err := e.root.eval(env)
+	if err != nil {
+		return false, err
+	}
+	return value != 0, nil
+}
+
+// node is an expression tree node; conditions evaluate to 1 or 0
+type node interface {
+	eval(env Env) (float64, error)
+	boolean() bool
+}
+
+type numberNode float64
+
+func (n numberNode) eval(Env) (float64, error) { return float64(n), nil }
+func (n numberNode) boolean() bool             { return false }
+
+type boolNode bool
+
+func (n boolNode) eval(Env) (float64, error) { return truth(bool(n)), nil }
+func (n boolNode) boolean() bool             { return true }
+
+type varNode string
+
+func (n varNode) eval(env Env) (float64, error) {
+	value, ok := env[string(n)]
+	if !ok {
+		return 0, fmt.Errorf("%s is not available", string(n))
+	}
+	return value, nil
+}
+func (n varNode) boolean() bool { return false }
+
+type unaryNode struct {
+	op string
+	x  node
+}
+
+func (n *unaryNode) eval(env Env) (float64, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	if n.op == "!" {
+		return truth(x == 0), nil
+	}
+	return -x, nil
+}
+func (n *unaryNode) boolean() bool { return n.op == "!" }
+
+type binaryNode struct {
+	op   string
+	x, y node
+}
+
+func (n *binaryNode) eval(env Env) (float64, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return 0, err
+	}
+
+	// Short-circuit so that unavailable variables on the other side don't matter
+	switch {
+	case n.op == "&&" && x == 0:
+		return 0, nil
+	case n.op == "||" && x != 0:
+		return 1, nil
+	}
+
+	y, err := n.y.eval(env)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n.op {
+	case "&&", "||":
+		return truth(y != 0), nil
+	case "==":
+		return truth(x == y), nil
+	case "!=":
+		return truth(x != y), nil
+	case "<":
+		return truth(x < y), nil
+	case "<=":
+		return truth(x <= y), nil
+	case ">":
+		return truth(x > y), nil
+	case ">=":
+		return truth(x >= y), nil
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/":
+		if y == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return x / y, nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", n.op)
+}
+
+func (n *binaryNode) boolean() bool {
+	switch n.op {
+	case "+", "-", "*", "/":
+		return false
+	}
+	return true
+}
+
+func truth(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// parser is a recursive descent parser with one token of lookahead. From
+// lowest to highest precedence: ||, &&, !, comparisons, + -, * /, unary -.
+type parser struct {
+	lexer
+	tok  token
+	vars map[string]bool
+}
+
+func (p *parser) next() error {
+	tok, err := p.lex()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("column %d: %s", p.tok.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) parseOr() (node, error) {
+	return p.parseLogical("||", p.parseAnd)
+}
+
+func (p *parser) parseAnd() (node, error) {
+	return p.parseLogical("&&", p.parseNot)
+}
+
+func (p *parser) parseLogical(op string, operand func() (node, error)) (node, error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokOp && p.tok.text == op {
+		if !x.boolean() {
+			return nil, p.errorf("%s needs conditions on both sides", op)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if !y.boolean() {
+			return nil, p.errorf("%s needs conditions on both sides", op)
+		}
+		x = &binaryNode{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.tok.kind == tokOp && p.tok.text == "!" {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if !x.boolean() {
+			return nil, p.errorf("! needs a condition")
+		}
+		return &unaryNode{op: "!", x: x}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	x, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind != tokOp {
+		return x, nil
+	}
+	switch op := p.tok.text; op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		y, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		if x.boolean() || y.boolean() {
+			return nil, p.errorf("%s compares numbers, not conditions", op)
+		}
+		return &binaryNode{op: op, x: x, y: y}, nil
+	}
+	return x, nil
+}
+
+func (p *parser) parseAdditive() (node, error) {
+	return p.parseArithmetic("+-", p.parseMultiplicative)
+}
+
+func (p *parser) parseMultiplicative() (node, error) {
+	return p.parseArithmetic("*/", p.parseUnary)
+}
+
+func (p *parser) parseArithmetic(ops string, operand func() (node, error)) (node, error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokOp && len(p.tok.text) == 1 && strings.Contains(ops, p.tok.text) {
+		op := p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		if x.boolean() || y.boolean() {
+			return nil, p.errorf("%s needs numbers on both sides", op)
+		}
+		x = &binaryNode{op: op, x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.tok.kind == tokOp && p.tok.text == "-" {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if x.boolean() {
+			return nil, p.errorf("- needs a number")
+		}
+		return &unaryNode{op: "-", x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokNumber:
+		value, err := parseNumber(tok.text)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		return numberNode(value), p.next()
+
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return boolNode(true), p.next()
+		case "false":
+			return boolNode(false), p.next()
+		}
+		if _, ok := Lookup(tok.text); !ok {
+			return nil, p.errorf("unknown variable %q", tok.text)
+		}
+		p.vars[tok.text] = true
+		return varNode(tok.text), p.next()
+
+	case tokOp:
+		if tok.text == "(" {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if p.tok.kind != tokOp || p.tok.text != ")" {
+				return nil, p.errorf("expected ), found %s", p.tok)
+			}
+			return x, p.next()
+		}
+	}
+
+	return nil, p.errorf("unexpected %s", tok)
+}
+
+// parseNumber parses a literal with an optional unit. Sizes use upper-case
+// binary suffixes (4K, 512M, 2G, 1T, optionally followed by i and/or B) and
+// evaluate to bytes. Durations use lower-case suffixes (ms, s, m, h, d) and
+// evaluate to seconds. A % suffix is allowed and ignored.
+func parseNumber(text string) (float64, error) {
+	i := 0
+	for i < len(text) && (text[i] >= '0' && text[i] <= '9' || text[i] == '.') {
+		i++
+	}
+	num, unit := text[:i], text[i:]
+
+	value, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", text)
+	}
+
+	switch unit {
+	case "", "%":
+		return value, nil
+	case "ms":
+		return value / 1000, nil
+	case "s":
+		return value, nil
+	case "m":
+		return value * 60, nil
+	case "h":
+		return value * 3600, nil
+	case "d":
+		return value * 86400, nil
+	}
+
+	if unit[0] >= 'A' && unit[0] <= 'Z' {
+		bytes, err := units.ParseBytes("1" + unit)
+		if err == nil {
+			return value * float64(bytes), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid unit in %q", text)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+type lexer struct {
+	src string
+	pos int
+}
+
+// lex returns the next token
+func (l *lexer) lex() (token, error) {
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t' || l.src[l.pos] == '\n') {
+		l.pos++
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, pos: l.pos}, nil
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	switch {
+	case isDigit(c) || c == '.':
+		// A number followed directly by its unit, e.g. 2G or 15m
+		for l.pos < len(l.src) && (isDigit(l.src[l.pos]) || l.src[l.pos] == '.' || isLetter(l.src[l.pos]) || l.src[l.pos] == '%') {
+			l.pos++
+		}
+		return token{kind: tokNumber, text: l.src[start:l.pos], pos: start}, nil
+
+	case isLetter(c):
+		for l.pos < len(l.src) && (isLetter(l.src[l.pos]) || isDigit(l.src[l.pos]) || l.src[l.pos] == '.') {
+			l.pos++
+		}
+		return token{kind: tokIdent, text: l.src[start:l.pos], pos: start}, nil
+	}
+
+	for _, op := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "(", ")"} {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, text: op, pos: start}, nil
+		}
+	}
+
+	return token{}, fmt.Errorf("column %d: unexpected character %q", start+1, c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
@@ -0,0 +1,116 @@
+package expr
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	env := Env{
+		"rss":               3 << 30,
+		"age":               20 * 60,
+		"cpu_usage":         0.5,
+		"psi.memory.some10": 4.2,
+	}
+
+	tests := []struct {
+		name string
+		expr string
+		want bool
+	}{
+		{"size suffix", "rss > 2G", true},
+		{"size suffix with iB", "rss >= 3GiB", true},
+		{"duration suffix", "age > 15m", true},
+		{"hours", "age < 1h", true},
+		{"and", "rss > 2G && age > 15m && psi.memory.some10 > 3", true},
+		{"and false", "rss > 2G && age > 30m", false},
+		{"or", "rss > 4G || psi.memory.some10 > 4", true},
+		{"not", "!(cpu_usage > 1)", true},
+		{"arithmetic", "rss / 1G * 2 == 6", true},
+		{"precedence", "1 + 2 * 3 == 7", true},
+		{"unary minus", "-rss < 0", true},
+		{"percent suffix", "psi.memory.some10 > 4%", true},
+		{"literal", "true && !false", true},
+		{"short circuit skips missing variable", "rss < 1G && swap > 0", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := Parse(tc.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q) unexpected error: %v", tc.expr, err)
+			}
+			got, err := e.Eval(env)
+			if err != nil {
+				t.Fatalf("Eval() unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("Eval(%q) = %v, want %v", tc.expr, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		want string
+	}{
+		{"missing variable", "swap > 0", "swap is not available"},
+		{"division by zero", "rss / 0 > 1", "division by zero"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := Parse(tc.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q) unexpected error: %v", tc.expr, err)
+			}
+			_, err = e.Eval(Env{"rss": 1})
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Eval(%q) error = %v, want %q", tc.expr, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		want string
+	}{
+		{"unknown variable", "rsss > 1G", `column 1: unknown variable "rsss"`},
+		{"not a condition", "rss + 1", "not a condition"},
+		{"and on numbers", "rss && age > 1", "&& needs conditions"},
+		{"compare conditions", "(rss > 1) > 0", "compares numbers"},
+		{"bad unit", "rss > 2X", `invalid unit in "2X"`},
+		{"unclosed paren", "(rss > 1", "expected )"},
+		{"trailing token", "rss > 1 age", `unexpected "age"`},
+		{"bad character", "rss > 1 $", "unexpected character"},
+		{"empty", "", "unexpected end of expression"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(tc.expr)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Parse(%q) error = %v, want %q", tc.expr, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestVars(t *testing.T) {
+	e, err := Parse("rss > 1G && (age > 1h || rss > 2G) && psi.io.full60 < 5")
+	if err != nil {
+		t.Fatalf("Parse() unexpected error: %v", err)
+	}
+
+	want := []string{"age", "psi.io.full60", "rss"}
+	if !reflect.DeepEqual(e.Vars(), want) {
+		t.Errorf("Vars() = %v, want %v", e.Vars(), want)
+	}
+}
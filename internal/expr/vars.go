@@ -0,0 +1,183 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/sysinfo"
+)
+
+// Variable documents a variable that expressions may use
+type Variable struct {
+	Name string
+	Unit string // bytes, seconds, percent or count
+	Help string
+
+	source source
+}
+
+// source is where the value of a variable comes from
+type source int
+
+const (
+	sourceMemory   source = iota // /proc/[pid]/smaps_rollup
+	sourceStat                   // /proc/[pid]/stat
+	sourceCgroup                 // The process's cgroup v2 memory controller
+	sourceMeminfo                // /proc/meminfo
+	sourcePressure               // /proc/pressure
+	sourceIdle                   // An idle tracker
+)
+
+// Variables is the documented variable set, in display order
+var Variables = variables()
+
+func variables() []Variable {
+	vars := []Variable{
+		{Name: "rss", Unit: "bytes", Help: "Resident set size of the process", source: sourceMemory},
+		{Name: "anon", Unit: "bytes", Help: "Resident anonymous memory", source: sourceMemory},
+		{Name: "private", Unit: "bytes", Help: "Resident memory not shared with other processes", source: sourceMemory},
+		{Name: "shared", Unit: "bytes", Help: "Resident memory shared with other processes", source: sourceMemory},
+		{Name: "swap", Unit: "bytes", Help: "Memory of the process currently in swap", source: sourceMemory},
+		{Name: "majflt", Unit: "count", Help: "Major page faults since the process started", source: sourceStat},
+		{Name: "cpu_time", Unit: "seconds", Help: "User plus system CPU time used", source: sourceStat},
+		{Name: "age", Unit: "seconds", Help: "Time since the process started", source: sourceStat},
+		{Name: "cpu_usage", Unit: "percent", Help: "Average CPU usage over the process lifetime", source: sourceStat},
+		{Name: "idle_for", Unit: "seconds", Help: "Time since the process last used CPU or woke up voluntarily, across runs", source: sourceIdle},
+		{Name: "cgroup.memory.current", Unit: "bytes", Help: "Memory usage of the process's cgroup", source: sourceCgroup},
+		{Name: "cgroup.memory.high", Unit: "bytes", Help: "memory.high of the cgroup (very large if unset)", source: sourceCgroup},
+		{Name: "cgroup.memory.max", Unit: "bytes", Help: "memory.max of the cgroup (very large if unset)", source: sourceCgroup},
+		{Name: "cgroup.memory.swap", Unit: "bytes", Help: "Swap usage of the cgroup", source: sourceCgroup},
+		{Name: "cgroup.memory.anon", Unit: "bytes", Help: "Anonymous memory of the cgroup", source: sourceCgroup},
+		{Name: "cgroup.memory.file", Unit: "bytes", Help: "Page cache of the cgroup", source: sourceCgroup},
+		{Name: "mem.total", Unit: "bytes", Help: "MemTotal from /proc/meminfo", source: sourceMeminfo},
+		{Name: "mem.available", Unit: "bytes", Help: "MemAvailable from /proc/meminfo", source: sourceMeminfo},
+		{Name: "swap.total", Unit: "bytes", Help: "SwapTotal from /proc/meminfo", source: sourceMeminfo},
+		{Name: "swap.free", Unit: "bytes", Help: "SwapFree from /proc/meminfo", source: sourceMeminfo},
+	}
+
+	for _, resource := range []string{"memory", "io", "cpu"} {
+		for _, kind := range []string{"some", "full"} {
+			for _, window := range []string{"10", "60", "300"} {
+				vars = append(vars, Variable{
+					Name:   fmt.Sprintf("psi.%s.%s%s", resource, kind, window),
+					Unit:   "percent",
+					Help:   fmt.Sprintf("System-wide %s %s pressure, avg%s", resource, kind, window),
+					source: sourcePressure,
+				})
+			}
+		}
+	}
+
+	return vars
+}
+
+// Lookup returns the variable called name
+func Lookup(name string) (Variable, bool) {
+	for _, v := range Variables {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Variable{}, false
+}
+
+// Collect gathers the values of the named variables for pid. stats may be
+// passed in when the caller has already read them; idle_for is sampled from
+// idle. Variables whose source cannot be read (e.g. no cgroup v2 memory
+// controller) are left out of the environment, so expressions using them
+// fail to evaluate.
+func Collect(names []string, pid int, stats *inspector.MemoryStats, idle *inspector.IdleTracker) (Env, error) {
+	needed := make(map[source]bool)
+	for _, name := range names {
+		if v, ok := Lookup(name); ok {
+			needed[v.source] = true
+		}
+	}
+
+	env := make(Env)
+
+	if needed[sourceMemory] {
+		if stats == nil {
+			procInspector, err := inspector.NewProcessInspector(pid)
+			if err != nil {
+				return nil, err
+			}
+			if stats, err = procInspector.GetMemoryStats(); err != nil {
+				return nil, err
+			}
+		}
+		env["rss"] = float64(stats.TotalRSS)
+		env["anon"] = float64(stats.Anon)
+		env["private"] = float64(stats.Private)
+		env["shared"] = float64(stats.Shared)
+		env["swap"] = float64(stats.TotalSwap)
+	}
+
+	if needed[sourceStat] {
+		stat, err := inspector.ReadProcStat(pid)
+		if err != nil {
+			return nil, err
+		}
+		env["majflt"] = float64(stat.MajFlt)
+		env["cpu_time"] = stat.CPUTime().Seconds()
+
+		if uptime, err := sysinfo.ReadUptime(); err == nil {
+			age := (uptime - stat.Started()).Seconds()
+			env["age"] = age
+			if age > 0 {
+				env["cpu_usage"] = env["cpu_time"] / age * 100
+			}
+		}
+	}
+
+	if needed[sourceIdle] && idle != nil {
+		idleFor, err := idle.IdleFor(pid, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		env["idle_for"] = idleFor.Seconds()
+	}
+
+	if needed[sourceCgroup] {
+		if id, err := inspector.ReadIdentity(pid); err == nil && id.Cgroup != "" {
+			if mem, err := sysinfo.ReadCgroupMemory(id.Cgroup); err == nil {
+				env["cgroup.memory.current"] = float64(mem.Current)
+				env["cgroup.memory.high"] = float64(mem.High)
+				env["cgroup.memory.max"] = float64(mem.Max)
+				env["cgroup.memory.swap"] = float64(mem.SwapCurrent)
+				env["cgroup.memory.anon"] = float64(mem.Anon)
+				env["cgroup.memory.file"] = float64(mem.File)
+			}
+		}
+	}
+
+	if needed[sourceMeminfo] {
+		if info, err := sysinfo.ReadMeminfo(); err == nil {
+			env["mem.total"] = float64(info.MemTotal)
+			env["mem.available"] = float64(info.MemAvailable)
+			env["swap.total"] = float64(info.SwapTotal)
+			env["swap.free"] = float64(info.SwapFree)
+		}
+	}
+
+	if needed[sourcePressure] {
+		for _, name := range names {
+			if !strings.HasPrefix(name, "psi.") {
+				continue
+			}
+			parts := strings.Split(name, ".")
+			pressure, err := sysinfo.ReadPressure(parts[1])
+			if err != nil {
+				continue
+			}
+			kind := strings.TrimRight(parts[2], "0123456789")
+			if value, err := pressure.Window(kind, "avg"+strings.TrimPrefix(parts[2], kind)); err == nil {
+				env[name] = value
+			}
+		}
+	}
+
+	return env, nil
+}
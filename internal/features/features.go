@@ -0,0 +1,268 @@
+// Package features probes what the running kernel supports. The results are
+// cached for the rest of the boot, so that normal runs don't have to probe.
+package features
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/zouuup/memadvise/internal/syscall"
+	"github.com/zouuup/memadvise/internal/sysinfo"
+)
+
+// DefaultPath is where the probe results are cached between runs
+const DefaultPath = "/var/lib/memadvise/features.json"
+
+// Modes are the advice modes memadvise uses, in the order they are probed
+var Modes = []string{"cold", "pageout", "willneed"}
+
+// Mode probe results
+const (
+	Supported   = "supported"
+	Unsupported = "unsupported"
+	Unknown     = "unknown" // The probe failed, e.g. without CAP_SYS_NICE on older kernels
+)
+
+// ModeProbe is the result of probing an advice mode
+type ModeProbe struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Swap is the swap configuration
+type Swap struct {
+	Devices         int      `json:"devices"`
+	Total           int64    `json:"total"`
+	Zswap           bool     `json:"zswap"`
+	ZswapCompressor string   `json:"zswap_compressor,omitempty"`
+	ZramDevices     []string `json:"zram_devices"`
+}
+
+// Cgroup is the cgroup v2 hierarchy
+type Cgroup struct {
+	V2          bool     `json:"v2"`          // Whether cgroup v2 is mounted at sysinfo.CgroupRoot
+	Controllers []string `json:"controllers"` // Controllers available at the root
+}
+
+// Report is what the running kernel supports
+type Report struct {
+	Kernel string    `json:"kernel"` // Release, as in uname -r
+	BootID string    `json:"boot_id"`
+	Probed time.Time `json:"probed"`
+
+	Modes       map[string]ModeProbe `json:"modes"`
+	SmapsRollup bool                 `json:"smaps_rollup"`
+	PageIdle    bool                 `json:"page_idle"`
+	THP         string               `json:"thp"`        // always, madvise or never; empty without THP
+	THPDefrag   string               `json:"thp_defrag"` // Defrag setting of THP
+	Swap        Swap                 `json:"swap"`
+	MGLRU       string               `json:"mglru"` // Features enabled in lru_gen, e.g. 0x0007; empty without MGLRU
+	Cgroup      Cgroup               `json:"cgroup"`
+	PSI         []string             `json:"psi"`              // Resources with pressure stall information
+	Errors      []string             `json:"errors,omitempty"` // Probes that failed
+}
+
+// Probe finds out what the running kernel supports
+func Probe() *Report {
+	r := &Report{
+		BootID: readLine("/proc/sys/kernel/random/boot_id"),
+		Probed: time.Now(),
+		Modes:  make(map[string]ModeProbe, len(Modes)),
+	}
+
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err == nil {
+		r.Kernel = unix.ByteSliceToString(uts.Release[:])
+	}
+
+	for _, mode := range Modes {
+		r.Modes[mode] = probeMode(mode)
+	}
+
+	r.SmapsRollup = exists("/proc/self/smaps_rollup")
+	r.PageIdle = exists("/sys/kernel/mm/page_idle/bitmap")
+	r.THP = selected(readLine("/sys/kernel/mm/transparent_hugepage/enabled"))
+	r.THPDefrag = selected(readLine("/sys/kernel/mm/transparent_hugepage/defrag"))
+	r.MGLRU = readLine("/sys/kernel/mm/lru_gen/enabled")
+
+	if status, err := sysinfo.ReadSwapStatus(); err == nil {
+		r.Swap = Swap{
+			Devices:     len(status.Devices),
+			Total:       status.SwapTotal,
+			Zswap:       status.ZswapEnabled,
+			ZramDevices: status.ZramDevices,
+		}
+		if status.ZswapEnabled {
+			r.Swap.ZswapCompressor = readLine("/sys/module/zswap/parameters/compressor")
+		}
+	} else {
+		r.Errors = append(r.Errors, err.Error())
+	}
+	if r.Swap.ZramDevices == nil {
+		r.Swap.ZramDevices = []string{}
+	}
+
+	r.Cgroup.Controllers = []string{}
+	if controllers, err := os.ReadFile(filepath.Join(sysinfo.CgroupRoot, "cgroup.controllers")); err == nil {
+		r.Cgroup.V2 = true
+		r.Cgroup.Controllers = append(r.Cgroup.Controllers, strings.Fields(string(controllers))...)
+	}
+
+	r.PSI = []string{}
+	for _, resource := range []string{"cpu", "io", "memory"} {
+		// The files exist but can't be read when PSI is disabled at boot
+		if _, err := sysinfo.ReadPressure(resource); err == nil {
+			r.PSI = append(r.PSI, resource)
+		}
+	}
+
+	return r
+}
+
+// probeMode probes a single advice mode
+func probeMode(mode string) ModeProbe {
+	err := syscall.ProbeMode(mode)
+	switch {
+	case err == nil:
+		return ModeProbe{Status: Supported}
+	case errors.Is(err, syscall.ErrUnsupported):
+		return ModeProbe{Status: Unsupported, Error: err.Error()}
+	}
+	return ModeProbe{Status: Unknown, Error: err.Error()}
+}
+
+// CheckMode returns an error matching syscall.ErrUnsupported if the kernel
+// can't advise with mode. Modes that couldn't be probed are assumed to work.
+func (r *Report) CheckMode(mode string) error {
+	if probe, ok := r.Modes[mode]; ok && probe.Status == Unsupported {
+		return fmt.Errorf("process_madvise with %s: %w", mode, syscall.ErrUnsupported)
+	}
+	return nil
+}
+
+// KernelVersion returns the major and minor version of the kernel, from its
+// release. ok is false if the release can't be parsed.
+func (r *Report) KernelVersion() (major, minor int, ok bool) {
+	fields := strings.SplitN(r.Kernel, ".", 3)
+	if len(fields) < 2 {
+		return 0, 0, false
+	}
+	// The minor version may be followed by a suffix, as in 6.1-rc2
+	digits := strings.IndexFunc(fields[1], func(c rune) bool { return c < '0' || c > '9' })
+	if digits >= 0 {
+		fields[1] = fields[1][:digits]
+	}
+
+	major, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
+// Load reads the report cached at path. It returns nil if there is none, or
+// if it was probed in another boot or was incomplete.
+func Load(path string) (*Report, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read features: %w", err)
+	}
+
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid features in %s: %w", path, err)
+	}
+	if r.BootID == "" || r.BootID != readLine("/proc/sys/kernel/random/boot_id") {
+		return nil, nil
+	}
+	for _, mode := range Modes {
+		if probe, ok := r.Modes[mode]; !ok || probe.Status == Unknown {
+			return nil, nil
+		}
+	}
+	return &r, nil
+}
+
+// Save caches the report at path
+func (r *Report) Save(path string) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to save features: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save features: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save features: %w", err)
+	}
+	return nil
+}
+
+var (
+	currentOnce sync.Once
+	current     *Report
+)
+
+// Current returns what the running kernel supports, from the cache at
+// DefaultPath. The kernel is probed, and the cache written if possible, on
+// the first use after a boot.
+func Current() *Report {
+	currentOnce.Do(func() {
+		if r, err := Load(DefaultPath); err == nil && r != nil {
+			current = r
+			return
+		}
+		current = Probe()
+		current.Save(DefaultPath) // Probed again next time if memadvise may not write it
+	})
+	return current
+}
+
+// readLine returns the first line of a file, or "" if it can't be read
+func readLine(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	line, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimSpace(line)
+}
+
+// exists reports whether path exists
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// selected returns the bracketed choice of a sysfs setting such as
+// "always [madvise] never"
+func selected(setting string) string {
+	open := strings.IndexByte(setting, '[')
+	end := strings.IndexByte(setting, ']')
+	if open < 0 || end < open {
+		return setting
+	}
+	return setting[open+1 : end]
+}
@@ -0,0 +1,109 @@
+package features
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/zouuup/memadvise/internal/syscall"
+)
+
+func TestSelected(t *testing.T) {
+	testCases := []struct {
+		setting string
+		want    string
+	}{
+		{"always [madvise] never", "madvise"},
+		{"[always] defer defer+madvise madvise never", "always"},
+		{"", ""},
+		{"0x0007", "0x0007"},
+	}
+
+	for _, tc := range testCases {
+		if got := selected(tc.setting); got != tc.want {
+			t.Errorf("selected(%q) = %q, want %q", tc.setting, got, tc.want)
+		}
+	}
+}
+
+func TestCheckMode(t *testing.T) {
+	r := &Report{Modes: map[string]ModeProbe{
+		"cold":     {Status: Supported},
+		"pageout":  {Status: Unsupported, Error: "pageout: not supported by this kernel"},
+		"willneed": {Status: Unknown, Error: "operation not permitted"},
+	}}
+
+	if err := r.CheckMode("cold"); err != nil {
+		t.Errorf("CheckMode(cold) = %v", err)
+	}
+	if err := r.CheckMode("pageout"); !errors.Is(err, syscall.ErrUnsupported) {
+		t.Errorf("CheckMode(pageout) = %v, want ErrUnsupported", err)
+	}
+	if err := r.CheckMode("willneed"); err != nil {
+		t.Errorf("CheckMode(willneed) = %v, want nil for a mode that couldn't be probed", err)
+	}
+}
+
+func TestKernelVersion(t *testing.T) {
+	testCases := []struct {
+		release      string
+		major, minor int
+		ok           bool
+	}{
+		{"6.8.0-45-generic", 6, 8, true},
+		{"5.10.226", 5, 10, true},
+		{"6.13-rc4", 6, 13, true},
+		{"", 0, 0, false},
+		{"linux", 0, 0, false},
+	}
+
+	for _, tc := range testCases {
+		major, minor, ok := (&Report{Kernel: tc.release}).KernelVersion()
+		if major != tc.major || minor != tc.minor || ok != tc.ok {
+			t.Errorf("KernelVersion(%q) = %d, %d, %t; want %d, %d, %t", tc.release, major, minor, ok, tc.major, tc.minor, tc.ok)
+		}
+	}
+}
+
+func TestLoadSave(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "features.json")
+
+	if r, err := Load(path); r != nil || err != nil {
+		t.Fatalf("Load() of a missing cache = %v, %v", r, err)
+	}
+
+	probed := Probe()
+	if probed.Kernel == "" || len(probed.Modes) != len(Modes) {
+		t.Fatalf("Probe() = %+v", probed)
+	}
+
+	// Force a complete report, whatever the permissions of the test
+	for _, mode := range Modes {
+		probed.Modes[mode] = ModeProbe{Status: Supported}
+	}
+	if err := probed.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil || loaded == nil {
+		t.Fatalf("Load() = %v, %v", loaded, err)
+	}
+	if loaded.Kernel != probed.Kernel || loaded.Modes["cold"].Status != Supported {
+		t.Errorf("Load() = %+v, want %+v", loaded, probed)
+	}
+
+	// Another boot, or a probe without permission, is probed again
+	stale := *probed
+	stale.BootID = "another boot"
+	stale.Save(path)
+	if r, _ := Load(path); r != nil {
+		t.Error("Load() returned a report from another boot")
+	}
+	incomplete := *probed
+	incomplete.Modes = map[string]ModeProbe{"cold": {Status: Unknown}}
+	incomplete.Save(path)
+	if r, _ := Load(path); r != nil {
+		t.Error("Load() returned a report with unprobed modes")
+	}
+}
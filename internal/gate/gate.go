@@ -0,0 +1,169 @@
+package gate
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zouuup/memadvise/internal/sysinfo"
+	"github.com/zouuup/memadvise/internal/units"
+)
+
+// Condition is a system-wide precondition for reclaim
+type Condition interface {
+	Evaluate() (Result, error)
+}
+
+// Result is the outcome of evaluating a condition
+type Result struct {
+	Condition string  // The condition as given by the user
+	Met       bool    // Whether reclaim should proceed
+	Value     float64 // Observed value
+	Threshold float64 // Threshold the value was compared against
+	Excess    float64 // How far past the threshold, relative to the threshold
+	Bytes     bool    // Value and Threshold are byte counts rather than percentages
+}
+
+// PressureCondition is met when a PSI average exceeds a threshold,
+// e.g. "some-avg10>5"
+type PressureCondition struct {
+	spec      string
+	Resource  string
+	Kind      string
+	Window    string
+	Threshold float64
+}
+
+// ParsePressure parses a "<some|full>-<avg10|avg60|avg300>><threshold>" spec
+// for the memory PSI file
+func ParsePressure(spec string) (*PressureCondition, error) {
+	return parsePressure("memory", spec)
+}
+
+// ParseIOPressure parses the same format as ParsePressure for the io PSI file
+func ParseIOPressure(spec string) (*PressureCondition, error) {
+	return parsePressure("io", spec)
+}
+
+func parsePressure(resource string, spec string) (*PressureCondition, error) {
+	metric, threshold, ok := strings.Cut(strings.TrimSpace(spec), ">")
+	if !ok {
+		return nil, fmt.Errorf("invalid pressure condition '%s': expected <some|full>-<avg10|avg60|avg300>><threshold>", spec)
+	}
+
+	kind, window, ok := strings.Cut(metric, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid pressure metric '%s': expected <some|full>-<avg10|avg60|avg300>", metric)
+	}
+
+	// Validate kind and window up front
+	if _, err := (&sysinfo.Pressure{}).Window(kind, window); err != nil {
+		return nil, fmt.Errorf("invalid pressure condition '%s': %w", spec, err)
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSuffix(threshold, "%"), 64)
+	if err != nil || value <= 0 || value > 100 {
+		return nil, fmt.Errorf("invalid pressure threshold '%s': must be a percentage between 0 and 100", threshold)
+	}
+
+	return &PressureCondition{
+		spec:      spec,
+		Resource:  resource,
+		Kind:      kind,
+		Window:    window,
+		Threshold: value,
+	}, nil
+}
+
+// Evaluate reads the PSI file and compares it to the threshold
+func (c *PressureCondition) Evaluate() (Result, error) {
+	pressure, err := sysinfo.ReadPressure(c.Resource)
+	if err != nil {
+		return Result{}, err
+	}
+	return c.evaluate(pressure)
+}
+
+func (c *PressureCondition) evaluate(pressure *sysinfo.Pressure) (Result, error) {
+	value, err := pressure.Window(c.Kind, c.Window)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		Condition: c.spec,
+		Met:       value > c.Threshold,
+		Value:     value,
+		Threshold: c.Threshold,
+		Excess:    (value - c.Threshold) / c.Threshold,
+	}, nil
+}
+
+// AvailableCondition is met when MemAvailable drops below a threshold,
+// given either as a percentage of MemTotal ("10%") or a size ("2G")
+type AvailableCondition struct {
+	spec    string
+	Percent float64
+	Bytes   int64
+}
+
+// ParseAvailable parses a "<percent>%" or "<size>" spec
+func ParseAvailable(spec string) (*AvailableCondition, error) {
+	str := strings.TrimSpace(spec)
+
+	if strings.HasSuffix(str, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(str, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid available threshold '%s': percentage must be between 0 and 100", spec)
+		}
+		return &AvailableCondition{spec: spec, Percent: percent}, nil
+	}
+
+	bytes, err := units.ParseBytes(str)
+	if err != nil || bytes <= 0 {
+		return nil, fmt.Errorf("invalid available threshold '%s': must be a percentage or a size", spec)
+	}
+	return &AvailableCondition{spec: spec, Bytes: bytes}, nil
+}
+
+// Evaluate reads /proc/meminfo and compares MemAvailable to the threshold
+func (c *AvailableCondition) Evaluate() (Result, error) {
+	meminfo, err := sysinfo.ReadMeminfo()
+	if err != nil {
+		return Result{}, err
+	}
+	return c.evaluate(meminfo), nil
+}
+
+func (c *AvailableCondition) evaluate(meminfo *sysinfo.Meminfo) Result {
+	threshold := float64(c.Bytes)
+	if c.Percent > 0 {
+		threshold = float64(meminfo.MemTotal) * c.Percent / 100
+	}
+	value := float64(meminfo.MemAvailable)
+
+	return Result{
+		Condition: c.spec,
+		Met:       value < threshold,
+		Value:     value,
+		Threshold: threshold,
+		Excess:    (threshold - value) / threshold,
+		Bytes:     true,
+	}
+}
+
+// Scale returns the fraction of the budget to use given met results. The
+// full budget is used once every condition is at least double its threshold
+// (or, for available memory, once availability is exhausted).
+func Scale(results []Result) float64 {
+	scale := 1.0
+	for _, result := range results {
+		if !result.Met {
+			return 0
+		}
+		if result.Excess < scale {
+			scale = result.Excess
+		}
+	}
+	return scale
+}
@@ -0,0 +1,106 @@
+package gate
+
+import (
+	"testing"
+
+	"github.com/zouuup/memadvise/internal/sysinfo"
+)
+
+func TestParsePressure(t *testing.T) {
+	testCases := []struct {
+		spec    string
+		kind    string
+		window  string
+		value   float64
+		wantErr bool
+	}{
+		{spec: "some-avg10>5", kind: "some", window: "avg10", value: 5},
+		{spec: "full-avg60>2.5%", kind: "full", window: "avg60", value: 2.5},
+		{spec: "some-avg10", wantErr: true},
+		{spec: "most-avg10>5", wantErr: true},
+		{spec: "some-avg5>5", wantErr: true},
+		{spec: "some-avg10>abc", wantErr: true},
+		{spec: "some-avg10>150", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			cond, err := ParsePressure(tc.spec)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParsePressure(%q) error = %v, wantErr %v", tc.spec, err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if cond.Kind != tc.kind || cond.Window != tc.window || cond.Threshold != tc.value {
+				t.Errorf("ParsePressure(%q) = %+v", tc.spec, cond)
+			}
+		})
+	}
+}
+
+func TestPressureEvaluate(t *testing.T) {
+	cond, err := ParsePressure("some-avg10>5")
+	if err != nil {
+		t.Fatalf("ParsePressure() unexpected error: %v", err)
+	}
+
+	result, err := cond.evaluate(&sysinfo.Pressure{Some: sysinfo.PressureLine{Avg10: 7.5}})
+	if err != nil {
+		t.Fatalf("evaluate() unexpected error: %v", err)
+	}
+	if !result.Met || result.Excess != 0.5 {
+		t.Errorf("evaluate() = %+v, want met with excess 0.5", result)
+	}
+
+	result, _ = cond.evaluate(&sysinfo.Pressure{Some: sysinfo.PressureLine{Avg10: 1}})
+	if result.Met {
+		t.Errorf("evaluate() = %+v, want not met", result)
+	}
+}
+
+func TestAvailableEvaluate(t *testing.T) {
+	meminfo := &sysinfo.Meminfo{MemTotal: 1000, MemAvailable: 50}
+
+	percent, err := ParseAvailable("10%")
+	if err != nil {
+		t.Fatalf("ParseAvailable() unexpected error: %v", err)
+	}
+	result := percent.evaluate(meminfo)
+	if !result.Met || result.Threshold != 100 || result.Excess != 0.5 {
+		t.Errorf("evaluate() = %+v, want met with threshold 100 and excess 0.5", result)
+	}
+
+	bytes, err := ParseAvailable("40")
+	if err != nil {
+		t.Fatalf("ParseAvailable() unexpected error: %v", err)
+	}
+	if result := bytes.evaluate(meminfo); result.Met {
+		t.Errorf("evaluate() = %+v, want not met", result)
+	}
+
+	if _, err := ParseAvailable("150%"); err == nil {
+		t.Errorf("ParseAvailable(150%%) expected error")
+	}
+}
+
+func TestScale(t *testing.T) {
+	testCases := []struct {
+		name    string
+		results []Result
+		want    float64
+	}{
+		{name: "no conditions", results: nil, want: 1},
+		{name: "far over threshold", results: []Result{{Met: true, Excess: 3}}, want: 1},
+		{name: "smallest excess wins", results: []Result{{Met: true, Excess: 0.8}, {Met: true, Excess: 0.25}}, want: 0.25},
+		{name: "unmet condition", results: []Result{{Met: true, Excess: 1}, {Met: false}}, want: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Scale(tc.results); got != tc.want {
+				t.Errorf("Scale() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
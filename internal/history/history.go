@@ -0,0 +1,296 @@
+// Package history keeps a record of the advice given to each process, so
+// that later runs can take earlier ones into account
+package history
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/syscall"
+)
+
+// DefaultPath is where the history is kept between runs
+const DefaultPath = "/var/lib/memadvise/history.json"
+
+const (
+	// MaxRecords is how many records are kept per process; older ones are dropped
+	MaxRecords = 100
+	// Retention is how long the history of a process is kept after its last record
+	Retention = 30 * 24 * time.Hour
+	// HotRefaultRatio is the refault ratio above which the ranges of a reclaim
+	// count as hot
+	HotRefaultRatio = 0.5
+)
+
+// Sources of records besides daemon rules, which use "rule <name>"
+const (
+	SourceReclaim  = "reclaim"
+	SourceAPI      = "api"
+	SourceRollback = "rollback"
+)
+
+// Key identifies a process. The start time alone is only unique within a
+// boot, and the executable and command line guard against PID reuse across
+// boots.
+type Key struct {
+	Exe         string `json:"exe"`
+	CmdlineHash string `json:"cmdline_hash"`
+	StartTime   uint64 `json:"start_time"` // Clock ticks after boot
+	BootID      string `json:"boot_id"`
+}
+
+// String returns the form the key is stored under
+func (k Key) String() string {
+	return fmt.Sprintf("%s/%d/%s/%s", k.BootID, k.StartTime, k.CmdlineHash, k.Exe)
+}
+
+// Range is an address range, [Start, End)
+type Range struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// Record is one advice given to a process
+type Record struct {
+	Time      time.Time `json:"time"`
+	Source    string    `json:"source"` // reclaim, api, rollback or "rule <name>"
+	Mode      string    `json:"mode"`
+	Requested int64     `json:"requested"` // Budget in bytes
+	Advised   int64     `json:"advised"`
+	RSSBefore int64     `json:"rss_before"`
+	RSSAfter  int64     `json:"rss_after"`
+	Ranges    []Range   `json:"ranges,omitempty"`
+	Error     string    `json:"error,omitempty"`
+
+	// Refaults measured after the advice, updated as they are observed
+	MajorFaults  int64   `json:"major_faults"`
+	RefaultRatio float64 `json:"refault_ratio"`
+
+	// HotUntil is set on rollbacks; the process is left alone until then
+	HotUntil *time.Time `json:"hot_until,omitempty"`
+}
+
+// Target is the history of one process
+type Target struct {
+	Key     Key      `json:"key"`
+	PID     int      `json:"pid"`
+	Comm    string   `json:"comm"`
+	Records []Record `json:"records"`
+}
+
+// LastAdvised returns the most recent record that advised memory away, or nil
+func (t *Target) LastAdvised() *Record {
+	for i := len(t.Records) - 1; i >= 0; i-- {
+		record := &t.Records[i]
+		if record.Error == "" && record.Advised > 0 && record.Mode != "willneed" {
+			return record
+		}
+	}
+	return nil
+}
+
+// HotUntil returns when the last rollback of the process expires, or the
+// zero time
+func (t *Target) HotUntil() time.Time {
+	var until time.Time
+	for _, record := range t.Records {
+		if record.HotUntil != nil && record.HotUntil.After(until) {
+			until = *record.HotUntil
+		}
+	}
+	return until
+}
+
+// HotRanges returns the ranges that were rolled back, or faulted back in
+// past HotRefaultRatio, sorted by address
+func (t *Target) HotRanges() []syscall.MemoryRegion {
+	var hot []syscall.MemoryRegion
+	for _, record := range t.Records {
+		if record.Source != SourceRollback && record.RefaultRatio < HotRefaultRatio {
+			continue
+		}
+		for _, r := range record.Ranges {
+			hot = append(hot, syscall.MemoryRegion{Start: r.Start, End: r.End, Size: r.End - r.Start})
+		}
+	}
+	sort.Slice(hot, func(i, j int) bool { return hot[i].Start < hot[j].Start })
+	return hot
+}
+
+// Store is the history of every process memadvise has advised
+type Store struct {
+	Targets map[string]*Target `json:"targets"` // Keyed by Key.String()
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{Targets: make(map[string]*Target)}
+}
+
+// Load reads a store saved by Save. A missing file yields an empty store.
+func Load(path string) (*Store, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NewStore(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	store := NewStore()
+	if err := json.Unmarshal(data, store); err != nil {
+		return nil, fmt.Errorf("invalid history in %s: %w", path, err)
+	}
+	if store.Targets == nil {
+		store.Targets = make(map[string]*Target)
+	}
+	return store, nil
+}
+
+// Save writes the store to path, dropping processes without a record in
+// Retention
+func (s *Store) Save(path string) error {
+	s.prune(time.Now().Add(-Retention))
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to save history: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save history: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save history: %w", err)
+	}
+	return nil
+}
+
+// Update loads the store at path, applies fn and saves it, holding a lock so
+// that concurrent runs don't lose each other's records
+func Update(path string, fn func(*Store) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to save history: %w", err)
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to lock history: %w", err)
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock history: %w", err)
+	}
+
+	store, err := Load(path)
+	if err != nil {
+		return err
+	}
+	if err := fn(store); err != nil {
+		return err
+	}
+	return store.Save(path)
+}
+
+// Lookup returns the history of the process with key, or nil
+func (s *Store) Lookup(key Key) *Target {
+	return s.Targets[key.String()]
+}
+
+// Add appends a record to the history of the process with key
+func (s *Store) Add(key Key, pid int, comm string, record Record) {
+	t, ok := s.Targets[key.String()]
+	if !ok {
+		t = &Target{Key: key}
+		s.Targets[key.String()] = t
+	}
+	t.PID, t.Comm = pid, comm
+
+	t.Records = append(t.Records, record)
+	if len(t.Records) > MaxRecords {
+		t.Records = append([]Record(nil), t.Records[len(t.Records)-MaxRecords:]...)
+	}
+}
+
+// List returns the stored processes, most recently advised first
+func (s *Store) List() []*Target {
+	targets := make([]*Target, 0, len(s.Targets))
+	for _, t := range s.Targets {
+		if len(t.Records) > 0 {
+			targets = append(targets, t)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Records[len(targets[i].Records)-1].Time.After(targets[j].Records[len(targets[j].Records)-1].Time)
+	})
+	return targets
+}
+
+// prune drops processes whose last record is older than before
+func (s *Store) prune(before time.Time) {
+	for key, t := range s.Targets {
+		if len(t.Records) == 0 || t.Records[len(t.Records)-1].Time.Before(before) {
+			delete(s.Targets, key)
+		}
+	}
+}
+
+// KeyOf returns the key of a process identity
+func KeyOf(id *inspector.Identity) Key {
+	sum := sha256.Sum256([]byte(strings.Join(id.Cmdline, "\x00")))
+	return Key{
+		Exe:         id.Exe,
+		CmdlineHash: hex.EncodeToString(sum[:8]),
+		StartTime:   id.StartTime,
+		BootID:      bootID(),
+	}
+}
+
+// ReadKey reads the identity of pid and returns its key
+func ReadKey(pid int) (Key, *inspector.Identity, error) {
+	id, err := inspector.ReadIdentity(pid)
+	if err != nil {
+		return Key{}, nil, err
+	}
+	return KeyOf(id), id, nil
+}
+
+// RangesOf converts advised regions to ranges
+func RangesOf(regions []syscall.MemoryRegion) []Range {
+	ranges := make([]Range, 0, len(regions))
+	for _, region := range regions {
+		ranges = append(ranges, Range{Start: region.Start, End: region.End})
+	}
+	return ranges
+}
+
+var (
+	bootOnce sync.Once
+	boot     string
+)
+
+// bootID returns the kernel's random ID of the current boot
+func bootID() string {
+	bootOnce.Do(func() {
+		if data, err := os.ReadFile("/proc/sys/kernel/random/boot_id"); err == nil {
+			boot = strings.TrimSpace(string(data))
+		}
+	})
+	return boot
+}
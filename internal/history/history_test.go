@@ -0,0 +1,84 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zouuup/memadvise/internal/inspector"
+)
+
+func TestKeyOf(t *testing.T) {
+	id := &inspector.Identity{PID: 100, Exe: "/usr/bin/worker", Cmdline: []string{"worker", "--port", "80"}, StartTime: 4242}
+	key := KeyOf(id)
+
+	if key.Exe != id.Exe || key.StartTime != id.StartTime || len(key.CmdlineHash) != 16 {
+		t.Errorf("KeyOf() = %+v", key)
+	}
+
+	other := *id
+	other.Cmdline = []string{"worker", "--port 80"}
+	if KeyOf(&other) == key {
+		t.Error("command lines that only differ in argument boundaries have the same key")
+	}
+}
+
+func TestTarget(t *testing.T) {
+	now := time.Now()
+	hotUntil := now.Add(time.Hour)
+
+	target := &Target{Records: []Record{
+		{Time: now.Add(-3 * time.Hour), Mode: "cold", Advised: 1 << 20, Ranges: []Range{{Start: 0x3000, End: 0x4000}}},
+		{Time: now.Add(-2 * time.Hour), Mode: "pageout", Advised: 2 << 20, RefaultRatio: 0.9, Ranges: []Range{{Start: 0x2000, End: 0x3000}}},
+		{Time: now.Add(-time.Hour), Source: SourceRollback, Mode: "willneed", Advised: 2 << 20, HotUntil: &hotUntil, Ranges: []Range{{Start: 0x1000, End: 0x2000}}},
+		{Time: now, Mode: "pageout", Error: "process_madvise syscall failed: operation not permitted"},
+	}}
+
+	if last := target.LastAdvised(); last == nil || last.Advised != 2<<20 {
+		t.Errorf("LastAdvised() = %+v, want the pageout before the rollback", last)
+	}
+	if !target.HotUntil().Equal(hotUntil) {
+		t.Errorf("HotUntil() = %v, want %v", target.HotUntil(), hotUntil)
+	}
+
+	hot := target.HotRanges()
+	if len(hot) != 2 || hot[0].Start != 0x1000 || hot[1].Start != 0x2000 {
+		t.Errorf("HotRanges() = %+v, want the rolled back and refaulted ranges", hot)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	key := Key{Exe: "/usr/bin/worker", CmdlineHash: "abc", StartTime: 1, BootID: "b"}
+	stale := Key{Exe: "/usr/bin/old", CmdlineHash: "def", StartTime: 2, BootID: "b"}
+
+	err := Update(path, func(s *Store) error {
+		for i := 0; i < MaxRecords+5; i++ {
+			s.Add(key, 100, "worker", Record{Time: time.Now(), Advised: int64(i)})
+		}
+		s.Add(stale, 200, "old", Record{Time: time.Now().Add(-2 * Retention)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := store.Lookup(key)
+	if target == nil || len(target.Records) != MaxRecords || target.Records[0].Advised != 5 {
+		t.Fatalf("Lookup() = %+v, want the last %d records", target, MaxRecords)
+	}
+	if store.Lookup(stale) != nil {
+		t.Error("a process without records in the retention period was kept")
+	}
+	if len(store.List()) != 1 {
+		t.Errorf("List() returned %d processes, want 1", len(store.List()))
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("Load() of a missing file: %v", err)
+	}
+}
@@ -0,0 +1,306 @@
+package inspector
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/zouuup/memadvise/internal/features"
+	"github.com/zouuup/memadvise/internal/syscall"
+)
+
+// Access checks, as reported in AccessProblem.Check
+const (
+	CheckCapNice  = "cap_sys_nice" // process_madvise needs CAP_SYS_NICE
+	CheckPtrace   = "ptrace"       // Reading the memory maps needs ptrace read access
+	CheckDumpable = "dumpable"     // Non-dumpable processes need CAP_SYS_PTRACE
+	CheckUserNS   = "userns"       // Capabilities only count in their own user namespace
+	CheckDenied   = "denied"       // Denied for a reason memadvise can't see, e.g. an LSM
+)
+
+// Credentials are the IDs and capabilities of a process that decide what it
+// may access
+type Credentials struct {
+	PID        int
+	UID        [4]uint32 // Real, effective, saved and filesystem UIDs
+	GID        [4]uint32 // Real, effective, saved and filesystem GIDs
+	CapEff     uint64    // Effective capability set
+	InitUserNS bool      // Whether the process is in the initial user namespace
+}
+
+// HasCap reports whether cap is in the effective capability set
+func (c *Credentials) HasCap(cap int) bool {
+	return c.CapEff&(1<<uint(cap)) != 0
+}
+
+// ReadCredentials reads the credentials of pid from /proc
+func ReadCredentials(pid int) (*Credentials, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, &ProcError{PID: pid, File: "status", Err: err}
+	}
+	defer file.Close()
+
+	creds, err := parseCredentials(file)
+	if err != nil {
+		return nil, &ProcError{PID: pid, File: "status", Err: err}
+	}
+	creds.PID = pid
+
+	// The initial namespace maps every ID onto itself
+	if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/uid_map", pid)); err == nil {
+		creds.InitUserNS = strings.Join(strings.Fields(string(data)), " ") == "0 0 4294967295"
+	}
+	return creds, nil
+}
+
+// parseCredentials parses the Uid, Gid and CapEff lines of /proc/[pid]/status
+func parseCredentials(r io.Reader) (*Credentials, error) {
+	creds := &Credentials{}
+	found := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+
+		switch key {
+		case "Uid", "Gid":
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("invalid %s line: %s", key, value)
+			}
+			ids := &creds.UID
+			if key == "Gid" {
+				ids = &creds.GID
+			}
+			for i, field := range fields {
+				id, err := strconv.ParseUint(field, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s line: %s", key, value)
+				}
+				ids[i] = uint32(id)
+			}
+			found++
+		case "CapEff":
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("invalid CapEff line: %s", value)
+			}
+			caps, err := strconv.ParseUint(fields[0], 16, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CapEff line: %s", value)
+			}
+			creds.CapEff = caps
+			found++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if found != 3 {
+		return nil, fmt.Errorf("missing Uid, Gid or CapEff line")
+	}
+	return creds, nil
+}
+
+// AccessProblem is a reason memadvise can't advise a process
+type AccessProblem struct {
+	Check  string // One of the Check constants
+	Reason string
+	Fix    string
+}
+
+// Access is whether memadvise may advise a process
+type Access struct {
+	PID      int
+	Problems []AccessProblem // Empty when the process can be advised
+	Notes    []string        // Findings that don't stop advice
+}
+
+// Allowed reports whether the process can be advised
+func (a *Access) Allowed() bool {
+	return len(a.Problems) == 0
+}
+
+// Err returns an AccessError for the problems, or nil if there are none
+func (a *Access) Err() error {
+	if a.Allowed() {
+		return nil
+	}
+	return &AccessError{PID: a.PID, Problems: a.Problems}
+}
+
+// AccessError is returned for a process that can't be advised. It matches
+// syscall.ErrPermission.
+type AccessError struct {
+	PID      int
+	Problems []AccessProblem
+}
+
+func (e *AccessError) Error() string {
+	reasons := make([]string, 0, len(e.Problems))
+	for _, problem := range e.Problems {
+		reasons = append(reasons, problem.Reason)
+	}
+	return fmt.Sprintf("PID %d cannot be advised: %s", e.PID, strings.Join(reasons, "; "))
+}
+
+// Is reports whether target is syscall.ErrPermission
+func (e *AccessError) Is(target error) bool {
+	return target == syscall.ErrPermission
+}
+
+// accessFacts are what CheckAccess finds out about a target besides its
+// credentials
+type accessFacts struct {
+	self         bool // The target is memadvise itself
+	ptraceDenied bool // The kernel refused ptrace read access to the target
+	dumpable     bool
+	ptraceScope  int // Yama's ptrace_scope, or -1 without Yama
+
+	// What the kernel version tells about process_madvise; both are false
+	// when the version is unknown
+	ptraceAttach bool // 5.10 and 5.11 check ptrace attach access, which Yama restricts
+	selfExempt   bool // From 6.13, advising itself needs no CAP_SYS_NICE
+}
+
+// CheckAccess checks whether the process with credentials self may advise
+// pid, without touching the memory of pid.
+//
+// Whether ptrace read access is granted is asked of the kernel, by reading
+// the target's user namespace link, which needs the same access as its
+// memory maps; the credentials and dumpable flag only explain a refusal.
+// CAP_SYS_NICE, which process_madvise checks in the initial user namespace,
+// is judged from the credentials alone.
+func CheckAccess(self *Credentials, pid int) (*Access, error) {
+	target, err := ReadCredentials(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	facts := accessFacts{self: pid == self.PID, dumpable: true, ptraceScope: -1}
+
+	// The link is missing on kernels without user namespaces; access is then
+	// left to be found out by inspecting the target
+	if _, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/user", pid)); errors.Is(err, fs.ErrPermission) {
+		facts.ptraceDenied = true
+	}
+
+	// /proc/[pid] belongs to root while a process is not dumpable
+	var st unix.Stat_t
+	if err := unix.Stat(fmt.Sprintf("/proc/%d", pid), &st); err == nil {
+		facts.dumpable = st.Uid != 0 || target.UID[1] == 0
+	}
+
+	if data, err := os.ReadFile("/proc/sys/kernel/yama/ptrace_scope"); err == nil {
+		if scope, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			facts.ptraceScope = scope
+		}
+	}
+
+	if major, minor, ok := features.Current().KernelVersion(); ok {
+		facts.ptraceAttach = major < 5 || (major == 5 && minor < 12)
+		facts.selfExempt = major > 6 || (major == 6 && minor >= 13)
+	}
+
+	return evaluateAccess(self, target, facts), nil
+}
+
+// evaluateAccess works out the access of self to target from the facts
+func evaluateAccess(self *Credentials, target *Credentials, facts accessFacts) *Access {
+	access := &Access{PID: target.PID}
+
+	switch {
+	case facts.ptraceScope > 0 && facts.ptraceAttach:
+		access.Notes = append(access.Notes, fmt.Sprintf("Yama ptrace_scope is %d; before 5.12, process_madvise "+
+			"needs ptrace attach access, which Yama restricts, so the kernel may refuse advice to other processes", facts.ptraceScope))
+	case facts.ptraceScope > 0:
+		access.Notes = append(access.Notes, fmt.Sprintf("Yama ptrace_scope is %d; it only restricts attaching to "+
+			"processes, not the read access process_madvise needs from 5.12 on", facts.ptraceScope))
+	}
+
+	// A process always has ptrace access to itself
+	hasPtrace := self.HasCap(unix.CAP_SYS_PTRACE)
+	if facts.ptraceDenied && !facts.self {
+		switch {
+		case !hasPtrace && !sameIDs(self, target):
+			user := "root"
+			if target.UID[1] != 0 {
+				user = fmt.Sprintf("uid %d or as root", target.UID[1])
+			}
+			access.Problems = append(access.Problems, AccessProblem{
+				Check: CheckPtrace,
+				Reason: fmt.Sprintf("PID %d runs as uid %d gid %d and memadvise as uid %d gid %d, without CAP_SYS_PTRACE",
+					target.PID, target.UID[1], target.GID[1], self.UID[3], self.GID[3]),
+				Fix: fmt.Sprintf("run memadvise as %s, or grant it CAP_SYS_PTRACE "+
+					"(e.g. AmbientCapabilities=CAP_SYS_PTRACE CAP_SYS_NICE in its systemd unit)", user),
+			})
+		case !hasPtrace && !facts.dumpable:
+			access.Problems = append(access.Problems, AccessProblem{
+				Check: CheckDumpable,
+				Reason: fmt.Sprintf("PID %d is not dumpable, e.g. because it is a setuid program or called "+
+					"prctl(PR_SET_DUMPABLE, 0), and only CAP_SYS_PTRACE gives access to it", target.PID),
+				Fix: "run memadvise as root or grant it CAP_SYS_PTRACE, or have the process call prctl(PR_SET_DUMPABLE, 1)",
+			})
+		case hasPtrace && !self.InitUserNS:
+			access.Problems = append(access.Problems, AccessProblem{
+				Check: CheckUserNS,
+				Reason: fmt.Sprintf("memadvise only has CAP_SYS_PTRACE in its own user namespace, which "+
+					"doesn't contain PID %d", target.PID),
+				Fix: "run memadvise in the user namespace of the process or a parent of it, e.g. on the host",
+			})
+		default:
+			access.Problems = append(access.Problems, AccessProblem{
+				Check: CheckDenied,
+				Reason: fmt.Sprintf("the kernel refuses memadvise access to PID %d although its IDs, capabilities "+
+					"and the dumpable flag allow it; a security module such as SELinux or AppArmor is the likely cause", target.PID),
+				Fix: "look for ptrace denials of memadvise in the audit log (e.g. ausearch -m avc,apparmor) and allow read access",
+			})
+		}
+	}
+
+	// Until 6.13, CAP_SYS_NICE is checked even when memadvise advises itself
+	reason := "memadvise lacks CAP_SYS_NICE, which process_madvise needs to advise another process"
+	if facts.self {
+		reason = "memadvise lacks CAP_SYS_NICE, which process_madvise needs before 6.13 even to advise memadvise itself"
+	}
+	switch {
+	case facts.self && facts.selfExempt:
+	case !self.HasCap(unix.CAP_SYS_NICE):
+		access.Problems = append(access.Problems, AccessProblem{
+			Check:  CheckCapNice,
+			Reason: reason,
+			Fix: "run memadvise as root or grant it CAP_SYS_NICE " +
+				"(e.g. AmbientCapabilities=CAP_SYS_NICE in its systemd unit, or setcap cap_sys_nice+ep on the binary)",
+		})
+	case !self.InitUserNS:
+		access.Problems = append(access.Problems, AccessProblem{
+			Check: CheckUserNS,
+			Reason: "memadvise runs in a user namespace other than the initial one, e.g. in a rootless container, " +
+				"and process_madvise checks CAP_SYS_NICE in the initial one",
+			Fix: "run memadvise on the host, or in a container that shares the host's user namespace",
+		})
+	}
+
+	return access
+}
+
+// sameIDs reports whether the filesystem IDs of self match every ID of
+// target, which grants ptrace access without CAP_SYS_PTRACE
+func sameIDs(self *Credentials, target *Credentials) bool {
+	for i := 0; i < 3; i++ {
+		if target.UID[i] != self.UID[3] || target.GID[i] != self.GID[3] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,107 @@
+package inspector
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Identity describes who a process is, as opposed to what memory it uses
+type Identity struct {
+	PID       int
+	Comm      string   // Command name from /proc/[pid]/comm
+	Exe       string   // Resolved executable path; empty if unreadable
+	Cmdline   []string // Command line arguments
+	Cgroup    string   // cgroup v2 path, or the memory controller path on v1
+	StartTime uint64   // Start time in clock ticks after boot
+}
+
+// GetIdentity returns the identity of the process
+func (p *ProcessInspector) GetIdentity() (*Identity, error) {
+	return ReadIdentity(p.pid)
+}
+
+// ReadIdentity reads the identity of pid from /proc
+func ReadIdentity(pid int) (*Identity, error) {
+	stat, err := ReadProcStat(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &Identity{
+		PID:       pid,
+		Comm:      stat.Comm,
+		StartTime: stat.StartTime,
+	}
+
+	// The executable link is only readable with ptrace access; leave it empty otherwise
+	id.Exe, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err == nil {
+		id.Cmdline = strings.FieldsFunc(string(cmdline), func(r rune) bool { return r == 0 })
+	}
+
+	file, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err == nil {
+		id.Cgroup = parseCgroup(file)
+		file.Close()
+	}
+
+	return id, nil
+}
+
+// ListPIDs returns the PIDs of all processes visible in /proc
+func ListPIDs() ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes: %w", err)
+	}
+
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+
+	return pids, nil
+}
+
+// InCgroup reports whether the process is in cgroup or one of its descendants
+func (id *Identity) InCgroup(cgroup string) bool {
+	cgroup = strings.TrimSuffix(cgroup, "/")
+	return id.Cgroup == cgroup || strings.HasPrefix(id.Cgroup, cgroup+"/")
+}
+
+// parseCgroup parses /proc/[pid]/cgroup and returns the unified (v2) path,
+// falling back to the memory controller's path on cgroup v1
+func parseCgroup(r io.Reader) string {
+	var memoryPath string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Format is hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			return parts[2]
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			if controller == "memory" {
+				memoryPath = parts[2]
+			}
+		}
+	}
+
+	return memoryPath
+}
@@ -0,0 +1,141 @@
+package inspector
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IdleTracker estimates how long processes have been idle by comparing their
+// CPU time (utime+stime) and voluntary context switches between samples. A
+// process is idle since the last sample in which either counter changed, so
+// the estimate is only as precise as the sampling interval, and a process
+// seen for the first time counts as just active.
+type IdleTracker struct {
+	Samples map[string]*IdleSample `json:"samples"` // Keyed by PID and start time
+}
+
+// IdleSample is the last observation of a process
+type IdleSample struct {
+	PID               int       `json:"pid"`
+	StartTime         uint64    `json:"start_time"`
+	CPUTicks          uint64    `json:"cpu_ticks"`
+	VoluntarySwitches uint64    `json:"voluntary_switches"`
+	ActiveAt          time.Time `json:"active_at"` // When the counters last changed
+	SeenAt            time.Time `json:"seen_at"`
+}
+
+// NewIdleTracker creates an empty tracker
+func NewIdleTracker() *IdleTracker {
+	return &IdleTracker{Samples: make(map[string]*IdleSample)}
+}
+
+// LoadIdleTracker reads a tracker saved by Save. A missing file yields an
+// empty tracker.
+func LoadIdleTracker(path string) (*IdleTracker, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NewIdleTracker(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read idle state: %w", err)
+	}
+
+	tracker := NewIdleTracker()
+	if err := json.Unmarshal(data, tracker); err != nil {
+		return nil, fmt.Errorf("invalid idle state in %s: %w", path, err)
+	}
+	if tracker.Samples == nil {
+		tracker.Samples = make(map[string]*IdleSample)
+	}
+	return tracker, nil
+}
+
+// Save writes the tracker to path, dropping samples of processes that no
+// longer exist
+func (t *IdleTracker) Save(path string) error {
+	for key, sample := range t.Samples {
+		stat, err := ReadProcStat(sample.PID)
+		if err != nil || stat.StartTime != sample.StartTime {
+			delete(t.Samples, key)
+		}
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to save idle state: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save idle state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save idle state: %w", err)
+	}
+	return nil
+}
+
+// IdleFor samples pid and returns how long it has been idle
+func (t *IdleTracker) IdleFor(pid int, now time.Time) (time.Duration, error) {
+	stat, err := ReadProcStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	switches, err := readVoluntarySwitches(pid)
+	if err != nil {
+		return 0, err
+	}
+	return t.observe(pid, stat, switches, now), nil
+}
+
+// observe records a sample and returns the idle time it implies
+func (t *IdleTracker) observe(pid int, stat *ProcStat, switches uint64, now time.Time) time.Duration {
+	key := fmt.Sprintf("%d:%d", pid, stat.StartTime)
+	cpu := stat.UTime + stat.STime
+
+	sample, ok := t.Samples[key]
+	if !ok || sample.CPUTicks != cpu || sample.VoluntarySwitches != switches {
+		sample = &IdleSample{PID: pid, StartTime: stat.StartTime, ActiveAt: now}
+		t.Samples[key] = sample
+	}
+	sample.CPUTicks = cpu
+	sample.VoluntarySwitches = switches
+	sample.SeenAt = now
+
+	if now.Before(sample.ActiveAt) {
+		return 0 // The clock went backwards
+	}
+	return now.Sub(sample.ActiveAt)
+}
+
+// readVoluntarySwitches reads voluntary_ctxt_switches from /proc/[pid]/status
+func readVoluntarySwitches(pid int) (uint64, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open status file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if ok && key == "voluntary_ctxt_switches" {
+			return strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("error reading status file: %w", err)
+	}
+	return 0, nil // Not reported by this kernel
+}
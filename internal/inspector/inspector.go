@@ -2,11 +2,15 @@ package inspector
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"strconv"
 	"strings"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/zouuup/memadvise/internal/syscall"
 )
 
@@ -23,6 +27,41 @@ type MemoryStats struct {
 	HugetlbRSS int64 // Huge pages resident memory
 }
 
+// ProcError is a failure to read a file of a process under /proc. It matches
+// syscall.ErrNoProcess when the process has exited and syscall.ErrPermission
+// when the file is not readable by memadvise.
+type ProcError struct {
+	PID  int
+	File string // Name of the file under /proc/[pid], e.g. "smaps"
+	Err  error
+}
+
+func (e *ProcError) Error() string {
+	// The path is already in the message
+	err := e.Err
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return fmt.Sprintf("failed to read /proc/%d/%s: %v", e.PID, e.File, err)
+}
+
+// Unwrap returns the underlying error
+func (e *ProcError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error is of the kind target
+func (e *ProcError) Is(target error) bool {
+	switch target {
+	case syscall.ErrNoProcess:
+		return errors.Is(e.Err, fs.ErrNotExist) || errors.Is(e.Err, unix.ESRCH)
+	case syscall.ErrPermission:
+		return errors.Is(e.Err, fs.ErrPermission)
+	}
+	return false
+}
+
 // ProcessInspector provides methods to inspect a process's memory
 type ProcessInspector struct {
 	pid int
@@ -32,7 +71,7 @@ type ProcessInspector struct {
 func NewProcessInspector(pid int) (*ProcessInspector, error) {
 	// Verify PID exists
 	if !PidExists(pid) {
-		return nil, fmt.Errorf("process %d does not exist or is not accessible", pid)
+		return nil, fmt.Errorf("process %d: %w", pid, syscall.ErrNoProcess)
 	}
 
 	return &ProcessInspector{pid: pid}, nil
@@ -98,7 +137,7 @@ func (p *ProcessInspector) GetMemoryStats() (*MemoryStats, error) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading smaps_rollup: %w", err)
+		return nil, &ProcError{PID: p.pid, File: "smaps_rollup", Err: err}
 	}
 
 	return stats, nil
@@ -111,7 +150,7 @@ func (p *ProcessInspector) getMemoryStatsFromStatus() (*MemoryStats, error) {
 	statusPath := fmt.Sprintf("/proc/%d/status", p.pid)
 	file, err := os.Open(statusPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open status file: %w", err)
+		return nil, &ProcError{PID: p.pid, File: "status", Err: err}
 	}
 	defer file.Close()
 
@@ -151,7 +190,7 @@ func (p *ProcessInspector) getMemoryStatsFromStatus() (*MemoryStats, error) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading status file: %w", err)
+		return nil, &ProcError{PID: p.pid, File: "status", Err: err}
 	}
 
 	return stats, nil
@@ -159,13 +198,31 @@ func (p *ProcessInspector) getMemoryStatsFromStatus() (*MemoryStats, error) {
 
 // GetEligibleRegions returns memory regions eligible for memory advice
 func (p *ProcessInspector) GetEligibleRegions() ([]syscall.MemoryRegion, error) {
+	// Read /proc/[pid]/smaps for per-region RSS and THP usage
+	smapsPath := fmt.Sprintf("/proc/%d/smaps", p.pid)
+	file, err := os.Open(smapsPath)
+	if err != nil {
+		// Fallback to maps if smaps isn't available
+		return p.getEligibleRegionsFromMaps()
+	}
+	defer file.Close()
+
+	regions, err := parseSmaps(bufio.NewScanner(file))
+	if err != nil {
+		return nil, &ProcError{PID: p.pid, File: "smaps", Err: err}
+	}
+
+	return filterEligible(regions), nil
+}
+
+// getEligibleRegionsFromMaps is a fallback method to get regions from /proc/[pid]/maps
+func (p *ProcessInspector) getEligibleRegionsFromMaps() ([]syscall.MemoryRegion, error) {
 	var regions []syscall.MemoryRegion
 
-	// Read /proc/[pid]/maps
 	mapsPath := fmt.Sprintf("/proc/%d/maps", p.pid)
 	file, err := os.Open(mapsPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open maps file: %w", err)
+		return nil, &ProcError{PID: p.pid, File: "maps", Err: err}
 	}
 	defer file.Close()
 
@@ -176,24 +233,78 @@ func (p *ProcessInspector) GetEligibleRegions() ([]syscall.MemoryRegion, error)
 		if err != nil {
 			continue // Skip lines we can't parse
 		}
+		regions = append(regions, region)
+	}
 
-		// Filter for eligible regions: anonymous, private, writable
-		if region.Anonymous && region.Private && region.Writable {
-			// Exclude certain regions
-			if isExcludedRegion(region) {
+	if err := scanner.Err(); err != nil {
+		return nil, &ProcError{PID: p.pid, File: "maps", Err: err}
+	}
+
+	return filterEligible(regions), nil
+}
+
+// parseSmaps parses the contents of /proc/[pid]/smaps. Each mapping starts
+// with a maps-style header line followed by "Key: value kB" lines.
+func parseSmaps(scanner *bufio.Scanner) ([]syscall.MemoryRegion, error) {
+	var regions []syscall.MemoryRegion
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		parts := strings.Fields(line)
+		if len(parts) == 0 {
+			continue
+		}
+
+		// Attribute lines have a key ending in ':' as their first field
+		if strings.HasSuffix(parts[0], ":") {
+			if len(regions) == 0 || len(parts) < 2 {
 				continue
 			}
-			regions = append(regions, region)
+			value, err := strconv.ParseUint(parts[1], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			current := &regions[len(regions)-1]
+			switch parts[0] {
+			case "Rss:":
+				current.Rss = value * 1024
+			case "AnonHugePages:":
+				current.AnonHugePages = value * 1024
+			}
+			continue
 		}
+
+		region, err := parseMapLine(line)
+		if err != nil {
+			continue // Skip lines we can't parse
+		}
+		regions = append(regions, region)
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading maps file: %w", err)
+		return nil, err
 	}
 
 	return regions, nil
 }
 
+// filterEligible keeps regions that are anonymous, private and writable and
+// not otherwise excluded
+func filterEligible(regions []syscall.MemoryRegion) []syscall.MemoryRegion {
+	var eligible []syscall.MemoryRegion
+	for _, region := range regions {
+		if region.Anonymous && region.Private && region.Writable {
+			// Exclude certain regions
+			if isExcludedRegion(region) {
+				continue
+			}
+			eligible = append(eligible, region)
+		}
+	}
+	return eligible
+}
+
 // parseMapLine parses a line from /proc/[pid]/maps
 func parseMapLine(line string) (syscall.MemoryRegion, error) {
 	var region syscall.MemoryRegion
@@ -247,6 +358,9 @@ func parseMapLine(line string) (syscall.MemoryRegion, error) {
 	return region, nil
 }
 
+// pageSize is the base page size, which is not 4 KiB on every architecture
+var pageSize = uint64(os.Getpagesize())
+
 // isExcludedRegion checks if a memory region should be excluded from advising
 func isExcludedRegion(region syscall.MemoryRegion) bool {
 	// Exclude stack regions
@@ -264,8 +378,8 @@ func isExcludedRegion(region syscall.MemoryRegion) bool {
 		return true
 	}
 
-	// Exclude small regions (less than 4KB)
-	if region.Size < 4096 {
+	// Exclude regions smaller than a page
+	if region.Size < pageSize {
 		return true
 	}
 
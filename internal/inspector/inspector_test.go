@@ -1,7 +1,17 @@
 package inspector
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 
 	"github.com/zouuup/memadvise/internal/syscall"
 )
@@ -129,14 +139,14 @@ func TestIsExcludedRegion(t *testing.T) {
 		{
 			name:     "small region",
 			path:     "[anon]",
-			size:     2048, // less than 4KB
+			size:     pageSize / 2,
 			exec:     false,
 			excluded: true,
 		},
 		{
 			name:     "valid region",
 			path:     "[anon]",
-			size:     8192,
+			size:     2 * pageSize,
 			exec:     false,
 			excluded: false,
 		},
@@ -158,3 +168,242 @@ func TestIsExcludedRegion(t *testing.T) {
 		})
 	}
 }
+
+func TestParseSmaps(t *testing.T) {
+	input := `00400000-00600000 rw-p 00000000 00:00 0                      [heap]
+Size:               2048 kB
+Rss:                1024 kB
+AnonHugePages:      2048 kB
+VmFlags: rd wr mr mw me ac
+7f0000000000-7f0000001000 r-xp 00000000 08:01 123456                 /usr/lib/libc.so.6
+Size:                  4 kB
+Rss:                   4 kB
+AnonHugePages:         0 kB
+`
+
+	regions, err := parseSmaps(bufio.NewScanner(strings.NewReader(input)))
+	if err != nil {
+		t.Fatalf("parseSmaps() unexpected error: %v", err)
+	}
+
+	if len(regions) != 2 {
+		t.Fatalf("parseSmaps() got %d regions, want 2", len(regions))
+	}
+
+	if regions[0].Rss != 1024*1024 {
+		t.Errorf("parseSmaps() Rss = %d, want %d", regions[0].Rss, 1024*1024)
+	}
+
+	if regions[0].AnonHugePages != 2048*1024 {
+		t.Errorf("parseSmaps() AnonHugePages = %d, want %d", regions[0].AnonHugePages, 2048*1024)
+	}
+
+	if regions[1].AnonHugePages != 0 {
+		t.Errorf("parseSmaps() AnonHugePages = %d, want 0", regions[1].AnonHugePages)
+	}
+
+	eligible := filterEligible(regions)
+	if len(eligible) != 1 || eligible[0].Path != "[heap]" {
+		t.Errorf("filterEligible() got %v, want only the heap region", eligible)
+	}
+}
+
+func TestParseProcStat(t *testing.T) {
+	input := "1234 (my (weird) proc) S 1 1234 1234 0 -1 4194560 2500 0 42 0 150 30 0 0 20 0 4 0 987654 123456789 2048 18446744073709551615 0 0 0 0 0 0 0 0 0 0 0 0 17 3 0 0 0 0 0"
+
+	stat, err := parseProcStat(input)
+	if err != nil {
+		t.Fatalf("parseProcStat() unexpected error: %v", err)
+	}
+
+	if stat.Comm != "my (weird) proc" {
+		t.Errorf("parseProcStat() comm = %q", stat.Comm)
+	}
+	if stat.State != "S" {
+		t.Errorf("parseProcStat() state = %q, want S", stat.State)
+	}
+	if stat.MajFlt != 42 {
+		t.Errorf("parseProcStat() majflt = %d, want 42", stat.MajFlt)
+	}
+	if stat.UTime != 150 || stat.STime != 30 {
+		t.Errorf("parseProcStat() utime/stime = %d/%d, want 150/30", stat.UTime, stat.STime)
+	}
+	if stat.StartTime != 987654 {
+		t.Errorf("parseProcStat() starttime = %d, want 987654", stat.StartTime)
+	}
+
+	if _, err := parseProcStat("1234 no parens"); err == nil {
+		t.Errorf("parseProcStat() expected error for invalid input")
+	}
+}
+
+func TestProcError(t *testing.T) {
+	if _, err := NewProcessInspector(999999999); !errors.Is(err, syscall.ErrNoProcess) {
+		t.Errorf("NewProcessInspector() = %v, want ErrNoProcess", err)
+	}
+	if _, err := ReadProcStat(999999999); !errors.Is(err, syscall.ErrNoProcess) {
+		t.Errorf("ReadProcStat() = %v, want ErrNoProcess", err)
+	}
+
+	err := fmt.Errorf("wrapped: %w", &ProcError{PID: 1, File: "maps", Err: &fs.PathError{Op: "open", Path: "/proc/1/maps", Err: fs.ErrPermission}})
+	if !errors.Is(err, syscall.ErrPermission) || errors.Is(err, syscall.ErrNoProcess) {
+		t.Errorf("%v does not match only ErrPermission", err)
+	}
+}
+
+func TestParseCgroup(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "cgroup v2",
+			input: "0::/system.slice/nginx.service\n",
+			want:  "/system.slice/nginx.service",
+		},
+		{
+			name:  "cgroup v1",
+			input: "12:cpu,cpuacct:/user.slice\n7:memory:/user.slice/user-1000.slice\n1:name=systemd:/user.slice\n",
+			want:  "/user.slice/user-1000.slice",
+		},
+		{
+			name:  "empty",
+			input: "",
+			want:  "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := parseCgroup(strings.NewReader(tc.input)); got != tc.want {
+				t.Errorf("parseCgroup() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIdleTracker(t *testing.T) {
+	tracker := NewIdleTracker()
+	start := time.Now()
+	stat := &ProcStat{UTime: 100, STime: 20, StartTime: 5000}
+
+	if idle := tracker.observe(42, stat, 7, start); idle != 0 {
+		t.Errorf("first sample idle = %v, want 0", idle)
+	}
+	if idle := tracker.observe(42, stat, 7, start.Add(10*time.Minute)); idle != 10*time.Minute {
+		t.Errorf("unchanged counters idle = %v, want 10m", idle)
+	}
+	if idle := tracker.observe(42, stat, 8, start.Add(15*time.Minute)); idle != 0 {
+		t.Errorf("new voluntary switch idle = %v, want 0", idle)
+	}
+
+	busy := &ProcStat{UTime: 101, STime: 20, StartTime: 5000}
+	tracker.observe(42, busy, 8, start.Add(20*time.Minute))
+	if idle := tracker.observe(42, busy, 8, start.Add(25*time.Minute)); idle != 5*time.Minute {
+		t.Errorf("idle after CPU use = %v, want 5m", idle)
+	}
+
+	// A reused PID is a different process
+	reused := &ProcStat{UTime: 101, STime: 20, StartTime: 9000}
+	if idle := tracker.observe(42, reused, 8, start.Add(30*time.Minute)); idle != 0 {
+		t.Errorf("reused PID idle = %v, want 0", idle)
+	}
+}
+
+func TestIdleTrackerSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "idle.json")
+
+	tracker, err := LoadIdleTracker(path)
+	if err != nil {
+		t.Fatalf("LoadIdleTracker() on a missing file unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	if _, err := tracker.IdleFor(os.Getpid(), start); err != nil {
+		t.Fatalf("IdleFor() unexpected error: %v", err)
+	}
+	tracker.observe(999999999, &ProcStat{StartTime: 1}, 0, start) // Not a running process
+	if err := tracker.Save(path); err != nil {
+		t.Fatalf("Save() unexpected error: %v", err)
+	}
+
+	loaded, err := LoadIdleTracker(path)
+	if err != nil {
+		t.Fatalf("LoadIdleTracker() unexpected error: %v", err)
+	}
+	if len(loaded.Samples) != 1 {
+		t.Errorf("loaded %d samples, want only the live process", len(loaded.Samples))
+	}
+}
+
+func TestParseCredentials(t *testing.T) {
+	status := "Name:\tworker\nUid:\t1000\t1000\t1000\t1000\nGid:\t100\t100\t100\t100\n" +
+		"CapInh:\t0000000000000000\nCapEff:\t0000000000800000\n"
+	creds, err := parseCredentials(strings.NewReader(status))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.UID != [4]uint32{1000, 1000, 1000, 1000} || creds.GID[3] != 100 {
+		t.Errorf("parseCredentials() = %+v", creds)
+	}
+	if !creds.HasCap(unix.CAP_SYS_NICE) || creds.HasCap(unix.CAP_SYS_PTRACE) {
+		t.Errorf("CapEff %x parsed wrong", creds.CapEff)
+	}
+
+	if _, err := parseCredentials(strings.NewReader("Uid:\t1000\n")); err == nil {
+		t.Error("parseCredentials() accepted a status without Gid and CapEff")
+	}
+}
+
+func TestEvaluateAccess(t *testing.T) {
+	const nice, ptrace = 1 << unix.CAP_SYS_NICE, 1 << unix.CAP_SYS_PTRACE
+	user := func(uid uint32, caps uint64, init bool) *Credentials {
+		return &Credentials{PID: 10, UID: [4]uint32{uid, uid, uid, uid}, GID: [4]uint32{uid, uid, uid, uid}, CapEff: caps, InitUserNS: init}
+	}
+	target := &Credentials{PID: 20, UID: [4]uint32{1000, 1000, 1000, 1000}, GID: [4]uint32{1000, 1000, 1000, 1000}}
+
+	testCases := []struct {
+		name  string
+		self  *Credentials
+		facts accessFacts
+		want  []string
+	}{
+		{"Root", user(0, nice|ptrace, true), accessFacts{dumpable: true}, nil},
+		{"Same user with CAP_SYS_NICE", user(1000, nice, true), accessFacts{dumpable: true}, nil},
+		{"Same user", user(1000, 0, true), accessFacts{dumpable: true}, []string{CheckCapNice}},
+		{"Other user", user(1001, nice, true), accessFacts{ptraceDenied: true, dumpable: true}, []string{CheckPtrace}},
+		{"Not dumpable", user(1000, nice, true), accessFacts{ptraceDenied: true}, []string{CheckDumpable}},
+		{"Container", user(0, nice|ptrace, false), accessFacts{ptraceDenied: true, dumpable: true}, []string{CheckUserNS, CheckUserNS}},
+		{"Security module", user(0, nice|ptrace, true), accessFacts{ptraceDenied: true, dumpable: true}, []string{CheckDenied}},
+		{"Itself", user(1000, 0, false), accessFacts{self: true, selfExempt: true}, nil},
+		{"Itself without CAP_SYS_NICE", user(1000, 0, true), accessFacts{self: true, ptraceDenied: true}, []string{CheckCapNice}},
+		{"Itself in a container", user(0, nice|ptrace, false), accessFacts{self: true}, []string{CheckUserNS}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			access := evaluateAccess(tc.self, target, tc.facts)
+			var got []string
+			for _, problem := range access.Problems {
+				if problem.Reason == "" || problem.Fix == "" {
+					t.Errorf("problem without a reason or fix: %+v", problem)
+				}
+				got = append(got, problem.Check)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("problems = %v, want %v", got, tc.want)
+			}
+			if err := access.Err(); access.Allowed() != (err == nil) || (err != nil && !errors.Is(err, syscall.ErrPermission)) {
+				t.Errorf("Err() = %v", err)
+			}
+		})
+	}
+
+	for _, attach := range []bool{false, true} {
+		notes := evaluateAccess(user(0, nice|ptrace, true), target, accessFacts{dumpable: true, ptraceScope: 2, ptraceAttach: attach}).Notes
+		if len(notes) != 1 || strings.Contains(notes[0], "may refuse") != attach {
+			t.Errorf("Notes with ptraceAttach %t = %v, want the Yama scope", attach, notes)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package inspector
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClockTicks is the kernel's USER_HZ, the unit of the time fields in
+// /proc/[pid]/stat. It is 100 on every architecture Linux supports.
+const ClockTicks = 100
+
+// ProcStat contains the fields of /proc/[pid]/stat used by memadvise
+type ProcStat struct {
+	Comm      string
+	State     string
+	MajFlt    uint64 // Major faults, i.e. faults that required I/O
+	UTime     uint64 // User CPU time in clock ticks
+	STime     uint64 // System CPU time in clock ticks
+	StartTime uint64 // Start time in clock ticks after boot
+}
+
+// CPUTime returns the user plus system CPU time used by the process
+func (s *ProcStat) CPUTime() time.Duration {
+	return ticksToDuration(s.UTime + s.STime)
+}
+
+// Started returns when the process started, as time since boot
+func (s *ProcStat) Started() time.Duration {
+	return ticksToDuration(s.StartTime)
+}
+
+func ticksToDuration(ticks uint64) time.Duration {
+	return time.Duration(ticks) * time.Second / ClockTicks
+}
+
+// GetProcStat reads /proc/[pid]/stat for the process
+func (p *ProcessInspector) GetProcStat() (*ProcStat, error) {
+	return ReadProcStat(p.pid)
+}
+
+// ReadProcStat reads /proc/[pid]/stat for pid
+func ReadProcStat(pid int) (*ProcStat, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, &ProcError{PID: pid, File: "stat", Err: err}
+	}
+	return parseProcStat(string(data))
+}
+
+// parseProcStat parses the contents of /proc/[pid]/stat. The command name is
+// wrapped in parentheses and may itself contain spaces or parentheses.
+func parseProcStat(data string) (*ProcStat, error) {
+	open := strings.IndexByte(data, '(')
+	end := strings.LastIndexByte(data, ')')
+	if open < 0 || end < open {
+		return nil, fmt.Errorf("invalid stat format: %s", data)
+	}
+
+	// Fields after the command name, starting with field 3 (state)
+	fields := strings.Fields(data[end+1:])
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("invalid stat format: only %d fields", len(fields)+2)
+	}
+
+	field := func(n int) (uint64, error) {
+		value, err := strconv.ParseUint(fields[n-3], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid stat field %d: %s", n, fields[n-3])
+		}
+		return value, nil
+	}
+
+	stat := &ProcStat{
+		Comm:  data[open+1 : end],
+		State: fields[0],
+	}
+
+	var err error
+	if stat.MajFlt, err = field(12); err != nil {
+		return nil, err
+	}
+	if stat.UTime, err = field(14); err != nil {
+		return nil, err
+	}
+	if stat.STime, err = field(15); err != nil {
+		return nil, err
+	}
+	if stat.StartTime, err = field(22); err != nil {
+		return nil, err
+	}
+
+	return stat, nil
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"errors"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Default is the registry memadvise records into
+var Default = NewRegistry()
+
+// Skipped region reasons
+const (
+	SkipFilter = "filter" // Excluded by the region filter of a rule
+	SkipTHP    = "thp"    // Backed by transparent huge pages with --thp skip
+)
+
+// The metrics memadvise exports
+var (
+	AdvisedBytes = Default.NewCounter("memadvise_advised_bytes_total",
+		"Bytes the kernel reported advised, by mode and target", "mode", "pid", "comm")
+	Reclaims = Default.NewCounter("memadvise_reclaims_total",
+		"Reclaims of a single target, by mode and result (ok or error)", "mode", "result")
+	SyscallErrors = Default.NewCounter("memadvise_syscall_errors_total",
+		"Failed process_madvise or pidfd_open calls, by errno", "errno")
+	Rounds = Default.NewCounter("memadvise_rounds_total",
+		"Advise rounds; a non-iterative reclaim is one round", "mode")
+	Duration = Default.NewHistogram("memadvise_reclaim_duration_seconds",
+		"Time taken to reclaim from a single target",
+		[]float64{0.001, 0.01, 0.1, 0.5, 1, 5, 15, 60, 300}, "mode")
+	RSSBefore = Default.NewGauge("memadvise_rss_before_bytes",
+		"RSS of a target before its last reclaim", "pid", "comm")
+	RSSAfter = Default.NewGauge("memadvise_rss_after_bytes",
+		"RSS of a target after its last reclaim", "pid", "comm")
+	RefaultRatio = Default.NewGauge("memadvise_refault_ratio",
+		"Share of the bytes last advised from a target that were faulted back in", "pid", "comm")
+	SkippedRegions = Default.NewCounter("memadvise_skipped_regions_total",
+		"Eligible regions left out of a reclaim, by reason", "reason")
+	Triggers = Default.NewCounter("memadvise_trigger_events_total",
+		"PSI trigger and memory.events firings, by rule, kind and whether they were evaluated or debounced",
+		"rule", "kind", "outcome")
+	Rollbacks = Default.NewCounter("memadvise_rollbacks_total",
+		"Pageouts read back in with willneed after the target's major faults spiked, by rule and result (ok or error)",
+		"rule", "result")
+	LastRun = Default.NewGauge("memadvise_last_run_timestamp_seconds",
+		"Unix time of the last reclaim pass")
+)
+
+// Errno returns the errno name of err, e.g. "EPERM", or "other" if err
+// doesn't come from a system call
+func Errno(err error) string {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return "other"
+	}
+	if name := unix.ErrnoName(errno); name != "" {
+		return name
+	}
+	return strconv.Itoa(int(errno))
+}
+
+// ForgetTarget drops the per-target series of a process that exited
+func ForgetTarget(pid int) {
+	Default.Forget("pid", strconv.Itoa(pid))
+}
+
+// KeepTargets drops the per-target series of every process but those keep
+// accepts, so that a long-running daemon doesn't pile up series of processes
+// it no longer tracks
+func KeepTargets(keep func(pid int) bool) {
+	Default.ForgetUnless("pid", func(value string) bool {
+		pid, err := strconv.Atoi(value)
+		return err == nil && keep(pid)
+	})
+}
@@ -0,0 +1,272 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types of the Prometheus text format
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Registry holds metrics and writes them in the Prometheus text format
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+// family is a metric name with all its label combinations
+type family struct {
+	registry *Registry
+	name     string
+	help     string
+	kind     string
+	labels   []string
+	buckets  []float64 // Upper bounds, for histograms
+	series   map[string]*series
+}
+
+// series is one label combination of a metric
+type series struct {
+	values []string
+	value  float64  // Counter or gauge value
+	counts []uint64 // Per bucket, for histograms
+	sum    float64
+	count  uint64
+}
+
+// Counter only goes up
+type Counter struct{ f *family }
+
+// Gauge is set to the current value of something
+type Gauge struct{ f *family }
+
+// Histogram counts observations in buckets
+type Histogram struct{ f *family }
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(name, help, kind string, buckets []float64, labels []string) *family {
+	f := &family{
+		registry: r,
+		name:     name,
+		help:     help,
+		kind:     kind,
+		labels:   labels,
+		buckets:  buckets,
+		series:   make(map[string]*series),
+	}
+	r.mu.Lock()
+	r.families = append(r.families, f)
+	r.mu.Unlock()
+	return f
+}
+
+// NewCounter registers a counter with the given label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.add(name, help, typeCounter, nil, labels)}
+}
+
+// NewGauge registers a gauge with the given label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.add(name, help, typeGauge, nil, labels)}
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds and
+// label names
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.add(name, help, typeHistogram, buckets, labels)}
+}
+
+// Add increases the counter for the given label values by value
+func (c *Counter) Add(value float64, labels ...string) {
+	c.f.update(labels, func(s *series) { s.value += value })
+}
+
+// Inc increases the counter for the given label values by one
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Set sets the gauge for the given label values
+func (g *Gauge) Set(value float64, labels ...string) {
+	g.f.update(labels, func(s *series) { s.value = value })
+}
+
+// Observe records a value in the histogram for the given label values
+func (h *Histogram) Observe(value float64, labels ...string) {
+	h.f.update(labels, func(s *series) {
+		if s.counts == nil {
+			s.counts = make([]uint64, len(h.f.buckets))
+		}
+		for i, bound := range h.f.buckets {
+			if value <= bound {
+				s.counts[i]++
+			}
+		}
+		s.sum += value
+		s.count++
+	})
+}
+
+// update applies fn to the series with the given label values, creating it
+// if needed. Missing label values are left empty.
+func (f *family) update(values []string, fn func(s *series)) {
+	padded := make([]string, len(f.labels))
+	copy(padded, values)
+	key := strings.Join(padded, "\x00")
+
+	f.registry.mu.Lock()
+	defer f.registry.mu.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: padded}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+// Forget drops every series with the given value for label, e.g. those of a
+// process that exited
+func (r *Registry) Forget(label, value string) {
+	r.ForgetUnless(label, func(v string) bool {
+		return v != value
+	})
+}
+
+// ForgetUnless drops every series whose value for label keep rejects
+func (r *Registry) ForgetUnless(label string, keep func(value string) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, f := range r.families {
+		for i, name := range f.labels {
+			if name != label {
+				continue
+			}
+			for key, s := range f.series {
+				if !keep(s.values[i]) {
+					delete(f.series, key)
+				}
+			}
+		}
+	}
+}
+
+// Write writes every metric in the Prometheus text format. Metrics without
+// any series are left out.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	for _, f := range r.families {
+		if len(f.series) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind != typeHistogram {
+				fmt.Fprintf(&b, "%s%s %s\n", f.name, formatLabels(f.labels, s.values, "", ""), formatFloat(s.value))
+				continue
+			}
+			for i, bound := range f.buckets {
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", formatFloat(bound)), s.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", "+Inf"), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.values, "", ""), formatFloat(s.sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.values, "", ""), s.count)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteFile writes the metrics to path for node_exporter's textfile
+// collector. The file is replaced atomically so a scrape never sees it half
+// written.
+func (r *Registry) WriteFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := r.Write(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write metrics: %w", err)
+	}
+	return nil
+}
+
+// Handler serves the metrics over HTTP
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// labelEscaper escapes label values as the text format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats label pairs, adding extra=extraValue if extra is set
+func formatLabels(names, values []string, extra, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, labelEscaper.Replace(values[i])))
+	}
+	if extra != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra, labelEscaper.Replace(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatFloat formats a sample value the way Prometheus does
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	advised := r.NewCounter("test_advised_bytes_total", "Bytes advised", "mode", "comm")
+	rss := r.NewGauge("test_rss_bytes", "RSS")
+	duration := r.NewHistogram("test_duration_seconds", "Duration", []float64{0.1, 1}, "mode")
+	r.NewCounter("test_unused_total", "Never updated")
+
+	advised.Add(4096, "pageout", "worker")
+	advised.Add(4096, "pageout", "worker")
+	advised.Inc("cold", `say "hi"\n`)
+	rss.Set(1 << 20)
+	duration.Observe(0.05, "cold")
+	duration.Observe(0.5, "cold")
+
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+
+	want := `# HELP test_advised_bytes_total Bytes advised
+# TYPE test_advised_bytes_total counter
+test_advised_bytes_total{mode="cold",comm="say \"hi\"\\n"} 1
+test_advised_bytes_total{mode="pageout",comm="worker"} 8192
+# HELP test_rss_bytes RSS
+# TYPE test_rss_bytes gauge
+test_rss_bytes 1.048576e+06
+# HELP test_duration_seconds Duration
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{mode="cold",le="0.1"} 1
+test_duration_seconds_bucket{mode="cold",le="1"} 2
+test_duration_seconds_bucket{mode="cold",le="+Inf"} 2
+test_duration_seconds_sum{mode="cold"} 0.55
+test_duration_seconds_count{mode="cold"} 2
+`
+	if b.String() != want {
+		t.Errorf("Write() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestForget(t *testing.T) {
+	r := NewRegistry()
+	rss := r.NewGauge("test_rss_bytes", "RSS", "pid")
+	rss.Set(1, "1")
+	rss.Set(2, "2")
+
+	r.Forget("pid", "1")
+
+	var b strings.Builder
+	r.Write(&b)
+	if strings.Contains(b.String(), `pid="1"`) || !strings.Contains(b.String(), `pid="2"`) {
+		t.Errorf("Forget() left:\n%s", b.String())
+	}
+
+	rss.Set(3, "3")
+	r.ForgetUnless("pid", func(value string) bool {
+		return value == "3"
+	})
+
+	b.Reset()
+	r.Write(&b)
+	if strings.Contains(b.String(), `pid="2"`) || !strings.Contains(b.String(), `pid="3"`) {
+		t.Errorf("ForgetUnless() left:\n%s", b.String())
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("test_last_run", "Last run").Set(42)
+
+	path := filepath.Join(t.TempDir(), "memadvise.prom")
+	if err := r.WriteFile(path); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("metrics file not written: %v", err)
+	}
+	if !strings.Contains(string(data), "test_last_run 42\n") {
+		t.Errorf("metrics file = %q", data)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("WriteFile() left %d files behind, want 1", len(entries))
+	}
+}
+
+func TestErrno(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("process_madvise syscall failed: %w", syscall.EPERM), "EPERM"},
+		{syscall.ESRCH, "ESRCH"},
+		{fmt.Errorf("no eligible memory regions found"), "other"},
+	}
+
+	for _, tc := range testCases {
+		if got := Errno(tc.err); got != tc.want {
+			t.Errorf("Errno(%v) = %s, want %s", tc.err, got, tc.want)
+		}
+	}
+}
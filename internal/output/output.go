@@ -1,20 +1,36 @@
 package output
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync"
 	"text/tabwriter"
+	"time"
 
+	"github.com/zouuup/memadvise/internal/expr"
+	"github.com/zouuup/memadvise/internal/features"
+	"github.com/zouuup/memadvise/internal/gate"
+	"github.com/zouuup/memadvise/internal/history"
 	"github.com/zouuup/memadvise/internal/inspector"
 	"github.com/zouuup/memadvise/internal/syscall"
+	"github.com/zouuup/memadvise/internal/sysinfo"
 )
 
-// OutputManager handles formatted output for the CLI
+// OutputManager handles formatted output for the CLI. In text mode every
+// method writes as it is called; in JSON mode they record into a Report that
+// Finish writes as a single document.
 type OutputManager struct {
 	verbose bool
 	json    bool
 	writer  *tabwriter.Writer
+	stdout  io.Writer
+	stderr  io.Writer
+	now     func() time.Time
+
+	mu     sync.Mutex
+	report *Report
 }
 
 // New creates a new OutputManager
@@ -24,6 +40,10 @@ func New(verbose bool, jsonOutput bool) *OutputManager {
 		verbose: verbose,
 		json:    jsonOutput,
 		writer:  writer,
+		stdout:  os.Stdout,
+		stderr:  os.Stderr,
+		now:     time.Now,
+		report:  newReport(time.Now()),
 	}
 }
 
@@ -32,10 +52,27 @@ func (o *OutputManager) IsVerbose() bool {
 	return o.verbose
 }
 
+// TargetIdentity records who a target is. It has no text output.
+func (o *OutputManager) TargetIdentity(id *inspector.Identity) {
+	if !o.json {
+		return
+	}
+
+	o.recordTarget(id.PID, func(t *TargetReport) {
+		t.Identity = &IdentityReport{
+			Comm:      id.Comm,
+			Exe:       id.Exe,
+			Cgroup:    id.Cgroup,
+			StartTime: id.StartTime,
+		}
+	})
+}
+
 // MemoryStatsBefore outputs memory statistics before advice
 func (o *OutputManager) MemoryStatsBefore(pid int, stats *inspector.MemoryStats) {
 	if o.json {
-		return // Save for final output in JSON mode
+		o.recordTarget(pid, func(t *TargetReport) { t.Before = newStatsReport(stats) })
+		return
 	}
 
 	fmt.Fprintf(o.writer, "PID %d Before:\tRSS: %s\tAnon: %s\tPrivate: %s\n",
@@ -46,7 +83,8 @@ func (o *OutputManager) MemoryStatsBefore(pid int, stats *inspector.MemoryStats)
 // MemoryStatsAfter outputs memory statistics after advice
 func (o *OutputManager) MemoryStatsAfter(pid int, after *inspector.MemoryStats, before *inspector.MemoryStats) {
 	if o.json {
-		return // Save for final output in JSON mode
+		o.recordTarget(pid, func(t *TargetReport) { t.After = newStatsReport(after) })
+		return
 	}
 
 	diff := before.TotalRSS - after.TotalRSS
@@ -55,10 +93,17 @@ func (o *OutputManager) MemoryStatsAfter(pid int, after *inspector.MemoryStats,
 	o.writer.Flush()
 }
 
-// SelectedRegion outputs information about a selected memory region
+// SelectedRegion outputs information about a selected memory region. Text
+// output is only written in verbose mode.
 func (o *OutputManager) SelectedRegion(pid int, region syscall.MemoryRegion) {
-	if o.json || !o.verbose {
-		return // Only in verbose text mode
+	if o.json {
+		o.recordTarget(pid, func(t *TargetReport) {
+			t.Regions = append(t.Regions, newRegionReport(region, RegionSelected))
+		})
+		return
+	}
+	if !o.verbose {
+		return
 	}
 
 	path := region.Path
@@ -71,17 +116,43 @@ func (o *OutputManager) SelectedRegion(pid int, region syscall.MemoryRegion) {
 	o.writer.Flush()
 }
 
+// BatchResult records the outcome of one process_madvise call over regions,
+// which are selected regions or pieces of them. It has no text output.
+func (o *OutputManager) BatchResult(pid int, regions []syscall.MemoryRegion, err error) {
+	if !o.json {
+		return
+	}
+
+	outcome, message := RegionAdvised, ""
+	if err != nil {
+		outcome, message = RegionFailed, err.Error()
+	}
+
+	o.recordTarget(pid, func(t *TargetReport) {
+		for _, region := range regions {
+			// The most recent selection wins, as iterative rounds select again
+			for i := len(t.Regions) - 1; i >= 0; i-- {
+				r := &t.Regions[i]
+				if !r.contains(region.Start) {
+					continue
+				}
+				if r.Outcome != RegionFailed {
+					r.Outcome, r.Error = outcome, message
+				}
+				break
+			}
+		}
+	})
+}
+
 // DryRun outputs what would happen in a dry run
 func (o *OutputManager) DryRun(pid int, budget int64, mode string, regionCount int) {
 	if o.json {
-		data := map[string]interface{}{
-			"pid":          pid,
-			"would_advise": budget,
-			"mode":         mode,
-			"region_count": regionCount,
-			"dry_run":      true,
-		}
-		o.outputJSON(data)
+		o.recordTarget(pid, func(t *TargetReport) {
+			t.Mode = mode
+			t.DryRun = true
+			t.Plan = &PlanReport{Budget: budget, Regions: regionCount}
+		})
 		return
 	}
 
@@ -91,46 +162,811 @@ func (o *OutputManager) DryRun(pid int, budget int64, mode string, regionCount i
 }
 
 // SummaryResults outputs summary results after applying advice
-func (o *OutputManager) SummaryResults(pid int, bytesAdvised int64, bytesSelected int64, regionCount int, mode string) {
+func (o *OutputManager) SummaryResults(pid int, bytesAdvised int64, bytesSelected int64, regionCount int, iovecCount int, mode string) {
 	if o.json {
-		data := map[string]interface{}{
-			"pid":            pid,
-			"advised_bytes":  bytesAdvised,
-			"selected_bytes": bytesSelected,
-			"regions":        regionCount,
-			"mode":           mode,
-		}
-		o.outputJSON(data)
+		o.recordTarget(pid, func(t *TargetReport) {
+			t.Mode = mode
+			t.Result = &ResultReport{
+				AdvisedBytes:  bytesAdvised,
+				SelectedBytes: bytesSelected,
+				Regions:       regionCount,
+				Iovecs:        iovecCount,
+			}
+		})
 		return
 	}
 
-	fmt.Fprintf(o.writer, "PID %d Summary:\tAdvised %s / %s (%d%%) across %d regions using mode '%s'\n",
+	percent := 0
+	if bytesSelected > 0 {
+		percent = int(bytesAdvised * 100 / bytesSelected)
+	}
+
+	fmt.Fprintf(o.writer, "PID %d Summary:\tAdvised %s / %s (%d%%) across %d regions (%d iovecs) using mode '%s'\n",
 		pid, formatBytes(bytesAdvised), formatBytes(bytesSelected),
-		int(bytesAdvised*100/bytesSelected), regionCount, mode)
+		percent, regionCount, iovecCount, mode)
 	o.writer.Flush()
 }
 
-// Error outputs an error message
-func (o *OutputManager) Error(msg string) {
+// IterationRound outputs one round of an iterative reclaim
+func (o *OutputManager) IterationRound(pid int, round int, step int64, advised int64, rss int64, reclaimed int64, goal int64, elapsed time.Duration) {
+	if o.json {
+		o.recordTarget(pid, func(t *TargetReport) {
+			t.Rounds = append(t.Rounds, RoundReport{
+				Round:          round,
+				StepBytes:      step,
+				AdvisedBytes:   advised,
+				RSS:            rss,
+				ReclaimedBytes: reclaimed,
+				ElapsedMS:      elapsed.Milliseconds(),
+			})
+		})
+		return
+	}
+
+	percent := 0
+	if goal > 0 {
+		percent = int(reclaimed * 100 / goal)
+	}
+
+	fmt.Fprintf(o.writer, "PID %d Round %d:\t+%s\tStep: %s\tAdvised: %s\tRSS: %s\tReclaimed: %s (%d%% of goal)\n",
+		pid, round, elapsed.Truncate(time.Millisecond), formatBytes(step), formatBytes(advised),
+		formatBytes(rss), formatBytes(reclaimed), percent)
+	o.writer.Flush()
+}
+
+// IterationSummary outputs the result of an iterative reclaim
+func (o *OutputManager) IterationSummary(pid int, goal int64, reclaimed int64, advised int64, rounds int, reason string) {
+	if o.json {
+		o.recordTarget(pid, func(t *TargetReport) {
+			t.Iterative = &IterativeReport{
+				GoalBytes:      goal,
+				ReclaimedBytes: reclaimed,
+				AdvisedBytes:   advised,
+				Rounds:         rounds,
+				StopReason:     reason,
+			}
+		})
+		return
+	}
+
+	fmt.Fprintf(o.writer, "PID %d Iterative Summary:\tReclaimed %s of %s goal, advised %s in %d rounds (stopped: %s)\n",
+		pid, formatBytes(reclaimed), formatBytes(goal), formatBytes(advised), rounds, reason)
+	o.writer.Flush()
+}
+
+// PacingResults outputs how rate-limited advice was paced
+func (o *OutputManager) PacingResults(pid int, batches int, bytes int64, slept time.Duration, paused time.Duration, elapsed time.Duration) {
+	var rate int64
+	if elapsed > 0 {
+		rate = int64(float64(bytes) / elapsed.Seconds())
+	}
+
+	if o.json {
+		o.recordTarget(pid, func(t *TargetReport) {
+			t.Pacing = &PacingReport{
+				Batches:      batches,
+				AdvisedBytes: bytes,
+				SleptMS:      slept.Milliseconds(),
+				PausedMS:     paused.Milliseconds(),
+				ElapsedMS:    elapsed.Milliseconds(),
+				RateBytesS:   rate,
+			}
+		})
+		return
+	}
+
+	fmt.Fprintf(o.writer, "PID %d Pacing:\t%d batches in %s\tSlept: %s\tPaused: %s\tRate: %s/s\n",
+		pid, batches, elapsed.Truncate(time.Millisecond), slept.Truncate(time.Millisecond),
+		paused.Truncate(time.Millisecond), formatBytes(rate))
+	o.writer.Flush()
+}
+
+// Sample is the memory of a target at some point after advice
+type Sample struct {
+	Elapsed  time.Duration // Since advice finished
+	RSS      int64
+	Swap     int64
+	LazyFree int64
+}
+
+// Observation outputs how the memory of a target changed over the samples
+// taken after advice. Text output is a sparkline per value, followed in
+// verbose mode by every sample.
+func (o *OutputManager) Observation(pid int, interval time.Duration, samples []Sample) {
+	if len(samples) == 0 {
+		return
+	}
+
+	if o.json {
+		list := make([]SampleReport, 0, len(samples))
+		for _, sample := range samples {
+			list = append(list, SampleReport{
+				ElapsedMS: sample.Elapsed.Milliseconds(),
+				RSS:       sample.RSS,
+				Swap:      sample.Swap,
+				LazyFree:  sample.LazyFree,
+			})
+		}
+		o.recordTarget(pid, func(t *TargetReport) {
+			t.Observation = &ObservationReport{IntervalMS: interval.Milliseconds(), Samples: list}
+		})
+		return
+	}
+
+	rss := make([]int64, len(samples))
+	swap := make([]int64, len(samples))
+	lazyFree := make([]int64, len(samples))
+	for i, sample := range samples {
+		rss[i], swap[i], lazyFree[i] = sample.RSS, sample.Swap, sample.LazyFree
+	}
+	first, last := samples[0], samples[len(samples)-1]
+
+	fmt.Fprintf(o.writer, "PID %d Observed %s:\tRSS: %s -> %s %s\tSwap: %s -> %s %s\tLazyFree: %s -> %s %s\n",
+		pid, last.Elapsed.Round(time.Second),
+		formatBytes(first.RSS), formatBytes(last.RSS), sparkline(rss, sparklineWidth),
+		formatBytes(first.Swap), formatBytes(last.Swap), sparkline(swap, sparklineWidth),
+		formatBytes(first.LazyFree), formatBytes(last.LazyFree), sparkline(lazyFree, sparklineWidth))
+	if o.verbose {
+		for _, sample := range samples {
+			fmt.Fprintf(o.writer, "PID %d +%s:\tRSS: %s\tSwap: %s\tLazyFree: %s\n",
+				pid, sample.Elapsed.Round(time.Millisecond), formatBytes(sample.RSS),
+				formatBytes(sample.Swap), formatBytes(sample.LazyFree))
+		}
+	}
+	o.writer.Flush()
+}
+
+// Refaults outputs the major faults a target took since advice and the
+// refaulted share of what was advised. Negative cgroup counts mean they are
+// unavailable.
+func (o *OutputManager) Refaults(pid int, majorFaults int64, ratio float64, cgroupAnon int64, cgroupFile int64) {
+	if o.json {
+		report := &RefaultReport{MajorFaults: majorFaults, Ratio: ratio}
+		if cgroupAnon >= 0 && cgroupFile >= 0 {
+			report.CgroupRefaultAnon, report.CgroupRefaultFile = &cgroupAnon, &cgroupFile
+		}
+		o.recordTarget(pid, func(t *TargetReport) { t.Refaults = report })
+		return
+	}
+
+	fmt.Fprintf(o.writer, "PID %d Refaults:\t%d major faults (%.1f%% of advised)", pid, majorFaults, ratio*100)
+	if cgroupAnon >= 0 && cgroupFile >= 0 {
+		fmt.Fprintf(o.writer, "\tcgroup workingset refaults: %d anon, %d file", cgroupAnon, cgroupFile)
+	}
+	fmt.Fprintln(o.writer)
+	o.writer.Flush()
+}
+
+// TotalBudget outputs the overall result of distributing a total budget
+func (o *OutputManager) TotalBudget(requested int64, allocated int64, advised int64, targets int, policy string, dryRun bool) {
+	if o.json {
+		o.record(func(r *Report) {
+			r.TotalBudget = &TotalBudgetReport{
+				Requested:    requested,
+				Allocated:    allocated,
+				AdvisedBytes: advised,
+				Targets:      targets,
+				Distribution: policy,
+				DryRun:       dryRun,
+			}
+		})
+		return
+	}
+
+	if dryRun {
+		fmt.Fprintf(o.writer, "Total DRY RUN:\tWould allocate %s of %s across %d targets using distribution '%s'\n",
+			formatBytes(allocated), formatBytes(requested), targets, policy)
+	} else {
+		fmt.Fprintf(o.writer, "Total Summary:\tAdvised %s, allocated %s of %s across %d targets using distribution '%s'\n",
+			formatBytes(advised), formatBytes(allocated), formatBytes(requested), targets, policy)
+	}
+	o.writer.Flush()
+}
+
+// THPResults outputs how transparent huge page backed regions were handled
+func (o *OutputManager) THPResults(pid int, policy string, thpBytes int64, skippedRegions int, skippedBytes int64) {
 	if o.json {
-		data := map[string]interface{}{
-			"error": msg,
+		o.recordTarget(pid, func(t *TargetReport) {
+			t.THP = &THPReport{
+				Policy:         policy,
+				AdvisedBytes:   thpBytes,
+				SkippedRegions: skippedRegions,
+				SkippedBytes:   skippedBytes,
+			}
+		})
+		return
+	}
+
+	fmt.Fprintf(o.writer, "PID %d THP:\tAdvised %s of huge pages, skipped %d regions (%s) using policy '%s'\n",
+		pid, formatBytes(thpBytes), skippedRegions, formatBytes(skippedBytes), policy)
+	o.writer.Flush()
+}
+
+// GateResults outputs the evaluated reclaim conditions
+func (o *OutputManager) GateResults(results []gate.Result, scale float64) {
+	if o.json {
+		conditions := make([]ConditionResult, 0, len(results))
+		for _, result := range results {
+			conditions = append(conditions, ConditionResult{
+				Condition: result.Condition,
+				Met:       result.Met,
+				Value:     result.Value,
+				Threshold: result.Threshold,
+			})
 		}
-		o.outputJSON(data)
+		o.record(func(r *Report) {
+			r.Conditions = &ConditionsReport{Results: conditions, BudgetScale: scale}
+		})
 		return
 	}
 
-	fmt.Fprintf(os.Stderr, "Error: %s\n", msg)
+	for _, result := range results {
+		if result.Met && !o.verbose {
+			continue
+		}
+
+		status := "met"
+		if !result.Met {
+			status = "not met"
+		}
+
+		value, threshold := fmt.Sprintf("%.2f", result.Value), fmt.Sprintf("%.2f", result.Threshold)
+		if result.Bytes {
+			value, threshold = formatBytes(int64(result.Value)), formatBytes(int64(result.Threshold))
+		}
+
+		fmt.Fprintf(o.writer, "Condition %s:\t%s\t(value %s, threshold %s)\n",
+			status, result.Condition, value, threshold)
+	}
+	o.writer.Flush()
 }
 
-// outputJSON marshals and outputs JSON data
-func (o *OutputManager) outputJSON(data map[string]interface{}) {
-	jsonData, err := json.Marshal(data)
+// SwapPreflight outputs the swap state found before a pageout
+func (o *OutputManager) SwapPreflight(status *sysinfo.SwapStatus, reserve int64, headroom int64) {
+	if o.json {
+		zram := status.ZramDevices
+		if zram == nil {
+			zram = []string{}
+		}
+		o.record(func(r *Report) {
+			r.Swap = &SwapReport{
+				Devices:     len(status.Devices),
+				Total:       status.SwapTotal,
+				Free:        status.SwapFree,
+				Reserve:     reserve,
+				Headroom:    headroom,
+				Zswap:       status.ZswapEnabled,
+				ZramDevices: zram,
+			}
+		})
+		return
+	}
+
+	if !o.verbose {
+		return
+	}
+
+	zswap := "disabled"
+	if status.ZswapEnabled {
+		zswap = "enabled"
+	}
+
+	fmt.Fprintf(o.writer, "Swap Preflight:\tDevices: %d\tFree: %s / %s\tReserve: %s\tHeadroom: %s\tzswap: %s\tzram: %d\n",
+		len(status.Devices), formatBytes(status.SwapFree), formatBytes(status.SwapTotal),
+		formatBytes(reserve), formatBytes(headroom), zswap, len(status.ZramDevices))
+	o.writer.Flush()
+}
+
+// TriggerOutcome outputs the result of a rule evaluation caused by a trigger
+// event. count is the number of new memory.events occurrences, or 0 for PSI.
+func (o *OutputManager) TriggerOutcome(rule string, kind string, source string, count int64, targets int, reclaimed int, advised int64, failed int) {
+	if o.json {
+		o.record(func(r *Report) {
+			r.Trigger = &TriggerReport{
+				Rule:         rule,
+				Event:        kind,
+				Source:       source,
+				Count:        count,
+				Targets:      targets,
+				Reclaimed:    reclaimed,
+				AdvisedBytes: advised,
+				Failed:       failed,
+			}
+		})
+		return
+	}
+
+	event := kind
+	if count > 0 {
+		event = fmt.Sprintf("%s (+%d)", kind, count)
+	}
+	fmt.Fprintf(o.writer, "rule %q:\t%s event on %s\tadvised %s from %d of %d targets, %d failed\n",
+		rule, event, source, formatBytes(advised), reclaimed-failed, targets, failed)
+	o.writer.Flush()
+}
+
+// Rollback outputs a pageout read back in with willneed because the target's
+// major faults spiked afterwards
+func (o *OutputManager) Rollback(rule string, pid int, faultRate float64, ranges int, restored int64, hotUntil time.Time, err error) {
+	if o.json {
+		report := &RollbackReport{
+			Rule:          rule,
+			FaultRate:     faultRate,
+			Ranges:        ranges,
+			RestoredBytes: restored,
+			HotUntil:      hotUntil,
+		}
+		if err != nil {
+			report.Error = err.Error()
+		}
+		o.recordTarget(pid, func(t *TargetReport) { t.Rollback = report })
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintf(o.stderr, "Error: rule %q: PID %d faulting %.1f/s more since its pageout, failed to read %d ranges back in: %v\n",
+			rule, pid, faultRate, ranges, err)
+	} else {
+		fmt.Fprintf(o.writer, "rule %q:\tPID %d faulting %.1f/s more since its pageout\tread %s in %d ranges back in, hot until %s\n",
+			rule, pid, faultRate, formatBytes(restored), ranges, hotUntil.Format(time.RFC3339))
+		o.writer.Flush()
+	}
+}
+
+// PolicyEvaluation outputs the result of evaluating a rule condition for a process
+func (o *OutputManager) PolicyEvaluation(rule string, pid int, comm string, condition string, met bool, env expr.Env, err error) {
+	if o.json {
+		evaluation := EvaluationReport{
+			Rule:      rule,
+			PID:       pid,
+			Comm:      comm,
+			Condition: condition,
+			Met:       met,
+			Values:    env,
+		}
+		if evaluation.Values == nil {
+			evaluation.Values = expr.Env{}
+		}
+		if err != nil {
+			evaluation.Error = err.Error()
+		}
+		o.record(func(r *Report) { r.Evaluations = append(r.Evaluations, evaluation) })
+		return
+	}
+
+	status := "met"
+	switch {
+	case err != nil:
+		status = "error"
+	case !met:
+		status = "not met"
+	}
+
+	values := make([]string, 0, len(env))
+	for _, v := range expr.Variables {
+		if value, ok := env[v.Name]; ok {
+			values = append(values, fmt.Sprintf("%s=%s", v.Name, formatValue(value, v.Unit)))
+		}
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error marshaling JSON: %v\n", err)
+		values = append(values, err.Error())
+	}
+
+	fmt.Fprintf(o.writer, "rule %q:\tPID %d (%s)\t%s\t%s\n", rule, pid, comm, status, strings.Join(values, " "))
+	o.writer.Flush()
+}
+
+// PolicyVariables outputs the variables available in conditions
+func (o *OutputManager) PolicyVariables(vars []expr.Variable) {
+	if o.json {
+		list := make([]VariableReport, 0, len(vars))
+		for _, v := range vars {
+			list = append(list, VariableReport{Name: v.Name, Unit: v.Unit, Help: v.Help})
+		}
+		o.record(func(r *Report) { r.Variables = list })
+		return
+	}
+
+	for _, v := range vars {
+		fmt.Fprintf(o.writer, "%s\t%s\t%s\n", v.Name, v.Unit, v.Help)
+	}
+	o.writer.Flush()
+}
+
+// ProcessInspection outputs the memory of a process as reported by the daemon
+func (o *OutputManager) ProcessInspection(pid int, comm string, stats *inspector.MemoryStats, eligible int64, regions int) {
+	if o.json {
+		o.recordTarget(pid, func(t *TargetReport) {
+			t.Identity = &IdentityReport{Comm: comm}
+			t.Before = newStatsReport(stats)
+			t.Eligible = &EligibleReport{Bytes: eligible, Regions: regions}
+		})
+		return
+	}
+
+	fmt.Fprintf(o.writer, "PID %d (%s):\tRSS: %s\tAnon: %s\tPrivate: %s\tSwap: %s\tEligible: %s in %d regions\n",
+		pid, comm, formatBytes(stats.TotalRSS), formatBytes(stats.Anon), formatBytes(stats.Private),
+		formatBytes(stats.TotalSwap), formatBytes(eligible), regions)
+	o.writer.Flush()
+}
+
+// ReclaimPlan outputs the regions a reclaim would advise
+func (o *OutputManager) ReclaimPlan(pid int, mode string, budget int64, regions []syscall.MemoryRegion) {
+	var selected uint64
+	for _, region := range regions {
+		selected += region.Size
+	}
+
+	if o.json {
+		o.recordTarget(pid, func(t *TargetReport) {
+			t.Mode = mode
+			t.Plan = &PlanReport{Budget: budget, SelectedBytes: int64(selected), Regions: len(regions)}
+			for _, region := range regions {
+				t.Regions = append(t.Regions, newRegionReport(region, RegionPlanned))
+			}
+		})
+		return
+	}
+
+	fmt.Fprintf(o.writer, "PID %d Plan:\tWould advise %s of a %s budget across %d regions using mode '%s'\n",
+		pid, formatBytes(int64(selected)), formatBytes(budget), len(regions), mode)
+	o.writer.Flush()
+	for _, region := range regions {
+		o.SelectedRegion(pid, region)
+	}
+}
+
+// RequestResult outputs the outcome of advice requested from the daemon
+func (o *OutputManager) RequestResult(pid int, mode string, advised int64, rssBefore int64, rssAfter int64) {
+	if o.json {
+		o.recordTarget(pid, func(t *TargetReport) {
+			t.Mode = mode
+			t.Result = &ResultReport{AdvisedBytes: advised}
+			t.Before = &StatsReport{RSS: rssBefore}
+			t.After = &StatsReport{RSS: rssAfter}
+		})
+		return
+	}
+
+	fmt.Fprintf(o.writer, "PID %d:\tAdvised %s using mode '%s'\tRSS: %s -> %s\n",
+		pid, formatBytes(advised), mode, formatBytes(rssBefore), formatBytes(rssAfter))
+	o.writer.Flush()
+}
+
+// DaemonStatus outputs the status of a running daemon; the targets it keeps
+// state for follow as DaemonTarget
+func (o *OutputManager) DaemonStatus(pid int, started time.Time, interval string, rules []string, targets int) {
+	if o.json {
+		if rules == nil {
+			rules = []string{}
+		}
+		o.record(func(r *Report) {
+			r.Daemon = &DaemonReport{
+				PID:      pid,
+				Started:  started,
+				Interval: interval,
+				Rules:    rules,
+				Targets:  targets,
+			}
+		})
+		return
+	}
+
+	fmt.Fprintf(o.writer, "Daemon PID %d:\tup %s, evaluated every %s\t%d rules (%s), %d targets tracked\n",
+		pid, time.Since(started).Round(time.Second), interval, len(rules), strings.Join(rules, ", "), targets)
+	o.writer.Flush()
+}
+
+// DaemonTarget outputs the daemon's state for one process
+func (o *OutputManager) DaemonTarget(pid int, comm string, lastAdvised time.Time, advised int64, lastRSS int64, refaultRate float64, refaultRatio float64, budgetScale float64, hotUntil time.Time) {
+	if o.json {
+		o.recordTarget(pid, func(t *TargetReport) {
+			t.Identity = &IdentityReport{Comm: comm}
+			t.State = &StateReport{
+				LastAdvisedBytes: advised,
+				LastRSS:          lastRSS,
+				RefaultRate:      refaultRate,
+				RefaultRatio:     refaultRatio,
+				BudgetScale:      budgetScale,
+			}
+			if !hotUntil.IsZero() {
+				t.State.HotUntil = &hotUntil
+			}
+			if !lastAdvised.IsZero() {
+				t.State.LastAdvised = &lastAdvised
+			}
+		})
+		return
+	}
+
+	last := "never advised"
+	if !lastAdvised.IsZero() {
+		last = fmt.Sprintf("advised %s %s ago, RSS after: %s",
+			formatBytes(advised), time.Since(lastAdvised).Round(time.Second), formatBytes(lastRSS))
+	}
+	fmt.Fprintf(o.writer, "  PID %d (%s):\t%s\tmajor faults: %.1f/s\trefaulted: %.1f%%\tbudget: %.0f%%",
+		pid, comm, last, refaultRate, refaultRatio*100, budgetScale*100)
+	if time.Now().Before(hotUntil) {
+		fmt.Fprintf(o.writer, "\thot until %s", hotUntil.Format(time.RFC3339))
+	}
+	fmt.Fprintln(o.writer)
+	o.writer.Flush()
+}
+
+// HistoryTarget outputs the last limit records of a process from the advice
+// history; a limit of 0 outputs them all
+func (o *OutputManager) HistoryTarget(t *history.Target, limit int) {
+	shown := *t
+	if limit > 0 && len(shown.Records) > limit {
+		shown.Records = shown.Records[len(shown.Records)-limit:]
+	}
+
+	if o.json {
+		o.record(func(r *Report) { r.History = append(r.History, &shown) })
+		return
+	}
+
+	fmt.Fprintf(o.writer, "PID %d (%s) %s:\trecords: %d\n", t.PID, t.Comm, t.Key.Exe, len(t.Records))
+	for _, record := range shown.Records {
+		advised := formatBytes(record.Advised)
+		if record.Requested > 0 {
+			advised += " of " + formatBytes(record.Requested)
+		}
+		fmt.Fprintf(o.writer, "  %s\t%s\t%s\tadvised %s in %d ranges",
+			record.Time.Format(time.RFC3339), record.Source, record.Mode, advised, len(record.Ranges))
+		if record.RSSBefore > 0 {
+			fmt.Fprintf(o.writer, "\tRSS: %s -> %s", formatBytes(record.RSSBefore), formatBytes(record.RSSAfter))
+		}
+		if record.MajorFaults > 0 {
+			fmt.Fprintf(o.writer, "\trefaulted: %.1f%%", record.RefaultRatio*100)
+		}
+		if record.HotUntil != nil {
+			fmt.Fprintf(o.writer, "\thot until %s", record.HotUntil.Format(time.RFC3339))
+		}
+		if record.Error != "" {
+			fmt.Fprintf(o.writer, "\terror: %s", record.Error)
+		}
+		fmt.Fprintln(o.writer)
+		if o.verbose {
+			for _, r := range record.Ranges {
+				fmt.Fprintf(o.writer, "    0x%x-0x%x\t%s\n", r.Start, r.End, formatBytes(int64(r.End-r.Start)))
+			}
+		}
+	}
+	o.writer.Flush()
+}
+
+// Features outputs what the running kernel supports, for doctor
+func (o *OutputManager) Features(r *features.Report) {
+	if o.json {
+		o.record(func(report *Report) { report.Features = r })
+		return
+	}
+
+	fmt.Fprintf(o.writer, "Kernel:\t%s\n", r.Kernel)
+	for _, mode := range features.Modes {
+		probe := r.Modes[mode]
+		fmt.Fprintf(o.writer, "process_madvise %s:\t%s", mode, probe.Status)
+		if probe.Error != "" {
+			fmt.Fprintf(o.writer, " (%s)", probe.Error)
+		}
+		fmt.Fprintln(o.writer)
+	}
+	fmt.Fprintf(o.writer, "smaps_rollup:\t%s\n", availability(r.SmapsRollup))
+	fmt.Fprintf(o.writer, "page_idle:\t%s\n", availability(r.PageIdle))
+
+	thp := "unavailable"
+	if r.THP != "" {
+		thp = fmt.Sprintf("%s (defrag: %s)", r.THP, r.THPDefrag)
+	}
+	fmt.Fprintf(o.writer, "Transparent huge pages:\t%s\n", thp)
+
+	zswap := "disabled"
+	if r.Swap.Zswap {
+		zswap = "enabled"
+		if r.Swap.ZswapCompressor != "" {
+			zswap += " (" + r.Swap.ZswapCompressor + ")"
+		}
+	}
+	zram := "none"
+	if len(r.Swap.ZramDevices) > 0 {
+		zram = strings.Join(r.Swap.ZramDevices, " ")
+	}
+	fmt.Fprintf(o.writer, "Swap:\t%d devices, %s\tzswap: %s\tzram: %s\n", r.Swap.Devices, formatBytes(r.Swap.Total), zswap, zram)
+
+	mglru := "unavailable"
+	if r.MGLRU != "" {
+		mglru = "enabled (" + r.MGLRU + ")"
+		if r.MGLRU == "0x0000" {
+			mglru = "disabled"
+		}
+	}
+	fmt.Fprintf(o.writer, "MGLRU:\t%s\n", mglru)
+
+	cgroup := "unavailable"
+	if r.Cgroup.V2 {
+		cgroup = "controllers: " + strings.Join(r.Cgroup.Controllers, " ")
+	}
+	fmt.Fprintf(o.writer, "cgroup v2:\t%s\n", cgroup)
+
+	psi := "unavailable"
+	if len(r.PSI) > 0 {
+		psi = strings.Join(r.PSI, " ")
+	}
+	fmt.Fprintf(o.writer, "PSI:\t%s\n", psi)
+
+	for _, err := range r.Errors {
+		fmt.Fprintf(o.writer, "Probe failed:\t%s\n", err)
+	}
+	o.writer.Flush()
+}
+
+// availability describes whether a feature is available
+func availability(available bool) string {
+	if available {
+		return "available"
+	}
+	return "unavailable"
+}
+
+// TargetAccess outputs the permission preflight of a target: why it can't
+// be advised and how to fix that. It stands in for TargetError for a target
+// that can't be advised. Allowed targets are only reported in verbose mode,
+// and only if there is a note.
+func (o *OutputManager) TargetAccess(access *inspector.Access) {
+	if access.Allowed() && (!o.verbose || len(access.Notes) == 0) {
+		return
+	}
+
+	if o.json {
+		report := &AccessReport{
+			Allowed:  access.Allowed(),
+			Problems: make([]AccessProblemReport, 0, len(access.Problems)),
+			Notes:    append([]string{}, access.Notes...),
+		}
+		for _, problem := range access.Problems {
+			report.Problems = append(report.Problems, AccessProblemReport{Check: problem.Check, Reason: problem.Reason, Fix: problem.Fix})
+		}
+		o.recordTarget(access.PID, func(t *TargetReport) {
+			t.Access = report
+			if err := access.Err(); err != nil {
+				t.Errors = append(t.Errors, err.Error())
+			}
+		})
 		return
 	}
-	fmt.Println(string(jsonData))
+
+	if access.Allowed() {
+		for _, note := range access.Notes {
+			fmt.Fprintf(o.writer, "PID %d Access:\t%s\n", access.PID, note)
+		}
+		o.writer.Flush()
+		return
+	}
+
+	fmt.Fprintf(o.stderr, "Error: PID %d cannot be advised:\n", access.PID)
+	for _, problem := range access.Problems {
+		fmt.Fprintf(o.stderr, "  - %s\n    Fix: %s\n", problem.Reason, problem.Fix)
+	}
+	for _, note := range access.Notes {
+		fmt.Fprintf(o.stderr, "  Note: %s\n", note)
+	}
+}
+
+// TargetSkipped outputs why a target was left out. Text output is only
+// written in verbose mode.
+func (o *OutputManager) TargetSkipped(pid int, reason string) {
+	if o.json {
+		o.recordTarget(pid, func(t *TargetReport) { t.Skipped = reason })
+		return
+	}
+	if !o.verbose {
+		return
+	}
+
+	fmt.Fprintf(o.stdout, "PID %d skipped: %s\n", pid, reason)
+}
+
+// TargetError outputs an error that affected a single target
+func (o *OutputManager) TargetError(pid int, msg string) {
+	if o.json {
+		o.recordTarget(pid, func(t *TargetReport) { t.Errors = append(t.Errors, msg) })
+		return
+	}
+
+	fmt.Fprintf(o.stderr, "Error: %s\n", msg)
+}
+
+// Info outputs an informational message
+func (o *OutputManager) Info(msg string) {
+	if o.json {
+		o.message("info", msg)
+		return
+	}
+
+	fmt.Fprintf(o.stdout, "%s\n", msg)
+}
+
+// Warning outputs a warning message
+func (o *OutputManager) Warning(msg string) {
+	if o.json {
+		o.message("warning", msg)
+		return
+	}
+
+	fmt.Fprintf(o.stderr, "Warning: %s\n", msg)
+}
+
+// Error outputs an error message
+func (o *OutputManager) Error(msg string) {
+	if o.json {
+		o.message("error", msg)
+		return
+	}
+
+	fmt.Fprintf(o.stderr, "Error: %s\n", msg)
+}
+
+// message records a log message in the report
+func (o *OutputManager) message(level string, msg string) {
+	o.record(func(r *Report) {
+		r.Messages = append(r.Messages, Message{Level: level, Message: msg, Time: o.now()})
+	})
+}
+
+// sparklineWidth is the most characters a sparkline takes
+const sparklineWidth = 30
+
+// sparkline draws values as a row of block characters scaled between their
+// minimum and maximum. Longer series are reduced to width by keeping the last
+// value of each bucket.
+func sparkline(values []int64, width int) string {
+	const blocks = "▁▂▃▄▅▆▇█"
+	levels := []rune(blocks)
+
+	if len(values) > width {
+		reduced := make([]int64, width)
+		for i := range reduced {
+			reduced[i] = values[(i+1)*len(values)/width-1]
+		}
+		values = reduced
+	}
+
+	lowest, highest := values[0], values[0]
+	for _, value := range values {
+		if value < lowest {
+			lowest = value
+		}
+		if value > highest {
+			highest = value
+		}
+	}
+
+	var b strings.Builder
+	for _, value := range values {
+		level := 0
+		if highest > lowest {
+			level = int((value - lowest) * int64(len(levels)-1) / (highest - lowest))
+		}
+		b.WriteRune(levels[level])
+	}
+	return b.String()
+}
+
+// formatValue formats a condition variable according to its unit
+func formatValue(value float64, unit string) string {
+	switch unit {
+	case "bytes":
+		if value >= float64(sysinfo.Unlimited) {
+			return "max"
+		}
+		return formatBytes(int64(value))
+	case "seconds":
+		return time.Duration(value * float64(time.Second)).Round(time.Second).String()
+	case "percent":
+		return fmt.Sprintf("%.2f%%", value)
+	}
+	return fmt.Sprintf("%.0f", value)
 }
 
 // formatBytes formats a byte count as a human-readable string
@@ -0,0 +1,44 @@
+package output
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSparkline(t *testing.T) {
+	testCases := []struct {
+		values []int64
+		width  int
+		want   string
+	}{
+		{[]int64{0, 7}, 10, "▁█"},
+		{[]int64{70, 60, 50, 40, 30, 20, 10, 0}, 10, "█▇▆▅▄▃▂▁"},
+		{[]int64{5, 5, 5}, 10, "▁▁▁"},
+		// Reduced to the last value of each bucket
+		{[]int64{0, 1, 2, 3, 4, 5, 6, 7}, 4, "▁▃▅█"},
+	}
+
+	for _, tc := range testCases {
+		if got := sparkline(tc.values, tc.width); got != tc.want {
+			t.Errorf("sparkline(%v, %d) = %s, want %s", tc.values, tc.width, got, tc.want)
+		}
+	}
+}
+
+func TestObservationText(t *testing.T) {
+	var buf bytes.Buffer
+	o := New(false, false)
+	o.writer.Init(&buf, 0, 0, 2, ' ', 0)
+
+	o.Observation(100, time.Second, []Sample{
+		{Elapsed: 0, RSS: 40 << 20, LazyFree: 24 << 20},
+		{Elapsed: 30 * time.Second, RSS: 24 << 20},
+	})
+
+	want := "PID 100 Observed 30s:  RSS: 40.0 MiB -> 24.0 MiB █▁  Swap: 0 B -> 0 B ▁▁  LazyFree: 24.0 MiB -> 0 B █▁\n"
+	if !strings.HasPrefix(buf.String(), want) {
+		t.Errorf("Observation() =\n%q\nwant\n%q", buf.String(), want)
+	}
+}
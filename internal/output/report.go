@@ -0,0 +1,424 @@
+package output
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/zouuup/memadvise/internal/features"
+	"github.com/zouuup/memadvise/internal/history"
+	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/syscall"
+)
+
+// ReportVersion is the version of the JSON report. It changes whenever a
+// field is removed or changes meaning; new fields may be added at any time.
+const ReportVersion = 1
+
+// Schema is the JSON Schema of the report
+//
+//go:embed report.schema.json
+var Schema []byte
+
+// Region outcomes
+const (
+	RegionSelected = "selected" // Chosen for advice, not attempted yet
+	RegionAdvised  = "advised"  // process_madvise succeeded
+	RegionFailed   = "failed"   // process_madvise failed
+	RegionPlanned  = "planned"  // Would be advised; nothing was attempted
+)
+
+// Report is the JSON document written for each run in --json mode. A run is
+// one invocation of a one-shot command, or one evaluation of the daemon.
+type Report struct {
+	Version     int                `json:"version"`
+	Started     time.Time          `json:"started"`
+	Finished    time.Time          `json:"finished"`
+	DurationMS  int64              `json:"duration_ms"`
+	Conditions  *ConditionsReport  `json:"conditions,omitempty"`
+	Swap        *SwapReport        `json:"swap,omitempty"`
+	Trigger     *TriggerReport     `json:"trigger,omitempty"`
+	Targets     []*TargetReport    `json:"targets"`
+	TotalBudget *TotalBudgetReport `json:"total_budget,omitempty"`
+	Evaluations []EvaluationReport `json:"evaluations,omitempty"`
+	Variables   []VariableReport   `json:"variables,omitempty"`
+	Daemon      *DaemonReport      `json:"daemon,omitempty"`
+	History     []*history.Target  `json:"history,omitempty"`
+	Features    *features.Report   `json:"features,omitempty"`
+	Messages    []Message          `json:"messages"`
+}
+
+// TargetReport is everything that happened to one process during a run
+type TargetReport struct {
+	PID         int                `json:"pid"`
+	Identity    *IdentityReport    `json:"identity,omitempty"`
+	Before      *StatsReport       `json:"before,omitempty"`
+	After       *StatsReport       `json:"after,omitempty"`
+	Eligible    *EligibleReport    `json:"eligible,omitempty"`
+	Mode        string             `json:"mode,omitempty"`
+	DryRun      bool               `json:"dry_run,omitempty"`
+	Plan        *PlanReport        `json:"plan,omitempty"`
+	Result      *ResultReport      `json:"result,omitempty"`
+	Regions     []RegionReport     `json:"regions,omitempty"`
+	Rounds      []RoundReport      `json:"rounds,omitempty"`
+	Iterative   *IterativeReport   `json:"iterative,omitempty"`
+	Pacing      *PacingReport      `json:"pacing,omitempty"`
+	THP         *THPReport         `json:"thp,omitempty"`
+	Observation *ObservationReport `json:"observation,omitempty"`
+	Refaults    *RefaultReport     `json:"refaults,omitempty"`
+	Rollback    *RollbackReport    `json:"rollback,omitempty"`
+	State       *StateReport       `json:"state,omitempty"`
+	Access      *AccessReport      `json:"access,omitempty"`
+	Skipped     string             `json:"skipped,omitempty"`
+	Errors      []string           `json:"errors,omitempty"`
+	Started     time.Time          `json:"started"`
+	DurationMS  int64              `json:"duration_ms"`
+
+	lastEvent time.Time
+}
+
+// IdentityReport identifies a process
+type IdentityReport struct {
+	Comm      string `json:"comm"`
+	Exe       string `json:"exe,omitempty"`
+	Cgroup    string `json:"cgroup,omitempty"`
+	StartTime uint64 `json:"start_time,omitempty"`
+}
+
+// StatsReport is inspector.MemoryStats, in bytes
+type StatsReport struct {
+	RSS        int64 `json:"rss"`
+	Swap       int64 `json:"swap"`
+	Size       int64 `json:"size"`
+	Shared     int64 `json:"shared"`
+	Private    int64 `json:"private"`
+	Anon       int64 `json:"anon"`
+	LazyFree   int64 `json:"lazy_free"`
+	SwapPSS    int64 `json:"swap_pss"`
+	HugetlbRSS int64 `json:"hugetlb_rss"`
+}
+
+// EligibleReport is how much of a process may be advised
+type EligibleReport struct {
+	Bytes   int64 `json:"bytes"`
+	Regions int   `json:"regions"`
+}
+
+// PlanReport is what a dry run or plan would advise
+type PlanReport struct {
+	Budget        int64 `json:"budget"`
+	SelectedBytes int64 `json:"selected_bytes,omitempty"`
+	Regions       int   `json:"regions"`
+}
+
+// ResultReport is the outcome of advising a process
+type ResultReport struct {
+	AdvisedBytes  int64 `json:"advised_bytes"`
+	SelectedBytes int64 `json:"selected_bytes,omitempty"`
+	Regions       int   `json:"regions,omitempty"`
+	Iovecs        int   `json:"iovecs,omitempty"`
+}
+
+// RegionReport is a memory range selected for advice and what became of it
+type RegionReport struct {
+	Start   string `json:"start"` // Hexadecimal address
+	End     string `json:"end"`
+	Size    uint64 `json:"size"`
+	Path    string `json:"path,omitempty"`
+	RSS     uint64 `json:"rss,omitempty"`
+	THP     uint64 `json:"thp_bytes,omitempty"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+
+	start, end uint64
+}
+
+// contains reports whether addr falls in the region
+func (r *RegionReport) contains(addr uint64) bool {
+	return addr >= r.start && addr < r.end
+}
+
+// RoundReport is one round of an iterative reclaim
+type RoundReport struct {
+	Round          int   `json:"round"`
+	StepBytes      int64 `json:"step_bytes"`
+	AdvisedBytes   int64 `json:"advised_bytes"`
+	RSS            int64 `json:"rss"`
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+	ElapsedMS      int64 `json:"elapsed_ms"`
+}
+
+// IterativeReport is the overall result of an iterative reclaim
+type IterativeReport struct {
+	GoalBytes      int64  `json:"goal_bytes"`
+	ReclaimedBytes int64  `json:"reclaimed_bytes"`
+	AdvisedBytes   int64  `json:"advised_bytes"`
+	Rounds         int    `json:"rounds"`
+	StopReason     string `json:"stop_reason"`
+}
+
+// PacingReport is how rate-limited advice was paced
+type PacingReport struct {
+	Batches      int   `json:"batches"`
+	AdvisedBytes int64 `json:"advised_bytes"`
+	SleptMS      int64 `json:"slept_ms"`
+	PausedMS     int64 `json:"paused_ms"`
+	ElapsedMS    int64 `json:"elapsed_ms"`
+	RateBytesS   int64 `json:"rate_bytes_s"`
+}
+
+// THPReport is how transparent huge page backed regions were handled
+type THPReport struct {
+	Policy         string `json:"policy"`
+	AdvisedBytes   int64  `json:"advised_bytes"`
+	SkippedRegions int    `json:"skipped_regions"`
+	SkippedBytes   int64  `json:"skipped_bytes"`
+}
+
+// ObservationReport is the memory of a target sampled after advice
+type ObservationReport struct {
+	IntervalMS int64          `json:"interval_ms"`
+	Samples    []SampleReport `json:"samples"`
+}
+
+// SampleReport is one observation sample
+type SampleReport struct {
+	ElapsedMS int64 `json:"elapsed_ms"` // Since advice finished
+	RSS       int64 `json:"rss"`
+	Swap      int64 `json:"swap"`
+	LazyFree  int64 `json:"lazy_free"`
+}
+
+// RefaultReport is how much of the advised memory was faulted back in.
+// The cgroup counters are left out without a cgroup v2 memory controller.
+type RefaultReport struct {
+	MajorFaults       int64   `json:"major_faults"`
+	Ratio             float64 `json:"ratio"` // Refaulted bytes over advised bytes
+	CgroupRefaultAnon *int64  `json:"cgroup_refault_anon,omitempty"`
+	CgroupRefaultFile *int64  `json:"cgroup_refault_file,omitempty"`
+}
+
+// AccessReport is the permission preflight of a target that can't be
+// advised, or that can with notes
+type AccessReport struct {
+	Allowed  bool                  `json:"allowed"`
+	Problems []AccessProblemReport `json:"problems"`
+	Notes    []string              `json:"notes"`
+}
+
+// AccessProblemReport is a reason a target can't be advised
+type AccessProblemReport struct {
+	Check  string `json:"check"`
+	Reason string `json:"reason"`
+	Fix    string `json:"fix"`
+}
+
+// RollbackReport is a pageout the daemon read back in after the target's
+// major faults spiked
+type RollbackReport struct {
+	Rule          string    `json:"rule"`
+	FaultRate     float64   `json:"fault_rate"` // Rise in major faults per second since the pageout that triggered it
+	Ranges        int       `json:"ranges"`
+	RestoredBytes int64     `json:"restored_bytes"`
+	HotUntil      time.Time `json:"hot_until"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// StateReport is what the daemon remembers about a process
+type StateReport struct {
+	LastAdvised      *time.Time `json:"last_advised,omitempty"`
+	LastAdvisedBytes int64      `json:"last_advised_bytes"`
+	LastRSS          int64      `json:"last_rss"`
+	RefaultRate      float64    `json:"refault_rate"`
+	RefaultRatio     float64    `json:"refault_ratio"`
+	BudgetScale      float64    `json:"budget_scale"`
+	HotUntil         *time.Time `json:"hot_until,omitempty"`
+}
+
+// ConditionsReport is the evaluation of the --when-* conditions
+type ConditionsReport struct {
+	Results     []ConditionResult `json:"results"`
+	BudgetScale float64           `json:"budget_scale"`
+}
+
+// ConditionResult is a single evaluated condition
+type ConditionResult struct {
+	Condition string  `json:"condition"`
+	Met       bool    `json:"met"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+}
+
+// SwapReport is the swap state found before a pageout
+type SwapReport struct {
+	Devices     int      `json:"devices"`
+	Total       int64    `json:"total"`
+	Free        int64    `json:"free"`
+	Reserve     int64    `json:"reserve"`
+	Headroom    int64    `json:"headroom"`
+	Zswap       bool     `json:"zswap"`
+	ZramDevices []string `json:"zram_devices"`
+}
+
+// TriggerReport is the trigger event a daemon evaluation responded to
+type TriggerReport struct {
+	Rule         string `json:"rule"`
+	Event        string `json:"event"`
+	Source       string `json:"source"`
+	Count        int64  `json:"count"`
+	Targets      int    `json:"targets"`
+	Reclaimed    int    `json:"reclaimed"`
+	AdvisedBytes int64  `json:"advised_bytes"`
+	Failed       int    `json:"failed"`
+}
+
+// TotalBudgetReport is the result of distributing a total budget
+type TotalBudgetReport struct {
+	Requested    int64  `json:"requested"`
+	Allocated    int64  `json:"allocated"`
+	AdvisedBytes int64  `json:"advised_bytes"`
+	Targets      int    `json:"targets"`
+	Distribution string `json:"distribution"`
+	DryRun       bool   `json:"dry_run"`
+}
+
+// EvaluationReport is a rule condition evaluated for a process
+type EvaluationReport struct {
+	Rule      string             `json:"rule"`
+	PID       int                `json:"pid"`
+	Comm      string             `json:"comm"`
+	Condition string             `json:"condition"`
+	Met       bool               `json:"met"`
+	Values    map[string]float64 `json:"values"`
+	Error     string             `json:"error,omitempty"`
+}
+
+// VariableReport is a variable available in conditions
+type VariableReport struct {
+	Name string `json:"name"`
+	Unit string `json:"unit"`
+	Help string `json:"help"`
+}
+
+// DaemonReport is the status of a running daemon
+type DaemonReport struct {
+	PID      int       `json:"pid"`
+	Started  time.Time `json:"started"`
+	Interval string    `json:"interval"`
+	Rules    []string  `json:"rules"`
+	Targets  int       `json:"targets"`
+}
+
+// Message is a log message emitted during the run
+type Message struct {
+	Level   string    `json:"level"` // "info", "warning" or "error"
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// newReport starts an empty report
+func newReport(now time.Time) *Report {
+	return &Report{
+		Version:  ReportVersion,
+		Started:  now,
+		Targets:  []*TargetReport{},
+		Messages: []Message{},
+	}
+}
+
+// empty reports whether nothing was recorded
+func (r *Report) empty() bool {
+	return len(r.Targets) == 0 && len(r.Messages) == 0 && r.Conditions == nil && r.Swap == nil &&
+		r.Trigger == nil && r.TotalBudget == nil && r.Evaluations == nil && r.Variables == nil && r.Daemon == nil &&
+		r.History == nil && r.Features == nil
+}
+
+// record runs fn on the report while holding the lock
+func (o *OutputManager) record(fn func(r *Report)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	fn(o.report)
+}
+
+// recordTarget runs fn on the report of pid, creating it if needed
+func (o *OutputManager) recordTarget(pid int, fn func(t *TargetReport)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.now()
+	var target *TargetReport
+	for _, t := range o.report.Targets {
+		if t.PID == pid {
+			target = t
+			break
+		}
+	}
+	if target == nil {
+		target = &TargetReport{PID: pid, Started: now}
+		o.report.Targets = append(o.report.Targets, target)
+	}
+	target.lastEvent = now
+	fn(target)
+}
+
+// Finish ends the run: in JSON mode, the report is written as a single line
+// and a new one is started. Nothing is written if nothing was recorded.
+func (o *OutputManager) Finish() {
+	if !o.json {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	report := o.report
+	o.report = newReport(o.now())
+	if report.empty() {
+		return
+	}
+
+	report.Finished = o.now()
+	report.DurationMS = report.Finished.Sub(report.Started).Milliseconds()
+	for _, t := range report.Targets {
+		t.DurationMS = t.lastEvent.Sub(t.Started).Milliseconds()
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		fmt.Fprintf(o.stderr, "Error marshaling JSON: %v\n", err)
+		return
+	}
+	fmt.Fprintf(o.stdout, "%s\n", data)
+}
+
+// newStatsReport converts memory stats for the report
+func newStatsReport(stats *inspector.MemoryStats) *StatsReport {
+	return &StatsReport{
+		RSS:        stats.TotalRSS,
+		Swap:       stats.TotalSwap,
+		Size:       stats.TotalSize,
+		Shared:     stats.Shared,
+		Private:    stats.Private,
+		Anon:       stats.Anon,
+		LazyFree:   stats.LazyFree,
+		SwapPSS:    stats.SwapPSS,
+		HugetlbRSS: stats.HugetlbRSS,
+	}
+}
+
+// newRegionReport converts a region for the report
+func newRegionReport(region syscall.MemoryRegion, outcome string) RegionReport {
+	return RegionReport{
+		Start:   fmt.Sprintf("0x%x", region.Start),
+		End:     fmt.Sprintf("0x%x", region.End),
+		Size:    region.Size,
+		Path:    region.Path,
+		RSS:     region.Rss,
+		THP:     region.AnonHugePages,
+		Outcome: outcome,
+		start:   region.Start,
+		end:     region.End,
+	}
+}
@@ -0,0 +1,387 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zouuup/memadvise/internal/expr"
+	"github.com/zouuup/memadvise/internal/features"
+	"github.com/zouuup/memadvise/internal/gate"
+	"github.com/zouuup/memadvise/internal/history"
+	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/syscall"
+	"github.com/zouuup/memadvise/internal/sysinfo"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// newTestOutput returns a JSON OutputManager writing to buf, with a clock
+// that advances 10ms every time it is read
+func newTestOutput(buf *bytes.Buffer) *OutputManager {
+	clock := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	o := New(false, true)
+	o.stdout, o.stderr = buf, buf
+	o.now = func() time.Time {
+		clock = clock.Add(10 * time.Millisecond)
+		return clock
+	}
+	o.report = newReport(o.now())
+	return o
+}
+
+func TestReport(t *testing.T) {
+	stats := &inspector.MemoryStats{TotalRSS: 64 << 20, Anon: 48 << 20, Private: 56 << 20, TotalSize: 256 << 20}
+	after := &inspector.MemoryStats{TotalRSS: 40 << 20, Anon: 24 << 20, Private: 32 << 20, TotalSize: 256 << 20}
+	heap := syscall.MemoryRegion{Start: 0x1000000, End: 0x2000000, Size: 16 << 20, Rss: 12 << 20}
+	mapped := syscall.MemoryRegion{Start: 0x7f0000000000, End: 0x7f0000800000, Size: 8 << 20, Path: "/tmp/cache", AnonHugePages: 2 << 20}
+
+	testCases := []struct {
+		name string
+		run  func(o *OutputManager)
+	}{
+		{
+			name: "reclaim",
+			run: func(o *OutputManager) {
+				o.GateResults([]gate.Result{{Condition: "psi some avg10", Met: true, Value: 12.5, Threshold: 10}}, 1)
+				o.SwapPreflight(&sysinfo.SwapStatus{SwapTotal: 8 << 30, SwapFree: 6 << 30}, 1<<30, 5<<30)
+				o.TargetIdentity(&inspector.Identity{PID: 100, Comm: "worker", Exe: "/usr/bin/worker", Cgroup: "/app.slice", StartTime: 4242})
+				o.MemoryStatsBefore(100, stats)
+				o.SelectedRegion(100, heap)
+				o.SelectedRegion(100, mapped)
+				// The first region is split across two batches
+				o.BatchResult(100, []syscall.MemoryRegion{{Start: 0x1000000, End: 0x1800000}}, nil)
+				o.BatchResult(100, []syscall.MemoryRegion{{Start: 0x1800000, End: 0x2000000}}, nil)
+				o.BatchResult(100, []syscall.MemoryRegion{mapped}, errors.New("process_madvise syscall failed: invalid argument"))
+				o.SummaryResults(100, 16<<20, 24<<20, 2, 2, "pageout")
+				o.THPResults(100, "split", 2<<20, 0, 0)
+				o.PacingResults(100, 3, 16<<20, 200*time.Millisecond, 0, time.Second)
+				o.TargetError(100, "Failed to execute advice on PID 100: invalid argument")
+				o.MemoryStatsBefore(200, stats)
+				o.TargetSkipped(200, "condition not met")
+				o.TargetError(300, "PID 300 does not exist or is not accessible")
+				o.TotalBudget(64<<20, 32<<20, 16<<20, 1, "proportional", false)
+				o.Warning("no swap device or zram swap is active")
+			},
+		},
+		{
+			name: "access",
+			run: func(o *OutputManager) {
+				o.TargetAccess(&inspector.Access{PID: 100})
+				o.TargetAccess(&inspector.Access{
+					PID: 200,
+					Problems: []inspector.AccessProblem{{
+						Check:  inspector.CheckPtrace,
+						Reason: "PID 200 runs as uid 1000 gid 1000 and memadvise as uid 1001 gid 1001, without CAP_SYS_PTRACE",
+						Fix:    "run memadvise as uid 1000 or as root, or grant it CAP_SYS_PTRACE",
+					}},
+					Notes: []string{"Yama ptrace_scope is 1; it only restricts attaching to processes, not the read access process_madvise needs"},
+				})
+			},
+		},
+		{
+			name: "iterative",
+			run: func(o *OutputManager) {
+				o.MemoryStatsBefore(100, stats)
+				o.SelectedRegion(100, heap)
+				o.BatchResult(100, []syscall.MemoryRegion{heap}, nil)
+				o.IterationRound(100, 1, 16<<20, 16<<20, 48<<20, 16<<20, 24<<20, 500*time.Millisecond)
+				o.SelectedRegion(100, mapped)
+				o.BatchResult(100, []syscall.MemoryRegion{mapped}, nil)
+				o.IterationRound(100, 2, 8<<20, 8<<20, 40<<20, 24<<20, 24<<20, time.Second)
+				o.IterationSummary(100, 24<<20, 24<<20, 24<<20, 2, "goal reached")
+				o.MemoryStatsAfter(100, after, stats)
+			},
+		},
+		{
+			name: "observe",
+			run: func(o *OutputManager) {
+				o.MemoryStatsAfter(100, after, stats)
+				o.Observation(100, time.Second, []Sample{
+					{Elapsed: 0, RSS: 40 << 20, LazyFree: 24 << 20},
+					{Elapsed: time.Second, RSS: 32 << 20, LazyFree: 16 << 20},
+					{Elapsed: 2 * time.Second, RSS: 24 << 20, Swap: 1 << 20},
+				})
+				o.Refaults(100, 256, 0.04, 128, 64)
+				o.Refaults(200, 0, 0, -1, -1)
+			},
+		},
+		{
+			name: "dry-run",
+			run: func(o *OutputManager) {
+				o.MemoryStatsBefore(100, stats)
+				o.DryRun(100, 32<<20, "cold", 7)
+			},
+		},
+		{
+			name: "trigger",
+			run: func(o *OutputManager) {
+				o.Info(`rule "web": PID 100 in cooldown until 2024-05-01T12:05:00Z`)
+				o.TriggerOutcome("web", "psi", "/sys/fs/cgroup/web/memory.pressure", 0, 1, 0, 0, 0)
+				o.Rollback("web", 200, 850.5, 3, 96<<20, time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC), nil)
+			},
+		},
+		{
+			name: "client",
+			run: func(o *OutputManager) {
+				o.ProcessInspection(100, "worker", stats, 48<<20, 12)
+				o.ReclaimPlan(100, "cold", 16<<20, []syscall.MemoryRegion{heap})
+				o.RequestResult(200, "willneed", 8<<20, 32<<20, 40<<20)
+				o.DaemonStatus(1, time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC), "30s", []string{"web"}, 2)
+				o.DaemonTarget(300, "web", time.Date(2024, 5, 1, 11, 30, 0, 0, time.UTC), 16<<20, 40<<20, 1.5, 0.3, 0.5, time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC))
+				o.DaemonTarget(400, "idle", time.Time{}, 0, 0, 0, 0, 1, time.Time{})
+			},
+		},
+		{
+			name: "history",
+			run: func(o *OutputManager) {
+				advised := time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC)
+				hotUntil := advised.Add(2 * time.Hour)
+				o.HistoryTarget(&history.Target{
+					Key:  history.Key{Exe: "/usr/bin/worker", CmdlineHash: "5d41402abc4b2a76", StartTime: 4242, BootID: "b1"},
+					PID:  100,
+					Comm: "worker",
+					Records: []history.Record{
+						{Time: advised.Add(-time.Hour), Source: "reclaim", Mode: "cold", Requested: 16 << 20, Advised: 16 << 20},
+						{
+							Time: advised, Source: "rule web", Mode: "pageout", Requested: 32 << 20, Advised: 24 << 20,
+							RSSBefore: 64 << 20, RSSAfter: 40 << 20, Ranges: []history.Range{{Start: 0x1000000, End: 0x2800000}},
+							MajorFaults: 4096, RefaultRatio: 0.67,
+						},
+						{
+							Time: advised.Add(time.Hour), Source: "rollback", Mode: "willneed", Advised: 24 << 20,
+							Ranges: []history.Range{{Start: 0x1000000, End: 0x2800000}}, HotUntil: &hotUntil,
+						},
+					},
+				}, 2)
+			},
+		},
+		{
+			name: "doctor",
+			run: func(o *OutputManager) {
+				o.Features(&features.Report{
+					Kernel: "6.8.0",
+					BootID: "0d5d4ea0-6b3c-4f4e-9a43-0c7b8a1f7e52",
+					Probed: time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC),
+					Modes: map[string]features.ModeProbe{
+						"cold":     {Status: features.Supported},
+						"pageout":  {Status: features.Supported},
+						"willneed": {Status: features.Unsupported, Error: "willneed: not supported by this kernel"},
+					},
+					SmapsRollup: true,
+					THP:         "madvise",
+					THPDefrag:   "madvise",
+					Swap:        features.Swap{Devices: 1, Total: 8 << 30, Zswap: true, ZswapCompressor: "zstd", ZramDevices: []string{}},
+					MGLRU:       "0x0007",
+					Cgroup:      features.Cgroup{V2: true, Controllers: []string{"cpu", "io", "memory"}},
+					PSI:         []string{"cpu", "io", "memory"},
+				})
+			},
+		},
+		{
+			name: "policy",
+			run: func(o *OutputManager) {
+				o.PolicyEvaluation("web", 100, "worker", "rss > 1G", false, expr.Env{"rss": 64 << 20}, nil)
+				o.PolicyEvaluation("web", 200, "worker", "idle_for > 10m", false, nil, errors.New("process exited"))
+				o.PolicyVariables([]expr.Variable{{Name: "rss", Unit: "bytes", Help: "Resident memory"}})
+			},
+		},
+	}
+
+	var schema map[string]interface{}
+	if err := json.Unmarshal(Schema, &schema); err != nil {
+		t.Fatalf("invalid schema: %v", err)
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			o := newTestOutput(&buf)
+			tc.run(o)
+			o.Finish()
+
+			if strings.Count(buf.String(), "\n") != 1 {
+				t.Fatalf("Finish() wrote %q, want a single line", buf.String())
+			}
+
+			var doc interface{}
+			decoder := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+			decoder.UseNumber()
+			if err := decoder.Decode(&doc); err != nil {
+				t.Fatalf("Finish() wrote invalid JSON: %v", err)
+			}
+			if err := validate(schema, schema, doc, "$"); err != nil {
+				t.Errorf("report does not match the schema: %v", err)
+			}
+
+			var indented bytes.Buffer
+			json.Indent(&indented, buf.Bytes(), "", "  ")
+
+			golden := filepath.Join("testdata", tc.name+".json")
+			if *update {
+				if err := os.WriteFile(golden, indented.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("missing golden file, run with -update: %v", err)
+			}
+			if indented.String() != string(want) {
+				t.Errorf("report =\n%s\nwant\n%s", indented.String(), want)
+			}
+		})
+	}
+}
+
+func TestFinish(t *testing.T) {
+	var buf bytes.Buffer
+	o := newTestOutput(&buf)
+
+	o.Finish()
+	if buf.Len() != 0 {
+		t.Errorf("Finish() of an empty run wrote %q", buf.String())
+	}
+
+	o.Info("first")
+	o.Finish()
+	o.Info("second")
+	o.Finish()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Finish() wrote %d documents, want 2", len(lines))
+	}
+	if strings.Contains(lines[1], "first") {
+		t.Errorf("second document repeats the first run: %s", lines[1])
+	}
+}
+
+func TestText(t *testing.T) {
+	var buf bytes.Buffer
+	o := New(true, false)
+	o.stdout, o.stderr = &buf, &buf
+
+	o.TargetIdentity(&inspector.Identity{PID: 100, Comm: "worker"})
+	o.BatchResult(100, nil, nil)
+	o.TargetSkipped(100, "condition not met")
+	o.TargetError(200, "PID 200 does not exist")
+	o.TargetAccess(&inspector.Access{PID: 300, Problems: []inspector.AccessProblem{{Reason: "no CAP_SYS_NICE", Fix: "run as root"}}})
+	o.Finish()
+
+	want := "PID 100 skipped: condition not met\nError: PID 200 does not exist\n" +
+		"Error: PID 300 cannot be advised:\n  - no CAP_SYS_NICE\n    Fix: run as root\n"
+	if buf.String() != want {
+		t.Errorf("text output = %q, want %q", buf.String(), want)
+	}
+}
+
+// validate checks value against the subset of JSON Schema the report schema
+// uses: type, properties, required, additionalProperties, items, enum,
+// pattern and local $refs
+func validate(root, schema map[string]interface{}, value interface{}, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/$defs/")
+		def, ok := root["$defs"].(map[string]interface{})[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: unknown $ref %s", path, ref)
+		}
+		return validate(root, def, value, path)
+	}
+
+	if kind, ok := schema["type"].(string); ok && !hasType(value, kind) {
+		return fmt.Errorf("%s: %v is not of type %s", path, value, kind)
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+		}
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok {
+		if !regexp.MustCompile(pattern).MatchString(value.(string)) {
+			return fmt.Errorf("%s: %q does not match %s", path, value, pattern)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range requiredOf(schema) {
+			if _, ok := v[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing %s", path, name)
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, field := range v {
+			if property, ok := properties[name].(map[string]interface{}); ok {
+				if err := validate(root, property, field, path+"."+name); err != nil {
+					return err
+				}
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					return fmt.Errorf("%s: unexpected property %s", path, name)
+				}
+			case map[string]interface{}:
+				if err := validate(root, extra, field, path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validate(root, items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// requiredOf returns the required properties of an object schema
+func requiredOf(schema map[string]interface{}) []interface{} {
+	required, _ := schema["required"].([]interface{})
+	return required
+}
+
+// hasType reports whether a value decoded with UseNumber is of a JSON Schema type
+func hasType(value interface{}, kind string) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return kind == "object"
+	case []interface{}:
+		return kind == "array"
+	case string:
+		return kind == "string"
+	case bool:
+		return kind == "boolean"
+	case json.Number:
+		if kind == "number" {
+			return true
+		}
+		_, err := v.Int64()
+		return kind == "integer" && err == nil
+	}
+	return false
+}
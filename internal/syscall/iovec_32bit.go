@@ -0,0 +1,16 @@
+//go:build linux && (386 || arm || mips || mipsle)
+
+package syscall
+
+// Iovec is the struct iovec passed to process_madvise on 32-bit
+// architectures, where size_t is 32 bits wide
+type Iovec struct {
+	Base uintptr
+	Len  uint32
+}
+
+// newIovec returns the iovec for the addresses from start up to end, which
+// ProcessMadvise has checked fit in 32 bits
+func newIovec(start, end uint64) Iovec {
+	return Iovec{Base: uintptr(start), Len: uint32(end - start)}
+}
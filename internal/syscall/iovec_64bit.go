@@ -0,0 +1,15 @@
+//go:build linux && (amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64 || s390x)
+
+package syscall
+
+// Iovec is the struct iovec passed to process_madvise on 64-bit
+// architectures, where size_t is 64 bits wide
+type Iovec struct {
+	Base uintptr
+	Len  uint64
+}
+
+// newIovec returns the iovec for the addresses from start up to end
+func newIovec(start, end uint64) Iovec {
+	return Iovec{Base: uintptr(start), Len: end - start}
+}
@@ -1,27 +1,58 @@
 package syscall
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"syscall"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
-// Constants for madvise modes and syscall numbers
-const (
-	MADV_COLD    = 20
-	MADV_PAGEOUT = 21
+// The syscall numbers and advice values come from golang.org/x/sys/unix,
+// which defines them for each architecture. Iovec, whose layout differs
+// between 32-bit and 64-bit architectures, is defined in iovec_*.go.
 
-	SYS_PIDFD_OPEN      = 434 // syscall number for pidfd_open
-	SYS_PROCESS_MADVISE = 440 // syscall number for process_madvise
+// iovMax is the most iovecs the kernel accepts in one call (UIO_MAXIOV)
+const iovMax = 1024
+
+// Kinds of failure, matched with errors.Is. The inspector and advisor wrap
+// them too, so callers can tell why a target failed.
+var (
+	ErrNoProcess   = errors.New("process does not exist")
+	ErrPermission  = errors.New("permission denied")
+	ErrUnsupported = errors.New("not supported by this kernel")
 )
 
-// Iovec represents the structure passed to the process_madvise syscall
-type Iovec struct {
-	Base uintptr
-	Len  uint64
+// Error is a failed pidfd_open or process_madvise call
+type Error struct {
+	Op    string // Name of the syscall
+	PID   int
+	Errno syscall.Errno
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s syscall failed for process %d: %v", e.Op, e.PID, e.Errno)
+}
+
+// Unwrap returns the errno
+func (e *Error) Unwrap() error {
+	return e.Errno
+}
+
+// Is reports whether the errno is of the kind target
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNoProcess:
+		return e.Errno == syscall.ESRCH
+	case ErrPermission:
+		return e.Errno == syscall.EPERM || e.Errno == syscall.EACCES
+	case ErrUnsupported:
+		return e.Errno == syscall.ENOSYS
+	}
+	return false
 }
 
 // MemoryRegion represents a mapped memory region with its properties
@@ -35,6 +66,10 @@ type MemoryRegion struct {
 	Writable   bool
 	Executable bool
 	Path       string
+
+	// Populated from /proc/[pid]/smaps when available
+	Rss           uint64 // Resident bytes in the region
+	AnonHugePages uint64 // Bytes backed by transparent huge pages
 }
 
 // OpenPidfd opens a file descriptor for the specified process
@@ -43,13 +78,13 @@ func OpenPidfd(pid int) (int, error) {
 	procPath := fmt.Sprintf("/proc/%d", pid)
 	_, err := os.Stat(procPath)
 	if err != nil {
-		return -1, fmt.Errorf("process %d does not exist: %w", pid, err)
+		return -1, fmt.Errorf("process %d: %w", pid, ErrNoProcess)
 	}
 
 	// Direct syscall for pidfd_open
-	r1, _, errno := syscall.Syscall(SYS_PIDFD_OPEN, uintptr(pid), 0, 0)
+	r1, _, errno := syscall.Syscall(unix.SYS_PIDFD_OPEN, uintptr(pid), 0, 0)
 	if errno != 0 {
-		return -1, fmt.Errorf("failed to open pidfd for process %d: %w", pid, errno)
+		return -1, &Error{Op: "pidfd_open", PID: pid, Errno: errno}
 	}
 
 	return int(r1), nil
@@ -67,69 +102,104 @@ func ProcessMadvise(pid int, regions []MemoryRegion, mode string) (int64, error)
 	var adviceVal int
 	switch mode {
 	case "cold":
-		adviceVal = MADV_COLD
+		adviceVal = unix.MADV_COLD
 	case "pageout":
-		adviceVal = MADV_PAGEOUT
+		adviceVal = unix.MADV_PAGEOUT
+	case "willneed":
+		adviceVal = unix.MADV_WILLNEED
 	default:
 		return 0, fmt.Errorf("invalid mode: %s", mode)
 	}
 
-	// Create iovecs from memory regions
-	iovecs := make([]Iovec, 0, len(regions))
+	// A 32-bit memadvise can only address the memory of 32-bit processes
 	for _, region := range regions {
-		iovec := Iovec{
-			Base: uintptr(region.Start),
-			Len:  uint64(region.End - region.Start),
+		if last := region.End - 1; uint64(uintptr(last)) != last {
+			return 0, fmt.Errorf("region %#x-%#x of process %d is beyond the %d-bit address space of memadvise: %w",
+				region.Start, region.End, pid, 8*unsafe.Sizeof(uintptr(0)), ErrUnsupported)
 		}
-		iovecs = append(iovecs, iovec)
 	}
 
-	// Apply the advice directly using the syscall
-	r1, _, errno := syscall.Syscall6(
-		SYS_PROCESS_MADVISE,
-		uintptr(pidfd),
-		uintptr(unsafe.Pointer(&iovecs[0])),
-		uintptr(len(iovecs)),
-		uintptr(adviceVal),
-		0,
-		0,
-	)
+	// Create iovecs from memory regions, merging contiguous ones
+	iovecs := CoalesceRegions(regions)
 
-	if errno != 0 {
-		return 0, fmt.Errorf("process_madvise syscall failed: %w", errno)
+	// Apply the advice directly using the syscall, at most iovMax iovecs at
+	// a time since the kernel rejects longer vectors with EINVAL
+	var advised int64
+	for len(iovecs) > 0 {
+		n := len(iovecs)
+		if n > iovMax {
+			n = iovMax
+		}
+		r1, _, errno := syscall.Syscall6(
+			unix.SYS_PROCESS_MADVISE,
+			uintptr(pidfd),
+			uintptr(unsafe.Pointer(&iovecs[0])),
+			uintptr(n),
+			uintptr(adviceVal),
+			0,
+			0,
+		)
+		if errno != 0 {
+			return advised, &Error{Op: "process_madvise", PID: pid, Errno: errno}
+		}
+		advised += int64(r1)
+		iovecs = iovecs[n:]
 	}
 
-	return int64(r1), nil
+	return advised, nil
 }
 
-// SupportsProcessMadvise checks if the system supports the process_madvise syscall
-func SupportsProcessMadvise() bool {
-	// Try opening a pidfd for the current process
-	pidfd, err := OpenPidfd(os.Getpid())
-	if err != nil {
-		return false
+// CoalesceRegions builds the iovecs for the given regions, merging regions
+// that are adjacent or overlap in the target's address space into a single
+// iovec, so no memory is covered twice. The input slice is not modified.
+func CoalesceRegions(regions []MemoryRegion) []Iovec {
+	if len(regions) == 0 {
+		return nil
 	}
-	defer syscall.Close(pidfd)
 
-	// Create a dummy iovec for testing
-	data := make([]byte, unix.Getpagesize())
-	iovec := []Iovec{
-		{
-			Base: uintptr(unsafe.Pointer(&data[0])),
-			Len:  uint64(len(data)),
-		},
+	sorted := make([]MemoryRegion, len(regions))
+	copy(sorted, regions)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	iovecs := make([]Iovec, 0, len(sorted))
+	start, end := sorted[0].Start, sorted[0].End
+	for _, region := range sorted[1:] {
+		if region.Start <= end {
+			if region.End > end {
+				end = region.End
+			}
+			continue
+		}
+		iovecs = append(iovecs, newIovec(start, end))
+		start, end = region.Start, region.End
 	}
+	iovecs = append(iovecs, newIovec(start, end))
+
+	return iovecs
+}
 
-	// Try the syscall
-	_, _, errno := syscall.Syscall6(
-		SYS_PROCESS_MADVISE,
-		uintptr(pidfd),
-		uintptr(unsafe.Pointer(&iovec[0])),
-		uintptr(len(iovec)),
-		uintptr(MADV_COLD),
-		0,
-		0,
-	)
-
-	return errno == 0
+// ProbeMode advises a scratch page of memadvise's own memory with mode, to
+// find out whether the kernel supports it. The error matches ErrUnsupported
+// if the kernel lacks process_madvise or the mode, and ErrPermission if
+// memadvise may not advise even itself.
+func ProbeMode(mode string) error {
+	data, err := unix.Mmap(-1, 0, unix.Getpagesize(), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return fmt.Errorf("failed to map a scratch page: %w", err)
+	}
+	defer unix.Munmap(data)
+	data[0] = 1 // Fault the page in
+
+	start := uint64(uintptr(unsafe.Pointer(&data[0])))
+	region := MemoryRegion{Start: start, End: start + uint64(len(data)), Size: uint64(len(data))}
+	_, err = ProcessMadvise(os.Getpid(), []MemoryRegion{region}, mode)
+
+	// The kernel rejects advice it doesn't support with EINVAL
+	var sysErr *Error
+	if errors.As(err, &sysErr) && sysErr.Errno == syscall.EINVAL {
+		return fmt.Errorf("%s: %w", mode, ErrUnsupported)
+	}
+	return err
 }
@@ -1,8 +1,15 @@
 package syscall
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
+	"syscall"
 	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestPidExists(t *testing.T) {
@@ -17,8 +24,34 @@ func TestPidExists(t *testing.T) {
 	// Invalid PID should not exist
 	invalidPID := 999999999
 	_, err = OpenPidfd(invalidPID)
-	if err == nil {
-		t.Errorf("OpenPidfd(%d) should have failed for non-existent PID", invalidPID)
+	if !errors.Is(err, ErrNoProcess) {
+		t.Errorf("OpenPidfd(%d) = %v, want ErrNoProcess", invalidPID, err)
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	testCases := []struct {
+		errno syscall.Errno
+		want  error
+	}{
+		{syscall.ESRCH, ErrNoProcess},
+		{syscall.EPERM, ErrPermission},
+		{syscall.EACCES, ErrPermission},
+		{syscall.ENOSYS, ErrUnsupported},
+		{syscall.EINVAL, nil},
+	}
+
+	for _, tc := range testCases {
+		err := fmt.Errorf("wrapped: %w", &Error{Op: "process_madvise", PID: 1, Errno: tc.errno})
+		for _, kind := range []error{ErrNoProcess, ErrPermission, ErrUnsupported} {
+			if got := errors.Is(err, kind); got != (kind == tc.want) {
+				t.Errorf("errors.Is(%v, %v) = %t", err, kind, got)
+			}
+		}
+		var errno syscall.Errno
+		if !errors.As(err, &errno) || errno != tc.errno {
+			t.Errorf("errors.As(%v) = %v, want %v", err, errno, tc.errno)
+		}
 	}
 }
 
@@ -55,3 +88,152 @@ func TestMemoryRegion(t *testing.T) {
 		t.Errorf("Expected region not to be executable")
 	}
 }
+
+func TestCoalesceRegions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		regions []MemoryRegion
+		want    []Iovec
+	}{
+		{
+			name:    "no regions",
+			regions: nil,
+			want:    nil,
+		},
+		{
+			name: "single region",
+			regions: []MemoryRegion{
+				{Start: 0x1000, End: 0x3000},
+			},
+			want: []Iovec{{Base: 0x1000, Len: 0x2000}},
+		},
+		{
+			name: "adjacent regions merged",
+			regions: []MemoryRegion{
+				{Start: 0x1000, End: 0x2000},
+				{Start: 0x2000, End: 0x4000},
+				{Start: 0x4000, End: 0x5000},
+			},
+			want: []Iovec{{Base: 0x1000, Len: 0x4000}},
+		},
+		{
+			name: "unsorted regions with a gap",
+			regions: []MemoryRegion{
+				{Start: 0x8000, End: 0x9000},
+				{Start: 0x2000, End: 0x3000},
+				{Start: 0x1000, End: 0x2000},
+			},
+			want: []Iovec{
+				{Base: 0x1000, Len: 0x2000},
+				{Base: 0x8000, Len: 0x1000},
+			},
+		},
+		{
+			name: "overlapping and duplicate regions merged",
+			regions: []MemoryRegion{
+				{Start: 0x1000, End: 0x3000},
+				{Start: 0x2000, End: 0x4000},
+				{Start: 0x1000, End: 0x3000},
+				{Start: 0x2000, End: 0x2800},
+				{Start: 0x6000, End: 0x7000},
+				{Start: 0x6000, End: 0x7000},
+			},
+			want: []Iovec{
+				{Base: 0x1000, Len: 0x3000},
+				{Base: 0x6000, Len: 0x1000},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := CoalesceRegions(tc.regions)
+			if len(got) != len(tc.want) {
+				t.Fatalf("CoalesceRegions() got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("CoalesceRegions()[%d] = %+v, want %+v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProcessMadviseManyRegions(t *testing.T) {
+	if err := ProbeMode("cold"); err != nil {
+		t.Skipf("cold advice unavailable: %v", err)
+	}
+
+	// Every other page of a mapping, so no two regions are merged
+	page := unix.Getpagesize()
+	count := iovMax + iovMax/2
+	data, err := unix.Mmap(-1, 0, 2*count*page, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		t.Fatalf("mmap: %v", err)
+	}
+	defer unix.Munmap(data)
+
+	base := uint64(uintptr(unsafe.Pointer(&data[0])))
+	regions := make([]MemoryRegion, 0, count)
+	for i := 0; i < count; i++ {
+		start := base + uint64(2*i*page)
+		regions = append(regions, MemoryRegion{Start: start, End: start + uint64(page), Size: uint64(page)})
+	}
+	if n := len(CoalesceRegions(regions)); n != count {
+		t.Fatalf("CoalesceRegions() returned %d iovecs, want %d", n, count)
+	}
+
+	advised, err := ProcessMadvise(os.Getpid(), regions, "cold")
+	if err != nil {
+		t.Fatalf("ProcessMadvise() with %d regions: %v", count, err)
+	}
+	if want := int64(count * page); advised != want {
+		t.Errorf("ProcessMadvise() advised %d bytes, want %d", advised, want)
+	}
+}
+
+func TestIovecLayout(t *testing.T) {
+	// unix.Iovec is generated from the kernel headers of each architecture
+	var got Iovec
+	var want unix.Iovec
+	if unsafe.Sizeof(got) != unsafe.Sizeof(want) || unsafe.Offsetof(got.Len) != unsafe.Offsetof(want.Len) ||
+		unsafe.Sizeof(got.Len) != unsafe.Sizeof(want.Len) {
+		t.Errorf("Iovec is %d bytes with a %d-byte Len at %d, want %d bytes with a %d-byte Len at %d",
+			unsafe.Sizeof(got), unsafe.Sizeof(got.Len), unsafe.Offsetof(got.Len),
+			unsafe.Sizeof(want), unsafe.Sizeof(want.Len), unsafe.Offsetof(want.Len))
+	}
+}
+
+func TestCrossCompile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("cross-compiling is slow")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+
+	// Unlike go build, go vet also type-checks the tests of each package
+	for _, arch := range []string{"amd64", "arm64", "riscv64", "386", "arm"} {
+		t.Run(arch, func(t *testing.T) {
+			cmd := exec.Command(goTool, "vet", "github.com/zouuup/memadvise/...")
+			cmd.Env = append(os.Environ(), "GOOS=linux", "GOARCH="+arch, "CGO_ENABLED=0")
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("go vet for linux/%s failed: %v\n%s", arch, err, output)
+			}
+		})
+	}
+}
+
+func TestProbeMode(t *testing.T) {
+	for _, mode := range []string{"cold", "pageout", "willneed"} {
+		err := ProbeMode(mode)
+		if err != nil && !errors.Is(err, ErrUnsupported) && !errors.Is(err, ErrPermission) {
+			t.Errorf("ProbeMode(%s) = %v, want nil, ErrUnsupported or ErrPermission", mode, err)
+		}
+	}
+	if err := ProbeMode("free"); err == nil {
+		t.Error("ProbeMode() accepted an invalid mode")
+	}
+}
@@ -0,0 +1,133 @@
+package sysinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CgroupRoot is where the unified (v2) cgroup hierarchy is mounted
+const CgroupRoot = "/sys/fs/cgroup"
+
+// Unlimited is reported for memory limits set to "max"
+const Unlimited = math.MaxInt64
+
+// CgroupMemory contains the memory controller files of a cgroup v2 group
+type CgroupMemory struct {
+	Current     int64 // memory.current
+	High        int64 // memory.high; Unlimited if not set
+	Max         int64 // memory.max; Unlimited if not set
+	SwapCurrent int64 // memory.swap.current
+	Anon        int64 // anon from memory.stat
+	File        int64 // file from memory.stat
+	RefaultAnon int64 // workingset_refault_anon from memory.stat, in pages
+	RefaultFile int64 // workingset_refault_file from memory.stat, in pages
+}
+
+// CgroupPath returns the sysfs directory of a cgroup path such as
+// /system.slice/foo.service
+func CgroupPath(cgroup string) string {
+	return filepath.Join(CgroupRoot, cgroup)
+}
+
+// ReadCgroupMemory reads the memory controller files of cgroup. It fails if
+// the group has no memory.current, e.g. for the root group or on cgroup v1.
+func ReadCgroupMemory(cgroup string) (*CgroupMemory, error) {
+	dir := CgroupPath(cgroup)
+
+	current, err := readCgroupValue(filepath.Join(dir, "memory.current"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cgroup memory usage: %w", err)
+	}
+
+	mem := &CgroupMemory{Current: current, High: Unlimited, Max: Unlimited}
+	if value, err := readCgroupValue(filepath.Join(dir, "memory.high")); err == nil {
+		mem.High = value
+	}
+	if value, err := readCgroupValue(filepath.Join(dir, "memory.max")); err == nil {
+		mem.Max = value
+	}
+	if value, err := readCgroupValue(filepath.Join(dir, "memory.swap.current")); err == nil {
+		mem.SwapCurrent = value
+	}
+
+	if file, err := os.Open(filepath.Join(dir, "memory.stat")); err == nil {
+		defer file.Close()
+		stat, err := parseKeyedFile(file)
+		if err != nil {
+			return nil, err
+		}
+		mem.Anon = stat["anon"]
+		mem.File = stat["file"]
+		mem.RefaultAnon = stat["workingset_refault_anon"]
+		mem.RefaultFile = stat["workingset_refault_file"]
+		if refaults, ok := stat["workingset_refault"]; ok {
+			// Kernels before 5.9 don't split refaults by type
+			mem.RefaultFile = refaults
+		}
+	}
+
+	return mem, nil
+}
+
+// ReadCgroupEvents reads a memory.events file into a map of event counts,
+// e.g. "high" and "max"
+func ReadCgroupEvents(path string) (map[string]int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cgroup events: %w", err)
+	}
+	defer file.Close()
+
+	return parseKeyedFile(file)
+}
+
+// readCgroupValue reads a single-value cgroup file, mapping "max" to Unlimited
+func readCgroupValue(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return parseCgroupValue(string(data))
+}
+
+func parseCgroupValue(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "max" {
+		return Unlimited, nil
+	}
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cgroup value '%s'", s)
+	}
+	return value, nil
+}
+
+// parseKeyedFile parses "key value" lines such as memory.stat or memory.events
+func parseKeyedFile(r io.Reader) (map[string]int64, error) {
+	values := make(map[string]int64)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) != 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[parts[0]] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading cgroup file: %w", err)
+	}
+
+	return values, nil
+}
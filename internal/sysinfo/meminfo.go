@@ -0,0 +1,67 @@
+package sysinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Meminfo contains the system-wide memory counters used by memadvise
+type Meminfo struct {
+	MemTotal     int64 // Total usable RAM in bytes
+	MemAvailable int64 // Estimated memory available without swapping
+	SwapTotal    int64 // Total swap space in bytes
+	SwapFree     int64 // Unused swap space in bytes
+}
+
+// ReadMeminfo reads /proc/meminfo
+func ReadMeminfo() (*Meminfo, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open meminfo: %w", err)
+	}
+	defer file.Close()
+
+	return parseMeminfo(file)
+}
+
+// parseMeminfo parses the contents of /proc/meminfo
+func parseMeminfo(r io.Reader) (*Meminfo, error) {
+	info := &Meminfo{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 2 {
+			continue
+		}
+
+		value, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		// Convert from KB to bytes
+		value *= 1024
+
+		switch parts[0] {
+		case "MemTotal:":
+			info.MemTotal = value
+		case "MemAvailable:":
+			info.MemAvailable = value
+		case "SwapTotal:":
+			info.SwapTotal = value
+		case "SwapFree:":
+			info.SwapFree = value
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading meminfo: %w", err)
+	}
+
+	return info, nil
+}
@@ -0,0 +1,32 @@
+package sysinfo
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// hugePageSizePath holds the size of a PMD-mapped transparent huge page
+const hugePageSizePath = "/sys/kernel/mm/transparent_hugepage/hpage_pmd_size"
+
+// HugePageSize returns the size of a transparent huge page, as read from
+// sysfs. Without THP support it returns the size a PMD maps with base pages
+// of pageSize bytes.
+func HugePageSize(pageSize uint64) uint64 {
+	data, err := os.ReadFile(hugePageSizePath)
+	if err != nil {
+		return pmdSize(pageSize)
+	}
+	size, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || size == 0 {
+		return pmdSize(pageSize)
+	}
+	return size
+}
+
+// pmdSize returns the memory mapped by a PMD entry: a page table fills one
+// page with 8-byte entries, each mapping a page. That is 2 MiB with 4 KiB
+// pages, 32 MiB with 16 KiB pages and 512 MiB with 64 KiB pages.
+func pmdSize(pageSize uint64) uint64 {
+	return pageSize / 8 * pageSize
+}
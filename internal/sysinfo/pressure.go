@@ -0,0 +1,111 @@
+package sysinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PressureLine is one line of a PSI file, e.g. "some avg10=0.00 ..."
+type PressureLine struct {
+	Avg10  float64 // Percentage of time stalled over the last 10 seconds
+	Avg60  float64
+	Avg300 float64
+	Total  uint64 // Total stall time in microseconds
+}
+
+// Pressure holds the "some" and "full" lines of a PSI file
+type Pressure struct {
+	Some PressureLine
+	Full PressureLine
+}
+
+// ReadPressure reads /proc/pressure/<resource> (memory, io or cpu)
+func ReadPressure(resource string) (*Pressure, error) {
+	return ReadPressureFile(fmt.Sprintf("/proc/pressure/%s", resource))
+}
+
+// ReadPressureFile reads a PSI file such as a cgroup's memory.pressure
+func ReadPressureFile(path string) (*Pressure, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pressure file: %w", err)
+	}
+	defer file.Close()
+
+	return parsePressure(file)
+}
+
+// Window returns the average for kind ("some" or "full") over window
+// ("avg10", "avg60" or "avg300")
+func (p *Pressure) Window(kind, window string) (float64, error) {
+	var line PressureLine
+	switch kind {
+	case "some":
+		line = p.Some
+	case "full":
+		line = p.Full
+	default:
+		return 0, fmt.Errorf("invalid pressure kind: %s", kind)
+	}
+
+	switch window {
+	case "avg10":
+		return line.Avg10, nil
+	case "avg60":
+		return line.Avg60, nil
+	case "avg300":
+		return line.Avg300, nil
+	default:
+		return 0, fmt.Errorf("invalid pressure window: %s", window)
+	}
+}
+
+// parsePressure parses the contents of a PSI file
+func parsePressure(r io.Reader) (*Pressure, error) {
+	pressure := &Pressure{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) == 0 {
+			continue
+		}
+
+		var line *PressureLine
+		switch parts[0] {
+		case "some":
+			line = &pressure.Some
+		case "full":
+			line = &pressure.Full
+		default:
+			continue
+		}
+
+		for _, field := range parts[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			switch key {
+			case "avg10":
+				line.Avg10, _ = strconv.ParseFloat(value, 64)
+			case "avg60":
+				line.Avg60, _ = strconv.ParseFloat(value, 64)
+			case "avg300":
+				line.Avg300, _ = strconv.ParseFloat(value, 64)
+			case "total":
+				line.Total, _ = strconv.ParseUint(value, 10, 64)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading pressure file: %w", err)
+	}
+
+	return pressure, nil
+}
@@ -0,0 +1,116 @@
+package sysinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SwapDevice is an active swap area listed in /proc/swaps
+type SwapDevice struct {
+	Filename string
+	Type     string
+	Size     int64 // Size in bytes
+	Used     int64 // Used bytes
+	Priority int
+}
+
+// SwapStatus describes the swap backends available to pageout
+type SwapStatus struct {
+	Devices      []SwapDevice
+	SwapTotal    int64
+	SwapFree     int64
+	ZswapEnabled bool
+	ZramDevices  []string // zram block devices, whether or not used as swap
+}
+
+// ReadSwapStatus collects swap state from /proc/swaps, /proc/meminfo and sysfs
+func ReadSwapStatus() (*SwapStatus, error) {
+	status := &SwapStatus{}
+
+	file, err := os.Open("/proc/swaps")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open swaps file: %w", err)
+	}
+	defer file.Close()
+
+	status.Devices, err = parseSwaps(file)
+	if err != nil {
+		return nil, err
+	}
+
+	meminfo, err := ReadMeminfo()
+	if err != nil {
+		return nil, err
+	}
+	status.SwapTotal = meminfo.SwapTotal
+	status.SwapFree = meminfo.SwapFree
+
+	// zswap is a compressed cache in front of a swap device
+	enabled, err := os.ReadFile("/sys/module/zswap/parameters/enabled")
+	if err == nil {
+		status.ZswapEnabled = strings.TrimSpace(string(enabled)) == "Y"
+	}
+
+	zram, _ := filepath.Glob("/sys/block/zram*")
+	for _, dev := range zram {
+		status.ZramDevices = append(status.ZramDevices, filepath.Base(dev))
+	}
+
+	return status, nil
+}
+
+// HasBackend reports whether any swap area is active
+func (s *SwapStatus) HasBackend() bool {
+	return len(s.Devices) > 0 && s.SwapTotal > 0
+}
+
+// Headroom returns the free swap space left after keeping reserve bytes free
+func (s *SwapStatus) Headroom(reserve int64) int64 {
+	headroom := s.SwapFree - reserve
+	if headroom < 0 {
+		return 0
+	}
+	return headroom
+}
+
+// parseSwaps parses the contents of /proc/swaps
+func parseSwaps(r io.Reader) ([]SwapDevice, error) {
+	var devices []SwapDevice
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 5 || parts[0] == "Filename" {
+			continue // Skip the header and malformed lines
+		}
+
+		size, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		used, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			continue
+		}
+		priority, _ := strconv.Atoi(parts[4])
+
+		devices = append(devices, SwapDevice{
+			Filename: parts[0],
+			Type:     parts[1],
+			Size:     size * 1024, // Convert from KB to bytes
+			Used:     used * 1024,
+			Priority: priority,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading swaps file: %w", err)
+	}
+
+	return devices, nil
+}
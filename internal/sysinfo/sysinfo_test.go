@@ -0,0 +1,147 @@
+package sysinfo
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMeminfo(t *testing.T) {
+	input := `MemTotal:       16303912 kB
+MemFree:         1029384 kB
+MemAvailable:    8123456 kB
+SwapTotal:       2097148 kB
+SwapFree:        1048576 kB
+`
+
+	info, err := parseMeminfo(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseMeminfo() unexpected error: %v", err)
+	}
+
+	if info.MemTotal != 16303912*1024 {
+		t.Errorf("MemTotal = %d, want %d", info.MemTotal, int64(16303912*1024))
+	}
+	if info.MemAvailable != 8123456*1024 {
+		t.Errorf("MemAvailable = %d, want %d", info.MemAvailable, int64(8123456*1024))
+	}
+	if info.SwapFree != 1048576*1024 {
+		t.Errorf("SwapFree = %d, want %d", info.SwapFree, int64(1048576*1024))
+	}
+}
+
+func TestParseSwaps(t *testing.T) {
+	input := `Filename				Type		Size		Used		Priority
+/dev/zram0                              partition	4194300		1024		100
+/swapfile                               file		2097148		0		-2
+`
+
+	devices, err := parseSwaps(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parseSwaps() unexpected error: %v", err)
+	}
+
+	if len(devices) != 2 {
+		t.Fatalf("parseSwaps() got %d devices, want 2", len(devices))
+	}
+	if devices[0].Filename != "/dev/zram0" || devices[0].Size != 4194300*1024 || devices[0].Priority != 100 {
+		t.Errorf("parseSwaps() first device = %+v", devices[0])
+	}
+	if devices[1].Type != "file" || devices[1].Priority != -2 {
+		t.Errorf("parseSwaps() second device = %+v", devices[1])
+	}
+}
+
+func TestSwapHeadroom(t *testing.T) {
+	status := &SwapStatus{
+		Devices:   []SwapDevice{{Filename: "/swapfile"}},
+		SwapTotal: 1000,
+		SwapFree:  400,
+	}
+
+	if !status.HasBackend() {
+		t.Errorf("HasBackend() = false, want true")
+	}
+	if got := status.Headroom(100); got != 300 {
+		t.Errorf("Headroom(100) = %d, want 300", got)
+	}
+	if got := status.Headroom(500); got != 0 {
+		t.Errorf("Headroom(500) = %d, want 0", got)
+	}
+
+	empty := &SwapStatus{}
+	if empty.HasBackend() {
+		t.Errorf("HasBackend() = true for no devices, want false")
+	}
+}
+
+func TestParsePressure(t *testing.T) {
+	input := `some avg10=5.25 avg60=2.10 avg300=0.50 total=123456
+full avg10=1.00 avg60=0.40 avg300=0.10 total=6543
+`
+
+	pressure, err := parsePressure(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parsePressure() unexpected error: %v", err)
+	}
+
+	if pressure.Some.Avg10 != 5.25 || pressure.Some.Total != 123456 {
+		t.Errorf("parsePressure() some = %+v", pressure.Some)
+	}
+
+	got, err := pressure.Window("full", "avg60")
+	if err != nil || got != 0.40 {
+		t.Errorf("Window(full, avg60) = %v, %v, want 0.40", got, err)
+	}
+
+	if _, err := pressure.Window("partial", "avg10"); err == nil {
+		t.Errorf("Window() expected error for invalid kind")
+	}
+}
+
+func TestParseCgroupFiles(t *testing.T) {
+	if got, err := parseCgroupValue("max\n"); err != nil || got != Unlimited {
+		t.Errorf("parseCgroupValue(max) = %d, %v, want Unlimited", got, err)
+	}
+	if got, err := parseCgroupValue("1073741824\n"); err != nil || got != 1<<30 {
+		t.Errorf("parseCgroupValue() = %d, %v, want %d", got, err, 1<<30)
+	}
+	if _, err := parseCgroupValue("lots"); err == nil {
+		t.Errorf("parseCgroupValue() expected error for invalid value")
+	}
+
+	stat, err := parseKeyedFile(strings.NewReader("anon 4096\nfile 8192\nbogus\n"))
+	if err != nil {
+		t.Fatalf("parseKeyedFile() unexpected error: %v", err)
+	}
+	if stat["anon"] != 4096 || stat["file"] != 8192 || len(stat) != 2 {
+		t.Errorf("parseKeyedFile() = %v", stat)
+	}
+}
+
+func TestParseUptime(t *testing.T) {
+	got, err := parseUptime("350735.47 234388.90\n")
+	if err != nil {
+		t.Fatalf("parseUptime() unexpected error: %v", err)
+	}
+	if got != 350735470*time.Millisecond {
+		t.Errorf("parseUptime() = %v, want %v", got, 350735470*time.Millisecond)
+	}
+}
+
+func TestPMDSize(t *testing.T) {
+	testCases := []struct {
+		pageSize uint64
+		want     uint64
+	}{
+		{4 << 10, 2 << 20},
+		{16 << 10, 32 << 20},
+		{64 << 10, 512 << 20},
+	}
+
+	for _, tc := range testCases {
+		if got := pmdSize(tc.pageSize); got != tc.want {
+			t.Errorf("pmdSize(%d) = %d, want %d", tc.pageSize, got, tc.want)
+		}
+	}
+}
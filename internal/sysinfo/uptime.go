@@ -0,0 +1,31 @@
+package sysinfo
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReadUptime returns the time since boot from /proc/uptime
+func ReadUptime() (time.Duration, error) {
+	data, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read uptime: %w", err)
+	}
+	return parseUptime(string(data))
+}
+
+// parseUptime parses the contents of /proc/uptime, e.g. "350735.47 234388.90"
+func parseUptime(data string) (time.Duration, error) {
+	fields := strings.Fields(data)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("invalid uptime format: %q", data)
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid uptime format: %q", data)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
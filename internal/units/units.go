@@ -0,0 +1,60 @@
+package units
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseBytes parses a human readable size such as "512", "64K", "256MiB" or
+// "4G". Suffixes are binary multiples (K = 1024).
+func ParseBytes(s string) (int64, error) {
+	str := strings.TrimSpace(s)
+	if str == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	// Split the numeric prefix from the unit suffix
+	i := 0
+	for i < len(str) && (str[i] >= '0' && str[i] <= '9' || str[i] == '.') {
+		i++
+	}
+	num, unit := str[:i], strings.ToUpper(strings.TrimSpace(str[i:]))
+	if num == "" {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+
+	unit = strings.TrimSuffix(unit, "B")
+	unit = strings.TrimSuffix(unit, "I")
+
+	var multiplier float64
+	switch unit {
+	case "":
+		multiplier = 1
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	case "T":
+		multiplier = 1 << 40
+	default:
+		return 0, fmt.Errorf("invalid size unit in '%s'", s)
+	}
+
+	value, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s': %w", s, err)
+	}
+
+	return int64(value * multiplier), nil
+}
+
+// ParseRate parses a byte rate such as "64M/s" or "1G" into bytes per second
+func ParseRate(s string) (int64, error) {
+	str := strings.TrimSpace(s)
+	str = strings.TrimSuffix(str, "/s")
+	str = strings.TrimSuffix(str, "ps")
+	return ParseBytes(str)
+}
@@ -0,0 +1,63 @@
+package units
+
+import (
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{input: "512", want: 512},
+		{input: "64K", want: 64 * 1024},
+		{input: "256M", want: 256 * 1024 * 1024},
+		{input: "256MiB", want: 256 * 1024 * 1024},
+		{input: "4G", want: 4 * 1024 * 1024 * 1024},
+		{input: "1.5g", want: 3 * 512 * 1024 * 1024},
+		{input: " 2 MB ", want: 2 * 1024 * 1024},
+		{input: "", wantErr: true},
+		{input: "G", wantErr: true},
+		{input: "10X", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := ParseBytes(tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("ParseBytes(%q) error = %v, wantErr %v", tc.input, err, tc.wantErr)
+				return
+			}
+			if got != tc.want {
+				t.Errorf("ParseBytes(%q) = %d, want %d", tc.input, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{input: "64M/s", want: 64 * 1024 * 1024},
+		{input: "1G", want: 1024 * 1024 * 1024},
+		{input: "512Kps", want: 512 * 1024},
+		{input: "/s", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := ParseRate(tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("ParseRate(%q) error = %v, wantErr %v", tc.input, err, tc.wantErr)
+				return
+			}
+			if got != tc.want {
+				t.Errorf("ParseRate(%q) = %d, want %d", tc.input, got, tc.want)
+			}
+		})
+	}
+}
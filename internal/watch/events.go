@@ -0,0 +1,133 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/zouuup/memadvise/internal/sysinfo"
+)
+
+// Memory events a cgroup watcher can react to
+const (
+	EventHigh = "high" // The cgroup was throttled for exceeding memory.high
+	EventMax  = "max"  // The cgroup hit memory.max and had to reclaim directly
+)
+
+// ValidEvent reports whether kind is a memory.events counter that can be watched
+func ValidEvent(kind string) bool {
+	return kind == EventHigh || kind == EventMax
+}
+
+// EventsWatcher reports increments of a cgroup's memory.events counters. The
+// kernel signals changes to memory.events as inotify modify events.
+type EventsWatcher struct {
+	fd     int
+	path   string
+	cgroup string
+	kinds  []string
+	last   map[string]int64
+}
+
+// OpenEvents starts watching the memory.events file of cgroup for increments
+// of the given counters
+func OpenEvents(cgroup string, kinds []string) (*EventsWatcher, error) {
+	w, err := openEventsFile(filepath.Join(sysinfo.CgroupPath(cgroup), "memory.events"), kinds)
+	if err != nil {
+		return nil, err
+	}
+	w.cgroup = cgroup
+	return w, nil
+}
+
+func openEventsFile(path string, kinds []string) (*EventsWatcher, error) {
+	// Read the current counts first so only new events are reported
+	last, err := sysinfo.ReadCgroupEvents(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inotify instance: %w", err)
+	}
+	if _, err := unix.InotifyAddWatch(fd, path, unix.IN_MODIFY); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to watch %s: %w", path, err)
+	}
+
+	return &EventsWatcher{fd: fd, path: path, kinds: kinds, last: last}, nil
+}
+
+// Wait blocks until memory.events changes or timeout passes and returns an
+// event for every watched counter that increased
+func (w *EventsWatcher) Wait(timeout time.Duration) ([]Event, error) {
+	fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, int(timeout.Milliseconds()))
+	if err == unix.EINTR || (err == nil && n == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to poll %s: %w", w.path, err)
+	}
+
+	// Drain the notifications; their content doesn't matter
+	buf := make([]byte, 4096)
+	for {
+		if _, err := unix.Read(w.fd, buf); err != nil {
+			break
+		}
+	}
+
+	current, err := sysinfo.ReadCgroupEvents(w.path)
+	if err != nil {
+		return nil, fmt.Errorf("cgroup %s went away: %w", w.path, err)
+	}
+
+	now := time.Now()
+	var events []Event
+	for kind, count := range diffEvents(w.kinds, w.last, current) {
+		events = append(events, Event{Source: w.path, Kind: kind, Cgroup: w.cgroup, Count: count, Time: now})
+	}
+	w.last = current
+
+	return events, nil
+}
+
+// Watch calls fn for every counter increment until ctx is done
+func (w *EventsWatcher) Watch(ctx context.Context, fn func(Event)) error {
+	for ctx.Err() == nil {
+		events, err := w.Wait(pollTimeout)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			fn(event)
+		}
+	}
+	return nil
+}
+
+// Close stops watching
+func (w *EventsWatcher) Close() error {
+	return unix.Close(w.fd)
+}
+
+// diffEvents returns how much each of the kinds counters grew from last to
+// current. A counter that went down (the cgroup was recreated) counts from 0.
+func diffEvents(kinds []string, last, current map[string]int64) map[string]int64 {
+	diff := make(map[string]int64)
+	for _, kind := range kinds {
+		delta := current[kind] - last[kind]
+		if current[kind] < last[kind] {
+			delta = current[kind]
+		}
+		if delta > 0 {
+			diff[kind] = delta
+		}
+	}
+	return diff
+}
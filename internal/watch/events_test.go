@@ -0,0 +1,63 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffEvents(t *testing.T) {
+	kinds := []string{EventHigh, EventMax}
+	last := map[string]int64{"low": 0, "high": 10, "max": 2, "oom": 0}
+
+	testCases := []struct {
+		name    string
+		current map[string]int64
+		want    map[string]int64
+	}{
+		{name: "no change", current: map[string]int64{"high": 10, "max": 2}, want: map[string]int64{}},
+		{name: "high breaches", current: map[string]int64{"high": 13, "max": 2}, want: map[string]int64{"high": 3}},
+		{name: "unwatched counter", current: map[string]int64{"high": 10, "max": 2, "oom": 1}, want: map[string]int64{}},
+		{name: "recreated cgroup", current: map[string]int64{"high": 1, "max": 0}, want: map[string]int64{"high": 1}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := diffEvents(kinds, last, tc.current); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("diffEvents() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEventsWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory.events")
+	if err := os.WriteFile(path, []byte("low 0\nhigh 5\nmax 0\noom 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := openEventsFile(path, []string{EventHigh, EventMax})
+	if err != nil {
+		t.Fatalf("openEventsFile() unexpected error: %v", err)
+	}
+	defer w.Close()
+
+	events, err := w.Wait(10 * time.Millisecond)
+	if err != nil || len(events) != 0 {
+		t.Fatalf("Wait() = %v, %v, want no events before the file changes", events, err)
+	}
+
+	if err := os.WriteFile(path, []byte("low 0\nhigh 7\nmax 0\noom 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err = w.Wait(time.Second)
+	if err != nil {
+		t.Fatalf("Wait() unexpected error: %v", err)
+	}
+	if len(events) != 1 || events[0].Kind != EventHigh || events[0].Count != 2 {
+		t.Errorf("Wait() = %+v, want one high event with count 2", events)
+	}
+}
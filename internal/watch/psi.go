@@ -0,0 +1,169 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/zouuup/memadvise/internal/sysinfo"
+)
+
+// Kernel limits on the PSI trigger window
+const (
+	minWindow = 500 * time.Millisecond
+	maxWindow = 10 * time.Second
+
+	// Unprivileged triggers need a window that is a multiple of this
+	unprivilegedWindow = 2 * time.Second
+)
+
+// pollTimeout bounds how long Watch blocks before checking for cancellation
+const pollTimeout = time.Second
+
+// Event is a notification from a watcher
+type Event struct {
+	Source string // File the event came from
+	Kind   string // "psi" for PSI triggers, or the memory.events counter that increased
+	Cgroup string // Cgroup whose memory.events changed
+	Count  int64  // New memory.events occurrences since the last event
+	Time   time.Time
+}
+
+// Trigger is a PSI trigger: it fires when tasks stall on memory for more than
+// Stall within any Window
+type Trigger struct {
+	Kind   string // "some" or "full"
+	Stall  time.Duration
+	Window time.Duration
+	Cgroup string // Watch this cgroup's memory.pressure instead of the system's
+}
+
+// ParseTrigger parses a trigger in the kernel's format, e.g. "some 150000
+// 1000000" with times in microseconds. Times may also be written as
+// durations, e.g. "some 150ms 1s".
+func ParseTrigger(spec string) (Trigger, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 3 {
+		return Trigger{}, fmt.Errorf("invalid PSI trigger '%s' (expected e.g. 'some 150000 1000000')", spec)
+	}
+
+	trigger := Trigger{Kind: fields[0]}
+	if trigger.Kind != "some" && trigger.Kind != "full" {
+		return Trigger{}, fmt.Errorf("invalid PSI trigger kind '%s' (must be 'some' or 'full')", trigger.Kind)
+	}
+
+	var err error
+	if trigger.Stall, err = parseMicroseconds(fields[1]); err != nil {
+		return Trigger{}, err
+	}
+	if trigger.Window, err = parseMicroseconds(fields[2]); err != nil {
+		return Trigger{}, err
+	}
+
+	if trigger.Window < minWindow || trigger.Window > maxWindow {
+		return Trigger{}, fmt.Errorf("invalid PSI trigger window %s (must be between %s and %s)", trigger.Window, minWindow, maxWindow)
+	}
+	if trigger.Stall <= 0 || trigger.Stall > trigger.Window {
+		return Trigger{}, fmt.Errorf("invalid PSI trigger stall %s (must be positive and at most the window)", trigger.Stall)
+	}
+
+	return trigger, nil
+}
+
+// parseMicroseconds parses a plain number of microseconds or a duration
+func parseMicroseconds(s string) (time.Duration, error) {
+	if us, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(us) * time.Microsecond, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid PSI trigger time '%s'", s)
+	}
+	return d, nil
+}
+
+// String returns the trigger in the kernel's format
+func (t Trigger) String() string {
+	return fmt.Sprintf("%s %d %d", t.Kind, t.Stall.Microseconds(), t.Window.Microseconds())
+}
+
+// Path returns the pressure file the trigger is registered on
+func (t Trigger) Path() string {
+	if t.Cgroup == "" {
+		return "/proc/pressure/memory"
+	}
+	return filepath.Join(sysinfo.CgroupPath(t.Cgroup), "memory.pressure")
+}
+
+// PSIWatcher waits for a registered PSI trigger to fire
+type PSIWatcher struct {
+	fd      int
+	trigger Trigger
+}
+
+// OpenPSI registers trigger with the kernel. The trigger stays active until
+// the watcher is closed.
+func OpenPSI(trigger Trigger) (*PSIWatcher, error) {
+	path := trigger.Path()
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	// The kernel expects the trigger as a NUL-terminated string
+	if _, err := unix.Write(fd, append([]byte(trigger.String()), 0)); err != nil {
+		unix.Close(fd)
+		if err == unix.EINVAL && trigger.Window%unprivilegedWindow != 0 {
+			return nil, fmt.Errorf("failed to register PSI trigger '%s' on %s: %w (without CAP_SYS_RESOURCE "+
+				"the window must be a multiple of %s)", trigger, path, err, unprivilegedWindow)
+		}
+		return nil, fmt.Errorf("failed to register PSI trigger '%s' on %s: %w", trigger, path, err)
+	}
+
+	return &PSIWatcher{fd: fd, trigger: trigger}, nil
+}
+
+// Wait blocks until the trigger fires or timeout passes and reports whether
+// it fired
+func (w *PSIWatcher) Wait(timeout time.Duration) (bool, error) {
+	fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLPRI}}
+	n, err := unix.Poll(fds, int(timeout.Milliseconds()))
+	if err == unix.EINTR {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to poll %s: %w", w.trigger.Path(), err)
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	if fds[0].Revents&unix.POLLERR != 0 {
+		return false, fmt.Errorf("PSI trigger on %s was removed", w.trigger.Path())
+	}
+	return fds[0].Revents&unix.POLLPRI != 0, nil
+}
+
+// Watch calls fn every time the trigger fires until ctx is done
+func (w *PSIWatcher) Watch(ctx context.Context, fn func(Event)) error {
+	for ctx.Err() == nil {
+		fired, err := w.Wait(pollTimeout)
+		if err != nil {
+			return err
+		}
+		if fired {
+			fn(Event{Source: w.trigger.Path(), Kind: "psi", Time: time.Now()})
+		}
+	}
+	return nil
+}
+
+// Close unregisters the trigger
+func (w *PSIWatcher) Close() error {
+	return unix.Close(w.fd)
+}
@@ -0,0 +1,60 @@
+package watch
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTrigger(t *testing.T) {
+	testCases := []struct {
+		name    string
+		spec    string
+		want    Trigger
+		wantErr string
+	}{
+		{
+			name: "kernel format",
+			spec: "some 150000 1000000",
+			want: Trigger{Kind: "some", Stall: 150 * time.Millisecond, Window: time.Second},
+		},
+		{
+			name: "durations",
+			spec: "full 100ms 2s",
+			want: Trigger{Kind: "full", Stall: 100 * time.Millisecond, Window: 2 * time.Second},
+		},
+		{name: "missing field", spec: "some 150000", wantErr: "expected e.g."},
+		{name: "bad kind", spec: "most 150000 1000000", wantErr: "must be 'some' or 'full'"},
+		{name: "window too long", spec: "some 150000 20000000", wantErr: "window"},
+		{name: "stall above window", spec: "some 2s 1s", wantErr: "stall"},
+		{name: "bad time", spec: "some soon 1s", wantErr: "invalid PSI trigger time"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseTrigger(tc.spec)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("ParseTrigger(%q) error = %v, want %q", tc.spec, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseTrigger(%q) unexpected error: %v", tc.spec, err)
+			}
+			if got != tc.want {
+				t.Errorf("ParseTrigger(%q) = %+v, want %+v", tc.spec, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTriggerString(t *testing.T) {
+	trigger := Trigger{Kind: "some", Stall: 150 * time.Millisecond, Window: time.Second, Cgroup: "/system.slice"}
+	if got := trigger.String(); got != "some 150000 1000000" {
+		t.Errorf("String() = %q, want %q", got, "some 150000 1000000")
+	}
+	if got := trigger.Path(); got != "/sys/fs/cgroup/system.slice/memory.pressure" {
+		t.Errorf("Path() = %q", got)
+	}
+}
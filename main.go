@@ -1,18 +1,45 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
 
 	"github.com/urfave/cli/v2"
 	"github.com/zouuup/memadvise/internal/advisor"
-	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/budget"
+	"github.com/zouuup/memadvise/internal/history"
+	"github.com/zouuup/memadvise/internal/metrics"
 	"github.com/zouuup/memadvise/internal/output"
+	"github.com/zouuup/memadvise/internal/syscall"
+)
+
+// defaultIdleState is where idle tracking samples are kept between runs
+const defaultIdleState = "/var/lib/memadvise/idle.json"
+
+// Exit codes. A run in which every target failed exits with the code of the
+// failures, taken in the order below when they differ; a run in which only
+// some targets failed exits with 0, or exitPartial with --strict.
+const (
+	exitError           = 1 // Invalid arguments, or an error that stopped the run
+	exitPartial         = 2 // With --strict, some targets failed while others were advised
+	exitConditionNotMet = 3 // A --when or --when-* reclaim condition was not met
+	exitNoProcess       = 4 // The target processes do not exist
+	exitPermission      = 5 // memadvise is not allowed to inspect or advise the targets
+	exitUnsupported     = 6 // The kernel does not support process_madvise or the mode
+	exitNothingEligible = 7 // The targets have no memory eligible for advice, or were all skipped
 )
 
+// failureCodes orders the exit codes of failed targets, most actionable first
+var failureCodes = []int{exitUnsupported, exitPermission, exitError, exitNothingEligible, exitNoProcess}
+
 func main() {
 	// Preprocess arguments to handle multiple PIDs (e.g., from command substitution)
 	os.Args = preprocessArgs(os.Args)
@@ -22,49 +49,40 @@ func main() {
 		Usage: "Safely mark cold memory pages in running processes",
 		Description: "A command-line utility to allow advanced users and system integrators to safely and " +
 			"explicitly mark cold memory pages in running Linux processes using the process_madvise syscall",
-		Flags: []cli.Flag{
+		Flags: append(reclaimFlags(),
 			&cli.StringFlag{
-				Name:     "target",
-				Aliases:  []string{"t"},
-				Usage:    "Target PID or comma-separated list of PIDs",
-				Required: true,
+				Name:  "metrics-file",
+				Usage: "Write Prometheus metrics to this file after the run, for node_exporter's textfile collector",
 			},
-			&cli.IntFlag{
-				Name:    "percent",
-				Aliases: []string{"p"},
-				Usage:   "Percentage of eligible memory pages to reclaim",
-				Value:   30,
+			&cli.DurationFlag{
+				Name:  "observe",
+				Usage: "Keep sampling RSS, swap and lazily freed memory of each target for this long after advising (e.g. 30s)",
 			},
-			&cli.StringFlag{
-				Name:    "mode",
-				Aliases: []string{"m"},
-				Usage:   "Reclaim strategy: cold (lazy) or pageout (eager)",
-				Value:   "cold",
+			&cli.DurationFlag{
+				Name:  "sample",
+				Usage: "Sampling interval for --observe",
+				Value: time.Second,
 			},
-			&cli.BoolFlag{
-				Name:    "dry-run",
-				Aliases: []string{"d"},
-				Usage:   "Print what would be reclaimed without performing the operation",
-				Value:   false,
+			&cli.StringFlag{
+				Name:  "history",
+				Usage: "Keep the advice given to each process in this file (e.g. " + history.DefaultPath + "), for --cooldown and 'memadvise history'",
 			},
-			&cli.BoolFlag{
-				Name:    "verbose",
-				Aliases: []string{"v"},
-				Usage:   "Enable verbose logging",
-				Value:   false,
+			&cli.DurationFlag{
+				Name:  "cooldown",
+				Usage: "Skip processes that the history shows were advised less than this long ago; needs --history",
 			},
 			&cli.BoolFlag{
-				Name:    "json",
-				Aliases: []string{"j"},
-				Usage:   "Output results in JSON format",
-				Value:   false,
-			},
-			&cli.Int64Flag{
-				Name:    "max-bytes",
-				Aliases: []string{"b"},
-				Usage:   "Maximum number of bytes to reclaim (optional cap)",
-				Value:   0,
+				Name:  "strict",
+				Usage: "Exit with an error if any target fails, even when others were advised",
 			},
+		),
+		Commands: []*cli.Command{
+			daemonCommand(),
+			policyCommand(),
+			clientCommand(),
+			historyCommand(),
+			doctorCommand(),
+			schemaCommand(),
 		},
 		Action: func(c *cli.Context) error {
 			return run(c)
@@ -77,86 +95,306 @@ func main() {
 	}
 }
 
+// schemaCommand returns the "schema" subcommand
+func schemaCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "schema",
+		Usage: "Print the JSON Schema of the --json report",
+		Action: func(c *cli.Context) error {
+			_, err := os.Stdout.Write(output.Schema)
+			return err
+		},
+	}
+}
+
+// reclaimFlags returns the flags shared by one-shot runs and the daemon
+func reclaimFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "target",
+			Aliases: []string{"t"},
+			Usage:   "Target PID or comma-separated list of PIDs",
+		},
+		&cli.StringFlag{
+			Name:    "config",
+			Aliases: []string{"c"},
+			Usage:   "Policy file with reclaim rules (YAML); replaces --target",
+		},
+		&cli.IntFlag{
+			Name:    "percent",
+			Aliases: []string{"p"},
+			Usage:   "Percentage of eligible memory pages to reclaim",
+			Value:   30,
+		},
+		&cli.StringFlag{
+			Name:    "mode",
+			Aliases: []string{"m"},
+			Usage:   "Reclaim strategy: cold (lazy) or pageout (eager)",
+			Value:   "cold",
+		},
+		&cli.StringFlag{
+			Name:  "thp",
+			Usage: "Handling of transparent huge page backed regions: skip, full (never split huge pages) or split",
+			Value: advisor.THPFull,
+		},
+		&cli.StringFlag{
+			Name:  "swap-reserve",
+			Usage: "Swap space to keep free when paging out (e.g. 256M, 1G)",
+			Value: "256M",
+		},
+		&cli.StringFlag{
+			Name:  "no-swap",
+			Usage: "Action when pageout is requested without a swap backend: cold (downgrade) or refuse",
+			Value: "cold",
+		},
+		&cli.StringFlag{
+			Name:  "total-budget",
+			Usage: "Total bytes to reclaim across all targets (e.g. 4G); overrides --percent",
+		},
+		&cli.StringFlag{
+			Name:  "distribution",
+			Usage: "How --total-budget is shared: proportional (to eligible RSS), weight or largest",
+			Value: budget.Proportional,
+		},
+		&cli.StringFlag{
+			Name:  "weights",
+			Usage: "Per-target weights for --distribution weight (e.g. 1234=3,5678=1); default weight is 1",
+		},
+		&cli.BoolFlag{
+			Name:  "iterative",
+			Usage: "Advise in steps, re-measuring RSS after each step until the budget is reclaimed",
+			Value: false,
+		},
+		&cli.StringFlag{
+			Name:  "step",
+			Usage: "Bytes to advise in the first iterative round (default: a quarter of the budget)",
+		},
+		&cli.DurationFlag{
+			Name:  "interval",
+			Usage: "Wait between advising and re-measuring in iterative mode",
+			Value: 2 * time.Second,
+		},
+		&cli.IntFlag{
+			Name:  "max-rounds",
+			Usage: "Maximum number of iterative rounds",
+			Value: 10,
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Maximum duration of an iterative run per target (0 for no limit)",
+			Value: time.Minute,
+		},
+		&cli.StringFlag{
+			Name:  "rate",
+			Usage: "Maximum advice rate (e.g. 64M/s); advice is applied in paced batches",
+		},
+		&cli.StringFlag{
+			Name:  "max-inflight",
+			Usage: "Maximum bytes per process_madvise call (default: a quarter second at --rate)",
+		},
+		&cli.StringFlag{
+			Name:  "io-pressure-limit",
+			Usage: "Pause between batches while I/O PSI exceeds a threshold (e.g. some-avg10>20)",
+		},
+		&cli.DurationFlag{
+			Name:  "io-pause-max",
+			Usage: "Give up on a target after pausing this long for I/O pressure",
+			Value: time.Minute,
+		},
+		&cli.StringFlag{
+			Name:  "when-pressure",
+			Usage: "Only reclaim when memory PSI exceeds a threshold (e.g. some-avg10>5)",
+		},
+		&cli.StringFlag{
+			Name:  "when-available-below",
+			Usage: "Only reclaim when MemAvailable is below a percentage or size (e.g. 10%, 2G)",
+		},
+		&cli.StringFlag{
+			Name:  "when",
+			Usage: "Only reclaim from targets satisfying a condition (e.g. 'rss > 2G && age > 15m'); see 'policy vars'",
+		},
+		&cli.DurationFlag{
+			Name:  "idle-for",
+			Usage: "Only reclaim from targets that haven't used CPU for this long (e.g. 20m); see --idle-state",
+		},
+		&cli.StringFlag{
+			Name:  "idle-state",
+			Usage: "File in which CPU usage samples are kept between runs for --idle-for and idle_for",
+			Value: defaultIdleState,
+		},
+		&cli.StringFlag{
+			Name:  "audit-log",
+			Usage: "Log every advice action to this file as JSON lines, or to 'syslog' or 'journald'",
+		},
+		&cli.StringFlag{
+			Name:  "audit-max-size",
+			Usage: "Rotate the --audit-log file once it reaches this size; 0 never rotates",
+			Value: "10M",
+		},
+		&cli.IntFlag{
+			Name:  "audit-keep",
+			Usage: "Rotated --audit-log files to keep",
+			Value: 5,
+		},
+		&cli.BoolFlag{
+			Name:  "scale-budget",
+			Usage: "Scale the budget by how far past the --when-* thresholds the system is",
+			Value: false,
+		},
+		&cli.BoolFlag{
+			Name:    "dry-run",
+			Aliases: []string{"d"},
+			Usage:   "Print what would be reclaimed without performing the operation",
+			Value:   false,
+		},
+		&cli.BoolFlag{
+			Name:    "verbose",
+			Aliases: []string{"v"},
+			Usage:   "Enable verbose logging",
+			Value:   false,
+		},
+		&cli.BoolFlag{
+			Name:    "json",
+			Aliases: []string{"j"},
+			Usage:   "Output results in JSON format",
+			Value:   false,
+		},
+		&cli.Int64Flag{
+			Name:    "max-bytes",
+			Aliases: []string{"b"},
+			Usage:   "Maximum number of bytes to reclaim (optional cap)",
+			Value:   0,
+		},
+	}
+}
+
 func run(c *cli.Context) error {
-	// Parse targets (PIDs)
-	targetStr := c.String("target")
-	targetPids, err := parsePids(targetStr)
+	cfg, err := parseReclaimConfig(c)
 	if err != nil {
-		return fmt.Errorf("invalid target PIDs: %w", err)
+		return err
 	}
 
-	// Validate mode
-	mode := c.String("mode")
-	if mode != "cold" && mode != "pageout" {
-		return fmt.Errorf("invalid mode: %s (must be 'cold' or 'pageout')", mode)
+	// Observation blocks for the whole window, so it is only offered to one-shot runs
+	cfg.observe, cfg.sample = c.Duration("observe"), c.Duration("sample")
+	if cfg.observe < 0 {
+		return fmt.Errorf("invalid observe: %s (must be positive)", cfg.observe)
+	}
+	if cfg.observe > 0 && (cfg.sample <= 0 || cfg.sample > cfg.observe) {
+		return fmt.Errorf("invalid sample: %s (must be positive and at most --observe)", cfg.sample)
+	}
+	cfg.cooldown = c.Duration("cooldown")
+	if cfg.cooldown < 0 {
+		return fmt.Errorf("invalid cooldown: %s (must be positive)", cfg.cooldown)
+	}
+	if cfg.cooldown > 0 && cfg.history == "" {
+		return fmt.Errorf("--cooldown needs the history; set --history")
 	}
 
 	// Initialize output based on flags
 	out := output.New(c.Bool("verbose"), c.Bool("json"))
+	defer out.Finish()
 
-	// Process each target PID
-	for _, pid := range targetPids {
-		// Check if PID exists
-		if !inspector.PidExists(pid) {
-			out.Error(fmt.Sprintf("PID %d does not exist or is not accessible", pid))
-			continue
-		}
+	if path := c.String("metrics-file"); path != "" {
+		defer func() {
+			if err := metrics.Default.WriteFile(path); err != nil {
+				out.Error(err.Error())
+			}
+		}()
+	}
 
-		// Create process inspector
-		procInspector, err := inspector.NewProcessInspector(pid)
-		if err != nil {
-			out.Error(fmt.Sprintf("Failed to inspect PID %d: %v", pid, err))
-			continue
-		}
+	// SIGTERM and SIGINT cut a paced run or an --observe window short, and
+	// what was done so far is still reported
+	ctx, stop := signal.NotifyContext(c.Context, unix.SIGTERM, unix.SIGINT)
+	defer stop()
 
-		// Get memory stats before advice
-		beforeStats, err := procInspector.GetMemoryStats()
-		if err != nil {
-			out.Error(fmt.Sprintf("Failed to get memory stats for PID %d: %v", pid, err))
-			continue
+	var result runResult
+	if filename := c.String("config"); filename != "" {
+		err = runConfigFile(ctx, cfg, out, filename, &result)
+	} else {
+		// Parse targets (PIDs)
+		targetStr := c.String("target")
+		if targetStr == "" {
+			return fmt.Errorf("required flag \"target\" or \"config\" not set")
 		}
-
-		out.MemoryStatsBefore(pid, beforeStats)
-
-		// Get eligible memory regions
-		regions, err := procInspector.GetEligibleRegions()
-		if err != nil {
-			out.Error(fmt.Sprintf("Failed to get memory regions for PID %d: %v", pid, err))
-			continue
+		targetPids, parseErr := parsePids(targetStr)
+		if parseErr != nil {
+			return fmt.Errorf("invalid target PIDs: %w", parseErr)
 		}
 
-		// Calculate reclaim budget
-		percent := c.Int("percent")
-		maxBytes := c.Int64("max-bytes")
-		budget := calculateBudget(beforeStats.TotalRSS, percent, maxBytes)
+		var outcomes []targetOutcome
+		outcomes, err = reclaim(ctx, cfg, out, targetPids)
+		result.add(outcomes)
+	}
 
-		// Create advisor
-		adv := advisor.New(pid, regions, out)
+	if errors.Is(err, errConditionNotMet) {
+		return cli.Exit("", exitConditionNotMet)
+	}
+	if errors.Is(err, errNothingEligible) {
+		return cli.Exit("", exitNothingEligible)
+	}
+	if err != nil {
+		return err
+	}
+	if code := result.exitCode(c.Bool("strict")); code != 0 {
+		return cli.Exit("", code)
+	}
+	return nil
+}
 
-		// Execute the advice operation
-		if c.Bool("dry-run") {
-			out.DryRun(pid, budget, mode, len(regions))
+// runResult tallies the targets of a one-shot run for its exit code
+type runResult struct {
+	advised  int
+	failures []error
+}
+
+// add counts the outcomes of a reclaim
+func (r *runResult) add(outcomes []targetOutcome) {
+	for _, outcome := range outcomes {
+		if outcome.err != nil {
+			r.failures = append(r.failures, outcome.err)
 		} else {
-			err = adv.Execute(budget, mode)
-			if err != nil {
-				out.Error(fmt.Sprintf("Failed to execute advice on PID %d: %v", pid, err))
-				continue
-			}
+			r.advised++
 		}
+	}
+}
 
-		// Get memory stats after advice (if not dry run)
-		if !c.Bool("dry-run") {
-			afterStats, err := procInspector.GetMemoryStats()
-			if err != nil {
-				out.Error(fmt.Sprintf("Failed to get memory stats for PID %d: %v", pid, err))
-				continue
-			}
+// exitCode returns the exit code for the tallied targets
+func (r *runResult) exitCode(strict bool) int {
+	if len(r.failures) == 0 {
+		return 0
+	}
+	if r.advised > 0 {
+		if strict {
+			return exitPartial
+		}
+		return 0
+	}
 
-			out.MemoryStatsAfter(pid, afterStats, beforeStats)
+	codes := make(map[int]bool)
+	for _, err := range r.failures {
+		codes[exitCodeOf(err)] = true
+	}
+	for _, code := range failureCodes {
+		if codes[code] {
+			return code
 		}
 	}
+	return exitError
+}
 
-	return nil
+// exitCodeOf returns the exit code for a target that failed with err
+func exitCodeOf(err error) int {
+	switch {
+	case errors.Is(err, syscall.ErrUnsupported):
+		return exitUnsupported
+	case errors.Is(err, syscall.ErrPermission):
+		return exitPermission
+	case errors.Is(err, advisor.ErrNoRegions):
+		return exitNothingEligible
+	case errors.Is(err, syscall.ErrNoProcess):
+		return exitNoProcess
+	}
+	return exitError
 }
 
 func parsePids(targetStr string) ([]int, error) {
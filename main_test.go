@@ -1,7 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/zouuup/memadvise/internal/advisor"
+	"github.com/zouuup/memadvise/internal/expr"
+	"github.com/zouuup/memadvise/internal/history"
+	"github.com/zouuup/memadvise/internal/output"
+	"github.com/zouuup/memadvise/internal/syscall"
 )
 
 func TestParsePids(t *testing.T) {
@@ -127,3 +141,111 @@ func TestCalculateBudget(t *testing.T) {
 		})
 	}
 }
+
+func TestExitCode(t *testing.T) {
+	gone := fmt.Errorf("PID 1: %w", syscall.ErrNoProcess)
+	denied := &syscall.Error{Op: "process_madvise", PID: 1, Errno: unix.EPERM}
+	empty := fmt.Errorf("failed: %w", advisor.ErrNoRegions)
+
+	testCases := []struct {
+		name     string
+		outcomes []targetOutcome
+		strict   bool
+		want     int
+	}{
+		{"All advised", []targetOutcome{{pid: 1}, {pid: 2}}, true, 0},
+		{"Nothing to do", nil, true, 0},
+		{"Partial failure", []targetOutcome{{pid: 1}, {pid: 2, err: gone}}, false, 0},
+		{"Partial failure strict", []targetOutcome{{pid: 1}, {pid: 2, err: gone}}, true, exitPartial},
+		{"Vanished", []targetOutcome{{pid: 1, err: gone}}, false, exitNoProcess},
+		{"Nothing eligible", []targetOutcome{{pid: 1, err: empty}}, false, exitNothingEligible},
+		{"Permission before vanished", []targetOutcome{{pid: 1, err: gone}, {pid: 2, err: denied}}, false, exitPermission},
+		{"Unsupported", []targetOutcome{{pid: 1, err: fmt.Errorf("process_madvise: %w", syscall.ErrUnsupported)}}, false, exitUnsupported},
+		{"Other", []targetOutcome{{pid: 1, err: errors.New("I/O pressure stayed high")}, {pid: 2, err: empty}}, false, exitError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var result runResult
+			result.add(tc.outcomes)
+			if got := result.exitCode(tc.strict); got != tc.want {
+				t.Errorf("exitCode() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReclaimSkips(t *testing.T) {
+	pid := os.Getpid()
+
+	// A rollback that leaves this process hot for the next hour
+	hotHistory := filepath.Join(t.TempDir(), "history.json")
+	key, id, err := history.ReadKey(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hotUntil := time.Now().Add(time.Hour)
+	err = history.Update(hotHistory, func(store *history.Store) error {
+		store.Add(key, pid, id.Comm, history.Record{Time: time.Now(), Source: history.SourceRollback, HotUntil: &hotUntil})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		cfg      reclaimConfig
+		when     string
+		wantErr  error
+		wantCode int // Exit code of the failed target, when it failed rather than being skipped
+	}{
+		{name: "condition false", when: "rss < 1K", wantErr: errConditionNotMet},
+		{name: "condition error", when: "rss / 0 > 1", wantCode: exitError},
+		{name: "below min_rss", cfg: reclaimConfig{minRSS: 1 << 50}, wantErr: errNothingEligible},
+		{name: "not idle", cfg: reclaimConfig{idleFor: time.Hour, idle: &idleState{}}, wantErr: errNothingEligible},
+		{name: "hot", cfg: reclaimConfig{history: hotHistory}, wantErr: errNothingEligible},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := tc.cfg
+			cfg.mode, cfg.percent = "cold", 30
+			if tc.when != "" {
+				when, err := expr.Parse(tc.when)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg.when = when
+			}
+
+			outcomes, err := reclaim(context.Background(), &cfg, output.New(false, true), []int{pid})
+			if !errors.Is(err, tc.wantErr) || (tc.wantErr == nil && err != nil) {
+				t.Fatalf("reclaim() = %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantCode == 0 {
+				if len(outcomes) != 0 {
+					t.Errorf("reclaim() = %v, want the target skipped", outcomes)
+				}
+				return
+			}
+
+			var result runResult
+			result.add(outcomes)
+			if code := result.exitCode(false); code != tc.wantCode {
+				t.Errorf("exit code = %d, want %d", code, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestObserveCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	observe(ctx, nil, time.Hour, time.Second, output.New(false, true))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("observe() returned after %s, want at once once ctx is done", elapsed)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/zouuup/memadvise/internal/advisor"
+	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/output"
+)
+
+// observation collects memory samples of an advised target. cold advice is
+// lazy, so its effect only shows some time after the call returns.
+type observation struct {
+	target  *target
+	samples []output.Sample
+	exited  bool
+}
+
+// newObservation starts observing t, with the stats read right after advice
+// as the first sample
+func newObservation(t *target, after *inspector.MemoryStats) *observation {
+	return &observation{
+		target:  t,
+		samples: []output.Sample{newSample(0, after)},
+	}
+}
+
+// observe samples every target each interval until window has passed or
+// ctx is done, then outputs the timelines. Targets that exit stop being
+// sampled.
+func observe(ctx context.Context, observed []*observation, window time.Duration, interval time.Duration, out *output.OutputManager) {
+	start := time.Now()
+	for next := interval; next <= window; next += interval {
+		if err := advisor.SleepContext(ctx, time.Until(start.Add(next))); err != nil {
+			out.Warning(fmt.Sprintf("observation stopped after %s: %v", time.Since(start).Round(time.Second), err))
+			break
+		}
+
+		for _, o := range observed {
+			if o.exited {
+				continue
+			}
+			stats, err := o.target.inspector.GetMemoryStats()
+			if err != nil {
+				o.exited = true
+				out.Warning(fmt.Sprintf("PID %d stopped being observed after %s: %v",
+					o.target.pid, time.Since(start).Round(time.Second), err))
+				continue
+			}
+			o.samples = append(o.samples, newSample(time.Since(start), stats))
+		}
+	}
+
+	for _, o := range observed {
+		out.Observation(o.target.pid, interval, o.samples)
+	}
+}
+
+func newSample(elapsed time.Duration, stats *inspector.MemoryStats) output.Sample {
+	return output.Sample{
+		Elapsed:  elapsed,
+		RSS:      stats.TotalRSS,
+		Swap:     stats.TotalSwap,
+		LazyFree: stats.LazyFree,
+	}
+}
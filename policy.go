@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+	"github.com/zouuup/memadvise/internal/config"
+	"github.com/zouuup/memadvise/internal/expr"
+	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/output"
+)
+
+// policyCommand returns the "policy" subcommand
+func policyCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "policy",
+		Usage: "Inspect and test reclaim policies",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "test",
+				Usage: "Evaluate rule conditions against running processes without reclaiming",
+				Description: "Evaluates the 'when' condition of every rule in --config against the processes the " +
+					"rule selects, or --expr against --target, and prints the result with the variable values " +
+					"used. Exits with status 3 if no process satisfies a condition.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Usage:   "Policy file whose rule conditions to evaluate",
+					},
+					&cli.StringFlag{
+						Name:    "expr",
+						Aliases: []string{"e"},
+						Usage:   "Condition to evaluate instead of the rules of --config",
+					},
+					&cli.StringFlag{
+						Name:    "target",
+						Aliases: []string{"t"},
+						Usage:   "Evaluate against these PIDs instead of the processes the rules select",
+					},
+					&cli.StringFlag{
+						Name:  "idle-state",
+						Usage: "File with the CPU usage samples idle_for is computed from",
+						Value: defaultIdleState,
+					},
+					&cli.BoolFlag{
+						Name:    "json",
+						Aliases: []string{"j"},
+						Usage:   "Output results in JSON format",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return runPolicyTest(c)
+				},
+			},
+			{
+				Name:  "vars",
+				Usage: "List the variables available in conditions",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "json",
+						Aliases: []string{"j"},
+						Usage:   "Output results in JSON format",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					out := output.New(false, c.Bool("json"))
+					out.PolicyVariables(expr.Variables)
+					out.Finish()
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// policyCase is a condition and the processes to evaluate it against
+type policyCase struct {
+	rule string
+	when *expr.Expr
+	pids []int
+}
+
+func runPolicyTest(c *cli.Context) error {
+	out := output.New(false, c.Bool("json"))
+	defer out.Finish()
+
+	var targets []int
+	if targetStr := c.String("target"); targetStr != "" {
+		var err error
+		targets, err = parsePids(targetStr)
+		if err != nil {
+			return fmt.Errorf("invalid target PIDs: %w", err)
+		}
+	}
+
+	var cases []policyCase
+	switch {
+	case c.String("expr") != "":
+		when, err := expr.Parse(c.String("expr"))
+		if err != nil {
+			return fmt.Errorf("invalid condition: %w", err)
+		}
+		if len(targets) == 0 {
+			return fmt.Errorf("--expr requires --target")
+		}
+		cases = append(cases, policyCase{rule: "command-line", when: when, pids: targets})
+
+	case c.String("config") != "":
+		file, err := loadConfig(c.String("config"), out)
+		if err != nil {
+			return err
+		}
+		for _, rule := range file.Rules {
+			if rule.When == "" {
+				continue // Nothing to evaluate
+			}
+			when, err := expr.Parse(rule.When)
+			if err != nil {
+				return fmt.Errorf("rule %q: invalid condition: %w", rule.Name, err)
+			}
+
+			pids, err := policyTargets(rule.Selector, targets)
+			if err != nil {
+				return fmt.Errorf("rule %q: failed to resolve targets: %w", rule.Name, err)
+			}
+			cases = append(cases, policyCase{rule: rule.Name, when: when, pids: pids})
+		}
+
+	default:
+		return fmt.Errorf("required flag \"config\" or \"expr\" not set")
+	}
+
+	// Samples are read but not saved, so testing doesn't disturb idle tracking
+	idle, err := inspector.LoadIdleTracker(c.String("idle-state"))
+	if err != nil {
+		return err
+	}
+
+	anyMet := false
+	for _, pc := range cases {
+		for _, pid := range pc.pids {
+			comm := ""
+			if stat, err := inspector.ReadProcStat(pid); err == nil {
+				comm = stat.Comm
+			}
+
+			env, err := expr.Collect(pc.when.Vars(), pid, nil, idle)
+			met := false
+			if err == nil {
+				met, err = pc.when.Eval(env)
+			}
+			anyMet = anyMet || met
+
+			// Only report the variables the condition refers to
+			used := make(expr.Env)
+			for _, name := range pc.when.Vars() {
+				if value, ok := env[name]; ok {
+					used[name] = value
+				}
+			}
+			out.PolicyEvaluation(pc.rule, pid, comm, pc.when.String(), met, used, err)
+		}
+	}
+
+	if !anyMet {
+		return cli.Exit("", exitConditionNotMet)
+	}
+	return nil
+}
+
+// policyTargets returns the processes a selector matches, restricted to
+// targets when any are given
+func policyTargets(selector config.Selector, targets []int) ([]int, error) {
+	if len(targets) == 0 {
+		return selector.Resolve()
+	}
+
+	var pids []int
+	for _, pid := range targets {
+		id, err := inspector.ReadIdentity(pid)
+		if err != nil {
+			return nil, fmt.Errorf("PID %d does not exist or is not accessible", pid)
+		}
+		if selector.Matches(id) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
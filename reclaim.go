@@ -0,0 +1,923 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/zouuup/memadvise/internal/advisor"
+	"github.com/zouuup/memadvise/internal/api"
+	"github.com/zouuup/memadvise/internal/audit"
+	"github.com/zouuup/memadvise/internal/budget"
+	"github.com/zouuup/memadvise/internal/config"
+	"github.com/zouuup/memadvise/internal/expr"
+	"github.com/zouuup/memadvise/internal/gate"
+	"github.com/zouuup/memadvise/internal/history"
+	"github.com/zouuup/memadvise/internal/inspector"
+	"github.com/zouuup/memadvise/internal/metrics"
+	"github.com/zouuup/memadvise/internal/output"
+	"github.com/zouuup/memadvise/internal/syscall"
+	"github.com/zouuup/memadvise/internal/sysinfo"
+	"github.com/zouuup/memadvise/internal/units"
+)
+
+// errConditionNotMet is returned by reclaim when a --when-* condition, or the
+// --when condition of every target, is not met
+var errConditionNotMet = errors.New("reclaim condition not met")
+
+// errNothingEligible is returned by reclaim when every target was skipped,
+// and not all of them for their --when condition: for their size, idle time,
+// cooldown or a rollback
+var errNothingEligible = errors.New("no target is eligible for advice")
+
+// reclaimConfig holds the validated settings for a reclaim pass
+type reclaimConfig struct {
+	mode         string
+	percent      int
+	budgetBytes  int64 // Fixed per-target budget; overrides percent
+	targetRSS    int64 // Reclaim down to this RSS; overrides percent
+	minRSS       int64 // Skip targets smaller than this
+	maxBytes     int64
+	dryRun       bool
+	options      advisor.Options
+	iterative    bool
+	iterOpts     advisor.IterativeOptions
+	conditions   []gate.Condition
+	when         *expr.Expr    // Per-target condition
+	idleFor      time.Duration // Skip targets that used CPU more recently than this
+	idle         *idleState
+	scaleBudget  bool
+	swapReserve  int64
+	noSwap       string
+	totalBudget  int64
+	distribution string
+	weights      map[int]float64
+	observe      time.Duration   // Keep sampling targets this long after advice
+	sample       time.Duration   // Interval between observation samples
+	budgetScales map[int]float64 // Per-PID budget factor, set by the daemon after over-reclaim
+	history      string          // File the advice history is kept in; empty disables it
+	source       string          // What is advising, as recorded in the history
+	cooldown     time.Duration   // Skip targets the history shows were advised this recently
+	ignoreHot    bool            // Advise targets a rollback marked hot anyway
+	audit        *audit.Logger   // Where advice actions are logged; nil disables the audit log
+	caller       api.Caller      // API client a request is advised for; zero for other runs
+}
+
+// targetOutcome is the result of reclaiming from a single target
+type targetOutcome struct {
+	pid       int
+	advised   int64
+	rssBefore int64
+	rssAfter  int64
+	pagedOut  []syscall.MemoryRegion // Ranges paged out, which a rollback reads back in
+	err       error
+}
+
+// parseReclaimConfig validates the reclaim flags
+func parseReclaimConfig(c *cli.Context) (*reclaimConfig, error) {
+	var err error
+	cfg := &reclaimConfig{
+		percent:     c.Int("percent"),
+		maxBytes:    c.Int64("max-bytes"),
+		dryRun:      c.Bool("dry-run"),
+		iterative:   c.Bool("iterative"),
+		scaleBudget: c.Bool("scale-budget"),
+	}
+
+	// Validate mode
+	cfg.mode = c.String("mode")
+	if cfg.mode != "cold" && cfg.mode != "pageout" {
+		return nil, fmt.Errorf("invalid mode: %s (must be 'cold' or 'pageout')", cfg.mode)
+	}
+
+	// Validate THP policy
+	cfg.options.THPPolicy = c.String("thp")
+	if !advisor.ValidTHPPolicy(cfg.options.THPPolicy) {
+		return nil, fmt.Errorf("invalid thp policy: %s (must be 'skip', 'full' or 'split')", cfg.options.THPPolicy)
+	}
+
+	// Parse reclaim conditions
+	if spec := c.String("when-pressure"); spec != "" {
+		cond, err := gate.ParsePressure(spec)
+		if err != nil {
+			return nil, err
+		}
+		cfg.conditions = append(cfg.conditions, cond)
+	}
+	if spec := c.String("when-available-below"); spec != "" {
+		cond, err := gate.ParseAvailable(spec)
+		if err != nil {
+			return nil, err
+		}
+		cfg.conditions = append(cfg.conditions, cond)
+	}
+	cfg.idleFor = c.Duration("idle-for")
+	if cfg.idleFor < 0 {
+		return nil, fmt.Errorf("invalid idle-for: %s (must be positive)", cfg.idleFor)
+	}
+	cfg.idle = &idleState{path: c.String("idle-state")}
+	cfg.history = c.String("history")
+	cfg.source = history.SourceReclaim
+
+	if dest := c.String("audit-log"); dest != "" {
+		maxSize, err := units.ParseBytes(c.String("audit-max-size"))
+		if err != nil || maxSize < 0 {
+			return nil, fmt.Errorf("invalid audit max size: %s", c.String("audit-max-size"))
+		}
+		if c.Int("audit-keep") < 0 {
+			return nil, fmt.Errorf("invalid audit keep: %d (must be positive)", c.Int("audit-keep"))
+		}
+		cfg.audit = &audit.Logger{Dest: dest, MaxSize: maxSize, Keep: c.Int("audit-keep")}
+	}
+
+	if spec := c.String("when"); spec != "" {
+		cfg.when, err = expr.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition: %w", err)
+		}
+	}
+
+	// Validate swap options
+	cfg.swapReserve, err = units.ParseBytes(c.String("swap-reserve"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid swap reserve: %w", err)
+	}
+	cfg.noSwap = c.String("no-swap")
+	if cfg.noSwap != "cold" && cfg.noSwap != "refuse" {
+		return nil, fmt.Errorf("invalid no-swap action: %s (must be 'cold' or 'refuse')", cfg.noSwap)
+	}
+
+	// Validate iterative options
+	cfg.iterOpts = advisor.IterativeOptions{
+		Interval:  c.Duration("interval"),
+		MaxRounds: c.Int("max-rounds"),
+		Timeout:   c.Duration("timeout"),
+	}
+	if spec := c.String("step"); spec != "" {
+		cfg.iterOpts.Step, err = units.ParseBytes(spec)
+		if err != nil || cfg.iterOpts.Step <= 0 {
+			return nil, fmt.Errorf("invalid step: %s", spec)
+		}
+	}
+
+	// Validate pacing options
+	pacing := advisor.PacingOptions{
+		IOPoll:   time.Second,
+		MaxPause: c.Duration("io-pause-max"),
+	}
+	if spec := c.String("rate"); spec != "" {
+		pacing.Rate, err = units.ParseRate(spec)
+		if err != nil || pacing.Rate <= 0 {
+			return nil, fmt.Errorf("invalid rate: %s", spec)
+		}
+	}
+	if spec := c.String("max-inflight"); spec != "" {
+		pacing.MaxInflight, err = units.ParseBytes(spec)
+		if err != nil || pacing.MaxInflight <= 0 {
+			return nil, fmt.Errorf("invalid max-inflight: %s", spec)
+		}
+	}
+	if spec := c.String("io-pressure-limit"); spec != "" {
+		pacing.IOGuard, err = gate.ParseIOPressure(spec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg.options.Pacing = pacing
+
+	// Validate total budget options
+	if spec := c.String("total-budget"); spec != "" {
+		cfg.totalBudget, err = units.ParseBytes(spec)
+		if err != nil || cfg.totalBudget <= 0 {
+			return nil, fmt.Errorf("invalid total budget: %s", spec)
+		}
+	}
+	cfg.distribution = c.String("distribution")
+	if !budget.ValidPolicy(cfg.distribution) {
+		return nil, fmt.Errorf("invalid distribution: %s (must be 'proportional', 'weight' or 'largest')", cfg.distribution)
+	}
+	cfg.weights, err = budget.ParseWeights(c.String("weights"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid weights: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// reclaim runs one reclaim pass over pids and returns the outcome for every
+// target that could be inspected. Once ctx is done, the pass stops at the
+// next batch and leaves the remaining targets alone.
+func reclaim(ctx context.Context, cfg *reclaimConfig, out *output.OutputManager, pids []int) ([]targetOutcome, error) {
+	mode := cfg.mode
+
+	// Only proceed when the system is under the requested pressure
+	budgetScale := 1.0
+	if len(cfg.conditions) > 0 {
+		results := make([]gate.Result, 0, len(cfg.conditions))
+		for _, cond := range cfg.conditions {
+			result, err := cond.Evaluate()
+			if err != nil {
+				return nil, fmt.Errorf("failed to evaluate reclaim condition: %w", err)
+			}
+			results = append(results, result)
+		}
+
+		scale := gate.Scale(results)
+		out.GateResults(results, scale)
+		if scale == 0 {
+			return nil, errConditionNotMet
+		}
+		if cfg.scaleBudget {
+			budgetScale = scale
+		}
+	}
+
+	// Paging out anonymous memory needs somewhere to put it
+	swapHeadroom := int64(-1)
+	if mode == "pageout" {
+		var err error
+		swapHeadroom, mode, err = swapPreflight(out, cfg.swapReserve, cfg.noSwap)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Inspect every target before deciding budgets. Targets that cannot be
+	// inspected are failed outcomes, like targets whose advice fails.
+	var targets []*target
+	var outcomes []targetOutcome
+	notMet, ineligible := 0, 0 // Targets skipped by --when, and for any other reason
+
+	var idle *inspector.IdleTracker
+	if cfg.idleFor > 0 || (cfg.when != nil && cfg.when.Uses("idle_for")) {
+		var err error
+		if idle, err = cfg.idle.load(); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err := cfg.idle.save(); err != nil {
+				out.Warning(fmt.Sprintf("idle tracking will restart on the next run: %v", err))
+			}
+		}()
+	}
+
+	past := loadHistory(cfg, out)
+
+	self, err := inspector.ReadCredentials(os.Getpid())
+	if err != nil {
+		out.Warning(fmt.Sprintf("skipping the permission preflight: %v", err))
+	}
+
+	for _, pid := range pids {
+		if err := preflight(self, pid, out); err != nil {
+			outcomes = append(outcomes, targetOutcome{pid: pid, err: err})
+			continue
+		}
+		t, err := inspectTarget(pid, out, cfg.options)
+		if err != nil {
+			out.TargetError(pid, err.Error())
+			outcomes = append(outcomes, targetOutcome{pid: pid, err: err})
+			continue
+		}
+		if reason := checkHistory(cfg, t, past, out); reason != "" {
+			out.TargetSkipped(pid, reason)
+			ineligible++
+			continue
+		}
+		if t.before.TotalRSS < cfg.minRSS {
+			out.TargetSkipped(pid, fmt.Sprintf("RSS below minimum of %d bytes", cfg.minRSS))
+			ineligible++
+			continue
+		}
+		if cfg.idleFor > 0 {
+			idleFor, err := idle.IdleFor(pid, time.Now())
+			if err != nil || idleFor < cfg.idleFor {
+				reason := fmt.Sprintf("idle for %s, less than %s", idleFor.Round(time.Second), cfg.idleFor)
+				if err != nil {
+					reason = fmt.Sprintf("cannot determine idle time: %v", err)
+				}
+				out.TargetSkipped(pid, reason)
+				ineligible++
+				continue
+			}
+		}
+		if cfg.when != nil {
+			met, err := evaluateWhen(cfg.when, pid, t.before, idle)
+			if err != nil {
+				// A condition that can't be evaluated is a failure, not a "no"
+				err = fmt.Errorf("cannot evaluate condition: %w", err)
+				out.TargetError(pid, err.Error())
+				outcomes = append(outcomes, targetOutcome{pid: pid, err: err})
+				continue
+			}
+			if !met {
+				out.TargetSkipped(pid, "condition not met")
+				notMet++
+				continue
+			}
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 && len(outcomes) == 0 {
+		switch {
+		case ineligible > 0:
+			return nil, errNothingEligible
+		case notMet > 0:
+			return nil, errConditionNotMet
+		}
+	}
+
+	// Calculate reclaim budgets
+	if cfg.totalBudget > 0 {
+		total := int64(float64(cfg.totalBudget) * budgetScale)
+		distributeBudget(targets, total, cfg.distribution, cfg.weights, cfg.maxBytes)
+	} else {
+		for _, t := range targets {
+			t.budget = int64(float64(cfg.targetBudget(t.before.TotalRSS)) * budgetScale)
+		}
+	}
+
+	for _, t := range targets {
+		if scale, ok := cfg.budgetScales[t.pid]; ok {
+			t.budget = int64(float64(t.budget) * scale)
+		}
+	}
+
+	// Never page out more than the remaining swap headroom
+	if swapHeadroom >= 0 {
+		for _, t := range targets {
+			if t.budget > swapHeadroom {
+				t.budget = swapHeadroom
+			}
+			swapHeadroom -= t.budget
+		}
+	}
+
+	// Process each target
+	var allocated, advised int64
+	var observed []*observation
+	var advisedTargets []*target
+	for _, t := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+		allocated += t.budget
+		outcome := targetOutcome{pid: t.pid, rssBefore: t.before.TotalRSS, rssAfter: t.before.TotalRSS}
+
+		// Execute the advice operation
+		if cfg.dryRun {
+			out.DryRun(t.pid, t.budget, mode, len(t.regions))
+			outcomes = append(outcomes, outcome)
+			continue
+		}
+
+		start := time.Now()
+		rounds := 1
+		var ranges []syscall.MemoryRegion
+		if cfg.iterative {
+			result, err := t.advisor.ExecuteIterative(ctx, t.budget, mode, cfg.iterOpts, t.before, t.inspector.GetMemoryStats)
+			if result != nil {
+				outcome.advised = result.Advised
+				ranges = result.Ranges
+				rounds = len(result.Rounds)
+			}
+			outcome.err = err
+		} else {
+			result, err := t.advisor.Execute(ctx, t.budget, mode)
+			if result != nil {
+				outcome.advised = result.BytesAdvised
+				ranges = result.Ranges
+			}
+			outcome.err = err
+		}
+		if mode == "pageout" {
+			outcome.pagedOut = ranges
+		}
+		t.record = &history.Record{
+			Time:      start,
+			Source:    cfg.source,
+			Mode:      mode,
+			Requested: t.budget,
+			Advised:   outcome.advised,
+			RSSBefore: outcome.rssBefore,
+			RSSAfter:  outcome.rssAfter,
+			Ranges:    history.RangesOf(ranges),
+		}
+		if outcome.err != nil {
+			t.record.Error = outcome.err.Error()
+		}
+		auditAdvice(cfg, t, out)
+		advised += outcome.advised
+		metrics.Duration.Observe(time.Since(start).Seconds(), mode)
+		metrics.Rounds.Add(float64(rounds), mode)
+		metrics.AdvisedBytes.Add(float64(outcome.advised), mode, strconv.Itoa(t.pid), t.comm)
+
+		if outcome.err != nil {
+			out.TargetError(t.pid, fmt.Sprintf("Failed to execute advice on PID %d: %v", t.pid, outcome.err))
+			metrics.Reclaims.Inc(mode, "error")
+			outcomes = append(outcomes, outcome)
+			continue
+		}
+
+		// Get memory stats after advice
+		afterStats, err := t.inspector.GetMemoryStats()
+		if err != nil {
+			outcome.err = err
+			out.TargetError(t.pid, fmt.Sprintf("Failed to get memory stats for PID %d: %v", t.pid, err))
+			metrics.Reclaims.Inc(mode, "error")
+			outcomes = append(outcomes, outcome)
+			continue
+		}
+		outcome.rssAfter = afterStats.TotalRSS
+		t.record.RSSAfter = outcome.rssAfter
+		metrics.Reclaims.Inc(mode, "ok")
+		metrics.RSSBefore.Set(float64(outcome.rssBefore), strconv.Itoa(t.pid), t.comm)
+		metrics.RSSAfter.Set(float64(outcome.rssAfter), strconv.Itoa(t.pid), t.comm)
+
+		out.MemoryStatsAfter(t.pid, afterStats, t.before)
+		outcomes = append(outcomes, outcome)
+		advisedTargets = append(advisedTargets, t)
+		t.advised = outcome.advised
+		if cfg.observe > 0 {
+			observed = append(observed, newObservation(t, afterStats))
+		}
+	}
+
+	if len(observed) > 0 {
+		observe(ctx, observed, cfg.observe, cfg.sample, out)
+	}
+	// Right after advising, no page has had time to be faulted back in yet;
+	// refaults are only meaningful once --observe or the rounds of an
+	// iterative run have waited
+	if len(observed) > 0 || cfg.iterative {
+		for _, t := range advisedTargets {
+			reportRefaults(t, out)
+		}
+	}
+	saveHistory(cfg, targets, out)
+
+	metrics.LastRun.Set(float64(time.Now().Unix()))
+
+	if cfg.totalBudget > 0 {
+		out.TotalBudget(cfg.totalBudget, allocated, advised, len(targets), cfg.distribution, cfg.dryRun)
+	}
+
+	return outcomes, nil
+}
+
+// evaluateWhen evaluates a per-target condition for pid
+func evaluateWhen(when *expr.Expr, pid int, stats *inspector.MemoryStats, idle *inspector.IdleTracker) (bool, error) {
+	env, err := expr.Collect(when.Vars(), pid, stats, idle)
+	if err != nil {
+		return false, err
+	}
+	return when.Eval(env)
+}
+
+// targetBudget returns the budget for a target with the given RSS
+func (cfg *reclaimConfig) targetBudget(rss int64) int64 {
+	var budget int64
+	switch {
+	case cfg.budgetBytes > 0:
+		budget = cfg.budgetBytes
+	case cfg.targetRSS > 0:
+		budget = rss - cfg.targetRSS
+		if budget < 0 {
+			budget = 0
+		}
+	default:
+		return calculateBudget(rss, cfg.percent, cfg.maxBytes)
+	}
+
+	if cfg.maxBytes > 0 && budget > cfg.maxBytes {
+		budget = cfg.maxBytes
+	}
+	return budget
+}
+
+// ruleConfig derives the reclaim settings for a config rule. Fields the rule
+// leaves unset keep the values from base, i.e. the command line flags.
+func ruleConfig(base *reclaimConfig, rule config.Rule) (*reclaimConfig, error) {
+	cfg := *base
+	cfg.source = "rule " + rule.Name
+
+	if rule.Mode != "" {
+		cfg.mode = rule.Mode
+	}
+	if rule.Selector.IdleFor > 0 {
+		cfg.idleFor = time.Duration(rule.Selector.IdleFor)
+	}
+	if rule.When != "" {
+		when, err := expr.Parse(rule.When)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: invalid condition: %w", rule.Name, err)
+		}
+		cfg.when = when
+	}
+
+	switch {
+	case rule.Budget.Percent > 0:
+		cfg.percent = rule.Budget.Percent
+	case rule.Budget.Bytes > 0:
+		cfg.budgetBytes = int64(rule.Budget.Bytes)
+	case rule.Budget.TargetRSS > 0:
+		cfg.targetRSS = int64(rule.Budget.TargetRSS)
+	}
+
+	if rule.Strategy != "" {
+		cfg.options.Strategy = rule.Strategy
+	}
+	if rule.Regions.THP != "" {
+		cfg.options.THPPolicy = rule.Regions.THP
+	}
+	cfg.options.Filter = advisor.RegionFilter{
+		MinSize:      uint64(rule.Regions.MinSize),
+		MaxSize:      uint64(rule.Regions.MaxSize),
+		Paths:        rule.Regions.Paths,
+		ExcludePaths: rule.Regions.ExcludePaths,
+	}
+
+	if rule.Limits.MaxBytes > 0 {
+		cfg.maxBytes = int64(rule.Limits.MaxBytes)
+	}
+	if rule.Limits.MinRSS > 0 {
+		cfg.minRSS = int64(rule.Limits.MinRSS)
+	}
+	if rule.Limits.SwapReserve > 0 {
+		cfg.swapReserve = int64(rule.Limits.SwapReserve)
+	}
+	if rule.Limits.Rate != "" {
+		rate, err := units.ParseRate(rule.Limits.Rate)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: invalid rate: %w", rule.Name, err)
+		}
+		cfg.options.Pacing.Rate = rate
+	}
+
+	return &cfg, nil
+}
+
+// loadConfig loads a config file, warning about MEMADVISE_* environment
+// variables that override none of its fields
+func loadConfig(filename string, out *output.OutputManager) (*config.Config, error) {
+	file, err := config.Load(filename)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range file.Ignored {
+		out.Warning(fmt.Sprintf("ignoring %s: it matches no field of %s", key, filename))
+	}
+	return file, nil
+}
+
+// runConfigFile runs every rule of a config file once
+func runConfigFile(ctx context.Context, base *reclaimConfig, out *output.OutputManager, filename string, result *runResult) error {
+	file, err := loadConfig(filename, out)
+	if err != nil {
+		return err
+	}
+
+	notMet, gated, ineligible := true, len(base.conditions) > 0, false
+	for _, rule := range file.Rules {
+		cfg, err := ruleConfig(base, rule)
+		if err != nil {
+			return err
+		}
+
+		pids, err := rule.Selector.Resolve()
+		if err != nil {
+			out.Error(fmt.Sprintf("rule %q: failed to resolve targets: %v", rule.Name, err))
+			result.failures = append(result.failures, err)
+			continue
+		}
+		if len(pids) == 0 {
+			if out.IsVerbose() {
+				out.Info(fmt.Sprintf("rule %q: no matching processes", rule.Name))
+			}
+			continue
+		}
+
+		outcomes, err := reclaim(ctx, cfg, out, pids)
+		if errors.Is(err, errConditionNotMet) {
+			gated = true
+			continue
+		}
+		if errors.Is(err, errNothingEligible) {
+			ineligible = true
+			continue
+		}
+		notMet = false
+		result.add(outcomes)
+		if err != nil {
+			out.Error(fmt.Sprintf("rule %q: %v", rule.Name, err))
+			result.failures = append(result.failures, err)
+		}
+	}
+
+	switch {
+	case notMet && ineligible:
+		return errNothingEligible
+	case notMet && gated:
+		return errConditionNotMet
+	}
+	return nil
+}
+
+// idleState loads the idle tracker on first use and shares it between the
+// rules of a policy, so that it is kept across daemon runs
+type idleState struct {
+	path    string // File the tracker is kept in between runs; empty keeps it in memory
+	tracker *inspector.IdleTracker
+}
+
+func (s *idleState) load() (*inspector.IdleTracker, error) {
+	if s.tracker != nil {
+		return s.tracker, nil
+	}
+
+	s.tracker = inspector.NewIdleTracker()
+	if s.path != "" {
+		tracker, err := inspector.LoadIdleTracker(s.path)
+		if err != nil {
+			return nil, err
+		}
+		s.tracker = tracker
+	}
+	return s.tracker, nil
+}
+
+func (s *idleState) save() error {
+	if s.path == "" || s.tracker == nil {
+		return nil
+	}
+	return s.tracker.Save(s.path)
+}
+
+// target holds the state gathered for a PID before advice is applied
+type target struct {
+	pid       int
+	comm      string
+	inspector *inspector.ProcessInspector
+	before    *inspector.MemoryStats
+	regions   []syscall.MemoryRegion
+	advisor   *advisor.Advisor
+	budget    int64
+	advised   int64
+	key       *history.Key    // Identity in the history; nil if unreadable
+	record    *history.Record // What to add to the history once advised
+
+	// Refault counters before advice; cgroupBefore is nil without cgroup v2
+	majFltBefore uint64
+	cgroup       string
+	cgroupBefore *sysinfo.CgroupMemory
+}
+
+// preflight checks that memadvise may advise pid before anything is read from
+// it, and outputs why not. Targets that can't be checked are left to fail
+// inspection.
+func preflight(self *inspector.Credentials, pid int, out *output.OutputManager) error {
+	if self == nil {
+		return nil
+	}
+	access, err := inspector.CheckAccess(self, pid)
+	if err != nil {
+		return nil
+	}
+	out.TargetAccess(access)
+	return access.Err()
+}
+
+// inspectTarget gathers memory stats and eligible regions for pid
+func inspectTarget(pid int, out *output.OutputManager, opts advisor.Options) (*target, error) {
+	// Check if PID exists
+	if !inspector.PidExists(pid) {
+		return nil, fmt.Errorf("PID %d: %w", pid, syscall.ErrNoProcess)
+	}
+
+	// Create process inspector
+	procInspector, err := inspector.NewProcessInspector(pid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect PID %d: %w", pid, err)
+	}
+
+	// Get memory stats before advice
+	beforeStats, err := procInspector.GetMemoryStats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get memory stats for PID %d: %w", pid, err)
+	}
+
+	out.MemoryStatsBefore(pid, beforeStats)
+
+	// Get eligible memory regions
+	regions, err := procInspector.GetEligibleRegions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get memory regions for PID %d: %w", pid, err)
+	}
+
+	t := &target{
+		pid:       pid,
+		inspector: procInspector,
+		before:    beforeStats,
+		regions:   regions,
+		advisor:   advisor.New(pid, regions, out, opts),
+	}
+	if id, err := inspector.ReadIdentity(pid); err == nil {
+		t.comm, t.cgroup = id.Comm, id.Cgroup
+		key := history.KeyOf(id)
+		t.key = &key
+		out.TargetIdentity(id)
+	}
+	if stat, err := inspector.ReadProcStat(pid); err == nil {
+		t.majFltBefore = stat.MajFlt
+	}
+	if t.cgroup != "" {
+		t.cgroupBefore, _ = sysinfo.ReadCgroupMemory(t.cgroup)
+	}
+
+	return t, nil
+}
+
+// reportRefaults outputs how much of what was advised from t has been
+// faulted back in so far. The refault ratio is the bytes brought back by
+// major faults over the bytes advised. The workingset refaults of the
+// target's cgroup are reported alongside when it has a memory controller;
+// they count every process in the group.
+func reportRefaults(t *target, out *output.OutputManager) {
+	if t.advised == 0 {
+		return
+	}
+	stat, err := inspector.ReadProcStat(t.pid)
+	if err != nil || stat.MajFlt < t.majFltBefore {
+		return // Exited, or the PID was reused
+	}
+
+	faults := int64(stat.MajFlt - t.majFltBefore)
+	ratio := float64(faults*int64(os.Getpagesize())) / float64(t.advised)
+	metrics.RefaultRatio.Set(ratio, strconv.Itoa(t.pid), t.comm)
+	if t.record != nil {
+		t.record.MajorFaults, t.record.RefaultRatio = faults, ratio
+	}
+
+	refaultAnon, refaultFile := int64(-1), int64(-1)
+	if t.cgroupBefore != nil {
+		if after, err := sysinfo.ReadCgroupMemory(t.cgroup); err == nil {
+			refaultAnon = after.RefaultAnon - t.cgroupBefore.RefaultAnon
+			refaultFile = after.RefaultFile - t.cgroupBefore.RefaultFile
+		}
+	}
+
+	out.Refaults(t.pid, faults, ratio, refaultAnon, refaultFile)
+}
+
+// distributeBudget shares total across targets using the given policy. Each
+// target can take at most its eligible RSS, further capped by maxBytes.
+func distributeBudget(targets []*target, total int64, policy string, weights map[int]float64, maxBytes int64) {
+	candidates := make([]budget.Target, 0, len(targets))
+	for _, t := range targets {
+		capacity := t.advisor.EligibleBytes()
+		if maxBytes > 0 && capacity > maxBytes {
+			capacity = maxBytes
+		}
+
+		weight, ok := weights[t.pid]
+		if !ok {
+			weight = 1
+		}
+
+		candidates = append(candidates, budget.Target{
+			PID:      t.pid,
+			Capacity: capacity,
+			Weight:   weight,
+		})
+	}
+
+	for i, alloc := range budget.Distribute(total, candidates, policy) {
+		targets[i].budget = alloc
+	}
+}
+
+// swapPreflight checks that a swap backend exists before a pageout and returns
+// the swap headroom along with the mode to use. Without swap, pageout is either
+// refused or downgraded to cold depending on noSwap.
+func swapPreflight(out *output.OutputManager, reserve int64, noSwap string) (int64, string, error) {
+	status, err := sysinfo.ReadSwapStatus()
+	if err != nil {
+		return 0, "", fmt.Errorf("swap preflight failed: %w", err)
+	}
+
+	if !status.HasBackend() {
+		if noSwap == "refuse" {
+			return 0, "", fmt.Errorf("pageout requires swap, but no swap device or zram swap is active")
+		}
+		out.Warning("no swap device or zram swap is active; downgrading mode 'pageout' to 'cold'")
+		return -1, "cold", nil
+	}
+
+	headroom := status.Headroom(reserve)
+	out.SwapPreflight(status, reserve, headroom)
+	if headroom == 0 {
+		out.Warning(fmt.Sprintf("swap free (%d bytes) is within the %d byte reserve; nothing will be paged out",
+			status.SwapFree, reserve))
+	}
+
+	return headroom, "pageout", nil
+}
+
+// auditAdvice logs the advice just given to t to the audit log
+func auditAdvice(cfg *reclaimConfig, t *target, out *output.OutputManager) {
+	if cfg.audit == nil {
+		return
+	}
+
+	entry := audit.Entry{
+		Time:      t.record.Time,
+		UID:       cfg.caller.UID,
+		CallerPID: cfg.caller.PID,
+		Source:    cfg.source,
+		PID:       t.pid,
+		Comm:      t.comm,
+		Cgroup:    t.cgroup,
+		Mode:      t.record.Mode,
+		Requested: t.record.Requested,
+		Advised:   t.record.Advised,
+		Error:     t.record.Error,
+	}
+	if t.key != nil {
+		entry.Exe, entry.StartTime = t.key.Exe, t.key.StartTime
+	}
+	if err := cfg.audit.Log(entry); err != nil {
+		out.Warning(err.Error())
+	}
+}
+
+// loadHistory reads the advice history, if it is kept. A history that can't
+// be read is reported and treated as empty.
+func loadHistory(cfg *reclaimConfig, out *output.OutputManager) *history.Store {
+	if cfg.history == "" {
+		return history.NewStore()
+	}
+	store, err := history.Load(cfg.history)
+	if err != nil {
+		out.Warning(err.Error())
+		return history.NewStore()
+	}
+	return store
+}
+
+// checkHistory applies what the history knows about t: it returns why t
+// must be skipped, or else deprioritises the ranges that were hot before
+func checkHistory(cfg *reclaimConfig, t *target, past *history.Store, out *output.OutputManager) string {
+	if t.key == nil {
+		return ""
+	}
+	h := past.Lookup(*t.key)
+	if h == nil {
+		return ""
+	}
+
+	now := time.Now()
+	if until := h.HotUntil(); !cfg.ignoreHot && now.Before(until) {
+		return fmt.Sprintf("rolled back, hot until %s", until.Format(time.RFC3339))
+	}
+	if last := h.LastAdvised(); cfg.cooldown > 0 && last != nil && now.Sub(last.Time) < cfg.cooldown {
+		return fmt.Sprintf("advised %s ago, in cooldown until %s",
+			now.Sub(last.Time).Round(time.Second), last.Time.Add(cfg.cooldown).Format(time.RFC3339))
+	}
+
+	if hot := h.HotRanges(); len(hot) > 0 {
+		opts := cfg.options
+		opts.Hot = hot
+		t.advisor = advisor.New(t.pid, t.regions, out, opts)
+	}
+	return ""
+}
+
+// saveHistory adds the advice given to targets to the history
+func saveHistory(cfg *reclaimConfig, targets []*target, out *output.OutputManager) {
+	if cfg.history == "" || cfg.dryRun {
+		return
+	}
+	recorded := false
+	for _, t := range targets {
+		recorded = recorded || (t.key != nil && t.record != nil)
+	}
+	if !recorded {
+		return
+	}
+
+	err := history.Update(cfg.history, func(store *history.Store) error {
+		for _, t := range targets {
+			if t.key != nil && t.record != nil {
+				store.Add(*t.key, t.pid, t.comm, *t.record)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		out.Warning(fmt.Sprintf("advice not recorded in the history: %v", err))
+	}
+}